@@ -19,6 +19,7 @@ package cmd
 
 import (
 	"os"
+	"time"
 
 	"github.com/nalej/conductor/pkg/musician/scorer"
 	"github.com/nalej/conductor/pkg/musician/service"
@@ -47,10 +48,25 @@ func init() {
 	RootCmd.AddCommand(musicianCmd)
 
 	musicianCmd.Flags().Uint32P("musician-port", "u", utils.MUSICIAN_PORT, "musician endpoint")
+	musicianCmd.Flags().Uint32("metrics-port", utils.MUSICIAN_METRICS_PORT, "port where the musician serves its metrics")
 	musicianCmd.Flags().StringP("prometheus", "o", "", "prometheus endpoint")
+	musicianCmd.Flags().String("prometheusProfile", statuscollector.DefaultPrometheusProfile,
+		"built-in Prometheus queries (legacy for node_exporter < 0.16, modern for node_exporter >= 0.16)")
+	musicianCmd.Flags().String("prometheusQueries", "", "YAML file with the profile and the Prometheus queries overriding it")
 	musicianCmd.Flags().StringP("metrics", "m", "", "metrics api endpoint")
+	musicianCmd.Flags().Bool("kubernetes", false, "collect the status from the Kubernetes API")
+	musicianCmd.Flags().String("kubeconfig", "", "kubeconfig file to access the Kubernetes API, in cluster configuration if empty")
 	// 60s is default Prometheus scrape time - no use in collecting status more often
 	musicianCmd.Flags().Uint32P("sleep", "s", 60000, "time to sleep between queries in milliseconds")
+	musicianCmd.Flags().Duration("maxStatusAge", statuscollector.DefaultMaxStatusAge,
+		"maximum age of the collected status to score requests, 0 for no limit")
+	musicianCmd.Flags().Duration("statusWindow", statuscollector.DefaultStatusWindow,
+		"time window of the observations used to score requests, 0 to score with the latest observation")
+	musicianCmd.Flags().String("scorer", scorer.SimpleStrategy,
+		"scoring strategy (simple, weighted, binpacking, spread)")
+	musicianCmd.Flags().Float64("cpuWeight", scorer.DefaultResourceWeights.CPU, "weight of the CPU when scoring")
+	musicianCmd.Flags().Float64("memWeight", scorer.DefaultResourceWeights.Memory, "weight of the memory when scoring")
+	musicianCmd.Flags().Float64("diskWeight", scorer.DefaultResourceWeights.Disk, "weight of the disk when scoring")
 
 	viper.BindPFlags(musicianCmd.Flags())
 }
@@ -59,36 +75,64 @@ func init() {
 func RunMusician() {
 	// Prometheus URL
 	var prometheus string
+	// Prometheus queries profile and file
+	var prometheusProfile string
+	var prometheusQueries string
 	// Metrics collector address
 	var metrics string
+	// Collect the status from the Kubernetes API
+	var kubernetes bool
+	// Kubeconfig path
+	var kubeConfigPath string
 	// Time to sleep between monitoring queries
 	var sleepTime uint32
+	// Maximum age of the status used to score
+	var maxStatusAge time.Duration
+	// Time window of the observations used to score
+	var statusWindow time.Duration
 	// Application port
 	var port uint32
+	// Metrics port
+	var metricsPort uint32
+	// Scoring strategy
+	var strategy string
+	// Weights of the resources when scoring
+	var weights scorer.ResourceWeights
 	// Debug flag
 	var debug bool
 
 	port = uint32(viper.GetInt32("musician-port"))
+	metricsPort = uint32(viper.GetInt32("metrics-port"))
 	prometheus = viper.GetString("prometheus")
+	prometheusProfile = viper.GetString("prometheusProfile")
+	prometheusQueries = viper.GetString("prometheusQueries")
 	metrics = viper.GetString("metrics")
+	kubernetes = viper.GetBool("kubernetes")
+	kubeConfigPath = viper.GetString("kubeconfig")
 	sleepTime = uint32(viper.GetInt32("sleep"))
+	maxStatusAge = viper.GetDuration("maxStatusAge")
+	statusWindow = viper.GetDuration("statusWindow")
+	strategy = viper.GetString("scorer")
+	weights = scorer.ResourceWeights{
+		CPU:    viper.GetFloat64("cpuWeight"),
+		Memory: viper.GetFloat64("memWeight"),
+		Disk:   viper.GetFloat64("diskWeight"),
+	}
 	debug = viper.GetBool("debug")
 
 	log.Info().Msg("launching musician...")
 
-	if prometheus != "" && metrics != "" {
-		log.Fatal().Msg("only one of 'prometheus' and 'metrics' can be set")
-	}
-	if prometheus == "" && metrics == "" {
-		log.Fatal().Msg("one of 'prometheus' or 'metrics' should be set")
+	if prometheus == "" && metrics == "" && !kubernetes {
+		log.Fatal().Msg("at least one of 'prometheus', 'metrics' or 'kubernetes' should be set")
 	}
 
-	var collector statuscollector.StatusCollector
-
-	if prometheus != "" {
-		collector = statuscollector.NewPrometheusStatusCollector(prometheus, sleepTime)
+	if sleepTime == 0 {
+		log.Fatal().Msg("'sleep' should be greater than zero")
 	}
 
+	// collectors sorted by priority: metrics api, Prometheus and Kubernetes API
+	collectors := make([]statuscollector.StatusCollector, 0)
+
 	if metrics != "" {
 		metricsConn, err := grpc.Dial(metrics, grpc.WithInsecure())
 		if err != nil {
@@ -102,18 +146,52 @@ func RunMusician() {
 			log.Fatal().Msg("ORGANIZATION_ID or CLUSTER_ID environment not set")
 		}
 
-		collector = statuscollector.NewMetricsAPICollector(metricsClient, organizationId, clusterId, sleepTime)
+		collectors = append(collectors,
+			statuscollector.NewMetricsAPICollector(metricsClient, organizationId, clusterId, sleepTime, maxStatusAge))
+	}
+
+	if prometheus != "" {
+		queries, err := statuscollector.LoadPrometheusQueries(prometheusProfile, prometheusQueries)
+		if err != nil {
+			log.Fatal().Str("err", err.DebugReport()).Msg("invalid Prometheus queries")
+		}
+		log.Info().Interface("queries", queries).Msg("Prometheus queries")
+		collectors = append(collectors,
+			statuscollector.NewPrometheusStatusCollector(prometheus, sleepTime, maxStatusAge, *queries))
+	}
+
+	if kubernetes {
+		kubeClient, err := statuscollector.NewKubernetesClient(kubeConfigPath)
+		if err != nil {
+			log.Fatal().Str("err", err.DebugReport()).Msg("cannot create the Kubernetes client")
+		}
+		collectors = append(collectors, statuscollector.NewKubernetesStatusCollector(kubeClient, sleepTime, maxStatusAge))
 	}
 
+	// several sources fall back on each other
+	collector := collectors[0]
+	if len(collectors) > 1 {
+		collector = statuscollector.NewCompositeStatusCollector(collectors...)
+	}
+	if statusWindow > 0 {
+		collector = statuscollector.NewWindowedStatusCollector(collector, sleepTime, statusWindow)
+	}
+	log.Info().Str("collector", collector.Name()).Msg("status collector")
+
 	go collector.Run()
 
-	scorer := scorer.NewSimpleScorer(collector)
+	scorer, scorerErr := scorer.NewScorerFromStrategy(strategy, collector, weights)
+	if scorerErr != nil {
+		log.Fatal().Str("err", scorerErr.DebugReport()).Msg("impossible to create the scorer")
+	}
+	log.Info().Str("strategy", strategy).Interface("weights", weights).Msg("scoring strategy")
 
 	conf := &service.MusicianConfig{
-		Port:      port,
-		Scorer:    &scorer,
-		Collector: &collector,
-		Debug:     debug,
+		Port:        port,
+		MetricsPort: metricsPort,
+		Scorer:      &scorer,
+		Collector:   &collector,
+		Debug:       debug,
 	}
 
 	musicianService, err := service.NewMusicianService(conf)
@@ -19,11 +19,17 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/nalej/conductor/internal/persistence/operations"
+	"github.com/nalej/conductor/pkg/conductor/baton"
+	"github.com/nalej/conductor/pkg/conductor/scorer"
 	"github.com/nalej/conductor/pkg/conductor/service"
 	"github.com/nalej/conductor/pkg/utils"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var runCmd = &cobra.Command{
@@ -41,6 +47,7 @@ func init() {
 	RootCmd.AddCommand(runCmd)
 
 	runCmd.Flags().Uint32P("port", "c", utils.CONDUCTOR_PORT, "port where conductor listens to")
+	runCmd.Flags().Uint32("metricsPort", utils.CONDUCTOR_METRICS_PORT, "port where conductor serves the metrics")
 	runCmd.Flags().StringP("systemModelAddress", "s", fmt.Sprintf("localhost:%d", utils.SYSTEM_MODEL_PORT),
 		"host:port address for system model")
 	runCmd.Flags().StringP("networkManagerAddress", "n", fmt.Sprintf("localhost:%d", utils.NETWORKING_SERVICE_PORT),
@@ -60,6 +67,22 @@ func init() {
 		"path for the folder used to store the local database")
 	runCmd.Flags().StringP("networkMode","t", service.ConductorNetworkingModeZT,
 		"Indicate the kind of networking solution conductor will work on top of (zt, istio)")
+	runCmd.Flags().String("requestsQueue", service.ConductorRequestsQueueMemory,
+		"Indicate where incoming deployment requests are queued (memory, persistent, fair). The fair queue is persisted too")
+	runCmd.Flags().StringSlice("organizationWeights", []string{},
+		"Weights of the organizations when using the fair requests queue (organizationId=weight)")
+	runCmd.Flags().Int("deploymentWorkers", baton.DefaultDeploymentWorkers,
+		"Number of deployment requests processed concurrently")
+	runCmd.Flags().Int("scoringConcurrency", scorer.DefaultMaxConcurrentQueries,
+		"Maximum number of musicians queried at the same time")
+	runCmd.Flags().Duration("scoringDeadline", scorer.DefaultScoringDeadline,
+		"Deadline to collect the scores of all the clusters")
+	runCmd.Flags().Bool("weightScoresByConfidence", false,
+		"Weight the scores of every musician by its confidence on the observed cluster status")
+	runCmd.Flags().String("planDesigner", service.ConductorPlanDesignerSimple,
+		"Indicate how the groups of an application are placed in the clusters (simple, optimal)")
+	runCmd.Flags().Duration("operationsRetention", operations.DefaultRetention,
+		"Time finished deploy, undeploy and drain operations are kept")
 
 	viper.BindPFlags(runCmd.Flags())
 }
@@ -68,6 +91,8 @@ func init() {
 func RunConductor() {
 	// Incoming requests port
 	var port uint32
+	// Metrics port
+	var metricsPort uint32
 	// System model url
 	var systemModel string
 	// Networking service url
@@ -92,10 +117,25 @@ func RunConductor() {
 	var dbFolder string
 	// Networking mode
 	var networkingMode string
+	// Requests queue type
+	var requestsQueue string
+	// Organization weights for the fair queue
+	var organizationWeights []string
+	// Number of deployment workers
+	var deploymentWorkers int
+	// Scoring limits
+	var scoringConcurrency int
+	var scoringDeadline time.Duration
+	var weightScoresByConfidence bool
+	// Plan designer type
+	var planDesigner string
+	// Time finished operations are kept
+	var operationsRetention time.Duration
 	// Debug flag
 	var debug bool
 
 	port = uint32(viper.GetInt32("port"))
+	metricsPort = uint32(viper.GetInt32("metricsPort"))
 	systemModel = viper.GetString("systemModelAddress")
 	networkingService = viper.GetString("networkManagerAddress")
 	authxService = viper.GetString("authxAddress")
@@ -108,6 +148,14 @@ func RunConductor() {
 	queueAddress = viper.GetString("queueAddress")
 	dbFolder = viper.GetString("dbFolder")
 	networkingMode = viper.GetString("networkMode")
+	requestsQueue = viper.GetString("requestsQueue")
+	organizationWeights = viper.GetStringSlice("organizationWeights")
+	deploymentWorkers = viper.GetInt("deploymentWorkers")
+	scoringConcurrency = viper.GetInt("scoringConcurrency")
+	scoringDeadline = viper.GetDuration("scoringDeadline")
+	weightScoresByConfidence = viper.GetBool("weightScoresByConfidence")
+	planDesigner = viper.GetString("planDesigner")
+	operationsRetention = viper.GetDuration("operationsRetention")
 	debug = viper.GetBool("debug")
 
 	log.Info().Msg("launching conductor...")
@@ -118,8 +166,27 @@ func RunConductor() {
 		return
 	}
 
+	queueType, err := service.ConductorRequestsQueueTypeFromString(requestsQueue)
+	if err != nil {
+		log.Panic().Err(err).Msg("configuration error... leaving")
+		return
+	}
+
+	designerType, err := service.ConductorPlanDesignerTypeFromString(planDesigner)
+	if err != nil {
+		log.Panic().Err(err).Msg("configuration error... leaving")
+		return
+	}
+
+	weights, err := parseOrganizationWeights(organizationWeights)
+	if err != nil {
+		log.Panic().Err(err).Msg("configuration error... leaving")
+		return
+	}
+
 	config := service.ConductorConfig{
 		Port:                     port,
+		MetricsPort:              metricsPort,
 		SystemModelURL:           systemModel,
 		NetworkingServiceURL:     networkingService,
 		AppClusterApiPort:        appClusterApiPort,
@@ -132,6 +199,14 @@ func RunConductor() {
 		QueueURL:                 queueAddress,
 		DBFolder:                 dbFolder,
 		NetworkingMode:           netMode,
+		RequestsQueueType:        queueType,
+		OrganizationWeights:      weights,
+		DeploymentWorkers:        deploymentWorkers,
+		ScoringConcurrency:       scoringConcurrency,
+		ScoringDeadline:          scoringDeadline,
+		WeightScoresByConfidence: weightScoresByConfidence,
+		PlanDesignerType:         designerType,
+		OperationsRetention:      operationsRetention,
 		Debug:                    debug,
 	}
 	config.Print()
@@ -142,3 +217,24 @@ func RunConductor() {
 	}
 	conductorService.Run()
 }
+
+// Parse the list of organization weights.
+//  params:
+//   entries list of organizationId=weight entries
+//  return:
+//   weights indexed by organization id or error if any
+func parseOrganizationWeights(entries []string) (map[string]int, error) {
+	weights := make(map[string]int, 0)
+	for _, entry := range entries {
+		split := strings.SplitN(entry, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("malformed organization weight %s", entry)
+		}
+		weight, err := strconv.Atoi(split[1])
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid weight for organization %s", split[0])
+		}
+		weights[split[0]] = weight
+	}
+	return weights, nil
+}
@@ -18,11 +18,13 @@
 package entities
 
 import (
+	"github.com/google/uuid"
 	"github.com/nalej/derrors"
 	pbApplication "github.com/nalej/grpc-application-go"
 	"github.com/nalej/grpc-application-network-go"
 	pbConductor "github.com/nalej/grpc-conductor-go"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -33,6 +35,8 @@ type DeploymentScore struct {
 	DeploymentsScore []ClusterDeploymentScore `json:"scoring,omitempty"`
 	// Total number of evaluated clusters
 	NumEvaluatedClusters int `json:"num_evaluated_clusters,omitempty"`
+	// Clusters that did not answer before the scoring deadline
+	TimedOutClusters []string `json:"timed_out_clusters,omitempty"`
 }
 
 func NewClustersScore() DeploymentScore {
@@ -45,6 +49,11 @@ func (c *DeploymentScore) AddClusterScore(score ClusterDeploymentScore) {
 	c.NumEvaluatedClusters = c.NumEvaluatedClusters + 1
 }
 
+// AddTimedOutCluster records a cluster that did not return its score on time
+func (c *DeploymentScore) AddTimedOutCluster(clusterId string) {
+	c.TimedOutClusters = append(c.TimedOutClusters, clusterId)
+}
+
 // Cluster deployment score ------
 
 // Combinations of deployments evaluated by a cluster. Every combination is a set of service groups
@@ -73,6 +82,13 @@ func (cds *ClusterDeploymentScore) AddScore(serviceGroupIds []string, score floa
 	cds.Scores[newKey] = score
 }
 
+func (cds *ClusterDeploymentScore) ToGRPC() *pbConductor.ClusterDeploymentScore {
+	return &pbConductor.ClusterDeploymentScore{
+		ClusterId: cds.ClusterId,
+		Scores:    cds.Scores,
+	}
+}
+
 // End of cluster deployment score ------
 
 // Objects describing received deployment requests. These objects are designed to be stored into
@@ -87,6 +103,33 @@ type DeploymentRequest struct {
 	// The AppInstanceId is internally used to link this request with a certain instance
 	AppInstanceId string                                            `json:"app_instance_id,omitempty"`
 	Connections   []*grpc_application_network_go.ConnectionInstance `json:"connections,omitempty"`
+	// Optional priority of the request. Requests with a higher priority are processed first among the
+	// requests of the same organization.
+	Priority int32 `json:"priority,omitempty"`
+	// Operation tracking the progress of this request, if any
+	OperationId string `json:"operation_id,omitempty"`
+	// Time the request was pushed into the queue for the last time
+	EnqueuedAt *time.Time `json:"enqueued_at,omitempty"`
+}
+
+// Label of the application descriptor setting the priority of its deployment requests.
+const DeploymentPriorityLabel = "nalej-deployment-priority"
+
+// Obtain the priority of the deployment requests of an application descriptor.
+//  params:
+//   labels labels of the application descriptor
+//  return:
+//   priority set by DeploymentPriorityLabel, zero if the label is missing or is not a number
+func DeploymentPriorityFromLabels(labels map[string]string) int32 {
+	value, found := labels[DeploymentPriorityLabel]
+	if !found {
+		return 0
+	}
+	priority, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		return 0
+	}
+	return int32(priority)
 }
 
 // Fragment deployment Status definition
@@ -127,6 +170,66 @@ type DeploymentPlan struct {
 	DeploymentRequest *DeploymentRequest `json:"deployment_request,omitempty"`
 }
 
+// Request to compute the plan of an application without deploying it. The plan is computed for an existing
+// application instance or, if no instance is indicated, for an application descriptor.
+type DryRunRequest struct {
+	OrganizationId  string `json:"organization_id,omitempty"`
+	AppInstanceId   string `json:"app_instance_id,omitempty"`
+	AppDescriptorId string `json:"app_descriptor_id,omitempty"`
+}
+
+// Result of a dry run. It contains the plan that would be deployed and the information used to build it.
+type DryRunResult struct {
+	// Requirements found for the application
+	Requirements *Requirements `json:"requirements,omitempty"`
+	// Scores returned by the musicians
+	Score *DeploymentScore `json:"score,omitempty"`
+	// Plan that would be deployed
+	Plan *DeploymentPlan `json:"plan,omitempty"`
+}
+
+func NewDryRunRequestFromGRPC(request *pbConductor.DryRunRequest) *DryRunRequest {
+	if request == nil {
+		return nil
+	}
+	return &DryRunRequest{
+		OrganizationId:  request.OrganizationId,
+		AppInstanceId:   request.AppInstanceId,
+		AppDescriptorId: request.AppDescriptorId,
+	}
+}
+
+func (r *DryRunResult) ToGRPC() *pbConductor.DryRunResponse {
+	result := pbConductor.DryRunResponse{}
+	if r.Requirements != nil {
+		result.Requirements = r.Requirements.ToGRPC()
+	}
+	if r.Score != nil {
+		result.Scores = make([]*pbConductor.ClusterDeploymentScore, len(r.Score.DeploymentsScore))
+		for i, score := range r.Score.DeploymentsScore {
+			result.Scores[i] = score.ToGRPC()
+		}
+		result.TimedOutClusters = r.Score.TimedOutClusters
+	}
+	if r.Plan != nil {
+		result.Plan = r.Plan.ToGRPC()
+	}
+	return &result
+}
+
+func (dp *DeploymentPlan) ToGRPC() *pbConductor.DeploymentPlan {
+	convertedFragments := make([]*pbConductor.DeploymentFragment, len(dp.Fragments))
+	for i, fragment := range dp.Fragments {
+		convertedFragments[i] = fragment.ToGRPC()
+	}
+	return &pbConductor.DeploymentPlan{
+		DeploymentId:   dp.DeploymentId,
+		OrganizationId: dp.OrganizationId,
+		AppInstanceId:  dp.AppInstanceId,
+		Fragments:      convertedFragments,
+	}
+}
+
 // Start deployment fragment definition ----
 
 // Data structure representing the components of a plan that will be
@@ -155,7 +258,7 @@ type DeploymentFragment struct {
 	// Deployment stages belonging to this fragment
 	Stages []DeploymentStage `json:"stages,omitempty"`
 	// Identifier for the ZtNetworkID. This is a value only used by conductor.
-	ZtNetworkID string `json:"stages,omitempty"`
+	ZtNetworkID string `json:"zt_network_id,omitempty"`
 	// Status for this deployment fragment
 	Status DeploymentFragmentStatus `json:"status"`
 }
@@ -184,12 +287,19 @@ func (df *DeploymentFragment) ToGRPC() *pbConductor.DeploymentFragment {
 // ----
 
 type UndeployRequest struct {
+	// RequestId identifying the undeploy request
+	RequestId string `json:"request_id,omitempty"`
 	// OrganizationId this deployment belongs to
 	OrganizationId string `json:"organization_id,omitempty"`
 	// AppInstanceId for the instance of the application to run
 	AppInstanceId string `json:"app_instance_id,omitempty"`
 }
 
+// Create an undeploy request with a new request id.
+func NewUndeployRequest(organizationId string, appInstanceId string) *UndeployRequest {
+	return &UndeployRequest{RequestId: uuid.New().String(), OrganizationId: organizationId, AppInstanceId: appInstanceId}
+}
+
 // ------------------------------------ //
 // -- Deployment fragment definition -- //
 // ------------------------------------ //
@@ -399,3 +509,17 @@ func ValidUndeployRequest(request *pbConductor.UndeployRequest) derrors.Error {
 	}
 	return nil
 }
+
+//ValidDryRunRequest validates request data before computing a plan without deploying it
+func ValidDryRunRequest(request *DryRunRequest) derrors.Error {
+	if request == nil {
+		return derrors.NewInvalidArgumentError(invalidRequest)
+	}
+	if request.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationID)
+	}
+	if request.AppInstanceId == "" && request.AppDescriptorId == "" {
+		return derrors.NewInvalidArgumentError(emptyAppDescriptorID)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package entities
+
+import (
+	"github.com/nalej/derrors"
+	pbConductor "github.com/nalej/grpc-conductor-go"
+)
+
+// Outcome of a fragment handled by a drain operation
+type DrainedFragmentOutcome int
+
+const (
+	DRAINED_FRAGMENT_REMOVED DrainedFragmentOutcome = iota
+	DRAINED_FRAGMENT_RESCHEDULED
+	DRAINED_FRAGMENT_FAILED
+)
+
+// Progress of the drain of a cluster. Every fragment running in the cluster is removed and then
+// rescheduled in a different cluster.
+type DrainProgress struct {
+	// Number of fragments running in the cluster when the operation started
+	TotalFragments int `json:"total_fragments"`
+	// Number of fragments removed from the cluster
+	RemovedFragments int `json:"removed_fragments"`
+	// Number of fragments scheduled again in other clusters
+	RescheduledFragments int `json:"rescheduled_fragments"`
+	// Number of fragments that could not be removed or rescheduled
+	FailedFragments int `json:"failed_fragments"`
+}
+
+// Count a fragment handled by the drain.
+func (p *DrainProgress) Add(outcome DrainedFragmentOutcome) {
+	switch outcome {
+	case DRAINED_FRAGMENT_REMOVED:
+		p.RemovedFragments++
+	case DRAINED_FRAGMENT_RESCHEDULED:
+		p.RescheduledFragments++
+	case DRAINED_FRAGMENT_FAILED:
+		p.FailedFragments++
+	}
+}
+
+func (p *DrainProgress) ToGRPC() *pbConductor.DrainProgress {
+	return &pbConductor.DrainProgress{
+		TotalFragments:       int32(p.TotalFragments),
+		RemovedFragments:     int32(p.RemovedFragments),
+		RescheduledFragments: int32(p.RescheduledFragments),
+		FailedFragments:      int32(p.FailedFragments),
+	}
+}
+
+//ValidDrainClusterRequest validates request data before draining a cluster
+func ValidDrainClusterRequest(request *pbConductor.DrainClusterRequest) derrors.Error {
+	if request == nil {
+		return derrors.NewInvalidArgumentError(invalidRequest)
+	}
+	if request.ClusterId == nil {
+		return derrors.NewInvalidArgumentError(emptyClusterID)
+	}
+	if request.ClusterId.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationID)
+	}
+	if request.ClusterId.ClusterId == "" {
+		return derrors.NewInvalidArgumentError(emptyClusterID)
+	}
+	return nil
+}
@@ -25,3 +25,6 @@ const emptyName = "name cannot be empty"
 const emptyFragmentID = "fragment_id cannot be empty"
 const emptyAppInstanceID = "appinstance_id cannot be empty"
 const emptyClusterID = "cluster_id cannot be empty"
+const emptyAppDescriptorID = "app_descriptor_id cannot be empty"
+const emptyOperationID = "operation_id cannot be empty"
+const invalidOperationsFilter = "either request_id or app_instance_id must be set"
@@ -0,0 +1,344 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package entities
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/nalej/derrors"
+	pbConductor "github.com/nalej/grpc-conductor-go"
+	"time"
+)
+
+// Type of long running operation
+type OperationType int
+
+const (
+	DEPLOY_OPERATION OperationType = iota
+	UNDEPLOY_OPERATION
+	DRAIN_OPERATION
+)
+
+var OperationTypeToString = map[OperationType]string{
+	DEPLOY_OPERATION:   "DEPLOY",
+	UNDEPLOY_OPERATION: "UNDEPLOY",
+	DRAIN_OPERATION:    "DRAIN",
+}
+
+// MarshalJSON encodes the type of operation using its name.
+func (t OperationType) MarshalJSON() ([]byte, error) {
+	name, found := OperationTypeToString[t]
+	if !found {
+		return nil, fmt.Errorf("unknown operation type %d", t)
+	}
+	return json.Marshal(name)
+}
+
+var OperationTypeToGRPC = map[OperationType]pbConductor.OperationType{
+	DEPLOY_OPERATION:   pbConductor.OperationType_DEPLOY,
+	UNDEPLOY_OPERATION: pbConductor.OperationType_UNDEPLOY,
+	DRAIN_OPERATION:    pbConductor.OperationType_DRAIN,
+}
+
+// UnmarshalJSON decodes the type of operation from its name. Numeric values stored by previous versions
+// are also accepted.
+func (t *OperationType) UnmarshalJSON(data []byte) error {
+	value, err := enumFromJSON(data, "operation type", func(name string) (int, bool) {
+		for opType, opName := range OperationTypeToString {
+			if opName == name {
+				return int(opType), true
+			}
+		}
+		return 0, false
+	})
+	if err != nil {
+		return err
+	}
+	*t = OperationType(value)
+	return nil
+}
+
+// Status of a long running operation
+type OperationStatus int
+
+const (
+	OPERATION_IN_PROGRESS OperationStatus = iota
+	OPERATION_DONE
+	OPERATION_FAILED
+)
+
+var OperationStatusToString = map[OperationStatus]string{
+	OPERATION_IN_PROGRESS: "IN_PROGRESS",
+	OPERATION_DONE:        "DONE",
+	OPERATION_FAILED:      "FAILED",
+}
+
+// MarshalJSON encodes the status of an operation using its name.
+func (s OperationStatus) MarshalJSON() ([]byte, error) {
+	name, found := OperationStatusToString[s]
+	if !found {
+		return nil, fmt.Errorf("unknown operation status %d", s)
+	}
+	return json.Marshal(name)
+}
+
+var OperationStatusToGRPC = map[OperationStatus]pbConductor.OperationStatus{
+	OPERATION_IN_PROGRESS: pbConductor.OperationStatus_IN_PROGRESS,
+	OPERATION_DONE:        pbConductor.OperationStatus_DONE,
+	OPERATION_FAILED:      pbConductor.OperationStatus_FAILED,
+}
+
+// UnmarshalJSON decodes the status of an operation from its name. Numeric values stored by previous versions
+// are also accepted.
+func (s *OperationStatus) UnmarshalJSON(data []byte) error {
+	value, err := enumFromJSON(data, "operation status", func(name string) (int, bool) {
+		for status, statusName := range OperationStatusToString {
+			if statusName == name {
+				return int(status), true
+			}
+		}
+		return 0, false
+	})
+	if err != nil {
+		return err
+	}
+	*s = OperationStatus(value)
+	return nil
+}
+
+// Decode an enumerated value encoded either with its name or with its numeric value.
+func enumFromJSON(data []byte, kind string, fromName func(name string) (int, bool)) (int, error) {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var value int
+		if numErr := json.Unmarshal(data, &value); numErr != nil {
+			return 0, fmt.Errorf("invalid %s %s", kind, string(data))
+		}
+		return value, nil
+	}
+	value, found := fromName(name)
+	if !found {
+		return 0, fmt.Errorf("unknown %s %s", kind, name)
+	}
+	return value, nil
+}
+
+// Phase reached by an operation
+type OperationPhase string
+
+// Deployment phases
+const (
+	PHASE_QUEUED           OperationPhase = "queued"
+	PHASE_SCORED           OperationPhase = "scored"
+	PHASE_PLANNED          OperationPhase = "planned"
+	PHASE_NETWORK_PREPARED OperationPhase = "network_prepared"
+	PHASE_FRAGMENTS_SENT   OperationPhase = "fragments_sent"
+	PHASE_RUNNING          OperationPhase = "running"
+)
+
+// Undeployment phases
+const (
+	PHASE_UNDEPLOY_REQUESTED OperationPhase = "undeploy_requested"
+	PHASE_UNDEPLOY_SENT      OperationPhase = "undeploy_sent"
+	PHASE_INSTANCE_REMOVED   OperationPhase = "instance_removed"
+)
+
+// Drain phases
+const (
+	PHASE_DRAIN_STARTED         OperationPhase = "drain_started"
+	PHASE_FRAGMENTS_REMOVED     OperationPhase = "fragments_removed"
+	PHASE_FRAGMENTS_RESCHEDULED OperationPhase = "fragments_rescheduled"
+)
+
+// Phase recorded when an operation fails
+const PHASE_FAILED OperationPhase = "failed"
+
+// Record of a phase reached by an operation
+type OperationPhaseRecord struct {
+	// Reached phase
+	Phase OperationPhase `json:"phase"`
+	// Time the phase was reached
+	Timestamp time.Time `json:"timestamp"`
+	// Error found in this phase if any
+	Error string `json:"error,omitempty"`
+}
+
+// Long running operation triggered by a deployment, undeployment or drain request.
+type Operation struct {
+	// Identifier of the operation
+	OperationId string `json:"operation_id,omitempty"`
+	// Identifier of the request that triggered the operation if any
+	RequestId string `json:"request_id,omitempty"`
+	// Type of operation
+	Type OperationType `json:"type"`
+	// Organization the operation belongs to
+	OrganizationId string `json:"organization_id,omitempty"`
+	// Application instance involved in the operation if any
+	AppInstanceId string `json:"app_instance_id,omitempty"`
+	// Cluster involved in the operation if any
+	ClusterId string `json:"cluster_id,omitempty"`
+	// Current status
+	Status OperationStatus `json:"status"`
+	// Phases reached so far
+	Phases []OperationPhaseRecord `json:"phases,omitempty"`
+	// Error that made the operation fail if any
+	Error string `json:"error,omitempty"`
+	// Progress of the drained fragments, only set for drain operations
+	Drain *DrainProgress `json:"drain,omitempty"`
+	// Time the operation was created
+	Created time.Time `json:"created"`
+	// Time of the last update
+	Updated time.Time `json:"updated"`
+	// Time the operation finished if any
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Create a new operation in progress.
+// params:
+//
+//	operationId identifier of the operation
+//	opType type of operation
+//	requestId request that triggered the operation if any
+//	organizationId organization the operation belongs to
+//	appInstanceId application instance involved if any
+//	clusterId cluster involved if any
+//
+// return:
+//
+//	new operation
+func NewOperation(operationId string, opType OperationType, requestId string, organizationId string,
+	appInstanceId string, clusterId string) *Operation {
+	now := time.Now()
+	return &Operation{
+		OperationId:    operationId,
+		RequestId:      requestId,
+		Type:           opType,
+		OrganizationId: organizationId,
+		AppInstanceId:  appInstanceId,
+		ClusterId:      clusterId,
+		Status:         OPERATION_IN_PROGRESS,
+		Phases:         make([]OperationPhaseRecord, 0),
+		Created:        now,
+		Updated:        now,
+	}
+}
+
+// Create a new drain operation in progress with a new operation id.
+// params:
+//  organizationId organization the drained cluster belongs to
+//  clusterId drained cluster
+//  totalFragments number of fragments running in the cluster
+// return:
+//  new operation
+func NewDrainOperation(organizationId string, clusterId string, totalFragments int) *Operation {
+	op := NewOperation(uuid.New().String(), DRAIN_OPERATION, "", organizationId, "", clusterId)
+	op.Drain = &DrainProgress{TotalFragments: totalFragments}
+	return op
+}
+
+// Record a new phase. The error, if any, is recorded without changing the status of the operation.
+func (o *Operation) AddPhase(phase OperationPhase, err error, timestamp time.Time) {
+	record := OperationPhaseRecord{Phase: phase, Timestamp: timestamp}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	o.Phases = append(o.Phases, record)
+	o.Updated = timestamp
+}
+
+// Finish the operation after reaching its final phase.
+func (o *Operation) Finish(phase OperationPhase, timestamp time.Time) {
+	o.AddPhase(phase, nil, timestamp)
+	o.Status = OPERATION_DONE
+	o.Finished = &timestamp
+}
+
+// Finish the operation with an error.
+func (o *Operation) Fail(err error, timestamp time.Time) {
+	o.AddPhase(PHASE_FAILED, err, timestamp)
+	o.Status = OPERATION_FAILED
+	if err != nil {
+		o.Error = err.Error()
+	}
+	o.Finished = &timestamp
+}
+
+// Check if the operation is finished.
+func (o *Operation) IsFinished() bool {
+	return o.Status != OPERATION_IN_PROGRESS
+}
+
+func (o *Operation) ToGRPC() *pbConductor.Operation {
+	phases := make([]*pbConductor.OperationPhase, len(o.Phases))
+	for i, phase := range o.Phases {
+		phases[i] = &pbConductor.OperationPhase{
+			Phase:     string(phase.Phase),
+			Timestamp: phase.Timestamp.Unix(),
+			Error:     phase.Error,
+		}
+	}
+	result := pbConductor.Operation{
+		OperationId:    o.OperationId,
+		RequestId:      o.RequestId,
+		Type:           OperationTypeToGRPC[o.Type],
+		OrganizationId: o.OrganizationId,
+		AppInstanceId:  o.AppInstanceId,
+		ClusterId:      o.ClusterId,
+		Status:         OperationStatusToGRPC[o.Status],
+		Phases:         phases,
+		Error:          o.Error,
+		Created:        o.Created.Unix(),
+		Updated:        o.Updated.Unix(),
+	}
+	if o.Finished != nil {
+		result.Finished = o.Finished.Unix()
+	}
+	if o.Drain != nil {
+		result.Drain = o.Drain.ToGRPC()
+	}
+	return &result
+}
+
+//ValidOperationId validates request data before retrieving an operation
+func ValidOperationId(request *pbConductor.OperationId) derrors.Error {
+	if request == nil {
+		return derrors.NewInvalidArgumentError(invalidRequest)
+	}
+	if request.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationID)
+	}
+	if request.OperationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOperationID)
+	}
+	return nil
+}
+
+//ValidListOperationsRequest validates request data before listing the operations of a request or an application instance
+func ValidListOperationsRequest(request *pbConductor.ListOperationsRequest) derrors.Error {
+	if request == nil {
+		return derrors.NewInvalidArgumentError(invalidRequest)
+	}
+	if request.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationID)
+	}
+	if (request.RequestId == "") == (request.AppInstanceId == "") {
+		return derrors.NewInvalidArgumentError(invalidOperationsFilter)
+	}
+	return nil
+}
@@ -24,6 +24,8 @@ import (
 // List of requirements demanded by an app
 type Requirements struct {
 	List []Requirement `json:"list, omitempty"`
+	// Sets of group service ids that must be deployed in the same cluster and have to be scored together
+	CollocationSets [][]string `json:"collocation_sets,omitempty"`
 }
 
 func NewRequirements() Requirements {
@@ -35,6 +37,11 @@ func (r *Requirements) AddRequirement(req Requirement) {
 	r.List = append(r.List, req)
 }
 
+// AddCollocationSet adds a set of group service ids to be scored together
+func (r *Requirements) AddCollocationSet(groupServiceIds []string) {
+	r.CollocationSets = append(r.CollocationSets, groupServiceIds)
+}
+
 func (r *Requirements) ToGRPC() []*pbConductor.Requirement {
 	toReturn := make([]*pbConductor.Requirement, len(r.List))
 
@@ -68,6 +75,11 @@ type Requirement struct {
 	Replicas int32 `json:"replicas, omitempty"`
 	// Cluster selection labels
 	DeploymentSelectors map[string]string `json:"deployment_selectors, omitempty"`
+	// Largest amount of CPUNum, memory and storage requested by a single service replica of the group. A replica
+	// must fit into a single node.
+	MaxServiceCPU     int64 `json:"max_service_cpu,omitempty"`
+	MaxServiceMemory  int64 `json:"max_service_memory,omitempty"`
+	MaxServiceStorage int64 `json:"max_service_storage,omitempty"`
 }
 
 func NewRequirement(appInstanceId string, groupServiceId string, cpu int64, memory int64, storage int64,
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package entities
+
+// Scoring modes
+const (
+	// Score every combination of requirements. This is the default mode.
+	CombinationsScoringMode = "combinations"
+	// Score every requirement individually plus the requested co-location sets.
+	IndividualScoringMode = "individual"
+)
+
+// Maximum number of requirements scored in every combination. Larger requests are scored individually.
+const MaxCombinationRequirements = 10
+
+// Maximum number of co-location sets accepted when scoring requirements individually.
+const MaxCollocationSets = 64
+
+// Options indicating which sets of requirements have to be scored.
+type ScoringOptions struct {
+	// Scoring mode
+	Mode string
+	// Sets of group service instance ids to be scored together in the individual mode
+	CollocationSets [][]string
+	// Resources of the largest service replica of every group indexed by group service instance id
+	LargestServices map[string]ServiceResources
+}
+
+// Resources requested by a single service replica.
+type ServiceResources struct {
+	// Millicores
+	CPU int64
+	// Memory in bytes
+	Memory int64
+	// Storage in bytes
+	Storage int64
+}
+
+// Build the options to score every combination of requirements.
+//  return:
+//   scoring options
+func NewCombinationsScoringOptions() *ScoringOptions {
+	return &ScoringOptions{Mode: CombinationsScoringMode}
+}
+
+// Build the options to score every requirement individually plus the indicated co-location sets.
+//  params:
+//   collocationSets sets of group service instance ids to be scored together
+//  return:
+//   scoring options
+func NewIndividualScoringOptions(collocationSets [][]string) *ScoringOptions {
+	return &ScoringOptions{Mode: IndividualScoringMode, CollocationSets: collocationSets}
+}
@@ -22,8 +22,98 @@ import "time"
 // System Status representation.
 type Status struct {
 	Timestamp time.Time `json:"timestamp,omitempty"`
-	MemFree   float64   `json: "mem_free,omitempty"`
-	CPUNum    float64   `json: "cpu_num,omitempty"`
-	CPUIdle   float64   `json: "cpu_idle,omitempty"`
-	DiskFree  float64   `json: "disk_free,omitempty"`
+	// Free memory accumulated for all the nodes
+	MemFree float64 `json: "mem_free,omitempty"`
+	CPUNum  float64 `json: "cpu_num,omitempty"`
+	CPUIdle float64 `json: "cpu_idle,omitempty"`
+	// Free disk of the node with the largest free space. Unlike memory it is not accumulated, as a volume
+	// cannot span several nodes.
+	DiskFree float64 `json: "disk_free,omitempty"`
+	// Allocatable resources of every node, empty if unknown
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+	// Collector that produced every metric indexed by metric name, empty if there is a single source
+	Sources map[string]string `json:"sources,omitempty"`
+	// Statistics of the latest observations, nil if the collector keeps no history
+	Window *StatusWindow `json:"window,omitempty"`
+}
+
+// Statistics computed over the observations of a time window.
+type StatusWindow struct {
+	// Number of observations in the window
+	Samples int `json:"samples,omitempty"`
+	// Time between the oldest and the newest observation
+	Duration time.Duration `json:"duration,omitempty"`
+	// 95th percentile of the CPU utilisation from 0 to 1, negative if unknown
+	CPUUsageP95 float64 `json:"cpu_usage_p95,omitempty"`
+	// Variation of the free memory in bytes per second, negative when the free memory decreases
+	MemFreeTrend float64 `json:"mem_free_trend,omitempty"`
+	// Confidence on the statistics from 0 to 1, it grows as the observations cover the whole window
+	Confidence float64 `json:"confidence,omitempty"`
+}
+
+// Allocatable resources of a cluster node.
+type NodeStatus struct {
+	// Node name
+	Name string `json:"name,omitempty"`
+	// Allocatable number of cores
+	CPU float64 `json:"cpu,omitempty"`
+	// Allocatable memory in bytes
+	Memory float64 `json:"memory,omitempty"`
+	// Allocatable disk in bytes
+	Disk float64 `json:"disk,omitempty"`
+	// Maximum number of pods, zero if unknown
+	MaxPods float64 `json:"max_pods,omitempty"`
+	// Number of running pods
+	Pods float64 `json:"pods,omitempty"`
+	// Number of cores requested by the pods in the node, zero if unknown
+	RequestedCPU float64 `json:"requested_cpu,omitempty"`
+	// Memory in bytes requested by the pods in the node, zero if unknown
+	RequestedMemory float64 `json:"requested_memory,omitempty"`
+	// Disk in bytes requested by the pods in the node, zero if unknown
+	RequestedDisk float64 `json:"requested_disk,omitempty"`
+}
+
+// Number of pods that can still be scheduled in the node.
+//  return:
+//   pod headroom, negative if the maximum number of pods is unknown
+func (n NodeStatus) PodHeadroom() float64 {
+	if n.MaxPods <= 0 {
+		return -1
+	}
+	return n.MaxPods - n.Pods
+}
+
+// Check whether a single replica with the given resources can be placed in the node.
+//  params:
+//   cpu requested millicores
+//   memory requested bytes
+//   disk requested bytes
+//  return:
+//   true if the replica fits into the allocatable resources not yet requested and there is room for a new pod
+func (n NodeStatus) Fits(cpu float64, memory float64, disk float64) bool {
+	if cpu > (n.CPU-n.RequestedCPU)*1000 || memory > n.Memory-n.RequestedMemory ||
+		(disk > 0 && disk > n.Disk-n.RequestedDisk) {
+		return false
+	}
+	headroom := n.PodHeadroom()
+	return headroom < 0 || headroom >= 1
+}
+
+// Check whether a single replica with the given resources can be placed in any node of the cluster.
+//  params:
+//   cpu requested millicores
+//   memory requested bytes
+//   disk requested bytes
+//  return:
+//   true if there is a node where it fits, or if the nodes are unknown
+func (s *Status) FitsInAnyNode(cpu float64, memory float64, disk float64) bool {
+	if len(s.Nodes) == 0 {
+		return true
+	}
+	for _, n := range s.Nodes {
+		if n.Fits(cpu, memory, disk) {
+			return true
+		}
+	}
+	return false
 }
@@ -18,12 +18,13 @@
 package app_cluster
 
 import (
-	"bytes"
-	"encoding/gob"
+	"fmt"
 	"github.com/nalej/conductor/internal/entities"
 	"github.com/nalej/conductor/pkg/provider"
 	"github.com/nalej/derrors"
 	"github.com/rs/zerolog/log"
+	"sort"
+	"sync"
 )
 
 // Manipulation of persistent entries storing information about applications running
@@ -35,85 +36,316 @@ import (
 // bucket    --> key                    --> value
 // clusterId --> DeploymentFragmentId_1 --> deploymentFragment
 // clusterId --> DeploymentFragmentId_2 --> deploymentFragment
+// Deployment fragments are stored using the versioned record envelope defined in record.go.
+// Secondary indexes by application instance, deployment and organization are maintained in
+// additional buckets as defined in indexes.go. Changes are published to the subscriptions defined
+// in subscriptions.go. Pending deployment plans are stored in their own bucket as defined in pending_plans.go.
 
 type AppClusterDB struct {
 	// provider to persist information
 	db provider.KeyValueProvider
+	// mutex to publish the changes in the same order they are committed
+	writeMu sync.Mutex
+	// mutex for the subscriptions
+	subscribersMu sync.Mutex
+	// active subscriptions
+	subscribers map[uint64]*Subscription
+	// identifier for the next subscription
+	nextSubscriptionId uint64
 }
 
 func NewAppClusterDB(db provider.KeyValueProvider) *AppClusterDB {
 	return &AppClusterDB{
-		db: db,
+		db:          db,
+		subscribers: make(map[uint64]*Subscription, 0),
 	}
 }
 
+// Add or overwrite a deployment fragment. The fragment and its index entries are written in the same transaction.
 func (a *AppClusterDB) AddDeploymentFragment(fragment *entities.DeploymentFragment) derrors.Error {
-	var buffer bytes.Buffer
-	e := gob.NewEncoder(&buffer)
-	if err := e.Encode(fragment); err != nil {
-		return derrors.NewInternalError("impossible to marshall deployment fragment", err)
+	return a.AddDeploymentFragmentWithPlan(fragment, nil)
+}
+
+// Update the status of a stored deployment fragment.
+// params:
+//  clusterId
+//  fragmentId
+//  status new status of the fragment
+// return:
+//  updated fragment or error if any
+func (a *AppClusterDB) UpdateFragmentStatus(clusterId string, fragmentId string, status entities.DeploymentFragmentStatus) (*entities.DeploymentFragment, derrors.Error) {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	var previous *entities.DeploymentFragment
+	var updated *entities.DeploymentFragment
+	err := a.db.Update(func(tx provider.KeyValueTx) derrors.Error {
+		stored, err := getStoredFragment(tx, clusterId, fragmentId)
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			return derrors.NewNotFoundError(fmt.Sprintf("deployment fragment %s not found in cluster %s",
+				fragmentId, clusterId))
+		}
+		updated = copyFragment(stored)
+		updated.Status = status
+		previous, err = putFragment(tx, updated)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.publish(FragmentEvent{ClusterId: clusterId, FragmentId: fragmentId, Previous: previous,
+		Current: copyFragment(updated)})
+	return updated, nil
+}
+
+// Write a fragment and its index entries in a transaction.
+// return:
+//  previously stored fragment, nil if it was not stored
+func putFragment(tx provider.KeyValueTx, fragment *entities.DeploymentFragment) (*entities.DeploymentFragment, derrors.Error) {
+	value, err := encodeFragment(fragment)
+	if err != nil {
+		return nil, err
+	}
+	// fragments are overwritten on every status update, remove the index entries of the previous version
+	previous, err := getStoredFragment(tx, fragment.ClusterId, fragment.FragmentId)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		if err := updateIndexes(tx, previous, -1); err != nil {
+			return nil, err
+		}
 	}
 
-	return a.db.Put([]byte(fragment.ClusterId), []byte(fragment.FragmentId), buffer.Bytes())
+	if err := tx.Put([]byte(fragment.ClusterId), []byte(fragment.FragmentId), value); err != nil {
+		return nil, err
+	}
+	return previous, updateIndexes(tx, fragment, 1)
 }
 
-func (a *AppClusterDB) GetDeploymentFragment(clusterId string, fragmentId string) (*entities.DeploymentFragment, derrors.Error) {
-	retrieved, err := a.db.Get([]byte(clusterId), []byte(fragmentId))
+// Copy a fragment so the published events are not modified by the callers.
+func copyFragment(fragment *entities.DeploymentFragment) *entities.DeploymentFragment {
+	value, err := encodeFragment(fragment)
 	if err != nil {
-		return nil, derrors.NewInternalError("impossible to get deployment fragment", err)
+		aux := *fragment
+		return &aux
 	}
-	if retrieved == nil {
-		return nil, nil
+	copied, err := decodeFragment(value)
+	if err != nil {
+		aux := *fragment
+		return &aux
 	}
+	return copied
+}
 
-	b := bytes.NewReader(retrieved)
-	d := gob.NewDecoder(b)
-	var df entities.DeploymentFragment
-	if err := d.Decode(&df); err != nil {
-		return nil, derrors.NewInternalError("impossible to unmarshall deployment fragment", err)
+// Get a deployment fragment.
+// params:
+//  clusterId cluster the fragment is deployed on
+//  fragmentId fragment identifier
+// return:
+//  the fragment, nil if it is not stored, or error if the database could not be read
+func (a *AppClusterDB) GetDeploymentFragment(clusterId string, fragmentId string) (*entities.DeploymentFragment, derrors.Error) {
+	var fragment *entities.DeploymentFragment
+	err := a.db.View(func(tx provider.KeyValueTx) derrors.Error {
+		var err derrors.Error
+		fragment, err = getStoredFragment(tx, clusterId, fragmentId)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return &df, nil
+	return fragment, nil
 }
 
+// Delete a deployment fragment. The fragment and its index entries are removed in the same transaction.
 func (a *AppClusterDB) DeleteDeploymentFragment(clusterId string, fragmentId string) derrors.Error {
 	log.Debug().Str("clusterId", clusterId).Str("fragmentId", fragmentId).Msg("delete deployment fragment from db")
-	err := a.db.Delete([]byte(clusterId), []byte(fragmentId))
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	var previous *entities.DeploymentFragment
+	err := a.db.Update(func(tx provider.KeyValueTx) derrors.Error {
+		var err derrors.Error
+		previous, err = getStoredFragment(tx, clusterId, fragmentId)
+		if err != nil {
+			return err
+		}
+		err = tx.Delete([]byte(clusterId), []byte(fragmentId))
+		if err != nil {
+			return derrors.NewInternalError("impossible to delete deployment fragment", err)
+		}
+		if previous != nil {
+			return updateIndexes(tx, previous, -1)
+		}
+		return nil
+	})
 	if err != nil {
-		return derrors.NewInternalError("impossible to delete deployment fragment", err)
+		return err
+	}
+	if previous != nil {
+		a.publish(FragmentEvent{ClusterId: clusterId, FragmentId: fragmentId, Previous: previous})
 	}
 	return nil
 }
 
+// Get a stored fragment returning nil if the cluster bucket or the fragment do not exist.
+func getStoredFragment(tx provider.KeyValueTx, clusterId string, fragmentId string) (*entities.DeploymentFragment, derrors.Error) {
+	if !tx.BucketExists([]byte(clusterId)) {
+		return nil, nil
+	}
+	retrieved, err := tx.Get([]byte(clusterId), []byte(fragmentId))
+	if err != nil {
+		return nil, derrors.NewInternalError("impossible to get deployment fragment", err)
+	}
+	if retrieved == nil {
+		return nil, nil
+	}
+	return decodeFragment(retrieved)
+}
+
 func (a *AppClusterDB) GetFragmentsInCluster(clusterId string) ([]entities.DeploymentFragment, derrors.Error) {
-	pairs, err := a.db.GetAllPairsInBucket([]byte(clusterId))
+	result := make([]entities.DeploymentFragment, 0)
+	var decodeErr derrors.Error
+	err := a.db.ScanPrefix([]byte(clusterId), nil, func(key []byte, value []byte) bool {
+		df, err := decodeFragment(value)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		result = append(result, *df)
+		return true
+	})
 	if err != nil {
 		return nil, derrors.NewInternalError("impossible to get deployments from cluster")
 	}
-	result := make([]entities.DeploymentFragment, len(pairs))
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	return result, nil
+}
 
-	for i, pair := range pairs {
-		b := bytes.NewReader(pair.Value)
-		d := gob.NewDecoder(b)
-		var df entities.DeploymentFragment
-		if err := d.Decode(&df); err != nil {
-			return nil, derrors.NewInternalError("impossible to unmarshall deployment fragment", err)
+// Return all the stored deployment fragments.
+// return:
+//  fragments of all the clusters or error if any
+func (a *AppClusterDB) GetAllFragments() ([]entities.DeploymentFragment, derrors.Error) {
+	result := make([]entities.DeploymentFragment, 0)
+	for _, bucket := range a.db.GetBuckets() {
+		if !isClusterBucket(bucket) {
+			continue
 		}
-		result[i] = df
+		fragments, err := a.GetFragmentsInCluster(string(bucket))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, fragments...)
 	}
 	return result, nil
 }
 
-// Return the deployment fragments for an application
+// Return the deployment fragments for an application running in a cluster
 func (a *AppClusterDB) GetFragmentsApp(clusterId string, appInstanceId string) ([]entities.DeploymentFragment, derrors.Error) {
-	fragmentsCluster, err := a.GetFragmentsInCluster(clusterId)
+	return a.getIndexedFragments(appInstanceIndex, appInstanceId, clusterId)
+}
+
+// Return the deployment fragments of an application instance in any cluster.
+// params:
+//  appInstanceId
+// return:
+//  fragments of the application instance or error if any
+func (a *AppClusterDB) GetFragmentsByAppInstance(appInstanceId string) ([]entities.DeploymentFragment, derrors.Error) {
+	return a.getIndexedFragments(appInstanceIndex, appInstanceId, "")
+}
+
+// Return the deployment fragments generated by a deployment plan.
+// params:
+//  deploymentId
+// return:
+//  fragments of the deployment or error if any
+func (a *AppClusterDB) GetFragmentsByDeployment(deploymentId string) ([]entities.DeploymentFragment, derrors.Error) {
+	return a.getIndexedFragments(deploymentIndex, deploymentId, "")
+}
+
+// Return the clusters running fragments of an organization.
+// params:
+//  organizationId
+// return:
+//  sorted list of cluster ids or error if any
+func (a *AppClusterDB) GetClustersInOrganization(organizationId string) ([]string, derrors.Error) {
+	var entry indexEntry
+	err := a.db.View(func(tx provider.KeyValueTx) derrors.Error {
+		var err derrors.Error
+		entry, err = getIndexEntry(tx, organizationIndex, organizationId)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	toReturn := make([]entities.DeploymentFragment, 0)
-	for _, f := range fragmentsCluster {
-		if f.AppInstanceId == appInstanceId {
-			toReturn = append(toReturn, f)
+	result := make([]string, 0, len(entry))
+	for clusterId := range entry {
+		result = append(result, clusterId)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Upgrade the stored records to the current record version. Records written by previous versions of conductor
+// are readable anyway, but migrating them at startup avoids upgrading them on every read.
+// return:
+//  number of upgraded records or error if any
+func (a *AppClusterDB) Migrate() (int, derrors.Error) {
+	upgraded := 0
+	for _, bucket := range a.db.GetBuckets() {
+		if !isClusterBucket(bucket) {
+			continue
+		}
+		// the records of a cluster are upgraded in the same transaction
+		err := a.db.Update(func(tx provider.KeyValueTx) derrors.Error {
+			toUpgrade := make([]provider.KVTuple, 0)
+			var parseErr derrors.Error
+			err := tx.ScanPrefix(bucket, nil, func(key []byte, value []byte) bool {
+				r, err := parseRecord(value)
+				if err != nil {
+					parseErr = err
+					return false
+				}
+				if r.version != CurrentRecordVersion {
+					toUpgrade = append(toUpgrade, provider.KVTuple{Key: key, Value: value})
+				}
+				return true
+			})
+			if err != nil {
+				return derrors.NewInternalError("impossible to get deployments from cluster", err)
+			}
+			if parseErr != nil {
+				return parseErr
+			}
+			for _, pair := range toUpgrade {
+				r, err := parseRecord(pair.Value)
+				if err != nil {
+					return err
+				}
+				r, err = upgradeRecord(r, fragmentUpgrades)
+				if err != nil {
+					log.Error().Err(err).Str("clusterId", string(bucket)).Str("fragmentId", string(pair.Key)).
+						Msg("impossible to upgrade deployment fragment")
+					return err
+				}
+				if err := tx.Put(bucket, pair.Key, r.bytes()); err != nil {
+					return err
+				}
+			}
+			upgraded += len(toUpgrade)
+			return nil
+		})
+		if err != nil {
+			return upgraded, err
 		}
 	}
-	return toReturn, nil
+	if upgraded > 0 {
+		log.Info().Int("upgraded", upgraded).Msg("app cluster records migrated")
+	}
+	return upgraded, nil
 }
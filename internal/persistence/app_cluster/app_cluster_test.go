@@ -119,4 +119,48 @@ var _ = ginkgo.Describe("application cluster data persistence test", func() {
 		gomega.Expect(len(pairs)).To(gomega.Equal(2))
 	})
 
+	ginkgo.It("stores a fragment together with its pending plan", func() {
+		toAdd := entities.DeploymentFragment{
+			ClusterId:      "cluster1",
+			DeploymentId:   "deployment1",
+			AppInstanceId:  "myappinstance1",
+			OrganizationId: "someorg",
+			AppName:        "testApp",
+			FragmentId:     "fragment1",
+		}
+		plan := PendingPlanRecord{
+			Plan: &entities.DeploymentPlan{
+				DeploymentId:      "deployment1",
+				AppInstanceId:     "myappinstance1",
+				Fragments:         []entities.DeploymentFragment{toAdd},
+				DeploymentRequest: &entities.DeploymentRequest{RequestId: "request1"},
+			},
+			Fragments: map[string]bool{"fragment1": true},
+		}
+		errAdd := db.AddDeploymentFragmentWithPlan(&toAdd, &plan)
+		gomega.Expect(errAdd).ToNot(gomega.HaveOccurred())
+
+		plans, err := db.GetPendingPlans()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(plans).To(gomega.HaveLen(1))
+		gomega.Expect(plans[0].Plan.DeploymentRequest.RequestId).To(gomega.Equal("request1"))
+		gomega.Expect(plans[0].Fragments).To(gomega.Equal(plan.Fragments))
+
+		// the plans are not taken as the fragments of a cluster
+		fragments, err := db.GetAllFragments()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(fragments).To(gomega.HaveLen(1))
+		err = db.RebuildIndexes()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		upgraded, err := db.Migrate()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(upgraded).To(gomega.Equal(0))
+
+		err = db.DeletePendingPlan("deployment1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		plans, err = db.GetPendingPlans()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(plans).To(gomega.BeEmpty())
+	})
+
 })
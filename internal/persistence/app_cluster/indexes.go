@@ -0,0 +1,252 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app_cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/derrors"
+	"sort"
+	"strings"
+)
+
+// Secondary indexes of the app cluster db. Every index is stored in its own bucket and maps a key to the
+// set of members related to that key together with the number of fragments supporting each member.
+// bucket                    --> key            --> value
+// index:app_instance        --> appInstanceId  --> {clusterId/fragmentId: 1, ...}
+// index:deployment          --> deploymentId   --> {clusterId/fragmentId: 1, ...}
+// index:organization        --> organizationId --> {clusterId: numFragments, ...}
+// Index buckets share the prefix IndexBucketPrefix so they cannot be confused with cluster buckets.
+
+// Prefix of the buckets used by the secondary indexes
+const IndexBucketPrefix = "index:"
+
+const (
+	// Index from application instances to fragments
+	appInstanceIndex = IndexBucketPrefix + "app_instance"
+	// Index from deployments to fragments
+	deploymentIndex = IndexBucketPrefix + "deployment"
+	// Index from organizations to clusters
+	organizationIndex = IndexBucketPrefix + "organization"
+)
+
+// Separator between the cluster and the fragment identifier of a fragment reference
+const fragmentRefSeparator = "/"
+
+// Members of an index key with the number of fragments supporting them.
+type indexEntry map[string]int
+
+// Check if a bucket contains a secondary index.
+func isIndexBucket(bucket []byte) bool {
+	return bytes.HasPrefix(bucket, []byte(IndexBucketPrefix))
+}
+
+// Reference to a fragment used as index member.
+func fragmentRef(clusterId string, fragmentId string) string {
+	return clusterId + fragmentRefSeparator + fragmentId
+}
+
+// Split a fragment reference into the cluster and the fragment identifiers.
+func splitFragmentRef(ref string) (string, string) {
+	split := strings.SplitN(ref, fragmentRefSeparator, 2)
+	if len(split) != 2 {
+		return ref, ""
+	}
+	return split[0], split[1]
+}
+
+// Index keys and members affected by a fragment.
+type indexUpdate struct {
+	bucket string
+	key    string
+	member string
+}
+
+func fragmentIndexUpdates(fragment *entities.DeploymentFragment) []indexUpdate {
+	ref := fragmentRef(fragment.ClusterId, fragment.FragmentId)
+	updates := make([]indexUpdate, 0, 3)
+	if fragment.AppInstanceId != "" {
+		updates = append(updates, indexUpdate{bucket: appInstanceIndex, key: fragment.AppInstanceId, member: ref})
+	}
+	if fragment.DeploymentId != "" {
+		updates = append(updates, indexUpdate{bucket: deploymentIndex, key: fragment.DeploymentId, member: ref})
+	}
+	if fragment.OrganizationId != "" {
+		updates = append(updates, indexUpdate{bucket: organizationIndex, key: fragment.OrganizationId,
+			member: fragment.ClusterId})
+	}
+	return updates
+}
+
+// Read an index entry. Missing buckets and keys return an empty entry.
+func getIndexEntry(tx provider.KeyValueTx, bucket string, key string) (indexEntry, derrors.Error) {
+	entry := make(indexEntry, 0)
+	if !tx.BucketExists([]byte(bucket)) {
+		return entry, nil
+	}
+	retrieved, err := tx.Get([]byte(bucket), []byte(key))
+	if err != nil {
+		return nil, derrors.NewInternalError("impossible to get index entry", err)
+	}
+	if retrieved == nil {
+		return entry, nil
+	}
+	if err := json.Unmarshal(retrieved, &entry); err != nil {
+		return nil, derrors.NewInternalError("impossible to unmarshall index entry", err)
+	}
+	return entry, nil
+}
+
+// Write an index entry removing the key if it has no members.
+func putIndexEntry(tx provider.KeyValueTx, bucket string, key string, entry indexEntry) derrors.Error {
+	if len(entry) == 0 {
+		if !tx.BucketExists([]byte(bucket)) {
+			return nil
+		}
+		return tx.Delete([]byte(bucket), []byte(key))
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return derrors.NewInternalError("impossible to marshall index entry", err)
+	}
+	return tx.Put([]byte(bucket), []byte(key), value)
+}
+
+// Add or remove the index members of a fragment.
+func updateIndexes(tx provider.KeyValueTx, fragment *entities.DeploymentFragment, delta int) derrors.Error {
+	for _, update := range fragmentIndexUpdates(fragment) {
+		entry, err := getIndexEntry(tx, update.bucket, update.key)
+		if err != nil {
+			return err
+		}
+		entry[update.member] = entry[update.member] + delta
+		if entry[update.member] <= 0 {
+			delete(entry, update.member)
+		}
+		if err := putIndexEntry(tx, update.bucket, update.key, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retrieve the fragments referenced by an index key. The index and the fragments are read in the same
+// transaction so the result is consistent.
+func (a *AppClusterDB) getIndexedFragments(bucket string, key string, clusterId string) ([]entities.DeploymentFragment, derrors.Error) {
+	result := make([]entities.DeploymentFragment, 0)
+	err := a.db.View(func(tx provider.KeyValueTx) derrors.Error {
+		entry, err := getIndexEntry(tx, bucket, key)
+		if err != nil {
+			return err
+		}
+		refs := make([]string, 0, len(entry))
+		for ref := range entry {
+			refs = append(refs, ref)
+		}
+		sort.Strings(refs)
+		for _, ref := range refs {
+			fragmentCluster, fragmentId := splitFragmentRef(ref)
+			if clusterId != "" && fragmentCluster != clusterId {
+				continue
+			}
+			fragment, err := getStoredFragment(tx, fragmentCluster, fragmentId)
+			if err != nil {
+				return err
+			}
+			if fragment != nil {
+				result = append(result, *fragment)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Rebuild the secondary indexes from the stored fragments. Indexes are rebuilt on startup so databases
+// written before the indexes were introduced are indexed too. The indexes are replaced in a single transaction.
+// return:
+//  error if any
+func (a *AppClusterDB) RebuildIndexes() derrors.Error {
+	return a.db.Update(func(tx provider.KeyValueTx) derrors.Error {
+		indexes := map[string]map[string]indexEntry{
+			appInstanceIndex:  make(map[string]indexEntry, 0),
+			deploymentIndex:   make(map[string]indexEntry, 0),
+			organizationIndex: make(map[string]indexEntry, 0),
+		}
+		for _, bucket := range tx.GetBuckets() {
+			if !isClusterBucket(bucket) {
+				continue
+			}
+			var decodeErr derrors.Error
+			err := tx.ScanPrefix(bucket, nil, func(key []byte, value []byte) bool {
+				fragment, err := decodeFragment(value)
+				if err != nil {
+					decodeErr = err
+					return false
+				}
+				for _, update := range fragmentIndexUpdates(fragment) {
+					entry, found := indexes[update.bucket][update.key]
+					if !found {
+						entry = make(indexEntry, 0)
+						indexes[update.bucket][update.key] = entry
+					}
+					entry[update.member] = entry[update.member] + 1
+				}
+				return true
+			})
+			if err != nil {
+				return derrors.NewInternalError("impossible to get deployments from cluster", err)
+			}
+			if decodeErr != nil {
+				return decodeErr
+			}
+		}
+
+		for bucket, entries := range indexes {
+			// remove stale keys
+			if tx.BucketExists([]byte(bucket)) {
+				stale := make([][]byte, 0)
+				err := tx.ScanPrefix([]byte(bucket), nil, func(key []byte, value []byte) bool {
+					if _, found := entries[string(key)]; !found {
+						stale = append(stale, key)
+					}
+					return true
+				})
+				if err != nil {
+					return derrors.NewInternalError("impossible to get index entries", err)
+				}
+				for _, key := range stale {
+					if err := tx.Delete([]byte(bucket), key); err != nil {
+						return err
+					}
+				}
+			}
+			for key, entry := range entries {
+				if err := putIndexEntry(tx, bucket, key, entry); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app_cluster
+
+import (
+	"fmt"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/conductor/pkg/provider/kv"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"os"
+	"testing"
+)
+
+func indexedFragment(clusterId string, appInstanceId string, fragmentId string) entities.DeploymentFragment {
+	return entities.DeploymentFragment{
+		ClusterId:      clusterId,
+		DeploymentId:   "deployment-" + appInstanceId,
+		AppInstanceId:  appInstanceId,
+		OrganizationId: "someorg",
+		AppName:        "testApp",
+		FragmentId:     fragmentId,
+	}
+}
+
+var _ = ginkgo.Describe("application cluster secondary indexes", func() {
+
+	var db *AppClusterDB
+	var localDB provider.KeyValueProvider
+	dbPath := "/tmp/app_cluster_indexes_test.db"
+
+	ginkgo.BeforeEach(func() {
+		aux, errDB := kv.NewLocalDB(dbPath)
+		gomega.Expect(errDB).ToNot(gomega.HaveOccurred())
+
+		localDB = aux
+		db = NewAppClusterDB(localDB)
+
+		fragments := []entities.DeploymentFragment{
+			indexedFragment("cluster1", "app1", "fragment1"),
+			indexedFragment("cluster2", "app1", "fragment2"),
+			indexedFragment("cluster1", "app2", "fragment3"),
+		}
+		for i := range fragments {
+			err := db.AddDeploymentFragment(&fragments[i])
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		errClose := localDB.Close()
+		gomega.Expect(errClose).ToNot(gomega.HaveOccurred())
+
+		err := os.Remove(dbPath)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("retrieves the fragments of an application instance", func() {
+		fragments, err := db.GetFragmentsByAppInstance("app1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(len(fragments)).To(gomega.Equal(2))
+		gomega.Expect(fragments[0].FragmentId).To(gomega.Equal("fragment1"))
+		gomega.Expect(fragments[1].FragmentId).To(gomega.Equal("fragment2"))
+
+		inCluster, err := db.GetFragmentsApp("cluster2", "app1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(len(inCluster)).To(gomega.Equal(1))
+		gomega.Expect(inCluster[0].FragmentId).To(gomega.Equal("fragment2"))
+	})
+
+	ginkgo.It("retrieves the fragments of a deployment", func() {
+		fragments, err := db.GetFragmentsByDeployment("deployment-app2")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(len(fragments)).To(gomega.Equal(1))
+		gomega.Expect(fragments[0].FragmentId).To(gomega.Equal("fragment3"))
+
+		none, err := db.GetFragmentsByDeployment("unknown")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(none).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("retrieves the clusters of an organization", func() {
+		clusters, err := db.GetClustersInOrganization("someorg")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(clusters).To(gomega.Equal([]string{"cluster1", "cluster2"}))
+	})
+
+	ginkgo.It("keeps the indexes consistent after updates and deletions", func() {
+		// overwriting a fragment must not duplicate index entries
+		updated := indexedFragment("cluster1", "app1", "fragment1")
+		updated.Status = entities.FRAGMENT_DONE
+		err := db.AddDeploymentFragment(&updated)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		fragments, err := db.GetFragmentsByAppInstance("app1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(len(fragments)).To(gomega.Equal(2))
+
+		err = db.DeleteDeploymentFragment("cluster2", "fragment2")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		fragments, err = db.GetFragmentsByAppInstance("app1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(len(fragments)).To(gomega.Equal(1))
+		clusters, err := db.GetClustersInOrganization("someorg")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(clusters).To(gomega.Equal([]string{"cluster1"}))
+	})
+
+	ginkgo.It("rebuilds the indexes", func() {
+		// remove an index entry and add a stale one
+		err := localDB.Delete([]byte(appInstanceIndex), []byte("app1"))
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		err = localDB.Put([]byte(deploymentIndex), []byte("stale"), []byte(`{"cluster9/fragment9":1}`))
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		err = db.RebuildIndexes()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		fragments, err := db.GetFragmentsByAppInstance("app1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(len(fragments)).To(gomega.Equal(2))
+		stale, err := localDB.Get([]byte(deploymentIndex), []byte("stale"))
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(stale).To(gomega.BeNil())
+	})
+
+	ginkgo.It("skips the index buckets during migrations", func() {
+		upgraded, err := db.Migrate()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(upgraded).To(gomega.Equal(0))
+	})
+})
+
+// Fill a database with numClusters clusters running numApps applications with one fragment each.
+func populateBenchmarkDB(b *testing.B, dbPath string, numClusters int, numApps int) (*AppClusterDB, provider.KeyValueProvider) {
+	localDB, err := kv.NewLocalDB(dbPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	db := NewAppClusterDB(localDB)
+	for c := 0; c < numClusters; c++ {
+		for app := 0; app < numApps; app++ {
+			fragment := indexedFragment(fmt.Sprintf("cluster%d", c), fmt.Sprintf("app%d", app),
+				fmt.Sprintf("fragment%d-%d", c, app))
+			if err := db.AddDeploymentFragment(&fragment); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return db, localDB
+}
+
+// Benchmark the lookup of the fragments of an application using the secondary index.
+func BenchmarkGetFragmentsByAppInstance(b *testing.B) {
+	dbPath := "/tmp/app_cluster_benchmark_index.db"
+	db, localDB := populateBenchmarkDB(b, dbPath, 10, 100)
+	defer os.Remove(dbPath)
+	defer localDB.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fragments, err := db.GetFragmentsByAppInstance("app42")
+		if err != nil || len(fragments) != 10 {
+			b.Fatal("unexpected result", err)
+		}
+	}
+}
+
+// Benchmark the lookup of the fragments of an application scanning all the clusters as done before
+// the secondary indexes were available.
+func BenchmarkScanFragmentsByAppInstance(b *testing.B) {
+	dbPath := "/tmp/app_cluster_benchmark_scan.db"
+	db, localDB := populateBenchmarkDB(b, dbPath, 10, 100)
+	defer os.Remove(dbPath)
+	defer localDB.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fragments := make([]entities.DeploymentFragment, 0)
+		for c := 0; c < 10; c++ {
+			inCluster, err := db.GetFragmentsInCluster(fmt.Sprintf("cluster%d", c))
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, f := range inCluster {
+				if f.AppInstanceId == "app42" {
+					fragments = append(fragments, f)
+				}
+			}
+		}
+		if len(fragments) != 10 {
+			b.Fatal("unexpected result")
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app_cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/derrors"
+)
+
+// Pending deployment plans are stored next to the deployment fragments so the plans and the fragments
+// deployed from them are written in the same transaction. Every plan is stored with its deployment request
+// and the state of its monitored fragments.
+// bucket        --> key          --> value
+// plans:pending --> deploymentId --> PendingPlanRecord
+
+// Bucket used to store the pending plans
+const PendingPlansBucket = "plans:pending"
+
+// State of a pending plan stored in the database.
+type PendingPlanRecord struct {
+	// The monitored plan with the deployment request used to retry it
+	Plan *entities.DeploymentPlan `json:"plan"`
+	// fragment_id -> pending flag of the fragments still monitored
+	Fragments map[string]bool `json:"fragments"`
+}
+
+// Check if a bucket stores the fragments of a cluster.
+func isClusterBucket(bucket []byte) bool {
+	return !isIndexBucket(bucket) && !bytes.Equal(bucket, []byte(PendingPlansBucket))
+}
+
+// Add or overwrite a deployment fragment together with the state of the pending plan it belongs to. The fragment,
+// its index entries and the plan are written in the same transaction.
+// params:
+//  fragment to be stored
+//  plan state of the pending plan, nil if no plan has to be stored
+// return:
+//  error if any
+func (a *AppClusterDB) AddDeploymentFragmentWithPlan(fragment *entities.DeploymentFragment, plan *PendingPlanRecord) derrors.Error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	var previous *entities.DeploymentFragment
+	err := a.db.Update(func(tx provider.KeyValueTx) derrors.Error {
+		var err derrors.Error
+		previous, err = putFragment(tx, fragment)
+		if err != nil {
+			return err
+		}
+		if plan == nil {
+			return nil
+		}
+		return putPendingPlan(tx, plan)
+	})
+	if err != nil {
+		return err
+	}
+	a.publish(FragmentEvent{ClusterId: fragment.ClusterId, FragmentId: fragment.FragmentId,
+		Previous: previous, Current: copyFragment(fragment)})
+	return nil
+}
+
+// Add or overwrite the state of a pending plan.
+// params:
+//  plan state of the pending plan
+// return:
+//  error if any
+func (a *AppClusterDB) StorePendingPlan(plan *PendingPlanRecord) derrors.Error {
+	return a.db.Update(func(tx provider.KeyValueTx) derrors.Error {
+		return putPendingPlan(tx, plan)
+	})
+}
+
+// Delete a pending plan. Deleting a plan that is not stored is not an error.
+// params:
+//  deploymentId
+// return:
+//  error if any
+func (a *AppClusterDB) DeletePendingPlan(deploymentId string) derrors.Error {
+	return a.db.Update(func(tx provider.KeyValueTx) derrors.Error {
+		if !tx.BucketExists([]byte(PendingPlansBucket)) {
+			return nil
+		}
+		return tx.Delete([]byte(PendingPlansBucket), []byte(deploymentId))
+	})
+}
+
+// Return all the stored pending plans.
+// return:
+//  list of pending plans or error if any
+func (a *AppClusterDB) GetPendingPlans() ([]PendingPlanRecord, derrors.Error) {
+	result := make([]PendingPlanRecord, 0)
+	err := a.db.View(func(tx provider.KeyValueTx) derrors.Error {
+		if !tx.BucketExists([]byte(PendingPlansBucket)) {
+			return nil
+		}
+		var decodeErr derrors.Error
+		err := tx.ScanPrefix([]byte(PendingPlansBucket), nil, func(key []byte, value []byte) bool {
+			var stored PendingPlanRecord
+			if err := json.Unmarshal(value, &stored); err != nil {
+				decodeErr = derrors.NewInternalError("impossible to unmarshall pending plan", err)
+				return false
+			}
+			result = append(result, stored)
+			return true
+		})
+		if err != nil {
+			return derrors.NewInternalError("impossible to get pending plans", err)
+		}
+		return decodeErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Write the state of a pending plan in a transaction.
+func putPendingPlan(tx provider.KeyValueTx, plan *PendingPlanRecord) derrors.Error {
+	value, err := json.Marshal(plan)
+	if err != nil {
+		return derrors.NewInternalError("impossible to marshall pending plan", err)
+	}
+	return tx.Put([]byte(PendingPlansBucket), []byte(plan.Plan.DeploymentId), value)
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app_cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+)
+
+// Versioned envelope for the records stored by the app cluster db. Every record is written as a small
+// header followed by the encoded entity.
+// marker (1 byte) | version (1 byte) | encoding (1 byte) | payload
+// Records written before the envelope was introduced are raw gob streams. A gob stream never starts with a
+// zero byte, so records without the marker are considered legacy records with version 0.
+// When the schema of a stored entity changes, CurrentRecordVersion must be increased and an upgrade from the
+// previous version registered in fragmentUpgrades. Old records are upgraded when read and rewritten by Migrate.
+
+// First byte of every enveloped record.
+const recordMarker byte = 0x00
+
+// Size of the record header.
+const recordHeaderSize = 3
+
+// Encoding of the payload of a record.
+type RecordEncoding byte
+
+const (
+	// Gob encoding, only used by legacy records
+	RecordEncodingGob RecordEncoding = iota
+	// JSON encoding
+	RecordEncodingJSON
+)
+
+const (
+	// Version of the records stored as raw gob before the envelope was introduced
+	LegacyRecordVersion byte = 0
+	// Version of the records currently written
+	CurrentRecordVersion byte = 1
+)
+
+// Stored record.
+type record struct {
+	version  byte
+	encoding RecordEncoding
+	payload  []byte
+}
+
+// Parse a stored value.
+func parseRecord(raw []byte) (*record, derrors.Error) {
+	if len(raw) == 0 {
+		return nil, derrors.NewInternalError("empty record")
+	}
+	if raw[0] != recordMarker {
+		return &record{version: LegacyRecordVersion, encoding: RecordEncodingGob, payload: raw}, nil
+	}
+	if len(raw) < recordHeaderSize {
+		return nil, derrors.NewInternalError("truncated record header")
+	}
+	return &record{version: raw[1], encoding: RecordEncoding(raw[2]), payload: raw[recordHeaderSize:]}, nil
+}
+
+// Serialize a record with its header.
+func (r *record) bytes() []byte {
+	toReturn := make([]byte, 0, recordHeaderSize+len(r.payload))
+	toReturn = append(toReturn, recordMarker, r.version, byte(r.encoding))
+	return append(toReturn, r.payload...)
+}
+
+// Function upgrading a record to the next version.
+type recordUpgrade func(r *record) (*record, derrors.Error)
+
+// Upgrades of deployment fragment records indexed by the version they upgrade from.
+var fragmentUpgrades = map[byte]recordUpgrade{
+	LegacyRecordVersion: upgradeLegacyFragment,
+}
+
+// Apply the registered upgrades until the record reaches the current version.
+func upgradeRecord(r *record, upgrades map[byte]recordUpgrade) (*record, derrors.Error) {
+	if r.version > CurrentRecordVersion {
+		return nil, derrors.NewFailedPreconditionError(
+			fmt.Sprintf("record version %d is newer than the supported version %d", r.version, CurrentRecordVersion))
+	}
+	for r.version < CurrentRecordVersion {
+		upgrade, found := upgrades[r.version]
+		if !found {
+			return nil, derrors.NewInternalError(fmt.Sprintf("no upgrade available for record version %d", r.version))
+		}
+		upgraded, err := upgrade(r)
+		if err != nil {
+			return nil, err
+		}
+		if upgraded.version <= r.version {
+			return nil, derrors.NewInternalError(fmt.Sprintf("upgrade of record version %d did not progress", r.version))
+		}
+		r = upgraded
+	}
+	return r, nil
+}
+
+// Upgrade a legacy gob record into a JSON record of version 1.
+func upgradeLegacyFragment(r *record) (*record, derrors.Error) {
+	if r.encoding != RecordEncodingGob {
+		return nil, derrors.NewInternalError("legacy records must be gob encoded")
+	}
+	var df entities.DeploymentFragment
+	if err := gob.NewDecoder(bytes.NewReader(r.payload)).Decode(&df); err != nil {
+		return nil, derrors.NewInternalError("impossible to unmarshall legacy deployment fragment", err)
+	}
+	payload, err := json.Marshal(&df)
+	if err != nil {
+		return nil, derrors.NewInternalError("impossible to marshall deployment fragment", err)
+	}
+	return &record{version: 1, encoding: RecordEncodingJSON, payload: payload}, nil
+}
+
+// Encode a deployment fragment as a record of the current version.
+func encodeFragment(fragment *entities.DeploymentFragment) ([]byte, derrors.Error) {
+	payload, err := json.Marshal(fragment)
+	if err != nil {
+		return nil, derrors.NewInternalError("impossible to marshall deployment fragment", err)
+	}
+	r := record{version: CurrentRecordVersion, encoding: RecordEncodingJSON, payload: payload}
+	return r.bytes(), nil
+}
+
+// Decode a stored deployment fragment upgrading it if required.
+func decodeFragment(raw []byte) (*entities.DeploymentFragment, derrors.Error) {
+	r, err := parseRecord(raw)
+	if err != nil {
+		return nil, err
+	}
+	r, err = upgradeRecord(r, fragmentUpgrades)
+	if err != nil {
+		return nil, err
+	}
+	if r.encoding != RecordEncodingJSON {
+		return nil, derrors.NewInternalError(fmt.Sprintf("unsupported record encoding %d", r.encoding))
+	}
+	var df entities.DeploymentFragment
+	if err := json.Unmarshal(r.payload, &df); err != nil {
+		return nil, derrors.NewInternalError("impossible to unmarshall deployment fragment", err)
+	}
+	return &df, nil
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package app_cluster
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/conductor/pkg/provider/kv"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+)
+
+// Fragment stored in the fixtures of the testdata folder.
+//  fragment_v0.gob raw gob record written before the record envelope was introduced
+//  fragment_v1.record JSON record of version 1
+func fixtureFragment() entities.DeploymentFragment {
+	return entities.DeploymentFragment{
+		OrganizationId:    "org1",
+		OrganizationName:  "organization",
+		AppDescriptorId:   "desc1",
+		AppDescriptorName: "descriptor",
+		AppInstanceId:     "app1",
+		AppName:           "application",
+		DeploymentId:      "deployment1",
+		FragmentId:        "fragment1",
+		ClusterId:         "cluster1",
+		NalejVariables:    map[string]string{"NALEJ_SERV_WEB": "web.org1"},
+		Stages: []entities.DeploymentStage{{
+			FragmentId: "fragment1",
+			StageId:    "stage1",
+			Services: []entities.ServiceInstance{{
+				OrganizationId:         "org1",
+				AppDescriptorId:        "desc1",
+				AppInstanceId:          "app1",
+				ServiceInstanceId:      "service-instance1",
+				ServiceId:              "service1",
+				ServiceGroupInstanceId: "group-instance1",
+				ServiceGroupId:         "group1",
+				ServiceGroupName:       "group",
+				ServiceName:            "web",
+				Image:                  "nginx:1.17",
+				Specs:                  &entities.DeploySpecs{Cpu: 100, Memory: 256, Replicas: 2},
+				ExposedPorts: []entities.Port{{Name: "http", InternalPort: 80, ExposedPort: 80,
+					Endpoints: []entities.Endpoint{{Path: "/", Options: map[string]string{"a": "b"}}}}},
+				EnvironmentVariables: map[string]string{"ENV": "production"},
+				Labels:               map[string]string{"app": "web"},
+				DeployAfter:          []string{"db"},
+				RunArguments:         []string{"--verbose"},
+			}},
+			PublicRules: []entities.PublicSecurityRuleInstance{{OrganizationId: "org1", AppDescriptorId: "desc1",
+				RuleId: "rule1", TargetServiceGroupId: "group1", TargetServiceId: "service1", TargetPort: 80,
+				ServiceName: "web"}},
+			DeviceGroupRules: []entities.DeviceGroupSecurityRuleInstance{{OrganizationId: "org1", RuleId: "rule2",
+				TargetPort: 80, DeviceGroupIds: []string{"dg1"}, DeviceGroupJwtSecrets: []string{"secret"}}},
+		}},
+		ZtNetworkID: "ztnetwork1",
+		Status:      entities.FRAGMENT_DONE,
+	}
+}
+
+func readFixture(name string) []byte {
+	content, err := ioutil.ReadFile("testdata/" + name)
+	gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	return content
+}
+
+var _ = ginkgo.Describe("app cluster records", func() {
+
+	ginkgo.It("round trips a deployment fragment", func() {
+		expected := fixtureFragment()
+		encoded, err := encodeFragment(&expected)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(encoded[:recordHeaderSize]).To(gomega.Equal(
+			[]byte{recordMarker, CurrentRecordVersion, byte(RecordEncodingJSON)}))
+
+		decoded, err := decodeFragment(encoded)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(*decoded).To(gomega.Equal(expected))
+	})
+
+	ginkgo.It("decodes the current record fixture", func() {
+		decoded, err := decodeFragment(readFixture("fragment_v1.record"))
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(*decoded).To(gomega.Equal(fixtureFragment()))
+	})
+
+	ginkgo.It("upgrades legacy gob records", func() {
+		decoded, err := decodeFragment(readFixture("fragment_v0.gob"))
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(*decoded).To(gomega.Equal(fixtureFragment()))
+	})
+
+	ginkgo.It("rejects records newer than the supported version", func() {
+		r := record{version: CurrentRecordVersion + 1, encoding: RecordEncodingJSON, payload: []byte("{}")}
+		_, err := decodeFragment(r.bytes())
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("rejects truncated records", func() {
+		_, err := decodeFragment([]byte{recordMarker, CurrentRecordVersion})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
+
+var _ = ginkgo.Describe("app cluster db migration", func() {
+
+	var db *AppClusterDB
+	var localDB provider.KeyValueProvider
+	dbPath := "/tmp/app_cluster_migration_test.db"
+
+	ginkgo.BeforeEach(func() {
+		aux, errDB := kv.NewLocalDB(dbPath)
+		gomega.Expect(errDB).ToNot(gomega.HaveOccurred())
+		localDB = aux
+		db = NewAppClusterDB(localDB)
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(localDB.Close()).ToNot(gomega.HaveOccurred())
+		gomega.Expect(os.Remove(dbPath)).ToNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("upgrades the legacy records on startup", func() {
+		expected := fixtureFragment()
+		err := localDB.Put([]byte(expected.ClusterId), []byte(expected.FragmentId), readFixture("fragment_v0.gob"))
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		current := expected
+		current.FragmentId = "fragment2"
+		gomega.Expect(db.AddDeploymentFragment(&current)).ToNot(gomega.HaveOccurred())
+
+		upgraded, err := db.Migrate()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(upgraded).To(gomega.Equal(1))
+
+		raw, err := localDB.Get([]byte(expected.ClusterId), []byte(expected.FragmentId))
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(raw[0]).To(gomega.Equal(recordMarker))
+		gomega.Expect(raw[1]).To(gomega.Equal(CurrentRecordVersion))
+
+		retrieved, err := db.GetDeploymentFragment(expected.ClusterId, expected.FragmentId)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(*retrieved).To(gomega.Equal(expected))
+
+		// nothing else to upgrade
+		upgraded, err = db.Migrate()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(upgraded).To(gomega.Equal(0))
+	})
+})
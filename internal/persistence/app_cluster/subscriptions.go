@@ -0,0 +1,155 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app_cluster
+
+import (
+	"context"
+	"github.com/nalej/conductor/internal/entities"
+	"sync"
+)
+
+// In-process subscriptions to the changes of the deployment fragments. Every mutation of the app cluster db
+// publishes an event to the subscribers once it has been committed. Events are queued per subscription so
+// publishers never block and subscribers never lose a transition.
+
+// Change of a deployment fragment.
+type FragmentEvent struct {
+	// Cluster the fragment belongs to
+	ClusterId string
+	// Fragment identifier
+	FragmentId string
+	// Stored fragment before the change, nil if the fragment was not stored
+	Previous *entities.DeploymentFragment
+	// Stored fragment after the change, nil if the fragment was deleted
+	Current *entities.DeploymentFragment
+}
+
+// Check if the event corresponds to the deletion of a fragment.
+func (e FragmentEvent) Deleted() bool {
+	return e.Current == nil
+}
+
+// Filter deciding which events are delivered to a subscription.
+type FragmentEventFilter func(event FragmentEvent) bool
+
+type Subscription struct {
+	id     uint64
+	db     *AppClusterDB
+	filter FragmentEventFilter
+	// mutex for the pending events
+	mu sync.Mutex
+	// events not consumed yet
+	pending []FragmentEvent
+	// signal the arrival of new events
+	notify chan struct{}
+	// flag to indicate the subscription was closed
+	closed bool
+}
+
+// Add an event to the subscription queue.
+func (s *Subscription) push(event FragmentEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.pending = append(s.pending, event)
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Wait for the next event of the subscription.
+// params:
+//  ctx context to stop waiting
+// return:
+//  next event and true, or false if the context is done or the subscription was closed
+func (s *Subscription) Next(ctx context.Context) (FragmentEvent, bool) {
+	for {
+		s.mu.Lock()
+		if len(s.pending) > 0 {
+			event := s.pending[0]
+			s.pending[0] = FragmentEvent{}
+			s.pending = s.pending[1:]
+			s.mu.Unlock()
+			return event, true
+		}
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return FragmentEvent{}, false
+		}
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return FragmentEvent{}, false
+		}
+	}
+}
+
+// Close the subscription. Pending events are discarded.
+func (s *Subscription) Close() {
+	s.db.unsubscribe(s.id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.pending = nil
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Subscribe to the changes of the deployment fragments. Only the changes committed after this function
+// returns are delivered. The subscription must be closed when it is no longer needed.
+// params:
+//  filter to select the events to be delivered, nil to receive all the events
+// return:
+//  subscription
+func (a *AppClusterDB) Subscribe(filter FragmentEventFilter) *Subscription {
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+	a.nextSubscriptionId++
+	s := &Subscription{
+		id:      a.nextSubscriptionId,
+		db:      a,
+		filter:  filter,
+		pending: make([]FragmentEvent, 0),
+		notify:  make(chan struct{}, 1),
+	}
+	a.subscribers[s.id] = s
+	return s
+}
+
+func (a *AppClusterDB) unsubscribe(id uint64) {
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+	delete(a.subscribers, id)
+}
+
+// Deliver an event to the interested subscriptions.
+func (a *AppClusterDB) publish(event FragmentEvent) {
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+	for _, s := range a.subscribers {
+		if s.filter == nil || s.filter(event) {
+			s.push(event)
+		}
+	}
+}
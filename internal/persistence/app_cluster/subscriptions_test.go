@@ -0,0 +1,127 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app_cluster
+
+import (
+	"context"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/conductor/pkg/provider/kv"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"os"
+	"time"
+)
+
+var _ = ginkgo.Describe("application cluster subscriptions", func() {
+
+	var db *AppClusterDB
+	var localDB provider.KeyValueProvider
+	dbPath := "/tmp/app_cluster_subscriptions_test.db"
+
+	ginkgo.BeforeEach(func() {
+		aux, errDB := kv.NewLocalDB(dbPath)
+		gomega.Expect(errDB).ToNot(gomega.HaveOccurred())
+
+		localDB = aux
+		db = NewAppClusterDB(localDB)
+	})
+
+	ginkgo.AfterEach(func() {
+		errClose := localDB.Close()
+		gomega.Expect(errClose).ToNot(gomega.HaveOccurred())
+
+		err := os.Remove(dbPath)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	})
+
+	nextEvent := func(s *Subscription) (FragmentEvent, bool) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return s.Next(ctx)
+	}
+
+	ginkgo.It("publishes every transition in order", func() {
+		s := db.Subscribe(nil)
+		defer s.Close()
+
+		fragment := indexedFragment("cluster1", "app1", "fragment1")
+		err := db.AddDeploymentFragment(&fragment)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		_, err = db.UpdateFragmentStatus("cluster1", "fragment1", entities.FRAGMENT_DEPLOYING)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		_, err = db.UpdateFragmentStatus("cluster1", "fragment1", entities.FRAGMENT_DONE)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		err = db.DeleteDeploymentFragment("cluster1", "fragment1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		event, ok := nextEvent(s)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(event.Previous).To(gomega.BeNil())
+		gomega.Expect(event.Current.Status).To(gomega.Equal(entities.FRAGMENT_WAITING))
+
+		event, ok = nextEvent(s)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(event.Previous.Status).To(gomega.Equal(entities.FRAGMENT_WAITING))
+		gomega.Expect(event.Current.Status).To(gomega.Equal(entities.FRAGMENT_DEPLOYING))
+
+		event, ok = nextEvent(s)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(event.Current.Status).To(gomega.Equal(entities.FRAGMENT_DONE))
+
+		event, ok = nextEvent(s)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(event.Deleted()).To(gomega.BeTrue())
+		gomega.Expect(event.Previous.Status).To(gomega.Equal(entities.FRAGMENT_DONE))
+	})
+
+	ginkgo.It("only delivers the events accepted by the filter", func() {
+		s := db.Subscribe(func(event FragmentEvent) bool {
+			return event.ClusterId == "cluster2"
+		})
+		defer s.Close()
+
+		first := indexedFragment("cluster1", "app1", "fragment1")
+		err := db.AddDeploymentFragment(&first)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		second := indexedFragment("cluster2", "app1", "fragment2")
+		err = db.AddDeploymentFragment(&second)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		event, ok := nextEvent(s)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(event.FragmentId).To(gomega.Equal("fragment2"))
+	})
+
+	ginkgo.It("fails to update the status of an unknown fragment", func() {
+		_, err := db.UpdateFragmentStatus("cluster1", "fragment1", entities.FRAGMENT_DONE)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("stops delivering events once closed", func() {
+		s := db.Subscribe(nil)
+		s.Close()
+
+		fragment := indexedFragment("cluster1", "app1", "fragment1")
+		err := db.AddDeploymentFragment(&fragment)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, ok := nextEvent(s)
+		gomega.Expect(ok).To(gomega.BeFalse())
+	})
+})
@@ -0,0 +1,438 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"time"
+)
+
+// Manipulation of persistent entries storing the long running operations triggered by deployment,
+// undeployment and drain requests. Operations are stored in a single bucket using their identifier
+// as key. Two index buckets reference the operations of every request and application instance. Index keys
+// are the concatenation of the indexed value and the operation identifier so the operations of a request or
+// an application instance are found with a prefix scan. Operations and index entries are written in the
+// same transaction.
+// bucket                        --> key                       --> value
+// operations                    --> operationId_1             --> operation
+// operations                    --> operationId_2             --> operation
+// index:operations:request      --> requestId/operationId     --> operationId
+// index:operations:app_instance --> appInstanceId/operationId --> operationId
+
+// Name of the bucket used to store the operations.
+const OperationsBucket = "operations"
+
+const (
+	// Index from requests to operations
+	requestIndex = "index:operations:request"
+	// Index from application instances to operations
+	appInstanceIndex = "index:operations:app_instance"
+)
+
+// Separator between the indexed value and the operation identifier of an index key
+const indexKeySeparator = "/"
+
+const (
+	// Time between two consecutive runs of the garbage collector
+	GarbageCollectorPeriod = time.Minute * 10
+	// Default time finished operations are kept
+	DefaultRetention = time.Hour * 24
+)
+
+type OperationsDB struct {
+	// provider to persist information
+	db provider.KeyValueProvider
+}
+
+func NewOperationsDB(db provider.KeyValueProvider) *OperationsDB {
+	return &OperationsDB{
+		db: db,
+	}
+}
+
+// Store a new operation or overwrite an existing one.
+func (o *OperationsDB) AddOperation(operation *entities.Operation) derrors.Error {
+	return o.db.Update(func(tx provider.KeyValueTx) derrors.Error {
+		previous, err := getOperation(tx, operation.OperationId)
+		if err != nil {
+			return err
+		}
+		if previous != nil {
+			if err := deleteIndexKeys(tx, previous); err != nil {
+				return err
+			}
+		}
+		return putOperation(tx, operation)
+	})
+}
+
+// Get an operation. If the operation is not found, the returned value is nil.
+func (o *OperationsDB) GetOperation(operationId string) (*entities.Operation, derrors.Error) {
+	var result *entities.Operation
+	err := o.db.View(func(tx provider.KeyValueTx) derrors.Error {
+		var err derrors.Error
+		result, err = getOperation(tx, operationId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Get the operations triggered by a request sorted by creation time.
+func (o *OperationsDB) GetOperationsByRequestId(requestId string) ([]entities.Operation, derrors.Error) {
+	return o.getIndexedOperations(requestIndex, requestId)
+}
+
+// Get the operations of an application instance sorted by creation time.
+func (o *OperationsDB) GetOperationsByAppInstanceId(appInstanceId string) ([]entities.Operation, derrors.Error) {
+	return o.getIndexedOperations(appInstanceIndex, appInstanceId)
+}
+
+// Get the latest operation of a given type for an application instance that is still in progress.
+// If no operation is found, the returned value is nil.
+func (o *OperationsDB) GetInProgressOperation(appInstanceId string, opType entities.OperationType) (*entities.Operation, derrors.Error) {
+	ops, err := o.GetOperationsByAppInstanceId(appInstanceId)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ops[i].Type == opType && !ops[i].IsFinished() {
+			return &ops[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Record a new phase of an operation in progress.
+// params:
+//  operationId operation identifier
+//  phase reached phase
+//  cause error found in this phase, if any. It does not make the operation fail.
+// return:
+//  error if any
+func (o *OperationsDB) RecordPhase(operationId string, phase entities.OperationPhase, cause error) derrors.Error {
+	return o.update(operationId, func(op *entities.Operation) {
+		op.AddPhase(phase, cause, time.Now())
+	})
+}
+
+// Count a fragment handled by a drain operation in progress.
+// params:
+//  operationId operation identifier
+//  outcome result of draining the fragment
+// return:
+//  error if any
+func (o *OperationsDB) RecordDrainedFragment(operationId string, outcome entities.DrainedFragmentOutcome) derrors.Error {
+	return o.update(operationId, func(op *entities.Operation) {
+		if op.Drain == nil {
+			op.Drain = &entities.DrainProgress{}
+		}
+		op.Drain.Add(outcome)
+		op.Updated = time.Now()
+	})
+}
+
+// Finish an operation in progress after reaching its final phase.
+func (o *OperationsDB) Finish(operationId string, phase entities.OperationPhase) derrors.Error {
+	return o.update(operationId, func(op *entities.Operation) {
+		op.Finish(phase, time.Now())
+	})
+}
+
+// Finish an operation in progress with an error.
+func (o *OperationsDB) Fail(operationId string, cause error) derrors.Error {
+	return o.update(operationId, func(op *entities.Operation) {
+		op.Fail(cause, time.Now())
+	})
+}
+
+// Update an operation in progress. Finished operations are not modified.
+func (o *OperationsDB) update(operationId string, f func(op *entities.Operation)) derrors.Error {
+	return o.db.Update(func(tx provider.KeyValueTx) derrors.Error {
+		op, err := getOperation(tx, operationId)
+		if err != nil {
+			return err
+		}
+		if op == nil {
+			return derrors.NewNotFoundError(fmt.Sprintf("operation %s not found", operationId))
+		}
+		if op.IsFinished() {
+			log.Debug().Str("operationId", operationId).Msg("ignore update of a finished operation")
+			return nil
+		}
+		f(op)
+		// the indexed fields are not modified, only the operation is written
+		value, mErr := json.Marshal(op)
+		if mErr != nil {
+			return derrors.NewInternalError("impossible to marshall operation", mErr)
+		}
+		return tx.Put([]byte(OperationsBucket), []byte(op.OperationId), value)
+	})
+}
+
+// Remove the operations finished before the retention period.
+// params:
+//  retention time finished operations are kept
+// return:
+//  number of removed operations or error if any
+func (o *OperationsDB) RemoveExpired(retention time.Duration) (int, derrors.Error) {
+	limit := time.Now().Add(-retention)
+	removed := 0
+	err := o.db.Update(func(tx provider.KeyValueTx) derrors.Error {
+		removed = 0
+		if !tx.BucketExists([]byte(OperationsBucket)) {
+			return nil
+		}
+		expired := make([]*entities.Operation, 0)
+		var decodeErr derrors.Error
+		err := tx.ScanPrefix([]byte(OperationsBucket), nil, func(key []byte, value []byte) bool {
+			op, err := decodeOperation(value)
+			if err != nil {
+				decodeErr = err
+				return false
+			}
+			if op.Finished != nil && op.Finished.Before(limit) {
+				expired = append(expired, op)
+			}
+			return true
+		})
+		if err != nil {
+			return derrors.NewInternalError("impossible to get stored operations", err)
+		}
+		if decodeErr != nil {
+			return decodeErr
+		}
+		for _, op := range expired {
+			if err := deleteIndexKeys(tx, op); err != nil {
+				return err
+			}
+			if err := tx.Delete([]byte(OperationsBucket), []byte(op.OperationId)); err != nil {
+				return derrors.NewInternalError("impossible to remove expired operation", err)
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Rebuild the request and application instance indexes from the stored operations. Indexes are rebuilt on
+// startup so databases written before the indexes were introduced are indexed too. The indexes are replaced
+// in a single transaction.
+// return:
+//  error if any
+func (o *OperationsDB) RebuildIndexes() derrors.Error {
+	return o.db.Update(func(tx provider.KeyValueTx) derrors.Error {
+		for _, bucket := range []string{requestIndex, appInstanceIndex} {
+			if !tx.BucketExists([]byte(bucket)) {
+				continue
+			}
+			keys := make([][]byte, 0)
+			err := tx.ScanPrefix([]byte(bucket), nil, func(key []byte, value []byte) bool {
+				keys = append(keys, key)
+				return true
+			})
+			if err != nil {
+				return derrors.NewInternalError("impossible to get index entries", err)
+			}
+			for _, key := range keys {
+				if err := tx.Delete([]byte(bucket), key); err != nil {
+					return err
+				}
+			}
+		}
+		if !tx.BucketExists([]byte(OperationsBucket)) {
+			return nil
+		}
+		stored := make([]*entities.Operation, 0)
+		var decodeErr derrors.Error
+		err := tx.ScanPrefix([]byte(OperationsBucket), nil, func(key []byte, value []byte) bool {
+			op, err := decodeOperation(value)
+			if err != nil {
+				decodeErr = err
+				return false
+			}
+			stored = append(stored, op)
+			return true
+		})
+		if err != nil {
+			return derrors.NewInternalError("impossible to get stored operations", err)
+		}
+		if decodeErr != nil {
+			return decodeErr
+		}
+		for _, op := range stored {
+			for _, index := range indexKeys(op) {
+				if err := tx.Put([]byte(index.bucket), index.key, []byte(op.OperationId)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Periodically remove the expired operations until the context is done.
+// params:
+//  ctx context to stop the collector
+//  retention time finished operations are kept
+//  period time between two consecutive runs
+func (o *OperationsDB) RunGarbageCollector(ctx context.Context, retention time.Duration, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := o.RemoveExpired(retention)
+			if err != nil {
+				log.Error().Err(err).Msg("impossible to remove expired operations")
+				continue
+			}
+			if removed > 0 {
+				log.Info().Int("removed", removed).Msg("expired operations removed")
+			}
+		}
+	}
+}
+
+// Retrieve the operations referenced by an index sorted by creation time. The index and the operations are
+// read in the same transaction so the result is consistent.
+func (o *OperationsDB) getIndexedOperations(bucket string, value string) ([]entities.Operation, derrors.Error) {
+	result := make([]entities.Operation, 0)
+	err := o.db.View(func(tx provider.KeyValueTx) derrors.Error {
+		if !tx.BucketExists([]byte(bucket)) {
+			return nil
+		}
+		operationIds := make([]string, 0)
+		err := tx.ScanPrefix([]byte(bucket), indexKeyPrefix(value), func(key []byte, value []byte) bool {
+			operationIds = append(operationIds, string(value))
+			return true
+		})
+		if err != nil {
+			return derrors.NewInternalError("impossible to get index entries", err)
+		}
+		for _, operationId := range operationIds {
+			op, err := getOperation(tx, operationId)
+			if err != nil {
+				return err
+			}
+			if op != nil {
+				result = append(result, *op)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Created.Before(result[j].Created)
+	})
+	return result, nil
+}
+
+// Index key of an operation.
+type indexKey struct {
+	bucket string
+	key    []byte
+}
+
+// Prefix shared by the index keys of an indexed value.
+func indexKeyPrefix(value string) []byte {
+	return []byte(value + indexKeySeparator)
+}
+
+func indexKeys(op *entities.Operation) []indexKey {
+	keys := make([]indexKey, 0, 2)
+	if op.RequestId != "" {
+		keys = append(keys, indexKey{bucket: requestIndex,
+			key: append(indexKeyPrefix(op.RequestId), []byte(op.OperationId)...)})
+	}
+	if op.AppInstanceId != "" {
+		keys = append(keys, indexKey{bucket: appInstanceIndex,
+			key: append(indexKeyPrefix(op.AppInstanceId), []byte(op.OperationId)...)})
+	}
+	return keys
+}
+
+// Write an operation and its index keys in a transaction.
+func putOperation(tx provider.KeyValueTx, op *entities.Operation) derrors.Error {
+	value, err := json.Marshal(op)
+	if err != nil {
+		return derrors.NewInternalError("impossible to marshall operation", err)
+	}
+	if err := tx.Put([]byte(OperationsBucket), []byte(op.OperationId), value); err != nil {
+		return err
+	}
+	for _, index := range indexKeys(op) {
+		if err := tx.Put([]byte(index.bucket), index.key, []byte(op.OperationId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the index keys of an operation in a transaction.
+func deleteIndexKeys(tx provider.KeyValueTx, op *entities.Operation) derrors.Error {
+	for _, index := range indexKeys(op) {
+		if !tx.BucketExists([]byte(index.bucket)) {
+			continue
+		}
+		if err := tx.Delete([]byte(index.bucket), index.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read an operation in a transaction. If the operation is not found, the returned value is nil.
+func getOperation(tx provider.KeyValueTx, operationId string) (*entities.Operation, derrors.Error) {
+	if !tx.BucketExists([]byte(OperationsBucket)) {
+		return nil, nil
+	}
+	retrieved, err := tx.Get([]byte(OperationsBucket), []byte(operationId))
+	if err != nil {
+		return nil, derrors.NewInternalError("impossible to get operation", err)
+	}
+	if retrieved == nil {
+		return nil, nil
+	}
+	return decodeOperation(retrieved)
+}
+
+func decodeOperation(value []byte) (*entities.Operation, derrors.Error) {
+	var op entities.Operation
+	if err := json.Unmarshal(value, &op); err != nil {
+		return nil, derrors.NewInternalError("impossible to unmarshall operation", err)
+	}
+	return &op, nil
+}
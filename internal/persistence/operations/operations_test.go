@@ -0,0 +1,235 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package operations
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/conductor/pkg/provider/kv"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"os"
+	"time"
+)
+
+var _ = ginkgo.Describe("operations persistence test", func() {
+
+	var db *OperationsDB
+	var localDB provider.KeyValueProvider
+	dbPath := "/tmp/operations_persistence_test.db"
+
+	ginkgo.BeforeEach(func() {
+		// create a kv provider
+		aux, errDB := kv.NewLocalDB(dbPath)
+		gomega.Expect(errDB).ToNot(gomega.HaveOccurred())
+
+		localDB = aux
+		db = NewOperationsDB(localDB)
+	})
+
+	ginkgo.AfterEach(func() {
+		errClose := localDB.Close()
+		gomega.Expect(errClose).ToNot(gomega.HaveOccurred())
+
+		err := os.Remove(dbPath)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("returns nothing when no operation was stored", func() {
+		retrieved, err := db.GetOperation("unknown")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(retrieved).To(gomega.BeNil())
+
+		list, err := db.GetOperationsByAppInstanceId("app1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(list).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("records the phases of an operation", func() {
+		op := entities.NewOperation("op1", entities.DEPLOY_OPERATION, "req1", "org1", "app1", "")
+		op.AddPhase(entities.PHASE_QUEUED, nil, time.Now())
+		gomega.Expect(db.AddOperation(op)).ToNot(gomega.HaveOccurred())
+
+		gomega.Expect(db.RecordPhase("op1", entities.PHASE_SCORED, nil)).ToNot(gomega.HaveOccurred())
+		gomega.Expect(db.RecordPhase("op1", entities.PHASE_QUEUED, errors.New("retry"))).ToNot(gomega.HaveOccurred())
+		gomega.Expect(db.Finish("op1", entities.PHASE_RUNNING)).ToNot(gomega.HaveOccurred())
+		// updates after finishing are ignored
+		gomega.Expect(db.Fail("op1", errors.New("late failure"))).ToNot(gomega.HaveOccurred())
+
+		retrieved, err := db.GetOperation("op1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(retrieved.Status).To(gomega.Equal(entities.OPERATION_DONE))
+		gomega.Expect(retrieved.Finished).ToNot(gomega.BeNil())
+		gomega.Expect(retrieved.Phases).To(gomega.HaveLen(4))
+		gomega.Expect(retrieved.Phases[2].Error).To(gomega.Equal("retry"))
+		gomega.Expect(retrieved.Phases[3].Phase).To(gomega.Equal(entities.PHASE_RUNNING))
+	})
+
+	ginkgo.It("fails an operation", func() {
+		op := entities.NewOperation("op1", entities.UNDEPLOY_OPERATION, "", "org1", "app1", "")
+		gomega.Expect(db.AddOperation(op)).ToNot(gomega.HaveOccurred())
+		gomega.Expect(db.Fail("op1", errors.New("cluster unavailable"))).ToNot(gomega.HaveOccurred())
+
+		retrieved, err := db.GetOperation("op1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(retrieved.Status).To(gomega.Equal(entities.OPERATION_FAILED))
+		gomega.Expect(retrieved.Error).To(gomega.Equal("cluster unavailable"))
+	})
+
+	ginkgo.It("cannot update an unknown operation", func() {
+		err := db.RecordPhase("unknown", entities.PHASE_SCORED, nil)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("queries operations by request and application instance", func() {
+		first := entities.NewOperation("op1", entities.DEPLOY_OPERATION, "req1", "org1", "app1", "")
+		second := entities.NewOperation("op2", entities.UNDEPLOY_OPERATION, "", "org1", "app1", "")
+		second.Created = first.Created.Add(time.Second)
+		other := entities.NewOperation("op3", entities.DEPLOY_OPERATION, "req2", "org1", "app2", "")
+		for _, op := range []*entities.Operation{second, other, first} {
+			gomega.Expect(db.AddOperation(op)).ToNot(gomega.HaveOccurred())
+		}
+
+		byRequest, err := db.GetOperationsByRequestId("req1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(byRequest).To(gomega.HaveLen(1))
+		gomega.Expect(byRequest[0].OperationId).To(gomega.Equal("op1"))
+
+		byApp, err := db.GetOperationsByAppInstanceId("app1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(byApp).To(gomega.HaveLen(2))
+		gomega.Expect(byApp[0].OperationId).To(gomega.Equal("op1"))
+		gomega.Expect(byApp[1].OperationId).To(gomega.Equal("op2"))
+
+		inProgress, err := db.GetInProgressOperation("app1", entities.UNDEPLOY_OPERATION)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(inProgress).ToNot(gomega.BeNil())
+		gomega.Expect(inProgress.OperationId).To(gomega.Equal("op2"))
+	})
+
+	ginkgo.It("stores the type and status of the operations by name", func() {
+		op := entities.NewOperation("op1", entities.DRAIN_OPERATION, "", "org1", "", "cluster1")
+		gomega.Expect(db.AddOperation(op)).ToNot(gomega.HaveOccurred())
+
+		stored, err := localDB.Get([]byte(OperationsBucket), []byte("op1"))
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		fields := make(map[string]interface{}, 0)
+		gomega.Expect(json.Unmarshal(stored, &fields)).ToNot(gomega.HaveOccurred())
+		gomega.Expect(fields["type"]).To(gomega.Equal("DRAIN"))
+		gomega.Expect(fields["status"]).To(gomega.Equal("IN_PROGRESS"))
+	})
+
+	ginkgo.It("reads the operations stored with numeric types and status", func() {
+		stored := []byte(`{"operation_id":"op1","type":1,"status":2,"app_instance_id":"app1"}`)
+		gomega.Expect(localDB.Put([]byte(OperationsBucket), []byte("op1"), stored)).ToNot(gomega.HaveOccurred())
+
+		retrieved, err := db.GetOperation("op1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(retrieved.Type).To(gomega.Equal(entities.UNDEPLOY_OPERATION))
+		gomega.Expect(retrieved.Status).To(gomega.Equal(entities.OPERATION_FAILED))
+	})
+
+	ginkgo.It("removes the operations finished before the retention period", func() {
+		finished := time.Now().Add(-time.Hour)
+		old := entities.NewOperation("old", entities.DEPLOY_OPERATION, "req1", "org1", "app1", "")
+		old.Finish(entities.PHASE_RUNNING, finished)
+		recent := entities.NewOperation("recent", entities.DEPLOY_OPERATION, "req2", "org1", "app1", "")
+		recent.Finish(entities.PHASE_RUNNING, time.Now())
+		running := entities.NewOperation("running", entities.DRAIN_OPERATION, "", "org1", "", "cluster1")
+		running.Created = finished
+		for _, op := range []*entities.Operation{old, recent, running} {
+			gomega.Expect(db.AddOperation(op)).ToNot(gomega.HaveOccurred())
+		}
+
+		removed, err := db.RemoveExpired(time.Minute * 30)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(removed).To(gomega.Equal(1))
+
+		retrieved, err := db.GetOperation("old")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(retrieved).To(gomega.BeNil())
+		retrieved, err = db.GetOperation("running")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(retrieved).ToNot(gomega.BeNil())
+	})
+
+	ginkgo.It("removes the index entries of the expired operations", func() {
+		old := entities.NewOperation("old", entities.DEPLOY_OPERATION, "req1", "org1", "app1", "")
+		old.Finish(entities.PHASE_RUNNING, time.Now().Add(-time.Hour))
+		gomega.Expect(db.AddOperation(old)).ToNot(gomega.HaveOccurred())
+
+		removed, err := db.RemoveExpired(time.Minute * 30)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(removed).To(gomega.Equal(1))
+
+		count := 0
+		for _, bucket := range []string{requestIndex, appInstanceIndex} {
+			pairs, err := localDB.GetAllPairsInBucket([]byte(bucket))
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			count += len(pairs)
+		}
+		gomega.Expect(count).To(gomega.BeZero())
+	})
+
+	ginkgo.It("moves the index entries of an overwritten operation", func() {
+		gomega.Expect(db.AddOperation(entities.NewOperation("op1", entities.DEPLOY_OPERATION, "req1", "org1", "app1", ""))).
+			ToNot(gomega.HaveOccurred())
+		gomega.Expect(db.AddOperation(entities.NewOperation("op1", entities.DEPLOY_OPERATION, "req2", "org1", "app1", ""))).
+			ToNot(gomega.HaveOccurred())
+
+		byRequest, err := db.GetOperationsByRequestId("req1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(byRequest).To(gomega.BeEmpty())
+		byRequest, err = db.GetOperationsByRequestId("req2")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(byRequest).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("indexes the operations stored without indexes", func() {
+		op := entities.NewOperation("op1", entities.DEPLOY_OPERATION, "req1", "org1", "app1", "")
+		stored, err := json.Marshal(op)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(localDB.Put([]byte(OperationsBucket), []byte("op1"), stored)).ToNot(gomega.HaveOccurred())
+
+		byApp, err := db.GetOperationsByAppInstanceId("app1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(byApp).To(gomega.BeEmpty())
+
+		gomega.Expect(db.RebuildIndexes()).ToNot(gomega.HaveOccurred())
+		byApp, err = db.GetOperationsByAppInstanceId("app1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(byApp).To(gomega.HaveLen(1))
+		byRequest, err := db.GetOperationsByRequestId("req1")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(byRequest).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("records the progress of a drain operation", func() {
+		op := entities.NewDrainOperation("org1", "cluster1", 3)
+		gomega.Expect(db.AddOperation(op)).ToNot(gomega.HaveOccurred())
+		gomega.Expect(db.RecordDrainedFragment(op.OperationId, entities.DRAINED_FRAGMENT_REMOVED)).ToNot(gomega.HaveOccurred())
+		gomega.Expect(db.RecordDrainedFragment(op.OperationId, entities.DRAINED_FRAGMENT_RESCHEDULED)).ToNot(gomega.HaveOccurred())
+		gomega.Expect(db.RecordDrainedFragment(op.OperationId, entities.DRAINED_FRAGMENT_FAILED)).ToNot(gomega.HaveOccurred())
+
+		retrieved, err := db.GetOperation(op.OperationId)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(retrieved.Drain).To(gomega.Equal(&entities.DrainProgress{TotalFragments: 3, RemovedFragments: 1,
+			RescheduledFragments: 1, FailedFragments: 1}))
+	})
+})
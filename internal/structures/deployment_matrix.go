@@ -51,7 +51,12 @@ func NewDeploymentMatrix(scores entities.DeploymentScore, allocatedGroups map[st
 	// initialize data structures
 	for _, ds := range scores.DeploymentsScore {
 		clusterScore[ds.ClusterId] = ds
-		allocatedScore[ds.ClusterId] = ds
+		// allocated scores are modified during the analysis, do not share the map with the original scores
+		allocated := entities.NewClusterDeploymentScore(ds.ClusterId)
+		for k, v := range ds.Scores {
+			allocated.Scores[k] = v
+		}
+		allocatedScore[ds.ClusterId] = allocated
 	}
 
 	var deployedGroups map[string][]string
@@ -77,109 +82,168 @@ func (dm *DeploymentMatrix) AddClusterScore(score entities.ClusterDeploymentScor
 // that all the scores are larger than for the group. If not all the groups permit to allocate this
 // group we return an error,
 func (dm *DeploymentMatrix) FindBestTargetsForReplication(group entities.ServiceGroup) ([]string, derrors.Error) {
-	// Iterate until we find the best solution to deploy as many replicas as required
-	var desiredReplicas int
-
-	// find if there are any initial replicas already allocated
-	alreadyAllocatedGroups := 0
-	groupDeployedOnClusters := make(map[string]bool, 0)
-	for clusterId, groupsInCluster := range dm.GroupsCluster {
-		for _, groupId := range groupsInCluster {
-			if groupId == group.ServiceGroupId {
-				alreadyAllocatedGroups = alreadyAllocatedGroups + 1
-				groupDeployedOnClusters[clusterId] = true
-			}
-		}
+	targets, err := dm.FindBestTargetsForCollocation([]entities.ServiceGroup{group}, nil)
+	if err != nil {
+		return nil, err
 	}
-	log.Debug().Int("alreadyAllocatedGroups", alreadyAllocatedGroups).
-		Interface("groupsCluster", dm.GroupsCluster).
-		Str("groupId", group.ServiceGroupId).
-		Msg("number of already allocated groups found")
+	return targets[group.ServiceGroupId], nil
+}
 
-	if group.Specs.MultiClusterReplica {
-		// This is a multiple cluster. Replicate as many times as available clusters we have.
-		desiredReplicas = len(dm.AllocatedScore) - alreadyAllocatedGroups
-	} else {
-		// Deploy as many replicas as mentioned in the deploy specs.
-		desiredReplicas = int(group.Specs.Replicas) - alreadyAllocatedGroups
+// Find the best targets for a set of groups that must be deployed together in the same clusters. Clusters are
+// evaluated using the score of the combination of groups returned by the musicians. Every group is placed
+// according to its own number of replicas, or in all the available clusters if it is a multi cluster replica.
+// The clusters with the best score host the replicas of every group, so a group with fewer replicas always shares
+// its clusters with the groups with more replicas.
+// params:
+//  groups set of groups to be deployed together
+//  excludedClusters clusters that cannot be used
+// return:
+//  map with the list of target clusters sorted by score per service group id, nil if no replicas are required,
+//  or error if not enough clusters were found
+func (dm *DeploymentMatrix) FindBestTargetsForCollocation(groups []entities.ServiceGroup,
+	excludedClusters map[string]bool) (map[string][]string, derrors.Error) {
+	if len(groups) == 0 {
+		return nil, derrors.NewInvalidArgumentError("no groups to find targets for")
 	}
+	scoreKey := dm.generateGroupId(groups)
+	groupNames := make([]string, len(groups))
+	for i, g := range groups {
+		groupNames[i] = g.Name
+	}
+
+	// find the number of additional replicas required by every group
+	desiredReplicas := make([]int, len(groups))
+	requiredReplicas := false
+	for i, g := range groups {
+		desiredReplicas[i] = dm.desiredReplicas(g)
+		requiredReplicas = requiredReplicas || desiredReplicas[i] > 0
+	}
+	log.Debug().Ints("desiredReplicas", desiredReplicas).
+		Interface("groupsCluster", dm.GroupsCluster).
+		Strs("groups", groupNames).
+		Msg("number of desired replicas found")
 
 	// Current conditions do not require additional replicas
-	if desiredReplicas == 0 {
-		log.Debug().Int("alreadyAllocatedGroups", alreadyAllocatedGroups).
-			Int("descriptorReplicas", int(group.Specs.Replicas)).
+	if !requiredReplicas {
+		log.Debug().Strs("groups", groupNames).
 			Msg("no desired replicas, exit the search of the best target replication scenario")
 		return nil, nil
 	}
 
 	log.Debug().Interface("deploymentMatrix", dm).Msg("deployment matrix during cluster search")
 
-	// Allocate a replica in the cluster with the largest score
-	// Skip clusters with already running replicas
-	// Greedy approach to find the best cluster with no allocated replica
-	targetClusters := make(map[string]float32, 0)
-	for i := 0; i < desiredReplicas; i++ {
-		roundCandidate := ""
-		candidateScore := float32(-1)
-		for clusterId, clusterScore := range dm.AllocatedScore {
-			// if we have already deployed on this cluster, skip it
-			if _, alreadyDeployed := groupDeployedOnClusters[clusterId]; alreadyDeployed {
-				continue
-			}
-			_, usedCluster := targetClusters[clusterId]
-			if !usedCluster {
-				// We have not allocated anything in this cluster
-				groupScoreInCluster, found := clusterScore.Scores[group.Name]
-				if !found {
-					msg := fmt.Sprintf("cluster %s has no score for group %s", clusterScore.ClusterId, group.Name)
-					log.Warn().Msg(msg)
-				} else if groupScoreInCluster >= 0 && groupScoreInCluster > candidateScore {
-					// Consider this cluster a potential candidate
-					roundCandidate = clusterId
-					candidateScore = groupScoreInCluster
-				}
+	// Collect the clusters where the groups can be deployed, skipping clusters already running all the groups
+	candidates := make([]string, 0)
+	for clusterId, clusterScore := range dm.AllocatedScore {
+		if excludedClusters[clusterId] {
+			continue
+		}
+		allDeployed := true
+		for _, g := range groups {
+			if !containsGroup(dm.GroupsCluster[clusterId], g.ServiceGroupId) {
+				allDeployed = false
+				break
 			}
 		}
-		if roundCandidate != "" {
-			targetClusters[roundCandidate] = candidateScore
-		} else {
-			// if a multicluster replica set was chosen we made our best effort. If not we cannot allocate
-			// the number of expected replicas.
-			if !group.Specs.MultiClusterReplica {
-				// It was impossible to allocate a remaining replica...
-				msg := fmt.Sprintf("only %d replicas could be allocated out of the %d desired", len(targetClusters), desiredReplicas)
-				return nil, derrors.NewUnavailableError(msg)
+		if allDeployed {
+			continue
+		}
+		groupScoreInCluster, found := clusterScore.Scores[scoreKey]
+		if !found {
+			msg := fmt.Sprintf("cluster %s has no score for groups %v", clusterScore.ClusterId, groupNames)
+			log.Warn().Msg(msg)
+		} else if groupScoreInCluster >= 0 {
+			candidates = append(candidates, clusterId)
+		}
+	}
+	// Greedy approach: the clusters with the largest score first
+	sort.Slice(candidates, func(i, j int) bool {
+		scoreI := dm.AllocatedScore[candidates[i]].Scores[scoreKey]
+		scoreJ := dm.AllocatedScore[candidates[j]].Scores[scoreKey]
+		if scoreI != scoreJ {
+			return scoreI > scoreJ
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	// Every cluster hosts the groups still requiring replicas that are not already running there
+	targets := make(map[string][]string, len(groups))
+	placement := make(map[string][]string, 0)
+	for _, clusterId := range candidates {
+		for i, g := range groups {
+			if len(targets[g.ServiceGroupId]) < desiredReplicas[i] &&
+				!containsGroup(dm.GroupsCluster[clusterId], g.ServiceGroupId) {
+				targets[g.ServiceGroupId] = append(targets[g.ServiceGroupId], clusterId)
+				placement[clusterId] = append(placement[clusterId], g.ServiceGroupId)
 			}
 		}
 	}
 
-	// if this is not a multi cluster replica we need to have as many target clusters as the desired replicas
-	if !group.Specs.MultiClusterReplica && desiredReplicas != len(targetClusters) {
-		// we could not allocate enough replicas
-		return nil, derrors.NewUnavailableError(fmt.Sprintf("no replicas could be allocated for group %s", group.Name))
+	// if a multicluster replica set was chosen we made our best effort. If not we cannot allocate
+	// the number of expected replicas.
+	for i, g := range groups {
+		if g.Specs.MultiClusterReplica || len(targets[g.ServiceGroupId]) >= desiredReplicas[i] {
+			continue
+		}
+		msg := fmt.Sprintf("only %d replicas could be allocated out of the %d desired for group %s",
+			len(targets[g.ServiceGroupId]), desiredReplicas[i], g.Name)
+		if len(groups) > 1 {
+			msg = fmt.Sprintf("%s. Groups %v must be deployed in the same cluster and no cluster can host all of them",
+				msg, groupNames)
+		}
+		if len(excludedClusters) > 0 {
+			msg = fmt.Sprintf("%s. %d clusters were excluded by the collocation policy", msg, len(excludedClusters))
+		}
+		return nil, derrors.NewUnavailableError(msg)
 	}
 
 	// Allocate all the replicas we could find
-	toReturn := make([]string, len(targetClusters))
-	i := 0
-	for clusterId, _ := range targetClusters {
-		dm.allocateGroups(clusterId, group.ServiceGroupId, []string{group.ServiceGroupId})
-		toReturn[i] = clusterId
-		i++
+	for _, clusterId := range candidates {
+		if groupIds, found := placement[clusterId]; found {
+			dm.allocateGroups(clusterId, groupIds)
+		}
 	}
 
-	return toReturn, nil
+	return targets, nil
 }
 
-// Allocate groups and update scores.
-func (dm *DeploymentMatrix) allocateGroups(clusterId string, groupId string, groups []string) {
-	dm.GroupsCluster[clusterId] = groups
-	scoreToRevisit := dm.AllocatedScore[clusterId]
-	load := dm.AllocatedScore[clusterId].Scores[groupId]
-	// substract scoring value for all the entries in this cluster
-	for _, v := range scoreToRevisit.Scores {
-		v = v - load
+// Number of additional replicas required by a group. Multi cluster replicas are required in every cluster.
+// params:
+//  group service group to be deployed
+// return:
+//  number of replicas not running yet in any cluster
+func (dm *DeploymentMatrix) desiredReplicas(group entities.ServiceGroup) int {
+	alreadyAllocated := 0
+	for _, groupsInCluster := range dm.GroupsCluster {
+		if containsGroup(groupsInCluster, group.ServiceGroupId) {
+			alreadyAllocated = alreadyAllocated + 1
+		}
 	}
+	if group.Specs.MultiClusterReplica {
+		// This is a multiple cluster. Replicate as many times as available clusters we have.
+		return len(dm.AllocatedScore) - alreadyAllocated
+	}
+	// Deploy as many replicas as mentioned in the deploy specs.
+	return int(group.Specs.Replicas) - alreadyAllocated
+}
+
+// Check if a group id is contained in a list of groups.
+func containsGroup(groups []string, groupId string) bool {
+	for _, g := range groups {
+		if g == groupId {
+			return true
+		}
+	}
+	return false
+}
+
+// Allocate groups in a cluster. Scores are not comparable with the resources they represent, so they are not
+// modified. The capacity consumed by several groups in the same cluster is checked by the placement solver using
+// the score of their combination.
+// params:
+//  clusterId cluster where the groups are allocated
+//  groups ids of the allocated groups
+func (dm *DeploymentMatrix) allocateGroups(clusterId string, groups []string) {
 	// Update the set of groups
 	for _, g := range groups {
 		dm.GroupsCluster[clusterId] = append(dm.GroupsCluster[clusterId], g)
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package structures
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("deployment matrix", func() {
+
+	// Build a deployment score where every cluster contains the scores indicated by the map
+	// cluster id -> group key -> score
+	buildScore := func(scores map[string]map[string]float32) entities.DeploymentScore {
+		toReturn := entities.NewClustersScore()
+		for clusterId, groupScores := range scores {
+			clusterScore := entities.NewClusterDeploymentScore(clusterId)
+			for key, value := range groupScores {
+				clusterScore.Scores[key] = value
+			}
+			toReturn.AddClusterScore(clusterScore)
+		}
+		return toReturn
+	}
+
+	groupA := entities.ServiceGroup{ServiceGroupId: "idA", Name: "groupA", Policy: entities.SameCluster,
+		Specs: entities.ServiceGroupDeploymentSpecs{Replicas: 1}}
+	groupB := entities.ServiceGroup{ServiceGroupId: "idB", Name: "groupB", Policy: entities.SameCluster,
+		Specs: entities.ServiceGroupDeploymentSpecs{Replicas: 2}}
+
+	ginkgo.It("selects the clusters with the best score for a single group", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"groupA": 0.2},
+			"cluster2": {"groupA": 0.8},
+			"cluster3": {"groupA": -1},
+		})
+		dm := NewDeploymentMatrix(score, nil)
+		targets, err := dm.FindBestTargetsForReplication(groupA)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(targets).To(gomega.Equal([]string{"cluster2"}))
+		gomega.Expect(dm.GroupsCluster["cluster2"]).To(gomega.Equal([]string{"idA"}))
+	})
+
+	ginkgo.It("places collocated groups using the score of the combination", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"groupA": 0.9, "groupB": 0.9, "groupAgroupB": -1},
+			"cluster2": {"groupA": 0.5, "groupB": 0.5, "groupAgroupB": 0.4},
+			"cluster3": {"groupA": 0.5, "groupB": 0.5, "groupAgroupB": 0.3},
+		})
+		dm := NewDeploymentMatrix(score, nil)
+		targets, err := dm.FindBestTargetsForCollocation([]entities.ServiceGroup{groupA, groupB}, nil)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		// every group is placed according to its own number of replicas
+		gomega.Expect(targets).To(gomega.Equal(map[string][]string{
+			"idA": {"cluster2"},
+			"idB": {"cluster2", "cluster3"},
+		}))
+		gomega.Expect(dm.GroupsCluster["cluster2"]).To(gomega.ConsistOf("idA", "idB"))
+		gomega.Expect(dm.GroupsCluster["cluster3"]).To(gomega.ConsistOf("idB"))
+		gomega.Expect(dm.GroupsCluster).ToNot(gomega.HaveKey("cluster1"))
+	})
+
+	ginkgo.It("only places the collocated groups missing replicas", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"groupA": 0.5, "groupB": 0.5, "groupAgroupB": 0.4},
+			"cluster2": {"groupA": 0.5, "groupB": 0.5, "groupAgroupB": 0.3},
+		})
+		dm := NewDeploymentMatrix(score, map[string][]string{"cluster1": {"idA", "idB"}})
+		targets, err := dm.FindBestTargetsForCollocation([]entities.ServiceGroup{groupA, groupB}, nil)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(targets).To(gomega.Equal(map[string][]string{"idB": {"cluster2"}}))
+		gomega.Expect(dm.GroupsCluster["cluster2"]).To(gomega.ConsistOf("idB"))
+	})
+
+	ginkgo.It("fails when no cluster can host the collocated groups", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"groupA": 0.9, "groupB": 0.9, "groupAgroupB": -1},
+			"cluster2": {"groupA": 0.5, "groupB": 0.5},
+		})
+		dm := NewDeploymentMatrix(score, nil)
+		targets, err := dm.FindBestTargetsForCollocation([]entities.ServiceGroup{groupA, groupB}, nil)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(targets).To(gomega.BeNil())
+	})
+
+	ginkgo.It("skips excluded clusters", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"groupA": 0.9},
+			"cluster2": {"groupA": 0.5},
+		})
+		dm := NewDeploymentMatrix(score, nil)
+		targets, err := dm.FindBestTargetsForCollocation([]entities.ServiceGroup{groupA},
+			map[string]bool{"cluster1": true})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(targets).To(gomega.Equal(map[string][]string{"idA": {"cluster2"}}))
+
+		dm = NewDeploymentMatrix(score, nil)
+		_, err = dm.FindBestTargetsForCollocation([]entities.ServiceGroup{groupA},
+			map[string]bool{"cluster1": true, "cluster2": true})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("places several groups in a single cluster", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"group1": 0.9, "group2": 0.5},
+		})
+		group1 := entities.ServiceGroup{ServiceGroupId: "id1", Name: "group1",
+			Specs: entities.ServiceGroupDeploymentSpecs{Replicas: 1}}
+		group2 := entities.ServiceGroup{ServiceGroupId: "id2", Name: "group2",
+			Specs: entities.ServiceGroupDeploymentSpecs{Replicas: 1}}
+		dm := NewDeploymentMatrix(score, nil)
+		targets, err := dm.FindBestTargetsForReplication(group1)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(targets).To(gomega.Equal([]string{"cluster1"}))
+		// allocating the first group does not make the score of the second one negative
+		targets, err = dm.FindBestTargetsForReplication(group2)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(targets).To(gomega.Equal([]string{"cluster1"}))
+		gomega.Expect(dm.GroupsCluster["cluster1"]).To(gomega.Equal([]string{"id1", "id2"}))
+	})
+
+	ginkgo.It("does not allocate again groups already running in a cluster", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"groupB": 0.9},
+			"cluster2": {"groupB": 0.5},
+			"cluster3": {"groupB": 0.7},
+		})
+		dm := NewDeploymentMatrix(score, map[string][]string{"cluster1": {"idB"}})
+		targets, err := dm.FindBestTargetsForReplication(groupB)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(targets).To(gomega.Equal([]string{"cluster3"}))
+	})
+})
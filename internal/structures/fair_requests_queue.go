@@ -0,0 +1,410 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package structures
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// Weight assigned to organizations without an explicit weight.
+const DefaultOrganizationWeight = 1
+
+// Queue in memory sharing the processing of requests among organizations. Every organization has its own
+// queue sorted by priority and arrival. Organizations are served using weighted fair queuing: each organization
+// has a virtual pass that increases every time one of its requests is served, the increment being inversely
+// proportional to its weight. The organization with the lowest pass among those with ready requests is served next.
+// The queue may be persisted using the same records as PersistentRequestQueue, in which case the requests returned
+// by the queue are kept in the database until they are acknowledged or pushed again.
+type FairRequestQueue struct {
+	// queues indexed by organization id
+	orgs map[string]*organizationQueue
+	// weights indexed by organization id
+	weights map[string]int
+	// pass of the latest served organization
+	virtualTime float64
+	// arrival sequence number for the next request
+	nextSeq uint64
+	// time to wait before a retried request is ready again
+	retryDelay time.Duration
+	// notification of new requests
+	signal chan struct{}
+	// provider to persist the queue, nil if the queue is only kept in memory
+	db provider.KeyValueProvider
+	// keys of the requests returned by the queue and not acknowledged yet
+	inFlight map[*entities.DeploymentRequest][]byte
+	// Mutex for queue operations
+	mux sync.RWMutex
+}
+
+// Requests of an organization.
+type organizationQueue struct {
+	// requests sorted by priority and arrival
+	requests []*fairEntry
+	// virtual pass of the organization
+	pass float64
+}
+
+// Internal entry linking a request with its arrival sequence number and its key in the database, if any.
+type fairEntry struct {
+	seq uint64
+	key []byte
+	req *entities.DeploymentRequest
+}
+
+// Create a new fair queue.
+//  params:
+//   retryDelay time to wait before a retried request is ready again
+//   weights weight of every organization. Organizations not found in the map use DefaultOrganizationWeight.
+//  returns:
+//   queue instance
+func NewFairRequestQueue(retryDelay time.Duration, weights map[string]int) *FairRequestQueue {
+	toReturn := &FairRequestQueue{orgs: make(map[string]*organizationQueue, 0), weights: make(map[string]int, 0),
+		retryDelay: retryDelay, signal: make(chan struct{}, 1),
+		inFlight: make(map[*entities.DeploymentRequest][]byte, 0)}
+	for organizationId, weight := range weights {
+		toReturn.SetOrganizationWeight(organizationId, weight)
+	}
+	return toReturn
+}
+
+// Create a new fair queue persisted using a key value provider. Any request already stored in the provider, including
+// those stored by a PersistentRequestQueue, is loaded keeping its arrival order.
+//  params:
+//   db provider to persist the queue
+//   retryDelay time to wait before a retried request is ready again
+//   weights weight of every organization. Organizations not found in the map use DefaultOrganizationWeight.
+//  returns:
+//   queue instance or error if any
+func NewPersistentFairRequestQueue(db provider.KeyValueProvider, retryDelay time.Duration,
+	weights map[string]int) (*FairRequestQueue, derrors.Error) {
+	toReturn := NewFairRequestQueue(retryDelay, weights)
+	toReturn.db = db
+	entries, nextSeq, err := loadStoredRequests(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		toReturn.enqueue(&fairEntry{seq: binary.BigEndian.Uint64(entry.key), key: entry.key, req: entry.req})
+	}
+	toReturn.nextSeq = nextSeq
+	log.Info().Int("queued requests", len(entries)).Msg("fair requests queue loaded from local database")
+	return toReturn, nil
+}
+
+// Set the weight of an organization. An organization with weight 2 is served twice as often as an organization
+// with weight 1 when both have pending requests.
+//  params:
+//   organizationId organization identifier
+//   weight positive weight, other values restore the default weight
+func (q *FairRequestQueue) SetOrganizationWeight(organizationId string, weight int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if weight < 1 {
+		delete(q.weights, organizationId)
+		return
+	}
+	q.weights[organizationId] = weight
+}
+
+func (q *FairRequestQueue) weight(organizationId string) int {
+	weight, found := q.weights[organizationId]
+	if !found {
+		return DefaultOrganizationWeight
+	}
+	return weight
+}
+
+// Thread-safe method to access queued requests
+func (q *FairRequestQueue) NextRequest() *entities.DeploymentRequest {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	toReturn, _ := q.popReady()
+	return toReturn
+}
+
+// Wait until a deployment request is ready to be processed.
+func (q *FairRequestQueue) Next(ctx context.Context) *entities.DeploymentRequest {
+	for {
+		q.mux.Lock()
+		toReturn, delay := q.popReady()
+		q.mux.Unlock()
+		if toReturn != nil {
+			return toReturn
+		}
+		if !waitRequest(ctx, q.signal, delay) {
+			return nil
+		}
+	}
+}
+
+// Remove the next ready request following the fair queuing policy. This function is not thread-safe.
+//  returns:
+//   ready request, or nil and the time to wait for the next one (negative if the queue is empty)
+func (q *FairRequestQueue) popReady() (*entities.DeploymentRequest, time.Duration) {
+	now := time.Now()
+	minDelay := time.Duration(-1)
+	var targetOrg string
+	var target *organizationQueue
+	targetIndex := -1
+	for organizationId, org := range q.orgs {
+		for i, entry := range org.requests {
+			delay := pendingDelay(entry.req, q.retryDelay, now)
+			if delay > 0 {
+				if minDelay < 0 || delay < minDelay {
+					minDelay = delay
+				}
+				continue
+			}
+			// first ready request of the organization, break ties by arrival
+			if target == nil || org.pass < target.pass ||
+				(org.pass == target.pass && entry.seq < target.requests[targetIndex].seq) {
+				targetOrg = organizationId
+				target = org
+				targetIndex = i
+			}
+			break
+		}
+	}
+
+	if target == nil {
+		return nil, minDelay
+	}
+
+	toReturn := target.requests[targetIndex].req
+	if q.db != nil {
+		q.inFlight[toReturn] = target.requests[targetIndex].key
+	}
+	target.requests = append(target.requests[:targetIndex], target.requests[targetIndex+1:]...)
+	q.virtualTime = target.pass
+	target.pass = target.pass + 1.0/float64(q.weight(targetOrg))
+	if q.numRequests() > 0 {
+		// let other consumers check the remaining requests
+		notifyRequest(q.signal)
+	}
+	return toReturn, 0
+}
+
+// Thread-safe function to find whether there are more requests available or not.
+func (q *FairRequestQueue) AvailableRequests() bool {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	return q.numRequests() != 0
+}
+
+// Total number of queued requests. This function is not thread-safe.
+func (q *FairRequestQueue) numRequests() int {
+	total := 0
+	for _, org := range q.orgs {
+		total = total + len(org.requests)
+	}
+	return total
+}
+
+// Push a new request to the queue of its organization for later processing. Persistent queues store the request
+// before being available in memory. Pushing again a request returned by the queue replaces its previous record.
+//  params:
+//   req entry to be enqueued
+func (q *FairRequestQueue) PushRequest(req *entities.DeploymentRequest) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	markEnqueued(req)
+	entry := &fairEntry{seq: q.nextSeq, req: req}
+	if q.db != nil {
+		// a request returned by the queue replaces its previous record
+		key, err := storeRequest(q.db, q.nextSeq, req, q.inFlight[req])
+		if err != nil {
+			return err
+		}
+		entry.key = key
+	}
+	q.nextSeq = q.nextSeq + 1
+	q.enqueue(entry)
+	delete(q.inFlight, req)
+
+	notifyRequest(q.signal)
+	return nil
+}
+
+// Add an entry to the queue of its organization. This function is not thread-safe.
+//  params:
+//   entry entry to be enqueued
+func (q *FairRequestQueue) enqueue(entry *fairEntry) {
+	req := entry.req
+	org, found := q.orgs[req.OrganizationId]
+	if !found {
+		org = &organizationQueue{requests: make([]*fairEntry, 0), pass: q.virtualTime}
+		q.orgs[req.OrganizationId] = org
+	}
+	if len(org.requests) == 0 && org.pass < q.virtualTime {
+		// an idle organization does not accumulate credit
+		org.pass = q.virtualTime
+	}
+
+	// keep the requests sorted by priority, FIFO for the same priority
+	index := len(org.requests)
+	for i, r := range org.requests {
+		if r.req.Priority < req.Priority {
+			index = i
+			break
+		}
+	}
+	org.requests = append(org.requests, nil)
+	copy(org.requests[index+1:], org.requests[index:])
+	org.requests[index] = entry
+}
+
+// Acknowledge a processed request. Persistent queues remove it from the database.
+//  params:
+//   req request returned by NextRequest or Next
+func (q *FairRequestQueue) Ack(req *entities.DeploymentRequest) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.deleteInFlight(req)
+}
+
+// Remove the record of a request returned by the queue. This function is not thread-safe.
+//  params:
+//   req request returned by the queue
+func (q *FairRequestQueue) deleteInFlight(req *entities.DeploymentRequest) {
+	key, found := q.inFlight[req]
+	if !found {
+		return
+	}
+	if q.deleteRecord(req, key) {
+		delete(q.inFlight, req)
+	}
+}
+
+// Remove the record of a request from the database, if the queue is persisted. This function is not thread-safe.
+//  params:
+//   req request to be removed
+//   key key of the request in the database
+//  returns:
+//   false if the record could not be removed
+func (q *FairRequestQueue) deleteRecord(req *entities.DeploymentRequest, key []byte) bool {
+	if q.db == nil || key == nil {
+		return true
+	}
+	err := q.db.Delete([]byte(PersistentRequestQueueBucket), key)
+	if err != nil {
+		log.Error().Err(err).Str("requestId", req.RequestId).
+			Msg("impossible to remove deployment request from the local database")
+		return false
+	}
+	return true
+}
+
+func (q *FairRequestQueue) Clear() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for _, org := range q.orgs {
+		for _, entry := range org.requests {
+			q.deleteRecord(entry.req, entry.key)
+		}
+	}
+	q.orgs = make(map[string]*organizationQueue, 0)
+	q.virtualTime = 0
+}
+
+func (q *FairRequestQueue) Len() int {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	return q.numRequests()
+}
+
+// Time the oldest queued request has been waiting since it was pushed.
+func (q *FairRequestQueue) OldestRequestAge() time.Duration {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	now := time.Now()
+	oldest := time.Duration(0)
+	for _, org := range q.orgs {
+		for _, entry := range org.requests {
+			if age := requestAge(entry.req, now); age > oldest {
+				oldest = age
+			}
+		}
+	}
+	return oldest
+}
+
+// Number of queued requests for an organization.
+//  params:
+//   organizationId organization identifier
+//  returns:
+//   number of queued requests
+func (q *FairRequestQueue) OrganizationLen(organizationId string) int {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	org, found := q.orgs[organizationId]
+	if !found {
+		return 0
+	}
+	return len(org.requests)
+}
+
+// Number of queued requests per organization.
+//  returns:
+//   map with the number of queued requests indexed by organization id
+func (q *FairRequestQueue) LenPerOrganization() map[string]int {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	toReturn := make(map[string]int, len(q.orgs))
+	for organizationId, org := range q.orgs {
+		if len(org.requests) > 0 {
+			toReturn[organizationId] = len(org.requests)
+		}
+	}
+	return toReturn
+}
+
+// Remove the entry with the indicated appInstanceId. The records of the requests of the instance that were
+// returned by the queue are removed too, so they are not processed again after a restart.
+// params:
+//  appInstanceId identifier of the instance to be removed
+// returns:
+//  true if a queued entry was removed
+func (q *FairRequestQueue) Remove(appInstanceId string) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for req := range q.inFlight {
+		if req.AppInstanceId == appInstanceId {
+			q.deleteInFlight(req)
+		}
+	}
+	for _, org := range q.orgs {
+		for i, entry := range org.requests {
+			if entry.req.AppInstanceId == appInstanceId {
+				if !q.deleteRecord(entry.req, entry.key) {
+					return false
+				}
+				org.requests = append(org.requests[:i], org.requests[i+1:]...)
+				return true
+			}
+		}
+	}
+	return false
+}
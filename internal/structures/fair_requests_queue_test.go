@@ -0,0 +1,196 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package structures
+
+import (
+	"fmt"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/conductor/pkg/provider/kv"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"os"
+	"time"
+)
+
+var _ = ginkgo.Describe("fair requests queue", func() {
+
+	var q *FairRequestQueue
+
+	push := func(organizationId string, requestId string, priority int32) {
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: requestId, OrganizationId: organizationId,
+			AppInstanceId: requestId, Priority: priority})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	}
+
+	ginkgo.BeforeEach(func() {
+		q = NewFairRequestQueue(time.Minute, map[string]int{"heavy": 2})
+	})
+
+	ginkgo.It("does not let an organization starve the others", func() {
+		for i := 0; i < 10; i++ {
+			push("org1", fmt.Sprintf("org1-%d", i), 0)
+		}
+		push("org2", "org2-0", 0)
+		push("org2", "org2-1", 0)
+
+		served := make([]string, 0)
+		for i := 0; i < 4; i++ {
+			served = append(served, q.NextRequest().RequestId)
+		}
+		gomega.Expect(served).To(gomega.Equal([]string{"org1-0", "org2-0", "org1-1", "org2-1"}))
+		gomega.Expect(q.OrganizationLen("org1")).To(gomega.Equal(8))
+		gomega.Expect(q.OrganizationLen("org2")).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("serves organizations proportionally to their weight", func() {
+		for i := 0; i < 6; i++ {
+			push("heavy", fmt.Sprintf("heavy-%d", i), 0)
+			push("light", fmt.Sprintf("light-%d", i), 0)
+		}
+		counter := map[string]int{}
+		for i := 0; i < 6; i++ {
+			counter[q.NextRequest().OrganizationId]++
+		}
+		gomega.Expect(counter["heavy"]).To(gomega.Equal(4))
+		gomega.Expect(counter["light"]).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("honours priorities inside an organization", func() {
+		push("org1", "low", 0)
+		push("org1", "high", 10)
+		push("org1", "medium", 5)
+		push("org1", "low2", 0)
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("high"))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("medium"))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("low"))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("low2"))
+	})
+
+	ginkgo.It("reports the queue depth per organization", func() {
+		push("org1", "req1", 0)
+		push("org1", "req2", 0)
+		push("org2", "req3", 0)
+		gomega.Expect(q.Len()).To(gomega.Equal(3))
+		gomega.Expect(q.LenPerOrganization()).To(gomega.Equal(map[string]int{"org1": 2, "org2": 1}))
+
+		gomega.Expect(q.Remove("req3")).To(gomega.BeTrue())
+		gomega.Expect(q.LenPerOrganization()).To(gomega.Equal(map[string]int{"org1": 2}))
+		q.Clear()
+		gomega.Expect(q.AvailableRequests()).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("reports the age of the oldest request across organizations", func() {
+		gomega.Expect(q.OldestRequestAge()).To(gomega.BeZero())
+		push("org2", "req1", 0)
+		time.Sleep(time.Millisecond * 100)
+		push("org1", "req2", 0)
+		gomega.Expect(q.OldestRequestAge() >= time.Millisecond*100).To(gomega.BeTrue())
+		gomega.Expect(q.Remove("req1")).To(gomega.BeTrue())
+		gomega.Expect(q.OldestRequestAge() < time.Millisecond*100).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("skips requests waiting for a retry", func() {
+		failed := time.Now()
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: "retry", OrganizationId: "org1",
+			AppInstanceId: "app1", NumRetries: 1, TimeRetry: &failed})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		push("org1", "new", 0)
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("new"))
+		gomega.Expect(q.NextRequest()).To(gomega.BeNil())
+		gomega.Expect(q.Len()).To(gomega.Equal(1))
+	})
+})
+
+var _ = ginkgo.Describe("persistent fair requests queue", func() {
+
+	var localDB provider.KeyValueProvider
+	var q *FairRequestQueue
+	dbPath := "/tmp/persistent_fair_requests_queue_test.db"
+
+	open := func() {
+		aux, errDB := kv.NewLocalDB(dbPath)
+		gomega.Expect(errDB).ToNot(gomega.HaveOccurred())
+		localDB = aux
+		queue, err := NewPersistentFairRequestQueue(localDB, time.Minute, nil)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		q = queue
+	}
+
+	push := func(organizationId string, requestId string, priority int32) {
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: requestId, OrganizationId: organizationId,
+			AppInstanceId: requestId, Priority: priority})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	}
+
+	// Close the current database and open the queue again from the same file
+	reopen := func() {
+		errClose := localDB.Close()
+		gomega.Expect(errClose).ToNot(gomega.HaveOccurred())
+		open()
+	}
+
+	ginkgo.BeforeEach(func() {
+		open()
+	})
+
+	ginkgo.AfterEach(func() {
+		errClose := localDB.Close()
+		gomega.Expect(errClose).ToNot(gomega.HaveOccurred())
+		err := os.Remove(dbPath)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("reloads the queued requests keeping their priority and arrival order", func() {
+		push("org1", "low", 0)
+		push("org2", "other", 0)
+		push("org1", "high", 5)
+
+		reopen()
+
+		gomega.Expect(q.Len()).To(gomega.Equal(3))
+		// organizations with the same pass are served by arrival
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("other"))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("high"))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("low"))
+	})
+
+	ginkgo.It("keeps the requests being processed until they are acknowledged", func() {
+		push("org1", "req1", 0)
+		push("org1", "req2", 0)
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req1"))
+		acked := q.NextRequest()
+		q.Ack(acked)
+
+		reopen()
+
+		gomega.Expect(q.Len()).To(gomega.Equal(1))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req1"))
+	})
+
+	ginkgo.It("removes entries by app instance id persistently", func() {
+		push("org1", "req1", 0)
+		push("org1", "req2", 0)
+		gomega.Expect(q.Remove("req1")).To(gomega.BeTrue())
+
+		reopen()
+
+		gomega.Expect(q.Len()).To(gomega.Equal(1))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req2"))
+	})
+})
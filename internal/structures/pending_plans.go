@@ -21,11 +21,16 @@ import (
 	"errors"
 	"fmt"
 	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/internal/persistence/app_cluster"
+	"github.com/nalej/derrors"
 	"github.com/rs/zerolog/log"
 	"sync"
+	"time"
 )
 
-// Struct to control Pending deployment plans
+// Struct to control Pending deployment plans. Pending plans can be persisted in the app cluster db
+// so the monitoring of the deployments continues after a restart. Every plan is stored with its deployment
+// request and the state of its monitored fragments.
 type PendingPlans struct {
 	// plan_id -> deployment plan
 	Pending map[string]*entities.DeploymentPlan
@@ -37,6 +42,8 @@ type PendingPlans struct {
 	Apps map[string]string
 	// mutex
 	mu sync.Mutex
+	// database to persist the plans, nil if the plans are only kept in memory
+	db *app_cluster.AppClusterDB
 }
 
 type PendingFragment struct {
@@ -55,6 +62,104 @@ func NewPendingPlans() *PendingPlans {
 	}
 }
 
+// Create a new pending plans structure persisted in the app cluster db. Any plan already stored in the
+// database is loaded.
+// params:
+//  db app cluster db to persist the plans
+// return:
+//  pending plans instance or error if any
+func NewPersistentPendingPlans(db *app_cluster.AppClusterDB) (*PendingPlans, derrors.Error) {
+	toReturn := NewPendingPlans()
+	toReturn.db = db
+	err := toReturn.load()
+	if err != nil {
+		return nil, err
+	}
+	return toReturn, nil
+}
+
+// Load the stored plans into memory.
+func (p *PendingPlans) load() derrors.Error {
+	stored, err := p.db.GetPendingPlans()
+	if err != nil {
+		return err
+	}
+	for _, record := range stored {
+		p.index(record.Plan, record.Fragments)
+	}
+	log.Info().Int("pending plans", len(p.Pending)).Msg("pending plans loaded from local database")
+	return nil
+}
+
+// Add a plan to the in memory indexes monitoring the given fragments. This function is not thread-safe.
+func (p *PendingPlans) index(plan *entities.DeploymentPlan, fragments map[string]bool) {
+	p.Pending[plan.DeploymentId] = plan
+	for _, frag := range plan.Fragments {
+		isPending, monitored := fragments[frag.FragmentId]
+		if !monitored {
+			continue
+		}
+		p.PendingFragments[frag.FragmentId] = &PendingFragment{plan.DeploymentId, isPending}
+		for _, stage := range frag.Stages {
+			for _, serv := range stage.Services {
+				p.PendingService[serv.ServiceId] = frag.FragmentId
+			}
+		}
+		p.Apps[plan.AppInstanceId] = plan.DeploymentId
+	}
+}
+
+// Build the record storing the current state of a plan. This function is not thread-safe.
+// return:
+//  record of the plan, nil if the plan is not pending
+func (p *PendingPlans) record(deploymentId string) *app_cluster.PendingPlanRecord {
+	plan, found := p.Pending[deploymentId]
+	if !found {
+		return nil
+	}
+	record := &app_cluster.PendingPlanRecord{Plan: plan, Fragments: make(map[string]bool, 0)}
+	for _, frag := range plan.Fragments {
+		if pending, monitored := p.PendingFragments[frag.FragmentId]; monitored {
+			record.Fragments[frag.FragmentId] = pending.IsPending
+		}
+	}
+	return record
+}
+
+// Store the current state of a plan, or remove it if it is no longer pending. Persistence errors are logged
+// as the in memory view remains valid. This function is not thread-safe.
+func (p *PendingPlans) persist(deploymentId string) {
+	if p.db == nil {
+		return
+	}
+	record := p.record(deploymentId)
+	if record == nil {
+		if err := p.db.DeletePendingPlan(deploymentId); err != nil {
+			log.Error().Err(err).Str("deploymentId", deploymentId).Msg("impossible to remove stored pending plan")
+		}
+		return
+	}
+	if err := p.db.StorePendingPlan(record); err != nil {
+		log.Error().Err(err).Str("deploymentId", deploymentId).Msg("impossible to store pending plan")
+	}
+}
+
+// Run a function with the current state of a plan. The plan cannot change until the function returns, so the
+// function can store the plan together with other entries like the fragments deployed from it.
+// params:
+//  deploymentId
+//  fn function receiving the record of the plan, nil if the plan is not pending or the plans are not persisted
+// return:
+//  error returned by the function
+func (p *PendingPlans) WithPlanRecord(deploymentId string, fn func(record *app_cluster.PendingPlanRecord) derrors.Error) derrors.Error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db == nil {
+		return fn(nil)
+	}
+	return fn(p.record(deploymentId))
+}
+
 func (p *PendingPlans) AddPendingPlan(plan *entities.DeploymentPlan) {
 	log.Debug().Msgf("add plan of deployment %s to Pending checks", plan.DeploymentId)
 	p.mu.Lock()
@@ -69,6 +174,7 @@ func (p *PendingPlans) AddPendingPlan(plan *entities.DeploymentPlan) {
 			}
 		}
 	}
+	p.persist(plan.DeploymentId)
 	p.printStatus()
 }
 
@@ -103,6 +209,7 @@ func (p *PendingPlans) RemovePendingPlanByApp(appInstanceId string) error {
 	delete(p.Pending, deploymentId)
 	// delete the app
 	delete(p.Apps, deploymentId)
+	p.persist(deploymentId)
 	p.printStatus()
 
 	return nil
@@ -133,6 +240,7 @@ func (p *PendingPlans) RemovePendingPlan(deploymentId string) {
 	delete(p.Pending, deploymentId)
 	// delete the app
 	delete(p.Apps, deploymentId)
+	p.persist(deploymentId)
 	p.printStatus()
 }
 
@@ -161,6 +269,7 @@ func (p *PendingPlans) SetFragmentNoPending(fragmentId string) {
 	defer p.mu.Unlock()
 	// get services Id by checking the corresponding plan
 	p.PendingFragments[fragmentId].IsPending = false
+	p.persist(p.PendingFragments[fragmentId].DeploymentPlanID)
 	p.printStatus()
 }
 
@@ -170,6 +279,7 @@ func (p *PendingPlans) SetFragmentPending(fragmentId string) {
 	defer p.mu.Unlock()
 	// get services Id by checking the corresponding plan
 	p.PendingFragments[fragmentId].IsPending = true
+	p.persist(p.PendingFragments[fragmentId].DeploymentPlanID)
 	p.printStatus()
 }
 
@@ -193,9 +303,119 @@ func (p *PendingPlans) RemoveFragment(fragmentId string) {
 	}
 	// delete the fragment
 	delete(p.PendingFragments, fragmentId)
+	p.persist(pendingPlan.DeploymentPlanID)
 	p.printStatus()
 }
 
+// Get a pending plan.
+// params:
+//  deploymentId
+// return:
+//  pending plan and true if it was found
+func (p *PendingPlans) GetPendingPlan(deploymentId string) (*entities.DeploymentPlan, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	plan, found := p.Pending[deploymentId]
+	return plan, found
+}
+
+// Record a new deployment attempt of a pending plan.
+// params:
+//  deploymentId
+//  retryTime time of the new attempt
+// return:
+//  deployment request to be queued again, nil if the plan is not pending or has no request
+func (p *PendingPlans) RecordRetry(deploymentId string, retryTime time.Time) *entities.DeploymentRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	plan, found := p.Pending[deploymentId]
+	if !found || plan.DeploymentRequest == nil {
+		return nil
+	}
+	plan.DeploymentRequest.NumRetries = plan.DeploymentRequest.NumRetries + 1
+	plan.DeploymentRequest.TimeRetry = &retryTime
+	p.persist(deploymentId)
+	return plan.DeploymentRequest
+}
+
+// Reconcile the pending plans with the deployment fragments stored as deployed. Fragments no longer deployed
+// stop being monitored, the pending flag of the remaining ones is set from their status, and deployed fragments
+// without a pending plan are monitored using a plan rebuilt from the fragments. Plans are stored with the fragments
+// deployed from them, so only fragments stored by previous versions of conductor need a recovered plan. Recovered
+// plans have no deployment request, so they are not retried.
+// params:
+//  deployed fragments currently deployed
+func (p *PendingPlans) Reconcile(deployed []entities.DeploymentFragment) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	deployedPlans := make(map[string][]entities.DeploymentFragment, 0)
+	deployedFragments := make(map[string]entities.DeploymentFragment, len(deployed))
+	for _, f := range deployed {
+		deployedPlans[f.DeploymentId] = append(deployedPlans[f.DeploymentId], f)
+		deployedFragments[f.FragmentId] = f
+	}
+
+	removed, updated, recovered := 0, 0, 0
+	for deploymentId, plan := range p.Pending {
+		for _, frag := range plan.Fragments {
+			pending, monitored := p.PendingFragments[frag.FragmentId]
+			if !monitored {
+				continue
+			}
+			current, isDeployed := deployedFragments[frag.FragmentId]
+			if !isDeployed {
+				p.unmonitor(frag)
+				removed++
+				continue
+			}
+			isPending := current.Status != entities.FRAGMENT_DONE && current.Status != entities.FRAGMENT_TERMINATING
+			if pending.IsPending != isPending {
+				pending.IsPending = isPending
+				updated++
+			}
+		}
+		if _, isDeployed := deployedPlans[deploymentId]; !isDeployed {
+			// nothing of this plan is deployed anymore
+			delete(p.Pending, deploymentId)
+			delete(p.Apps, plan.AppInstanceId)
+		}
+		p.persist(deploymentId)
+	}
+
+	for deploymentId, fragments := range deployedPlans {
+		if _, found := p.Pending[deploymentId]; found {
+			continue
+		}
+		plan := &entities.DeploymentPlan{
+			DeploymentId:   deploymentId,
+			OrganizationId: fragments[0].OrganizationId,
+			AppInstanceId:  fragments[0].AppInstanceId,
+			Fragments:      fragments,
+		}
+		monitored := make(map[string]bool, len(fragments))
+		for _, f := range fragments {
+			monitored[f.FragmentId] = f.Status != entities.FRAGMENT_DONE && f.Status != entities.FRAGMENT_TERMINATING
+		}
+		p.index(plan, monitored)
+		p.persist(deploymentId)
+		recovered++
+	}
+	log.Info().Int("removedFragments", removed).Int("updatedFragments", updated).Int("recoveredPlans", recovered).
+		Msg("pending plans reconciled with the deployed fragments")
+	p.printStatus()
+}
+
+// Stop monitoring a fragment. This function is not thread-safe.
+func (p *PendingPlans) unmonitor(fragment entities.DeploymentFragment) {
+	for _, stage := range fragment.Stages {
+		for _, service := range stage.Services {
+			delete(p.PendingService, service.ServiceId)
+		}
+	}
+	delete(p.PendingFragments, fragment.FragmentId)
+}
+
 func (p *PendingPlans) MonitoredFragment(fragmentID string) bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -207,3 +427,12 @@ func (p *PendingPlans) printStatus() {
 	log.Info().Msgf("%d Pending plans, %d Pending fragments, %d Pending services",
 		len(p.Pending), len(p.PendingFragments), len(p.PendingService))
 }
+
+// Number of monitored plans, fragments and services.
+//  returns:
+//   number of pending plans, pending fragments and pending services
+func (p *PendingPlans) Stats() (int, int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.Pending), len(p.PendingFragments), len(p.PendingService)
+}
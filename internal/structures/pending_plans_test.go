@@ -0,0 +1,183 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package structures
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/internal/persistence/app_cluster"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/conductor/pkg/provider/kv"
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"os"
+	"time"
+)
+
+func pendingTestPlan(deploymentId string, appInstanceId string, fragmentIds ...string) *entities.DeploymentPlan {
+	fragments := make([]entities.DeploymentFragment, len(fragmentIds))
+	for i, id := range fragmentIds {
+		fragments[i] = entities.DeploymentFragment{
+			DeploymentId:  deploymentId,
+			AppInstanceId: appInstanceId,
+			FragmentId:    id,
+			ClusterId:     "cluster1",
+			Stages: []entities.DeploymentStage{{Services: []entities.ServiceInstance{
+				{ServiceId: "service-" + id}}}},
+		}
+	}
+	return &entities.DeploymentPlan{
+		DeploymentId:      deploymentId,
+		AppInstanceId:     appInstanceId,
+		Fragments:         fragments,
+		DeploymentRequest: &entities.DeploymentRequest{RequestId: "request-" + deploymentId, AppInstanceId: appInstanceId},
+	}
+}
+
+var _ = ginkgo.Describe("persistent pending plans", func() {
+
+	var localDB provider.KeyValueProvider
+	var appClusterDB *app_cluster.AppClusterDB
+	var plans *PendingPlans
+	dbPath := "/tmp/persistent_pending_plans_test.db"
+
+	ginkgo.BeforeEach(func() {
+		aux, errDB := kv.NewLocalDB(dbPath)
+		gomega.Expect(errDB).ToNot(gomega.HaveOccurred())
+		localDB = aux
+		appClusterDB = app_cluster.NewAppClusterDB(localDB)
+		loaded, err := NewPersistentPendingPlans(appClusterDB)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		plans = loaded
+	})
+
+	ginkgo.AfterEach(func() {
+		errClose := localDB.Close()
+		gomega.Expect(errClose).ToNot(gomega.HaveOccurred())
+		err := os.Remove(dbPath)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	})
+
+	// Close the current database and load the pending plans again from the same file
+	reopen := func() {
+		errClose := localDB.Close()
+		gomega.Expect(errClose).ToNot(gomega.HaveOccurred())
+		aux, errDB := kv.NewLocalDB(dbPath)
+		gomega.Expect(errDB).ToNot(gomega.HaveOccurred())
+		localDB = aux
+		appClusterDB = app_cluster.NewAppClusterDB(localDB)
+		loaded, err := NewPersistentPendingPlans(appClusterDB)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		plans = loaded
+	}
+
+	ginkgo.It("recovers the monitored fragments after a restart", func() {
+		plans.AddPendingPlan(pendingTestPlan("deployment1", "app1", "fragment1", "fragment2"))
+		plans.SetFragmentNoPending("fragment1")
+		plans.RemoveFragment("fragment2")
+		retry := plans.RecordRetry("deployment1", time.Now())
+		gomega.Expect(retry).NotTo(gomega.BeNil())
+
+		reopen()
+
+		gomega.Expect(plans.MonitoredFragment("fragment1")).To(gomega.BeTrue())
+		gomega.Expect(plans.MonitoredFragment("fragment2")).To(gomega.BeFalse())
+		gomega.Expect(plans.PendingFragments["fragment1"].IsPending).To(gomega.BeFalse())
+		gomega.Expect(plans.PendingService).To(gomega.HaveKey("service-fragment1"))
+		gomega.Expect(plans.PendingService).NotTo(gomega.HaveKey("service-fragment2"))
+		plan, found := plans.GetPendingPlan("deployment1")
+		gomega.Expect(found).To(gomega.BeTrue())
+		gomega.Expect(plan.DeploymentRequest.NumRetries).To(gomega.Equal(int32(1)))
+		gomega.Expect(plan.DeploymentRequest.TimeRetry).NotTo(gomega.BeNil())
+	})
+
+	ginkgo.It("stores the plan with the fragments deployed from it", func() {
+		plan := pendingTestPlan("deployment1", "app1", "fragment1", "fragment2")
+		plans.AddPendingPlan(plan)
+		fragment := plan.Fragments[0]
+		err := plans.WithPlanRecord("deployment1", func(record *app_cluster.PendingPlanRecord) derrors.Error {
+			gomega.Expect(record).NotTo(gomega.BeNil())
+			return appClusterDB.AddDeploymentFragmentWithPlan(&fragment, record)
+		})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		reopen()
+
+		deployed, err := appClusterDB.GetAllFragments()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(deployed).To(gomega.HaveLen(1))
+		plans.Reconcile(deployed)
+		recovered, found := plans.GetPendingPlan("deployment1")
+		gomega.Expect(found).To(gomega.BeTrue())
+		gomega.Expect(recovered.DeploymentRequest).NotTo(gomega.BeNil())
+		gomega.Expect(recovered.DeploymentRequest.RequestId).To(gomega.Equal("request-deployment1"))
+		gomega.Expect(plans.MonitoredFragment("fragment1")).To(gomega.BeTrue())
+		gomega.Expect(plans.RecordRetry("deployment1", time.Now())).NotTo(gomega.BeNil())
+	})
+
+	ginkgo.It("forgets removed plans after a restart", func() {
+		plans.AddPendingPlan(pendingTestPlan("deployment1", "app1", "fragment1"))
+		plans.AddPendingPlan(pendingTestPlan("deployment2", "app2", "fragment2"))
+		plans.RemovePendingPlan("deployment1")
+		err := plans.RemovePendingPlanByApp("app2")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		reopen()
+
+		gomega.Expect(plans.Pending).To(gomega.BeEmpty())
+		gomega.Expect(plans.PendingFragments).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("reconciles the plans with the deployed fragments", func() {
+		plans.AddPendingPlan(pendingTestPlan("deployment1", "app1", "fragment1", "fragment2"))
+		plans.AddPendingPlan(pendingTestPlan("deployment2", "app2", "fragment3"))
+
+		deployed := []entities.DeploymentFragment{
+			// fragment1 finished, fragment2 was never deployed
+			{DeploymentId: "deployment1", AppInstanceId: "app1", FragmentId: "fragment1", Status: entities.FRAGMENT_DONE},
+			// deployment3 is deployed but its plan was lost
+			{DeploymentId: "deployment3", AppInstanceId: "app3", FragmentId: "fragment4", Status: entities.FRAGMENT_DEPLOYING},
+		}
+		plans.Reconcile(deployed)
+
+		gomega.Expect(plans.MonitoredFragment("fragment1")).To(gomega.BeTrue())
+		gomega.Expect(plans.PendingFragments["fragment1"].IsPending).To(gomega.BeFalse())
+		gomega.Expect(plans.MonitoredFragment("fragment2")).To(gomega.BeFalse())
+		gomega.Expect(plans.PendingService).NotTo(gomega.HaveKey("service-fragment2"))
+
+		// nothing of deployment2 is deployed
+		_, found := plans.GetPendingPlan("deployment2")
+		gomega.Expect(found).To(gomega.BeFalse())
+		gomega.Expect(plans.MonitoredFragment("fragment3")).To(gomega.BeFalse())
+
+		// deployment3 is monitored without a request to retry
+		recovered, found := plans.GetPendingPlan("deployment3")
+		gomega.Expect(found).To(gomega.BeTrue())
+		gomega.Expect(recovered.DeploymentRequest).To(gomega.BeNil())
+		gomega.Expect(plans.MonitoredFragment("fragment4")).To(gomega.BeTrue())
+		gomega.Expect(plans.PendingFragments["fragment4"].IsPending).To(gomega.BeTrue())
+		gomega.Expect(plans.RecordRetry("deployment3", time.Now())).To(gomega.BeNil())
+
+		// the reconciled state survives a restart
+		reopen()
+		_, found = plans.GetPendingPlan("deployment2")
+		gomega.Expect(found).To(gomega.BeFalse())
+		gomega.Expect(plans.MonitoredFragment("fragment4")).To(gomega.BeTrue())
+		gomega.Expect(plans.MonitoredFragment("fragment2")).To(gomega.BeFalse())
+	})
+})
@@ -0,0 +1,337 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package structures
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// Name of the bucket used to store the queued requests.
+const PersistentRequestQueueBucket = "requests_queue"
+
+// Queue of deployment requests persisted using a key value provider. Every request is stored
+// using a monotonically increasing sequence number as key. Keys are big endian encoded so the
+// natural ordering of the provider matches the FIFO ordering of the queue. Requests returned by the
+// queue are kept in the database until they are acknowledged or pushed again, so a request being
+// processed when the conductor stops is loaded again on the next start.
+// bucket         --> key         --> value
+// requests_queue --> sequence_0  --> deploymentRequest
+// requests_queue --> sequence_1  --> deploymentRequest
+type PersistentRequestQueue struct {
+	// provider to persist information
+	db provider.KeyValueProvider
+	// in memory view of the queue. This is always consistent with the database.
+	queue []*persistentEntry
+	// keys of the requests returned by the queue and not acknowledged yet
+	inFlight map[*entities.DeploymentRequest][]byte
+	// next sequence number to be assigned
+	nextSeq uint64
+	// time to wait before a retried request is ready again
+	retryDelay time.Duration
+	// notification of new requests
+	signal chan struct{}
+	// Mutex for queue operations
+	mux sync.RWMutex
+}
+
+// Internal entry linking a request with its key in the database.
+type persistentEntry struct {
+	key []byte
+	req *entities.DeploymentRequest
+}
+
+// Create a new persistent queue. Any request already stored in the provider is loaded and kept in the
+// same order it was pushed.
+// params:
+//  db provider to persist the queue
+//  retryDelay time to wait before a retried request is ready again
+// return:
+//  queue instance or error if any
+func NewPersistentRequestQueue(db provider.KeyValueProvider, retryDelay time.Duration) (RequestsQueue, derrors.Error) {
+	toReturn := &PersistentRequestQueue{db: db, queue: make([]*persistentEntry, 0),
+		inFlight: make(map[*entities.DeploymentRequest][]byte, 0), nextSeq: 0, retryDelay: retryDelay, signal: make(chan struct{}, 1)}
+	err := toReturn.load()
+	if err != nil {
+		return nil, err
+	}
+	return toReturn, nil
+}
+
+// Load the stored requests into memory.
+func (q *PersistentRequestQueue) load() derrors.Error {
+	entries, nextSeq, err := loadStoredRequests(q.db)
+	if err != nil {
+		return err
+	}
+	q.queue = append(q.queue, entries...)
+	q.nextSeq = nextSeq
+	log.Info().Int("queued requests", len(q.queue)).Msg("requests queue loaded from local database")
+	return nil
+}
+
+// Load the requests stored in a provider in the order they were pushed.
+//  params:
+//   db provider storing the queue
+//  returns:
+//   stored requests, next sequence number to be assigned or error if any
+func loadStoredRequests(db provider.KeyValueProvider) ([]*persistentEntry, uint64, derrors.Error) {
+	entries := make([]*persistentEntry, 0)
+	if !storedRequestsExist(db) {
+		log.Debug().Msg("no previous requests queue found")
+		return entries, 0, nil
+	}
+	pairs, err := db.GetAllPairsInBucket([]byte(PersistentRequestQueueBucket))
+	if err != nil {
+		return nil, 0, derrors.NewInternalError("impossible to load stored requests queue", err)
+	}
+	nextSeq := uint64(0)
+	for _, pair := range pairs {
+		var req entities.DeploymentRequest
+		if err := json.Unmarshal(pair.Value, &req); err != nil {
+			return nil, 0, derrors.NewInternalError("impossible to unmarshall queued deployment request", err)
+		}
+		entries = append(entries, &persistentEntry{key: pair.Key, req: &req})
+		seq := binary.BigEndian.Uint64(pair.Key)
+		if seq >= nextSeq {
+			nextSeq = seq + 1
+		}
+	}
+	return entries, nextSeq, nil
+}
+
+func storedRequestsExist(db provider.KeyValueProvider) bool {
+	for _, b := range db.GetBuckets() {
+		if bytes.Equal(b, []byte(PersistentRequestQueueBucket)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store a request using its sequence number as key. The previous record of the request, if any, is removed in
+// the same transaction so a crash never leaves both records or none.
+//  params:
+//   db provider storing the queue
+//   seq sequence number of the request
+//   req request to be stored
+//   replaced key of the previous record of the request, nil if there is none
+//  returns:
+//   key of the stored request or error if any
+func storeRequest(db provider.KeyValueProvider, seq uint64, req *entities.DeploymentRequest, replaced []byte) ([]byte, derrors.Error) {
+	value, err := json.Marshal(req)
+	if err != nil {
+		return nil, derrors.NewInternalError("impossible to marshall deployment request", err)
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	dbErr := db.Update(func(tx provider.KeyValueTx) derrors.Error {
+		if err := tx.Put([]byte(PersistentRequestQueueBucket), key, value); err != nil {
+			return err
+		}
+		if replaced == nil {
+			return nil
+		}
+		return tx.Delete([]byte(PersistentRequestQueueBucket), replaced)
+	})
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return key, nil
+}
+
+// Thread-safe method to access queued requests
+func (q *PersistentRequestQueue) NextRequest() *entities.DeploymentRequest {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	toReturn, _ := q.popReady()
+	return toReturn
+}
+
+// Wait until a deployment request is ready to be processed.
+func (q *PersistentRequestQueue) Next(ctx context.Context) *entities.DeploymentRequest {
+	for {
+		q.mux.Lock()
+		toReturn, delay := q.popReady()
+		q.mux.Unlock()
+		if toReturn != nil {
+			return toReturn
+		}
+		if !waitRequest(ctx, q.signal, delay) {
+			return nil
+		}
+	}
+}
+
+// Remove the first ready request from the queue. The request is kept in the database until it is
+// acknowledged. This function is not thread-safe.
+//  returns:
+//   ready request, or nil and the time to wait for the next one (negative if the queue is empty)
+func (q *PersistentRequestQueue) popReady() (*entities.DeploymentRequest, time.Duration) {
+	now := time.Now()
+	minDelay := time.Duration(-1)
+	for i, entry := range q.queue {
+		delay := pendingDelay(entry.req, q.retryDelay, now)
+		if delay <= 0 {
+			q.inFlight[entry.req] = entry.key
+			q.queue = append(q.queue[:i], q.queue[i+1:]...)
+			if len(q.queue) > 0 {
+				// let other consumers check the remaining requests
+				notifyRequest(q.signal)
+			}
+			return entry.req, 0
+		}
+		if minDelay < 0 || delay < minDelay {
+			minDelay = delay
+		}
+	}
+	return nil, minDelay
+}
+
+// Thread-safe function to find whether there are more requests available or not.
+func (q *PersistentRequestQueue) AvailableRequests() bool {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	return len(q.queue) != 0
+}
+
+// Push a new request to the queue for later processing. The request is persisted before
+// being available in memory. Pushing again a request returned by the queue replaces its previous record.
+//  params:
+//   req entry to be enqueued
+func (q *PersistentRequestQueue) PushRequest(req *entities.DeploymentRequest) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	markEnqueued(req)
+	// a request returned by the queue replaces its previous record
+	key, err := storeRequest(q.db, q.nextSeq, req, q.inFlight[req])
+	if err != nil {
+		return err
+	}
+	q.nextSeq = q.nextSeq + 1
+	q.queue = append(q.queue, &persistentEntry{key: key, req: req})
+	delete(q.inFlight, req)
+	notifyRequest(q.signal)
+	return nil
+}
+
+// Acknowledge a processed request removing it from the database.
+//  params:
+//   req request returned by NextRequest or Next
+func (q *PersistentRequestQueue) Ack(req *entities.DeploymentRequest) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.deleteInFlight(req)
+}
+
+// Remove the record of a request returned by the queue. This function is not thread-safe.
+//  params:
+//   req request returned by the queue
+func (q *PersistentRequestQueue) deleteInFlight(req *entities.DeploymentRequest) {
+	key, found := q.inFlight[req]
+	if !found {
+		return
+	}
+	err := q.db.Delete([]byte(PersistentRequestQueueBucket), key)
+	if err != nil {
+		log.Error().Err(err).Str("requestId", req.RequestId).
+			Msg("impossible to remove deployment request from the local database")
+		return
+	}
+	delete(q.inFlight, req)
+}
+
+func (q *PersistentRequestQueue) Clear() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for _, entry := range q.queue {
+		err := q.db.Delete([]byte(PersistentRequestQueueBucket), entry.key)
+		if err != nil {
+			log.Error().Err(err).Str("requestId", entry.req.RequestId).
+				Msg("impossible to remove deployment request from the local database")
+		}
+	}
+	q.queue = nil
+}
+
+func (q *PersistentRequestQueue) Len() int {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	return len(q.queue)
+}
+
+// Time the oldest queued request has been waiting since it was pushed. Requests loaded from the
+// database keep the time they were originally pushed.
+func (q *PersistentRequestQueue) OldestRequestAge() time.Duration {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	now := time.Now()
+	oldest := time.Duration(0)
+	for _, entry := range q.queue {
+		if age := requestAge(entry.req, now); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
+// Remove the entry with the indicated appInstanceId. The records of the requests of the instance that were
+// returned by the queue are removed too, so they are not processed again after a restart.
+// params:
+//  appInstanceId identifier of the instance to be removed
+// returns:
+//  true if a queued entry was removed
+func (q *PersistentRequestQueue) Remove(appInstanceId string) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for req := range q.inFlight {
+		if req.AppInstanceId == appInstanceId {
+			q.deleteInFlight(req)
+		}
+	}
+	targetIndex := -1
+	for i, entry := range q.queue {
+		if entry.req.AppInstanceId == appInstanceId {
+			targetIndex = i
+			break
+		}
+	}
+
+	if targetIndex == -1 {
+		return false
+	}
+
+	err := q.db.Delete([]byte(PersistentRequestQueueBucket), q.queue[targetIndex].key)
+	if err != nil {
+		log.Error().Err(err).Str("appInstanceId", appInstanceId).
+			Msg("impossible to remove deployment request from the local database")
+		return false
+	}
+
+	q.queue = append(q.queue[:targetIndex], q.queue[targetIndex+1:]...)
+	return true
+}
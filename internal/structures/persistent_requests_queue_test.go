@@ -0,0 +1,191 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package structures
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/conductor/pkg/provider/kv"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"os"
+	"time"
+)
+
+var _ = ginkgo.Describe("persistent requests queue", func() {
+
+	var localDB provider.KeyValueProvider
+	var q RequestsQueue
+	dbPath := "/tmp/persistent_requests_queue_test.db"
+
+	ginkgo.BeforeEach(func() {
+		aux, errDB := kv.NewLocalDB(dbPath)
+		gomega.Expect(errDB).ToNot(gomega.HaveOccurred())
+		localDB = aux
+		queue, err := NewPersistentRequestQueue(localDB, time.Minute)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		q = queue
+	})
+
+	ginkgo.AfterEach(func() {
+		errClose := localDB.Close()
+		gomega.Expect(errClose).ToNot(gomega.HaveOccurred())
+		err := os.Remove(dbPath)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	})
+
+	// Close the current database and open the queue again from the same file
+	reopen := func() {
+		errClose := localDB.Close()
+		gomega.Expect(errClose).ToNot(gomega.HaveOccurred())
+		aux, errDB := kv.NewLocalDB(dbPath)
+		gomega.Expect(errDB).ToNot(gomega.HaveOccurred())
+		localDB = aux
+		queue, err := NewPersistentRequestQueue(localDB, time.Minute)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		q = queue
+	}
+
+	ginkgo.It("returns nil when the queue is empty", func() {
+		gomega.Expect(q.AvailableRequests()).To(gomega.BeFalse())
+		gomega.Expect(q.NextRequest()).To(gomega.BeNil())
+	})
+
+	ginkgo.It("keeps FIFO order", func() {
+		for _, id := range []string{"req1", "req2", "req3"} {
+			err := q.PushRequest(&entities.DeploymentRequest{RequestId: id, AppInstanceId: id})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		}
+		gomega.Expect(q.Len()).To(gomega.Equal(3))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req1"))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req2"))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req3"))
+		gomega.Expect(q.AvailableRequests()).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("reloads the queue with retries after reopening the database", func() {
+		retryTime := time.Now().Add(-time.Hour).Round(time.Second)
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		err = q.PushRequest(&entities.DeploymentRequest{RequestId: "req2", AppInstanceId: "app2",
+			NumRetries: 2, TimeRetry: &retryTime})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		err = q.PushRequest(&entities.DeploymentRequest{RequestId: "req3", AppInstanceId: "app3"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		// consume the first one before restarting
+		consumed := q.NextRequest()
+		gomega.Expect(consumed.RequestId).To(gomega.Equal("req1"))
+		q.Ack(consumed)
+
+		reopen()
+
+		gomega.Expect(q.Len()).To(gomega.Equal(2))
+		retried := q.NextRequest()
+		gomega.Expect(retried.RequestId).To(gomega.Equal("req2"))
+		gomega.Expect(retried.NumRetries).To(gomega.Equal(int32(2)))
+		gomega.Expect(retried.TimeRetry.Equal(retryTime)).To(gomega.BeTrue())
+
+		// new entries go after the reloaded ones
+		err = q.PushRequest(&entities.DeploymentRequest{RequestId: "req4", AppInstanceId: "app4"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req3"))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req4"))
+	})
+
+	ginkgo.It("keeps the requests being processed until they are acknowledged", func() {
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		err = q.PushRequest(&entities.DeploymentRequest{RequestId: "req2", AppInstanceId: "app2"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req1"))
+		acked := q.NextRequest()
+		gomega.Expect(acked.RequestId).To(gomega.Equal("req2"))
+		q.Ack(acked)
+		gomega.Expect(q.Len()).To(gomega.Equal(0))
+
+		// the conductor stops while processing req1
+		reopen()
+
+		gomega.Expect(q.Len()).To(gomega.Equal(1))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req1"))
+	})
+
+	ginkgo.It("replaces the record of a request pushed again", func() {
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		retried := q.NextRequest()
+		retried.NumRetries = 1
+		err = q.PushRequest(retried)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		// acknowledging a request that was pushed again does not remove it
+		q.Ack(retried)
+
+		reopen()
+
+		gomega.Expect(q.Len()).To(gomega.Equal(1))
+		gomega.Expect(q.NextRequest().NumRetries).To(gomega.Equal(int32(1)))
+	})
+
+	ginkgo.It("removes the requests being processed of a removed instance", func() {
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req1"))
+		gomega.Expect(q.Remove("app1")).To(gomega.BeFalse())
+
+		reopen()
+
+		gomega.Expect(q.Len()).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("keeps the age of the queued requests after reopening the database", func() {
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		time.Sleep(time.Millisecond * 100)
+
+		reopen()
+
+		gomega.Expect(q.OldestRequestAge() >= time.Millisecond*100).To(gomega.BeTrue())
+		gomega.Expect(q.NextRequest().EnqueuedAt).ToNot(gomega.BeNil())
+		gomega.Expect(q.OldestRequestAge()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("removes entries by app instance id persistently", func() {
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		err = q.PushRequest(&entities.DeploymentRequest{RequestId: "req2", AppInstanceId: "app2"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		gomega.Expect(q.Remove("app1")).To(gomega.BeTrue())
+		gomega.Expect(q.Remove("notthere")).To(gomega.BeFalse())
+
+		reopen()
+
+		gomega.Expect(q.Len()).To(gomega.Equal(1))
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("req2"))
+	})
+
+	ginkgo.It("clears the stored queue", func() {
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		q.Clear()
+
+		reopen()
+
+		gomega.Expect(q.Len()).To(gomega.Equal(0))
+	})
+})
@@ -0,0 +1,371 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package structures
+
+import (
+	"fmt"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+)
+
+// Maximum number of nodes explored by the placement solver. When reached the best placement found so far is
+// returned.
+const MaxPlacementSolverNodes = 200000
+
+// The placement solver assigns the groups of an application to clusters using a branch and bound search over the
+// groups x clusters matrix. A set of groups fits into a cluster when the musician score for the combination is not
+// negative. If the musician did not score a combination, the set is considered not to fit as the capacity it
+// consumes is unknown. The solver maximizes the number of allocated replicas first and the sum of scores second. Clusters
+// and groups are explored in a fixed order so the same input always produces the same placement.
+
+// Set of groups placed together in the same clusters.
+type placementUnit struct {
+	// groups in the unit
+	groups []entities.ServiceGroup
+	// names of the groups in the unit
+	names []string
+	// key of the score for the unit
+	key string
+	// number of clusters required
+	needed int
+	// the unit is replicated in as many clusters as possible
+	multiCluster bool
+	// the unit cannot share cluster with any other separated group
+	separated bool
+	// clusters where the unit fits sorted by score
+	candidates []string
+	// upper bound of the score of this unit
+	maxScore float64
+}
+
+// Value of a placement.
+type placementValue struct {
+	replicas int
+	score    float64
+}
+
+// Check if a placement value is better than other one.
+func (v placementValue) betterThan(other placementValue) bool {
+	if v.replicas != other.replicas {
+		return v.replicas > other.replicas
+	}
+	return v.score > other.score
+}
+
+type placementSolver struct {
+	dm    *DeploymentMatrix
+	units []*placementUnit
+	// names of the groups assigned to every cluster by the solver
+	// cluster id -> [groupNameA, groupNameB...]
+	assigned map[string][]string
+	// clusters running a group with a separate clusters policy
+	// cluster id -> service group id
+	separatedHosts map[string]string
+	// clusters chosen for every unit in the current branch
+	current [][]string
+	// best solution found
+	best      [][]string
+	bestValue placementValue
+	found     bool
+	// number of explored nodes
+	nodes   int
+	aborted bool
+}
+
+// Find the placement of a set of groups maximizing the number of replicas and the score, respecting the scores of
+// the combinations of groups in every cluster and the collocation policies. The deployment matrix is updated with
+// the resulting allocation.
+// params:
+//  groups service groups to be placed
+// return:
+//  map with the sorted list of clusters for every service group id or error if no placement was found
+func (dm *DeploymentMatrix) FindOptimalPlacement(groups []entities.ServiceGroup) (map[string][]string, derrors.Error) {
+	solver := newPlacementSolver(dm, groups)
+	for _, u := range solver.units {
+		if !u.multiCluster && len(u.candidates) < u.needed {
+			return nil, derrors.NewUnavailableError(fmt.Sprintf(
+				"only %d clusters can host groups %v out of the %d desired", len(u.candidates), u.names, u.needed))
+		}
+	}
+
+	solver.search(0, placementValue{})
+	if !solver.found {
+		return nil, derrors.NewFailedPreconditionError(fmt.Sprintf(
+			"no placement satisfies the capacity and collocation constraints of %d groups", len(groups)))
+	}
+	if solver.aborted {
+		log.Warn().Int("nodes", solver.nodes).Msg("placement search stopped before completion, using the best placement found")
+	}
+	log.Debug().Int("nodes", solver.nodes).Int("replicas", solver.bestValue.replicas).
+		Float64("score", solver.bestValue.score).Msg("placement solver finished")
+
+	// every group of a unit takes as many of the best clusters of the unit as replicas it requires
+	toReturn := make(map[string][]string, 0)
+	for i, u := range solver.units {
+		clusters := append([]string{}, solver.best[i]...)
+		sort.Slice(clusters, func(a, b int) bool {
+			scoreA := solver.unitScore(u, clusters[a])
+			scoreB := solver.unitScore(u, clusters[b])
+			if scoreA != scoreB {
+				return scoreA > scoreB
+			}
+			return clusters[a] < clusters[b]
+		})
+		placement := make(map[string][]string, 0)
+		for _, g := range u.groups {
+			groupClusters := make([]string, 0)
+			desired := dm.desiredReplicas(g)
+			for _, clusterId := range clusters {
+				if len(groupClusters) < desired && !containsGroup(dm.GroupsCluster[clusterId], g.ServiceGroupId) {
+					groupClusters = append(groupClusters, clusterId)
+					placement[clusterId] = append(placement[clusterId], g.ServiceGroupId)
+				}
+			}
+			sort.Strings(groupClusters)
+			toReturn[g.ServiceGroupId] = groupClusters
+		}
+		for _, clusterId := range clusters {
+			if groupIds, found := placement[clusterId]; found {
+				dm.allocateGroups(clusterId, groupIds)
+			}
+		}
+	}
+	return toReturn, nil
+}
+
+// Build the solver for a set of groups. Groups with a same cluster policy form a single unit.
+func newPlacementSolver(dm *DeploymentMatrix, groups []entities.ServiceGroup) *placementSolver {
+	solver := &placementSolver{
+		dm:             dm,
+		units:          make([]*placementUnit, 0),
+		assigned:       make(map[string][]string, 0),
+		separatedHosts: make(map[string]string, 0),
+	}
+
+	collocated := make([]entities.ServiceGroup, 0)
+	for _, g := range groups {
+		if g.Policy == entities.SameCluster {
+			collocated = append(collocated, g)
+		} else {
+			solver.addUnit([]entities.ServiceGroup{g})
+		}
+		if g.Policy == entities.SeparateClusters {
+			for clusterId, groupIds := range dm.GroupsCluster {
+				if containsGroup(groupIds, g.ServiceGroupId) {
+					solver.separatedHosts[clusterId] = g.ServiceGroupId
+				}
+			}
+		}
+	}
+	if len(collocated) > 0 {
+		solver.addUnit(collocated)
+	}
+
+	// most constrained units first
+	sort.SliceStable(solver.units, func(i, j int) bool {
+		if len(solver.units[i].candidates) != len(solver.units[j].candidates) {
+			return len(solver.units[i].candidates) < len(solver.units[j].candidates)
+		}
+		return solver.units[i].key < solver.units[j].key
+	})
+	solver.current = make([][]string, len(solver.units))
+	return solver
+}
+
+// Add a unit to be placed if it requires any additional replica.
+func (s *placementSolver) addUnit(groups []entities.ServiceGroup) {
+	u := &placementUnit{groups: groups, names: make([]string, len(groups)), key: s.dm.generateGroupId(groups)}
+	var specReplicas int32 = 0
+	for i, g := range groups {
+		u.names[i] = g.Name
+		u.multiCluster = u.multiCluster || g.Specs.MultiClusterReplica
+		u.separated = g.Policy == entities.SeparateClusters
+		if g.Specs.Replicas > specReplicas {
+			specReplicas = g.Specs.Replicas
+		}
+	}
+
+	alreadyAllocated := 0
+	candidates := make([]string, 0)
+	for clusterId, clusterScore := range s.dm.AllocatedScore {
+		allDeployed := true
+		for _, g := range groups {
+			if !containsGroup(s.dm.GroupsCluster[clusterId], g.ServiceGroupId) {
+				allDeployed = false
+				break
+			}
+		}
+		if allDeployed {
+			alreadyAllocated = alreadyAllocated + 1
+			continue
+		}
+		if score, found := clusterScore.Scores[u.key]; found && score >= 0 {
+			candidates = append(candidates, clusterId)
+		}
+	}
+	if u.multiCluster {
+		u.needed = len(s.dm.AllocatedScore) - alreadyAllocated
+	} else {
+		u.needed = int(specReplicas) - alreadyAllocated
+	}
+	if u.needed <= 0 {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		scoreI := s.unitScore(u, candidates[i])
+		scoreJ := s.unitScore(u, candidates[j])
+		if scoreI != scoreJ {
+			return scoreI > scoreJ
+		}
+		return candidates[i] < candidates[j]
+	})
+	u.candidates = candidates
+	for i := 0; i < len(candidates) && i < u.needed; i++ {
+		u.maxScore = u.maxScore + s.unitScore(u, candidates[i])
+	}
+	s.units = append(s.units, u)
+}
+
+// Score of a unit in a cluster.
+func (s *placementSolver) unitScore(u *placementUnit, clusterId string) float64 {
+	return float64(s.dm.AllocatedScore[clusterId].Scores[u.key])
+}
+
+// Maximum number of replicas a unit can allocate.
+func (u *placementUnit) maxReplicas() int {
+	if u.needed < len(u.candidates) {
+		return u.needed
+	}
+	return len(u.candidates)
+}
+
+// Check if a unit fits into a cluster with the groups already assigned by the solver.
+func (s *placementSolver) fits(u *placementUnit, clusterId string) bool {
+	if u.separated {
+		if _, found := s.separatedHosts[clusterId]; found {
+			return false
+		}
+	}
+	assigned := s.assigned[clusterId]
+	if len(assigned) == 0 {
+		return true
+	}
+	names := append(append([]string{}, assigned...), u.names...)
+	sort.Strings(names)
+	score, found := s.dm.AllocatedScore[clusterId].Scores[strings.Join(names, "")]
+	return found && score >= 0
+}
+
+// Explore the placements for the units starting at the given index.
+func (s *placementSolver) search(index int, value placementValue) {
+	s.nodes = s.nodes + 1
+	if s.nodes > MaxPlacementSolverNodes {
+		s.aborted = true
+		return
+	}
+	if index == len(s.units) {
+		if !s.found || value.betterThan(s.bestValue) {
+			s.found = true
+			s.bestValue = value
+			s.best = make([][]string, len(s.current))
+			for i, clusters := range s.current {
+				s.best[i] = append([]string{}, clusters...)
+			}
+		}
+		return
+	}
+	if s.found && !s.upperBound(index, value).betterThan(s.bestValue) {
+		return
+	}
+
+	u := s.units[index]
+	available := make([]string, 0, len(u.candidates))
+	for _, clusterId := range u.candidates {
+		if s.fits(u, clusterId) {
+			available = append(available, clusterId)
+		}
+	}
+	sizes := []int{u.needed}
+	if u.multiCluster {
+		// best effort, try first with as many replicas as possible
+		sizes = make([]int, 0)
+		for size := u.maxReplicas(); size >= 0; size-- {
+			sizes = append(sizes, size)
+		}
+	}
+
+	for _, size := range sizes {
+		forEachSubset(available, size, func(clusters []string) bool {
+			added := placementValue{replicas: value.replicas + len(clusters), score: value.score}
+			for _, clusterId := range clusters {
+				added.score = added.score + s.unitScore(u, clusterId)
+				s.assigned[clusterId] = append(s.assigned[clusterId], u.names...)
+				if u.separated {
+					s.separatedHosts[clusterId] = u.groups[0].ServiceGroupId
+				}
+			}
+			s.current[index] = clusters
+			s.search(index+1, added)
+			for _, clusterId := range clusters {
+				s.assigned[clusterId] = s.assigned[clusterId][:len(s.assigned[clusterId])-len(u.names)]
+				if u.separated {
+					delete(s.separatedHosts, clusterId)
+				}
+			}
+			s.current[index] = nil
+			return !s.aborted
+		})
+		if s.aborted {
+			return
+		}
+	}
+}
+
+// Compute the best value that could be reached from the given index.
+func (s *placementSolver) upperBound(index int, value placementValue) placementValue {
+	for _, u := range s.units[index:] {
+		value.replicas = value.replicas + u.maxReplicas()
+		value.score = value.score + u.maxScore
+	}
+	return value
+}
+
+// Call a function with every subset of the given size keeping the order of the items. The iteration stops
+// when the function returns false.
+func forEachSubset(items []string, size int, fn func([]string) bool) bool {
+	chosen := make([]string, 0, size)
+	var visit func(start int) bool
+	visit = func(start int) bool {
+		if len(chosen) == size {
+			return fn(append([]string{}, chosen...))
+		}
+		for i := start; i <= len(items)-(size-len(chosen)); i++ {
+			chosen = append(chosen, items[i])
+			if !visit(i + 1) {
+				return false
+			}
+			chosen = chosen[:len(chosen)-1]
+		}
+		return true
+	}
+	return visit(0)
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package structures
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("placement solver", func() {
+
+	// Build a deployment score where every cluster contains the scores indicated by the map
+	// cluster id -> group key -> score
+	buildScore := func(scores map[string]map[string]float32) entities.DeploymentScore {
+		toReturn := entities.NewClustersScore()
+		for clusterId, groupScores := range scores {
+			clusterScore := entities.NewClusterDeploymentScore(clusterId)
+			for key, value := range groupScores {
+				clusterScore.Scores[key] = value
+			}
+			toReturn.AddClusterScore(clusterScore)
+		}
+		return toReturn
+	}
+
+	newGroup := func(name string, replicas int32, policy entities.CollocationPolicy) entities.ServiceGroup {
+		return entities.ServiceGroup{ServiceGroupId: "id" + name, Name: name, Policy: policy,
+			Specs: entities.ServiceGroupDeploymentSpecs{Replicas: replicas}}
+	}
+
+	ginkgo.It("respects the capacity consumed by other groups of the application", func() {
+		// The greedy approach places A and B in cluster1 although they do not fit together
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"A": 0.9, "B": 0.9, "AB": -1},
+			"cluster2": {"A": 0.1, "B": 0.2, "AB": 0.05},
+		})
+		dm := NewDeploymentMatrix(score, nil)
+		placement, err := dm.FindOptimalPlacement([]entities.ServiceGroup{newGroup("A", 1, 0), newGroup("B", 1, 0)})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(placement).To(gomega.HaveLen(2))
+		gomega.Expect(placement["idA"]).ToNot(gomega.Equal(placement["idB"]))
+		gomega.Expect(placement["idA"]).To(gomega.HaveLen(1))
+		gomega.Expect(placement["idB"]).To(gomega.HaveLen(1))
+		// B has the largest score in cluster2
+		gomega.Expect(placement["idA"]).To(gomega.Equal([]string{"cluster1"}))
+		gomega.Expect(placement["idB"]).To(gomega.Equal([]string{"cluster2"}))
+	})
+
+	ginkgo.It("maximizes the score of all the groups", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"A": 0.9, "B": 0.5, "AB": -1},
+			"cluster2": {"A": 0.8, "B": 0.1, "AB": -1},
+		})
+		dm := NewDeploymentMatrix(score, nil)
+		placement, err := dm.FindOptimalPlacement([]entities.ServiceGroup{newGroup("A", 1, 0), newGroup("B", 1, 0)})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		// 0.8 + 0.5 is better than 0.9 + 0.1
+		gomega.Expect(placement["idA"]).To(gomega.Equal([]string{"cluster2"}))
+		gomega.Expect(placement["idB"]).To(gomega.Equal([]string{"cluster1"}))
+	})
+
+	ginkgo.It("produces the same placement when clusters are tied", func() {
+		scores := map[string]map[string]float32{
+			"cluster1": {"A": 0.5},
+			"cluster2": {"A": 0.5},
+			"cluster3": {"A": 0.5},
+		}
+		for i := 0; i < 10; i++ {
+			dm := NewDeploymentMatrix(buildScore(scores), nil)
+			placement, err := dm.FindOptimalPlacement([]entities.ServiceGroup{newGroup("A", 2, 0)})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(placement["idA"]).To(gomega.Equal([]string{"cluster1", "cluster2"}))
+		}
+	})
+
+	ginkgo.It("honours the collocation policies", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"A": 0.9, "B": 0.9, "C": 0.9, "D": 0.9, "AB": 0.8, "ABC": 0.5, "CD": 0.5},
+			"cluster2": {"A": 0.9, "B": 0.9, "C": 0.9, "D": 0.9, "AB": -1, "CD": 0.5},
+			"cluster3": {"A": 0.9, "B": 0.9, "C": 0.1, "D": 0.9, "AB": 0.4},
+		})
+		dm := NewDeploymentMatrix(score, nil)
+		placement, err := dm.FindOptimalPlacement([]entities.ServiceGroup{
+			newGroup("A", 1, entities.SameCluster), newGroup("B", 1, entities.SameCluster),
+			newGroup("C", 1, entities.SeparateClusters), newGroup("D", 1, entities.SeparateClusters)})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(placement["idA"]).To(gomega.Equal(placement["idB"]))
+		gomega.Expect(placement["idC"]).To(gomega.HaveLen(1))
+		gomega.Expect(placement["idD"]).To(gomega.HaveLen(1))
+		gomega.Expect(placement["idC"]).ToNot(gomega.Equal(placement["idD"]))
+		gomega.Expect(dm.GroupsCluster[placement["idA"][0]]).To(gomega.ContainElement("idA"))
+		gomega.Expect(dm.GroupsCluster[placement["idA"][0]]).To(gomega.ContainElement("idB"))
+	})
+
+	ginkgo.It("places every collocated group according to its own number of replicas", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"A": 0.9, "B": 0.9, "AB": 0.3},
+			"cluster2": {"A": 0.9, "B": 0.9, "AB": 0.8},
+			"cluster3": {"A": 0.9, "B": 0.9, "AB": 0.5},
+		})
+		dm := NewDeploymentMatrix(score, nil)
+		placement, err := dm.FindOptimalPlacement([]entities.ServiceGroup{
+			newGroup("A", 1, entities.SameCluster), newGroup("B", 3, entities.SameCluster)})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(placement["idA"]).To(gomega.Equal([]string{"cluster2"}))
+		gomega.Expect(placement["idB"]).To(gomega.Equal([]string{"cluster1", "cluster2", "cluster3"}))
+		gomega.Expect(dm.GroupsCluster["cluster2"]).To(gomega.ConsistOf("idA", "idB"))
+		gomega.Expect(dm.GroupsCluster["cluster1"]).To(gomega.ConsistOf("idB"))
+	})
+
+	ginkgo.It("places several groups in a cluster using the score of their combination", func() {
+		// scores of every combination as returned by the musician of a single cluster
+		clusterScore := entities.NewClusterDeploymentScore("cluster1")
+		clusterScore.AddScore([]string{"A"}, 0.9)
+		clusterScore.AddScore([]string{"B"}, 0.5)
+		clusterScore.AddScore([]string{"B", "A"}, 0.3)
+		score := entities.NewClustersScore()
+		score.AddClusterScore(clusterScore)
+
+		dm := NewDeploymentMatrix(score, nil)
+		placement, err := dm.FindOptimalPlacement([]entities.ServiceGroup{newGroup("A", 1, 0), newGroup("B", 1, 0)})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(placement["idA"]).To(gomega.Equal([]string{"cluster1"}))
+		gomega.Expect(placement["idB"]).To(gomega.Equal([]string{"cluster1"}))
+		gomega.Expect(dm.GroupsCluster["cluster1"]).To(gomega.ConsistOf("idA", "idB"))
+	})
+
+	ginkgo.It("does not place groups together when their combination was not scored", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"A": 0.9, "B": 0.5},
+		})
+		dm := NewDeploymentMatrix(score, nil)
+		_, err := dm.FindOptimalPlacement([]entities.ServiceGroup{newGroup("A", 1, 0), newGroup("B", 1, 0)})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("fails when the groups do not fit", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"A": 0.9, "B": 0.9, "AB": -1},
+		})
+		dm := NewDeploymentMatrix(score, nil)
+		_, err := dm.FindOptimalPlacement([]entities.ServiceGroup{newGroup("A", 1, 0), newGroup("B", 1, 0)})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+
+		dm = NewDeploymentMatrix(score, nil)
+		_, err = dm.FindOptimalPlacement([]entities.ServiceGroup{newGroup("A", 2, 0)})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("replicates multi cluster groups in as many clusters as possible", func() {
+		score := buildScore(map[string]map[string]float32{
+			"cluster1": {"A": 0.9, "B": 0.9, "AB": -1},
+			"cluster2": {"A": 0.5, "B": 0.5, "AB": 0.2},
+			"cluster3": {"A": 0.5},
+		})
+		multi := newGroup("A", 0, 0)
+		multi.Specs.MultiClusterReplica = true
+		dm := NewDeploymentMatrix(score, nil)
+		placement, err := dm.FindOptimalPlacement([]entities.ServiceGroup{multi, newGroup("B", 1, 0)})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(placement["idA"]).To(gomega.Equal([]string{"cluster1", "cluster2", "cluster3"}))
+		gomega.Expect(placement["idB"]).To(gomega.Equal([]string{"cluster2"}))
+	})
+})
@@ -18,8 +18,10 @@
 package structures
 
 import (
+	"context"
 	"github.com/nalej/conductor/internal/entities"
 	"sync"
+	"time"
 )
 
 // Interface for a queue storing deployment requests
@@ -30,6 +32,14 @@ type RequestsQueue interface {
 	//   next deployment request, nil if nothing is ready
 	NextRequest() *entities.DeploymentRequest
 
+	// Wait until a deployment request is ready to be processed. Requests waiting for a retry are
+	// not returned until the retry delay of the queue has expired.
+	//  params:
+	//   ctx context to stop waiting
+	//  returns:
+	//   next deployment request, nil if the context is done
+	Next(ctx context.Context) *entities.DeploymentRequest
+
 	// Check if there are more available requests.
 	AvailableRequests() bool
 
@@ -40,6 +50,12 @@ type RequestsQueue interface {
 	//   error if any
 	PushRequest(req *entities.DeploymentRequest) error
 
+	// Acknowledge that a request returned by the queue has been processed. Persistent queues keep the
+	// request until it is acknowledged or pushed again, so it can be processed again after a restart.
+	//  params:
+	//   req request returned by NextRequest or Next
+	Ack(req *entities.DeploymentRequest)
+
 	// Remove the entry with the indicated appInstanceId.
 	// params:
 	//  appInstanceId identifier of the instance to be removed
@@ -52,18 +68,107 @@ type RequestsQueue interface {
 
 	// queue length
 	Len() int
+
+	// Time the oldest queued request has been waiting since it was pushed.
+	//  returns:
+	//   age of the oldest request, zero if the queue is empty
+	OldestRequestAge() time.Duration
+}
+
+// Compute how long a request has been queued.
+//  params:
+//   req queued request
+//   now current time
+//  returns:
+//   time since the request was pushed, zero if unknown
+func requestAge(req *entities.DeploymentRequest, now time.Time) time.Duration {
+	if req.EnqueuedAt == nil {
+		return 0
+	}
+	return now.Sub(*req.EnqueuedAt)
+}
+
+// Set the enqueue time of a request being pushed for the first time. Retries keep the original time so the age
+// of the request covers all its attempts.
+//  params:
+//   req request to be pushed
+func markEnqueued(req *entities.DeploymentRequest) {
+	if req.EnqueuedAt != nil {
+		return
+	}
+	now := time.Now()
+	req.EnqueuedAt = &now
+}
+
+// Compute how long a request has to wait before being processed. Requests that were never retried
+// are ready immediately.
+//  params:
+//   req request to be checked
+//   retryDelay time to wait between retries
+//   now current time
+//  returns:
+//   remaining time to wait, zero or negative if ready
+func pendingDelay(req *entities.DeploymentRequest, retryDelay time.Duration, now time.Time) time.Duration {
+	if req.NumRetries == 0 || req.TimeRetry == nil {
+		return 0
+	}
+	return req.TimeRetry.Add(retryDelay).Sub(now)
+}
+
+// Wake up a waiting consumer without blocking the producer.
+//  params:
+//   signal notification channel of the queue
+func notifyRequest(signal chan struct{}) {
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
+}
+
+// Block until the queue is notified, the indicated delay expires or the context is done.
+//  params:
+//   ctx context to stop waiting
+//   signal notification channel of the queue
+//   delay time to wait for the next retry, negative if there is nothing to wait for
+//  returns:
+//   false if the context is done
+func waitRequest(ctx context.Context, signal chan struct{}, delay time.Duration) bool {
+	var timeout <-chan time.Time
+	if delay >= 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-signal:
+		return true
+	case <-timeout:
+		return true
+	}
 }
 
 // Basic queue in memory solution.
 type MemoryRequestQueue struct {
 	// queue for incoming messages
 	queue []*entities.DeploymentRequest
+	// time to wait before a retried request is ready again
+	retryDelay time.Duration
+	// notification of new requests
+	signal chan struct{}
 	// Mutex for queue operations
 	mux sync.RWMutex
 }
 
-func NewMemoryRequestQueue() RequestsQueue {
-	toReturn := MemoryRequestQueue{queue: make([]*entities.DeploymentRequest, 0)}
+// Create a new queue in memory.
+//  params:
+//   retryDelay time to wait before a retried request is ready again
+//  returns:
+//   queue instance
+func NewMemoryRequestQueue(retryDelay time.Duration) RequestsQueue {
+	toReturn := MemoryRequestQueue{queue: make([]*entities.DeploymentRequest, 0), retryDelay: retryDelay,
+		signal: make(chan struct{}, 1)}
 	return &toReturn
 }
 
@@ -71,18 +176,46 @@ func NewMemoryRequestQueue() RequestsQueue {
 func (q *MemoryRequestQueue) NextRequest() *entities.DeploymentRequest {
 	q.mux.Lock()
 	defer q.mux.Unlock()
-	if len(q.queue) == 0 {
-		return nil
-	}
+	toReturn, _ := q.popReady()
+	return toReturn
+}
 
-	toReturn := q.queue[0]
-	if len(q.queue) == 1 {
-		q.queue = nil
-	} else {
-		q.queue = q.queue[1:]
+// Wait until a deployment request is ready to be processed.
+func (q *MemoryRequestQueue) Next(ctx context.Context) *entities.DeploymentRequest {
+	for {
+		q.mux.Lock()
+		toReturn, delay := q.popReady()
+		q.mux.Unlock()
+		if toReturn != nil {
+			return toReturn
+		}
+		if !waitRequest(ctx, q.signal, delay) {
+			return nil
+		}
 	}
+}
 
-	return toReturn
+// Remove the first ready request from the queue. This function is not thread-safe.
+//  returns:
+//   ready request, or nil and the time to wait for the next one (negative if the queue is empty)
+func (q *MemoryRequestQueue) popReady() (*entities.DeploymentRequest, time.Duration) {
+	now := time.Now()
+	minDelay := time.Duration(-1)
+	for i, req := range q.queue {
+		delay := pendingDelay(req, q.retryDelay, now)
+		if delay <= 0 {
+			q.queue = append(q.queue[:i], q.queue[i+1:]...)
+			if len(q.queue) > 0 {
+				// let other consumers check the remaining requests
+				notifyRequest(q.signal)
+			}
+			return req, 0
+		}
+		if minDelay < 0 || delay < minDelay {
+			minDelay = delay
+		}
+	}
+	return nil, minDelay
 }
 
 // Thread-safe function to find whether there are more requests available or not.
@@ -99,10 +232,15 @@ func (q *MemoryRequestQueue) AvailableRequests() bool {
 func (q *MemoryRequestQueue) PushRequest(req *entities.DeploymentRequest) error {
 	q.mux.Lock()
 	defer q.mux.Unlock()
+	markEnqueued(req)
 	q.queue = append(q.queue, req)
+	notifyRequest(q.signal)
 	return nil
 }
 
+// Acknowledge a processed request. Requests in memory are forgotten as soon as they are returned.
+func (q *MemoryRequestQueue) Ack(req *entities.DeploymentRequest) {}
+
 func (q *MemoryRequestQueue) Clear() {
 	q.mux.Lock()
 	defer q.mux.Unlock()
@@ -115,6 +253,20 @@ func (q *MemoryRequestQueue) Len() int {
 	return len(q.queue)
 }
 
+// Time the oldest queued request has been waiting since it was pushed.
+func (q *MemoryRequestQueue) OldestRequestAge() time.Duration {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	now := time.Now()
+	oldest := time.Duration(0)
+	for _, req := range q.queue {
+		if age := requestAge(req, now); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
 // Remove the entry with the indicated appInstanceId.
 // params:
 //  appInstanceId identifier of the instance to be removed
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package structures
+
+import (
+	"context"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"time"
+)
+
+var _ = ginkgo.Describe("memory requests queue", func() {
+
+	retryDelay := time.Millisecond * 300
+	var q RequestsQueue
+
+	ginkgo.BeforeEach(func() {
+		q = NewMemoryRequestQueue(retryDelay)
+	})
+
+	ginkgo.It("wakes up a waiting consumer when a request is pushed", func() {
+		go func() {
+			time.Sleep(time.Millisecond * 100)
+			err := q.PushRequest(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		next := q.Next(ctx)
+		gomega.Expect(next).ToNot(gomega.BeNil())
+		gomega.Expect(next.RequestId).To(gomega.Equal("req1"))
+	})
+
+	ginkgo.It("stops waiting when the context is done", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		gomega.Expect(q.Next(ctx)).To(gomega.BeNil())
+	})
+
+	ginkgo.It("holds retried requests until the retry delay expires", func() {
+		failed := time.Now()
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: "retry", AppInstanceId: "app1",
+			NumRetries: 1, TimeRetry: &failed})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		err = q.PushRequest(&entities.DeploymentRequest{RequestId: "new", AppInstanceId: "app2"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		// new requests are not blocked by pending retries
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("new"))
+		gomega.Expect(q.NextRequest()).To(gomega.BeNil())
+		gomega.Expect(q.AvailableRequests()).To(gomega.BeTrue())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		next := q.Next(ctx)
+		gomega.Expect(next).ToNot(gomega.BeNil())
+		gomega.Expect(next.RequestId).To(gomega.Equal("retry"))
+		gomega.Expect(time.Since(failed) >= retryDelay).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("reports the age of the oldest queued request", func() {
+		gomega.Expect(q.OldestRequestAge()).To(gomega.BeZero())
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: "old", AppInstanceId: "app1"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		time.Sleep(time.Millisecond * 100)
+		err = q.PushRequest(&entities.DeploymentRequest{RequestId: "new", AppInstanceId: "app2"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(q.OldestRequestAge() >= time.Millisecond*100).To(gomega.BeTrue())
+
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("old"))
+		gomega.Expect(q.OldestRequestAge() < time.Millisecond*100).To(gomega.BeTrue())
+		gomega.Expect(q.NextRequest().RequestId).To(gomega.Equal("new"))
+		gomega.Expect(q.OldestRequestAge()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("keeps the age of a request when it is retried", func() {
+		err := q.PushRequest(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		req := q.NextRequest()
+		enqueuedAt := *req.EnqueuedAt
+		time.Sleep(time.Millisecond * 100)
+
+		failed := time.Now()
+		req.NumRetries = 1
+		req.TimeRetry = &failed
+		err = q.PushRequest(req)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(*req.EnqueuedAt).To(gomega.Equal(enqueuedAt))
+		gomega.Expect(q.OldestRequestAge() >= time.Millisecond*100).To(gomega.BeTrue())
+	})
+})
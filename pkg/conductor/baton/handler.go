@@ -62,11 +62,8 @@ func (h *Handler) Undeploy(ctx context.Context, request *pbConductor.UndeployReq
 		return nil, conversions.ToGRPCError(err)
 	}
 
-	toUndeploy := entities.UndeployRequest{
-		OrganizationId: request.OrganizationId,
-		AppInstanceId:  request.AppInstanceId,
-	}
-	err := h.c.Undeploy(&toUndeploy)
+	toUndeploy := entities.NewUndeployRequest(request.OrganizationId, request.AppInstanceId)
+	err := h.c.Undeploy(toUndeploy)
 	if err != nil {
 		log.Error().Msgf("Unable to undeploy application %s", request.AppInstanceId)
 		return nil, err
@@ -75,7 +72,13 @@ func (h *Handler) Undeploy(ctx context.Context, request *pbConductor.UndeployReq
 	return &pbCommon.Success{}, nil
 }
 
-func (h *Handler) DrainCluster(ctx context.Context, request *pbConductor.DrainClusterRequest) (*pbCommon.Success, error) {
-	log.Info().Msg("drain cluster was invoked through the GRPC api but it is not implemented!!!!")
-	return &pbCommon.Success{}, nil
+//DrainCluster starts draining a cordoned cluster and returns the identifier of the drain operation
+func (h *Handler) DrainCluster(ctx context.Context, request *pbConductor.DrainClusterRequest) (*pbConductor.DrainClusterResponse, error) {
+	log.Debug().Interface("drainClusterRequest", request).Msg("DrainCluster")
+	operationId, err := h.c.StartDrainCluster(request)
+	if err != nil {
+		log.Error().Err(err).Msg("impossible to drain cluster")
+		return nil, conversions.ToGRPCError(err)
+	}
+	return &pbConductor.DrainClusterResponse{OperationId: operationId}, nil
 }
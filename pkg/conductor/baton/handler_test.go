@@ -36,6 +36,7 @@ import (
 	"google.golang.org/grpc/test/bufconn"
 
 	"os"
+	"time"
 )
 
 func InitializeEntries(orgClient pbOrganization.OrganizationsClient, appClient pbApplication.ApplicationsClient) *pbApplication.ParametrizedDescriptor {
@@ -161,7 +162,7 @@ var _ = ginkgo.Describe("Deployment server API", func() {
 		scorerMethod := scorer.NewSimpleScorer(connHelper)
 		designer := plandesigner.NewSimpleReplicaPlanDesigner(connHelper, network.NewIstioNetworkingOperator())
 		reqcoll := requirementscollector.NewSimpleRequirementsCollector()
-		q = structures.NewMemoryRequestQueue()
+		q = structures.NewMemoryRequestQueue(time.Second * ConductorSleepBetweenRetries)
 		plans = structures.NewPendingPlans()
 
 		conn, err := test.GetConn(*listener)
@@ -172,8 +173,8 @@ var _ = ginkgo.Describe("Deployment server API", func() {
 		appClient = pbApplication.NewApplicationsClient(connSM)
 		orgClient = pbOrganization.NewOrganizationsClient(connSM)
 
-		cond = NewManager(connHelper, q, scorerMethod, reqcoll, designer, plans, nil, nil,
-			network.NewIstioNetworkingOperator())
+		cond = NewManager(connHelper, q, scorerMethod, reqcoll, designer, plans, nil, nil, nil,
+			network.NewIstioNetworkingOperator(), DefaultDeploymentWorkers)
 		test.LaunchServer(server, listener)
 
 		// Register the service.
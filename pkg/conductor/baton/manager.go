@@ -24,8 +24,10 @@ import (
 	"github.com/google/uuid"
 	"github.com/nalej/conductor/internal/entities"
 	"github.com/nalej/conductor/internal/persistence/app_cluster"
+	"github.com/nalej/conductor/internal/persistence/operations"
 	"github.com/nalej/conductor/internal/structures"
 	"github.com/nalej/conductor/pkg/conductor"
+	"github.com/nalej/conductor/pkg/conductor/metrics"
 	"github.com/nalej/conductor/pkg/conductor/observer"
 	"github.com/nalej/conductor/pkg/conductor/plandesigner"
 	"github.com/nalej/conductor/pkg/conductor/requirementscollector"
@@ -47,9 +49,7 @@ import (
 	"time"
 )
 
-// Time to wait between checks in the queue in milliseconds.
 const (
-	CheckSleepTime = 2000
 	// Timeout in seconds for queries to the application clusters.
 	ConductorAppTimeout = 60
 	// Maximum number of retries per request
@@ -91,12 +91,18 @@ type Manager struct {
 	NetworkOperator conductor.NetworkOperator
 	// Application History Logs Client
 	AppHistoryClient pbApplicationHistory.ApplicationHistoryLogsClient
+	// Workers processing deployment requests
+	workers *requestWorkers
+	// Locks to serialize operations on the same application instance
+	instances *instanceLocks
+	// Long running operations triggered by the received requests
+	Operations *operations.OperationsDB
 }
 
 func NewManager(connHelper *utils.ConnectionsHelper, queue structures.RequestsQueue, scorer scorer.Scorer,
 	reqColl requirementscollector.RequirementsCollector, designer plandesigner.PlanDesigner,
-	pendingPlans *structures.PendingPlans, appClusterDB *app_cluster.AppClusterDB, networkOpsProducer *ops.NetworkOpsProducer,
-	networkOperator conductor.NetworkOperator) *Manager {
+	pendingPlans *structures.PendingPlans, appClusterDB *app_cluster.AppClusterDB, operationsDB *operations.OperationsDB,
+	networkOpsProducer *ops.NetworkOpsProducer, networkOperator conductor.NetworkOperator, numWorkers int) *Manager {
 	// initialize clients
 	pool := connHelper.GetSystemModelClients()
 	if pool != nil && len(pool.GetConnections()) == 0 {
@@ -123,56 +129,48 @@ func NewManager(connHelper *utils.ConnectionsHelper, queue structures.RequestsQu
 	netClient := pbNetwork.NewNetworksClient(netPool.GetConnections()[0])
 	dnsClient := pbNetwork.NewDNSClient(netPool.GetConnections()[0])
 	ulClient := pbCoordinator.NewCoordinatorClient(ulPool.GetConnections()[0])
-	return &Manager{ConnHelper: connHelper, Queue: queue, ScorerMethod: scorer, ReqCollector: reqColl,
+	manager := &Manager{ConnHelper: connHelper, Queue: queue, ScorerMethod: scorer, ReqCollector: reqColl,
 		Designer: designer, AppClient: appClient, PendingPlans: pendingPlans, NetClient: netClient,
 		DNSClient: dnsClient, UnifiedLoggingClient: ulClient, AppClusterDB: appClusterDB,
-		NetworkOpsProducer: networkOpsProducer, NetworkOperator: networkOperator, AppHistoryClient:appHistoryClient}
+		NetworkOpsProducer: networkOpsProducer, NetworkOperator: networkOperator, AppHistoryClient:appHistoryClient,
+		instances: newInstanceLocks(), Operations: operationsDB}
+	manager.workers = newRequestWorkers(numWorkers, manager.processInstanceRequest)
+	return manager
 }
 
-// Check iteratively if there is anything to be processed in the queue.
+// Process deployment requests as soon as they are ready in the queue. Requests waiting for a retry
+// are kept by the queue until ConductorSleepBetweenRetries expires. Ready requests are dispatched to the
+// pool of workers.
 func (c *Manager) Run() {
-	sleep := time.Tick(time.Millisecond * CheckSleepTime)
 	for {
-		select {
-		case <-sleep:
-			//TODO revisit this solution because it could lead to intensive active queue checking
-			forNextIteration := make([]*entities.DeploymentRequest, 0)
-			for c.Queue.AvailableRequests() {
-				log.Info().Int("queued requests", c.Queue.Len()).Msg("there are pending deployment requests")
-				next := c.Queue.NextRequest()
-				readyToProcess := true
-				// Check if there was any error with this deployment
-				if next.NumRetries > 0 {
-					// this app had a retry, check if enough time passed since the last check
-					elapsedTime := time.Now().Unix() - next.TimeRetry.Unix()
-					if elapsedTime < ConductorSleepBetweenRetries {
-						log.Debug().Str("requestId", next.RequestId).Msg("not enough time elapsed before retry")
-						readyToProcess = false
-					}
-				}
-
-				if readyToProcess {
-					c.processQueuedRequest(next)
-				} else {
-					// queue it for later
-					forNextIteration = append(forNextIteration, next)
-				}
-			}
-			// Add again to the queue the non-processed entries
-			if len(forNextIteration) > 0 {
-				log.Info().Int("pending", len(forNextIteration)).Msg("some deployments were excluded in this round")
-			}
-			for _, toAdd := range forNextIteration {
-				c.Queue.PushRequest(toAdd)
-			}
+		next := c.Queue.Next(context.Background())
+		if next == nil {
+			continue
 		}
+		log.Info().Str("requestId", next.RequestId).Int32("numRetries", next.NumRetries).
+			Int("queued requests", c.Queue.Len()).Msg("dispatching deployment request")
+		c.workers.Dispatch(next)
 	}
 }
 
-// Process a queued deployment request.
-func (c *Manager) processQueuedRequest(req *entities.DeploymentRequest) {
-	err := c.ProcessDeploymentRequest(req)
-	if err != nil {
+// Process a queued deployment request holding the lock of its application instance.
+func (c *Manager) processInstanceRequest(ctx context.Context, req *entities.DeploymentRequest) {
+	c.instances.Lock(req.AppInstanceId)
+	defer c.instances.Unlock(req.AppInstanceId)
+	c.processQueuedRequest(ctx, req)
+}
+
+// Process a queued deployment request. The request is acknowledged to the queue unless it is enqueued again
+// to be retried. A request cancelled by an undeploy is not retried, the teardown of the instance removes
+// whatever was deployed.
+func (c *Manager) processQueuedRequest(ctx context.Context, req *entities.DeploymentRequest) {
+	err := c.processDeploymentRequest(ctx, req)
+	if err != nil && ctx.Err() != nil {
+		log.Info().Str("requestId", req.RequestId).Str("appInstanceId", req.AppInstanceId).
+			Msg("deployment request cancelled")
+		c.Queue.Ack(req)
+		c.failOperation(req.OperationId, err)
+	} else if err != nil {
 
 		// Update this deployment request
 		req.NumRetries = req.NumRetries + 1
@@ -185,6 +183,8 @@ func (c *Manager) processQueuedRequest(req *entities.DeploymentRequest) {
 
 		if req.NumRetries >= ConductorMaxDeploymentRetries {
 			log.Error().Str("requestId", req.RequestId).Msg("exceeded number of retries")
+			c.Queue.Ack(req)
+			c.failOperation(req.OperationId, err)
 			// Consider this deployment to be failed
 			// Update instance value to ERROR
 			updateRequest = pbApplication.UpdateAppStatusRequest{
@@ -198,6 +198,8 @@ func (c *Manager) processQueuedRequest(req *entities.DeploymentRequest) {
 			currentTime := time.Now()
 			req.TimeRetry = &currentTime
 			c.Queue.PushRequest(req)
+			c.recordPhase(req.OperationId, entities.PHASE_QUEUED, err)
+			metrics.DeploymentRetries.Inc()
 
 			updateRequest = pbApplication.UpdateAppStatusRequest{
 				AppInstanceId:  req.InstanceId,
@@ -208,12 +210,15 @@ func (c *Manager) processQueuedRequest(req *entities.DeploymentRequest) {
 
 		}
 
+		metrics.DeploymentErrors.Inc()
 		_, errUpdate := client.UpdateAppStatus(context.Background(), &updateRequest)
 		if errUpdate != nil {
 			log.Error().Interface("request", updateRequest).Msg("error updating application instance status")
 		}
 		// call the Rollback
 		c.Rollback(req.OrganizationId, req.InstanceId, make([]string, 0))
+	} else {
+		c.Queue.Ack(req)
 	}
 }
 
@@ -236,16 +241,32 @@ func (c *Manager) PushRequest(req *pbConductor.DeploymentRequest) error {
 		TimeRetry:      nil,
 		AppInstanceId:  req.AppInstanceId.AppInstanceId,
 		Connections:    req.OutboundConnections,
+		Priority:       entities.DeploymentPriorityFromLabels(desc.Labels),
+		OperationId:    uuid.New().String(),
 	}
+	c.addOperation(entities.NewOperation(toEnqueue.OperationId, entities.DEPLOY_OPERATION, req.RequestId,
+		toEnqueue.OrganizationId, toEnqueue.AppInstanceId, ""))
 	err = c.Queue.PushRequest(&toEnqueue)
 	if err != nil {
+		c.failOperation(toEnqueue.OperationId, err)
 		return err
 	}
+	c.recordPhase(toEnqueue.OperationId, entities.PHASE_QUEUED, nil)
 
 	return nil
 }
 
 func (c *Manager) ProcessDeploymentRequest(req *entities.DeploymentRequest) derrors.Error {
+	return c.processDeploymentRequest(context.Background(), req)
+}
+
+// Process a deployment request checking between phases whether it has been cancelled.
+// params:
+//  ctx context cancelled when the request is cancelled
+//  req request to be processed
+// return:
+//  error if any
+func (c *Manager) processDeploymentRequest(ctx context.Context, req *entities.DeploymentRequest) derrors.Error {
 	if req == nil {
 		err := derrors.NewFailedPreconditionError("the queue was unexpectedly empty")
 		log.Error().Err(err)
@@ -273,7 +294,9 @@ func (c *Manager) ProcessDeploymentRequest(req *entities.DeploymentRequest) derr
 		return err
 	}
 
+	phaseStart := time.Now()
 	foundRequirements, err := c.ReqCollector.FindRequirements(appDescriptor, appInstance.AppInstanceId)
+	metrics.ObservePhase(metrics.PhaseRequirements, phaseStart)
 	if err != nil {
 		err := derrors.NewGenericError("impossible to find requirements for application")
 		log.Error().Err(err).Str("appDescriptorId", retrievedAppInstance.AppDescriptorId)
@@ -281,7 +304,9 @@ func (c *Manager) ProcessDeploymentRequest(req *entities.DeploymentRequest) derr
 	}
 
 	// 2) score requirements
+	phaseStart = time.Now()
 	scoreResult, err := c.ScorerMethod.ScoreRequirements(req.OrganizationId, foundRequirements)
+	metrics.ObservePhase(metrics.PhaseScoring, phaseStart)
 
 	if err != nil {
 		err := derrors.NewGenericError("error scoring request")
@@ -291,22 +316,38 @@ func (c *Manager) ProcessDeploymentRequest(req *entities.DeploymentRequest) derr
 
 	log.Info().Msgf("conductor maximum score for %s has score %v from %d potential candidates",
 		req.RequestId, scoreResult.DeploymentsScore, scoreResult.NumEvaluatedClusters)
+	c.recordPhase(req.OperationId, entities.PHASE_SCORED, nil)
+	if ctx.Err() != nil {
+		return requestCancelledError(req)
+	}
 
 	// 3) design plan
 	// Elaborate deployment plan for the application
+	phaseStart = time.Now()
 	plan, err := c.Designer.DesignPlan(appInstance, *scoreResult, *req, nil, nil)
+	metrics.ObservePhase(metrics.PhasePlanDesign, phaseStart)
 
 	if err != nil {
 		log.Error().Err(err).Str("requestId", req.RequestId).Str("appDescriptorId", retrievedAppInstance.AppDescriptorId)
 		return derrors.AsError(err, fmt.Sprintf("plan design failed for descriptor %s", err.Error()))
 	}
+	c.recordPhase(req.OperationId, entities.PHASE_PLANNED, nil)
+	if ctx.Err() != nil {
+		return requestCancelledError(req)
+	}
 
 	// Prepare Networks
+	phaseStart = time.Now()
 	networkId, err := c.NetworkOperator.PrepareNetwork(appDescriptor, retrievedAppInstance)
+	metrics.ObservePhase(metrics.PhaseNetwork, phaseStart)
 	if err != nil {
         log.Error().Err(err).Msg("there was an error preparing the network")
         return derrors.NewInternalError("there was an error preparing the network", err)
 	}
+	c.recordPhase(req.OperationId, entities.PHASE_NETWORK_PREPARED, nil)
+	if ctx.Err() != nil {
+		return requestCancelledError(req)
+	}
 	/*
 	// 4) Create the virtual service addresses
 	vsa, err := c.createVSA(entities.NewParametrizedDescriptorFromGRPC(appDescriptor), appInstance.AppInstanceId)
@@ -329,12 +370,15 @@ func (c *Manager) ProcessDeploymentRequest(req *entities.DeploymentRequest) derr
 
 	// 6) deploy fragments
 	// Tell deployment managers to execute plans
-	errDeploy := c.DeployPlan(plan, networkId, req.NumRetries)
+	phaseStart = time.Now()
+	errDeploy := c.deployPlan(ctx, plan, networkId, req.NumRetries)
+	metrics.ObservePhase(metrics.PhaseDeployPlan, phaseStart)
 	if errDeploy != nil {
 		err := derrors.NewGenericError("error deploying plan request", errDeploy)
 		log.Error().Err(errDeploy).Str("requestId", req.RequestId).Str("appDescriptorId", retrievedAppInstance.AppDescriptorId)
 		return err
 	}
+	c.recordPhase(req.OperationId, entities.PHASE_FRAGMENTS_SENT, nil)
 
 	for _, connectionToCreate := range req.Connections {
 		ctx, netCancel := context.WithTimeout(context.Background(), ConductorQueueTimeout)
@@ -357,6 +401,170 @@ func (c *Manager) ProcessDeploymentRequest(req *entities.DeploymentRequest) derr
 	return nil
 }
 
+// Build the error returned when a deployment request is cancelled.
+func requestCancelledError(req *entities.DeploymentRequest) derrors.Error {
+	return derrors.NewFailedPreconditionError(fmt.Sprintf("deployment request %s cancelled", req.RequestId))
+}
+
+// Compute the deployment plan of an application without deploying it. The requirements are collected and
+// scored as in a regular deployment but the plan is designed without side effects: no service group instances
+// are added, no network is prepared and no deployment manager is contacted.
+// params:
+//  request indicating the application instance or descriptor to be planned
+// return:
+//  requirements, scores and resulting plan or error if any
+func (c *Manager) DryRun(request *entities.DryRunRequest) (*entities.DryRunResult, derrors.Error) {
+	if err := entities.ValidDryRunRequest(request); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ConductorQueueTimeout)
+	defer cancel()
+
+	var appInstance entities.AppInstance
+	var appDescriptor *pbApplication.ParametrizedDescriptor
+	if request.AppInstanceId != "" {
+		instanceId := &pbApplication.AppInstanceId{OrganizationId: request.OrganizationId,
+			AppInstanceId: request.AppInstanceId}
+		retrievedAppInstance, err := c.AppClient.GetAppInstance(ctx, instanceId)
+		if err != nil {
+			log.Error().Err(err).Str("appInstanceId", request.AppInstanceId).Msg("impossible to retrieve app instance")
+			return nil, derrors.NewNotFoundError("impossible to retrieve app instance", err)
+		}
+		appInstance = entities.NewAppInstanceFromGRPC(retrievedAppInstance)
+		appDescriptor, err = c.AppClient.GetParametrizedDescriptor(ctx, instanceId)
+		if err != nil {
+			log.Error().Err(err).Str("appInstanceId", request.AppInstanceId).
+				Msg("application descriptor not found when processing dry run")
+			return nil, derrors.NewNotFoundError("impossible to find application descriptor", err)
+		}
+	} else {
+		retrievedDescriptor, err := c.AppClient.GetAppDescriptor(ctx, &pbApplication.AppDescriptorId{
+			OrganizationId: request.OrganizationId, AppDescriptorId: request.AppDescriptorId})
+		if err != nil {
+			log.Error().Err(err).Str("appDescriptorId", request.AppDescriptorId).
+				Msg("application descriptor not found when processing dry run")
+			return nil, derrors.NewNotFoundError("impossible to find application descriptor", err)
+		}
+		appDescriptor = toParametrizedDescriptor(retrievedDescriptor)
+		// the descriptor has no instance yet, use a temporary identifier
+		appInstance = entities.AppInstance{
+			OrganizationId:  request.OrganizationId,
+			AppDescriptorId: request.AppDescriptorId,
+			AppInstanceId:   uuid.New().String(),
+			Name:            retrievedDescriptor.Name,
+		}
+	}
+
+	// 1) collect requirements for the application descriptor
+	foundRequirements, err := c.ReqCollector.FindRequirements(appDescriptor, appInstance.AppInstanceId)
+	if err != nil {
+		log.Error().Err(err).Str("appDescriptorId", appDescriptor.AppDescriptorId).
+			Msg("impossible to find requirements for application")
+		return nil, derrors.NewGenericError("impossible to find requirements for application", err)
+	}
+
+	// 2) score requirements
+	scoreResult, err := c.ScorerMethod.ScoreRequirements(request.OrganizationId, foundRequirements)
+	if err != nil {
+		log.Error().Err(err).Str("appDescriptorId", appDescriptor.AppDescriptorId).Msg("error scoring dry run")
+		return nil, derrors.NewGenericError("error scoring request", err)
+	}
+
+	// 3) design plan without side effects
+	req := entities.DeploymentRequest{
+		RequestId:      uuid.New().String(),
+		OrganizationId: request.OrganizationId,
+		ApplicationId:  appInstance.AppDescriptorId,
+		InstanceId:     appInstance.AppInstanceId,
+		AppInstanceId:  appInstance.AppInstanceId,
+	}
+	// the plan of an existing instance takes into account the groups already running
+	var deployedGroups map[string][]string
+	if request.AppInstanceId != "" {
+		deployedGroups = c.allocatedGroups(request.OrganizationId, request.AppInstanceId)
+	}
+	plan, err := c.Designer.DryRunPlan(appInstance, appDescriptor, *scoreResult, req, deployedGroups)
+	if err != nil {
+		log.Error().Err(err).Str("appDescriptorId", appDescriptor.AppDescriptorId).Msg("dry run plan design failed")
+		return nil, derrors.AsError(err, "plan design failed")
+	}
+
+	log.Info().Str("appDescriptorId", appDescriptor.AppDescriptorId).Str("planId", plan.DeploymentId).
+		Int("number of fragments", len(plan.Fragments)).Msg("dry run plan computed")
+
+	return &entities.DryRunResult{Requirements: foundRequirements, Score: scoreResult, Plan: plan}, nil
+}
+
+// Build a summary of the service groups of an application instance running in every cluster.
+// params:
+//  organizationId organization the application belongs to
+//  appInstanceId application instance
+// return:
+//  map with the list of service group ids deployed per cluster clusterId -> [group0, group1...]
+func (c *Manager) allocatedGroups(organizationId string, appInstanceId string) map[string][]string {
+	allocatedGroupsPerClusters := make(map[string][]string, 0)
+	// every cluster running fragments of the organization is a potential target
+	clusterIds, err := c.AppClusterDB.GetClustersInOrganization(organizationId)
+	if err != nil {
+		log.Error().Err(err).Msg("error when getting the clusters of the organization")
+	}
+	for _, clusterId := range clusterIds {
+		allocatedGroupsPerClusters[clusterId] = make([]string, 0)
+	}
+	// get the list of the deployment fragments of the application in any cluster
+	fragments, err := c.AppClusterDB.GetFragmentsByAppInstance(appInstanceId)
+	if err != nil {
+		log.Error().Err(err).Msg("error when getting deployment fragments of the application")
+		return allocatedGroupsPerClusters
+	}
+	// TODO this check assumes all stages in a deployment fragment to be in the same service group
+	for _, cf := range fragments {
+		allocatedGroupsPerClusters[cf.ClusterId] = append(allocatedGroupsPerClusters[cf.ClusterId],
+			cf.Stages[0].Services[0].ServiceGroupId)
+	}
+	return allocatedGroupsPerClusters
+}
+
+// Return the deployment fragments of an application instance running in a set of clusters.
+// params:
+//  appInstanceId application instance
+//  clusterIds clusters to be considered
+// return:
+//  list of deployment fragments or error if any
+func (c *Manager) fragmentsInClusters(appInstanceId string, clusterIds []string) ([]entities.DeploymentFragment, derrors.Error) {
+	fragments, err := c.AppClusterDB.GetFragmentsByAppInstance(appInstanceId)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]bool, len(clusterIds))
+	for _, clusterId := range clusterIds {
+		targets[clusterId] = true
+	}
+	result := make([]entities.DeploymentFragment, 0, len(fragments))
+	for _, f := range fragments {
+		if targets[f.ClusterId] {
+			result = append(result, f)
+		}
+	}
+	return result, nil
+}
+
+// Build a parametrized descriptor from an application descriptor. Parameters are not resolved so the
+// descriptor contains the default values.
+func toParametrizedDescriptor(desc *pbApplication.AppDescriptor) *pbApplication.ParametrizedDescriptor {
+	return &pbApplication.ParametrizedDescriptor{
+		OrganizationId:       desc.OrganizationId,
+		AppDescriptorId:      desc.AppDescriptorId,
+		Name:                 desc.Name,
+		ConfigurationOptions: desc.ConfigurationOptions,
+		EnvironmentVariables: desc.EnvironmentVariables,
+		Labels:               desc.Labels,
+		Rules:                desc.Rules,
+		Groups:               desc.Groups,
+	}
+}
+
 // Reschedule all the current app instances if needed.
 func (c *Manager) scheduleRunningApps(organizationId string) {
 	log.Debug().Str("organizationId", organizationId).Msg("schedule running apps for potential replanning")
@@ -370,6 +578,7 @@ func (c *Manager) scheduleRunningApps(organizationId string) {
 	}
 
 	_ = c.ConnHelper.UpdateClusterConnections(organizationId)
+	orgClusters := c.ConnHelper.GetOrganizationClusters(organizationId)
 
 	for i, appInstance := range instances.Instances {
 		log.Debug().Msgf("Check if instance %d out of %d instances has to be scheduled", i+1, len(instances.Instances))
@@ -400,7 +609,7 @@ func (c *Manager) scheduleRunningApps(organizationId string) {
 		for _, group := range replicated {
 			expectedReplicas := 0
 			log.Debug().Str("groupId", group.ServiceGroupId).Msg("check group id")
-			for _, cluster := range c.ConnHelper.ClusterReference {
+			for _, cluster := range orgClusters {
 				if c.clusterCanDeployGroup(cluster.Labels, group.Specs.DeploymentSelectors) {
 					expectedReplicas++
 				}
@@ -429,6 +638,9 @@ func (c *Manager) scheduleRunningApps(organizationId string) {
 //  organizationId
 func (c *Manager) scheduleServiceGroups(serviceGroupIds []string, appInstance entities.AppInstance) {
 	log.Debug().Msgf("schedule %d services from app %s", len(serviceGroupIds), appInstance.AppInstanceId)
+	// deployments and undeployments of the instance are not processed meanwhile
+	c.instances.Lock(appInstance.AppInstanceId)
+	defer c.instances.Unlock(appInstance.AppInstanceId)
 
 	// get application descriptor
 	ctx, cancel := context.WithTimeout(context.Background(), ConductorQueueTimeout)
@@ -471,28 +683,7 @@ func (c *Manager) scheduleServiceGroups(serviceGroupIds []string, appInstance en
 
 	// design a plan for the service groups contained into the deployment fragment
 	// build a summary of the groups running in the cluster
-	allocatedGroupsPerClusters := make(map[string][]string, 0)
-	for clusterId := range c.ConnHelper.ClusterReference {
-		// get the list of the deployment fragments for the same service group of the
-		// target fragment in the cluster
-		clusterFragments, err := c.AppClusterDB.GetFragmentsApp(clusterId, appInstance.AppInstanceId)
-		if err != nil {
-			log.Error().Msg("error when getting deployment fragment from cluster")
-			continue
-		}
-		if clusterFragments != nil {
-			entry, found := allocatedGroupsPerClusters[clusterId]
-			if !found {
-				allocatedGroupsPerClusters[clusterId] = make([]string, 0)
-				entry = allocatedGroupsPerClusters[clusterId]
-			}
-			// TODO this check assumes all stages in a deployment fragment to be in the same service group
-			for _, cf := range clusterFragments {
-				entry = append(entry, cf.Stages[0].Services[0].ServiceGroupId)
-			}
-			allocatedGroupsPerClusters[clusterId] = entry
-		}
-	}
+	allocatedGroupsPerClusters := c.allocatedGroups(appInstance.OrganizationId, appInstance.AppInstanceId)
 
 	log.Debug().Interface("allocatedGroupsPerCluster", allocatedGroupsPerClusters).
 		Interface("serviceGroupIds", serviceGroupIds).
@@ -638,28 +829,7 @@ func (c *Manager) ProcessDeploymentFragment(fragment *entities.DeploymentFragmen
 
 	// design a plan for the service groups contained into the deployment fragment
 	// build a summary of the groups running in the cluster
-	allocatedGroupsPerClusters := make(map[string][]string, 0)
-	for clusterId := range c.ConnHelper.ClusterReference {
-		// get the list of the deployment fragments for the same service group of the
-		// target fragment in the cluster
-		clusterFragments, err := c.AppClusterDB.GetFragmentsApp(clusterId, fragment.AppInstanceId)
-		if err != nil {
-			log.Error().Msg("error when getting deployment fragment from cluster")
-			continue
-		}
-		if clusterFragments != nil {
-			entry, found := allocatedGroupsPerClusters[clusterId]
-			if !found {
-				allocatedGroupsPerClusters[clusterId] = make([]string, 0)
-				entry = allocatedGroupsPerClusters[clusterId]
-			}
-			// TODO this check assumes all stages in a deployment fragment to be in the same service group
-			for _, cf := range clusterFragments {
-				entry = append(entry, cf.Stages[0].Services[0].ServiceGroupId)
-			}
-			allocatedGroupsPerClusters[clusterId] = entry
-		}
-	}
+	allocatedGroupsPerClusters := c.allocatedGroups(fragment.OrganizationId, fragment.AppInstanceId)
 
 	log.Debug().Interface("allocatedGroupsPerCluster", allocatedGroupsPerClusters).
 		Interface("serviceGroupIds", serviceGroupIds).
@@ -716,6 +886,19 @@ func (c *Manager) CreateZTNetwork(name string, organizationId string, appInstanc
 // returns:
 //  error if any
 func (c *Manager) DeployPlan(plan *entities.DeploymentPlan, vpnNetworkId string, numRetry int32) error {
+	return c.deployPlan(context.Background(), plan, vpnNetworkId, numRetry)
+}
+
+// Deploy a plan stopping before the next fragment if the context is cancelled. The application instance is
+// updated with the fragments already sent so they can be undeployed.
+// params:
+//  ctx context cancelled when the deployment is cancelled
+//  plan to be deployed
+//  vpnNetworkId identifier for the network
+//  numRetry number of retry of this plan
+// returns:
+//  error if any
+func (c *Manager) deployPlan(ctx context.Context, plan *entities.DeploymentPlan, vpnNetworkId string, numRetry int32) error {
 	// Add this plan to the list of pending entries
 	c.PendingPlans.AddPendingPlan(plan)
 
@@ -728,7 +911,7 @@ func (c *Manager) DeployPlan(plan *entities.DeploymentPlan, vpnNetworkId string,
 
 	// before sending the deployment plan we check that all the involved clusters are ready
 	for _, fragment := range plan.Fragments {
-		targetCluster, found := c.ConnHelper.ClusterReference[fragment.ClusterId]
+		targetCluster, found := c.ConnHelper.GetClusterEntry(fragment.ClusterId)
 		if !found {
 			msg := fmt.Sprintf("unknown target address for cluster with id %s", fragment.ClusterId)
 			err := errors.New(msg)
@@ -744,12 +927,19 @@ func (c *Manager) DeployPlan(plan *entities.DeploymentPlan, vpnNetworkId string,
 	}
 
 	// time to deploy
+	var cancelled error
 	for fragmentIndex, fragment := range plan.Fragments {
+		if ctx.Err() != nil {
+			log.Info().Str("deploymentId", plan.DeploymentId).
+				Msgf("deployment cancelled after %d out of %d fragments", fragmentIndex, len(plan.Fragments))
+			cancelled = ctx.Err()
+			break
+		}
 		log.Debug().Interface("fragment", fragment).Msg("fragment to be deployed")
 		log.Info().Str("deploymentId", fragment.DeploymentId).
 			Msgf("start fragment %s deployment with %d out of %d fragments", fragment.DeploymentId, fragmentIndex+1, len(plan.Fragments))
 
-		targetCluster, found := c.ConnHelper.ClusterReference[fragment.ClusterId]
+		targetCluster, found := c.ConnHelper.GetClusterEntry(fragment.ClusterId)
 		if !found {
 			msg := fmt.Sprintf("unknown target address for cluster with id %s", fragment.ClusterId)
 			err := errors.New(msg)
@@ -780,9 +970,10 @@ func (c *Manager) DeployPlan(plan *entities.DeploymentPlan, vpnNetworkId string,
 		log.Debug().Interface("deploymentFragmentRequest", request).
 			Msg("deployment fragment request")
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*ConductorAppTimeout)
+		// a fragment being sent is not interrupted so it is stored and can be undeployed
+		execCtx, cancel := context.WithTimeout(context.Background(), time.Second*ConductorAppTimeout)
 		defer cancel()
-		response, err := client.Execute(ctx, &request)
+		response, err := client.Execute(execCtx, &request)
 
 		log.Debug().Interface("deploymentFragmentResponse", response).Interface("deploymentFragmentError", err).
 			Msg("finished fragment deployment")
@@ -796,7 +987,10 @@ func (c *Manager) DeployPlan(plan *entities.DeploymentPlan, vpnNetworkId string,
 		// update the db of fragments deployed on that cluster
 		// update the value of the vpnNetworkId in the local entity
 		fragment.ZtNetworkID = vpnNetworkId
-		err = c.AppClusterDB.AddDeploymentFragment(&fragment)
+		// the plan is stored with the fragment so it can be retried after a restart
+		err = c.PendingPlans.WithPlanRecord(plan.DeploymentId, func(record *app_cluster.PendingPlanRecord) derrors.Error {
+			return c.AppClusterDB.AddDeploymentFragmentWithPlan(&fragment, record)
+		})
 		if err != nil {
 			log.Error().Err(err).Msg("there was a problem when storing information about a deployment fragment")
 		}
@@ -824,12 +1018,31 @@ func (c *Manager) DeployPlan(plan *entities.DeploymentPlan, vpnNetworkId string,
 		return err
 	}
 
-	return nil
+	return cancelled
 }
 
-// Undeploy
+// Undeploy an application instance. The deployments of the instance waiting in the queue are removed and the one
+// in progress is cancelled. The teardown runs on the worker of the instance once the cancelled deployment stops,
+// so the caller does not wait for it. The progress is recorded in the undeploy operation.
 func (c *Manager) Undeploy(request *entities.UndeployRequest) error {
-	return c.HardUndeploy(request.OrganizationId, request.AppInstanceId)
+	operationId := uuid.New().String()
+	c.addOperation(entities.NewOperation(operationId, entities.UNDEPLOY_OPERATION, request.RequestId,
+		request.OrganizationId, request.AppInstanceId, ""))
+	c.recordPhase(operationId, entities.PHASE_UNDEPLOY_REQUESTED, nil)
+
+	c.Queue.Remove(request.AppInstanceId)
+	if c.workers.Cancel(request.AppInstanceId) {
+		log.Info().Str("appInstanceId", request.AppInstanceId).Msg("deployments cancelled by undeploy request")
+	}
+	c.workers.Submit(request.AppInstanceId, func() {
+		c.instances.Lock(request.AppInstanceId)
+		defer c.instances.Unlock(request.AppInstanceId)
+		err := c.hardUndeploy(operationId, request.OrganizationId, request.AppInstanceId)
+		if err != nil {
+			c.failOperation(operationId, err)
+		}
+	})
+	return nil
 }
 
 // Undeploy function that maintains the application instance in the system.
@@ -860,21 +1073,20 @@ func (c *Manager) SoftUndeploy(organizationId string, appInstanceId string) erro
 
 	// create observer and the array of entries to be observed
 	toObserve := make([]observer.ObservableDeploymentFragment, 0)
-	for _, clusterId := range clusterIds {
-		fragments, err := c.AppClusterDB.GetFragmentsApp(clusterId, appInstanceId)
-		if err != nil {
-			log.Error().Err(err).Msg("error when getting fragments from cluster")
-			continue
-		}
-		for _, fr := range fragments {
-			toObserve = append(toObserve, observer.ObservableDeploymentFragment{ClusterId: clusterId,
-				FragmentId: fr.FragmentId, AppInstanceId: appInstanceId})
-		}
+	fragments, errFragments := c.fragmentsInClusters(appInstanceId, clusterIds)
+	if errFragments != nil {
+		log.Error().Err(errFragments).Msg("error when getting fragments of the application")
+	}
+	for _, fr := range fragments {
+		toObserve = append(toObserve, observer.ObservableDeploymentFragment{ClusterId: fr.ClusterId,
+			FragmentId: fr.FragmentId, AppInstanceId: appInstanceId})
 	}
 
-	observer := observer.NewDeploymentFragmentsObserver(toObserve, c.AppClusterDB)
-	// Run an observer in a separated thread to send the schedule to the queue when is terminating
-	go observer.Observe(ConductorDrainClusterAppTimeout, entities.FRAGMENT_TERMINATING,
+	fragmentsObserver := observer.NewDeploymentFragmentsObserver(toObserve, c.AppClusterDB)
+	// Run an observer in a separated thread to send the schedule to the queue when is terminating,
+	// fragments removed by other operations are done too
+	go fragmentsObserver.ObserveWhen(ConductorDrainClusterAppTimeout,
+		observer.AnyOf(observer.StatusIs(entities.FRAGMENT_TERMINATING), observer.Gone()),
 		func(d *entities.DeploymentFragment) derrors.Error {
 			return c.AppClusterDB.DeleteDeploymentFragment(d.ClusterId, d.FragmentId)
 		}, nil)
@@ -885,6 +1097,11 @@ func (c *Manager) SoftUndeploy(organizationId string, appInstanceId string) erro
 
 // Undeploy function that removes the application instance
 func (c *Manager) HardUndeploy(organizationId string, appInstanceId string) error {
+	return c.hardUndeploy("", organizationId, appInstanceId)
+}
+
+// Remove the application instance recording the progress in the given operation if any.
+func (c *Manager) hardUndeploy(operationId string, organizationId string, appInstanceId string) error {
 	// find application instance
 	appInstance, err := c.AppClient.GetAppInstance(context.Background(),
 		&pbApplication.AppInstanceId{OrganizationId: organizationId, AppInstanceId: appInstanceId})
@@ -924,6 +1141,9 @@ func (c *Manager) HardUndeploy(organizationId string, appInstanceId string) erro
 
 	// Remove from the associated request from the queue
 	removed := c.Queue.Remove(appInstanceId)
+	if c.workers != nil && c.workers.Remove(appInstanceId) {
+		removed = true
+	}
 	if !removed {
 		log.Info().Interface("appInstanceId", appInstanceId).Msg("no request was found in the queue for this deployed app")
 	}
@@ -944,23 +1164,21 @@ func (c *Manager) HardUndeploy(organizationId string, appInstanceId string) erro
 
 	// create observer and the array of entries to be observed
 	toObserve := make([]observer.ObservableDeploymentFragment, 0)
-	for _, clusterId := range clusterIds {
-		fragments, err := c.AppClusterDB.GetFragmentsApp(clusterId, appInstanceId)
-		if err != nil {
-			log.Error().Err(err).Msg("error when getting fragments from cluster")
-			continue
-		}
-		for _, fr := range fragments {
-			toObserve = append(toObserve, observer.ObservableDeploymentFragment{ClusterId: clusterId,
-				FragmentId: fr.FragmentId, AppInstanceId: instID.AppInstanceId})
-		}
+	fragments, errFragments := c.fragmentsInClusters(appInstanceId, clusterIds)
+	if errFragments != nil {
+		log.Error().Err(errFragments).Msg("error when getting fragments of the application")
+	}
+	for _, fr := range fragments {
+		toObserve = append(toObserve, observer.ObservableDeploymentFragment{ClusterId: fr.ClusterId,
+			FragmentId: fr.FragmentId, AppInstanceId: instID.AppInstanceId})
 	}
 
-	observer := observer.NewDeploymentFragmentsObserver(toObserve, c.AppClusterDB)
+	fragmentsObserver := observer.NewDeploymentFragmentsObserver(toObserve, c.AppClusterDB)
 	// Run an observer in a separated thread to send the schedule to the queue when is terminating
-	go observer.Observe(
+	go fragmentsObserver.ObserveWhen(
 		ConductorDrainClusterAppTimeout,
-		entities.FRAGMENT_TERMINATING,
+		// fragments removed by other operations are done too
+		observer.AnyOf(observer.StatusIs(entities.FRAGMENT_TERMINATING), observer.Gone()),
 		// function to execute in every deployment fragment
 		func(d *entities.DeploymentFragment) derrors.Error {
 			log.Debug().Str("deploymentFragmentId", d.DeploymentId).Msg("deployment fragment terminated has" +
@@ -969,7 +1187,12 @@ func (c *Manager) HardUndeploy(organizationId string, appInstanceId string) erro
 			if err != nil {
 				return err
 			}
-			if !c.PendingPlans.PlanHasPendingFragments(d.DeploymentId) {
+			// the plan is done once none of its fragments is stored
+			remaining, err := c.AppClusterDB.GetFragmentsByDeployment(d.DeploymentId)
+			if err != nil {
+				return err
+			}
+			if len(remaining) == 0 || !c.PendingPlans.PlanHasPendingFragments(d.DeploymentId) {
 				log.Debug().Msg("pending plan has no fragments, remove it")
 				c.PendingPlans.RemovePendingPlan(d.DeploymentId)
 			}
@@ -1004,11 +1227,16 @@ func (c *Manager) HardUndeploy(organizationId string, appInstanceId string) erro
 			if err != nil {
 				log.Error().Err(err).Str("app_instance_id", appInstanceId).Msg("could not remove service history logs from system model")
 			}
+			c.finishOperation(operationId, entities.PHASE_INSTANCE_REMOVED)
 
 		})
 
 	// terminate execution
-	return c.undeployClustersInstance(appInstance.OrganizationId, appInstance.AppInstanceId, clusterIds)
+	errUndeploy := c.undeployClustersInstance(appInstance.OrganizationId, appInstance.AppInstanceId, clusterIds)
+	if errUndeploy == nil {
+		c.recordPhase(operationId, entities.PHASE_UNDEPLOY_SENT, nil)
+	}
+	return errUndeploy
 }
 
 // Private function to communicate the application clusters to remove a running instance.
@@ -1027,11 +1255,12 @@ func (c *Manager) undeployClustersInstance(organizationId string, appInstanceId
 		log.Error().Err(err).Str("organizationID", organizationId).Msg("error updating connections for organization")
 		return err
 	}
-	if len(c.ConnHelper.ClusterReference) == 0 {
+	orgClusters := c.ConnHelper.GetOrganizationClusters(organizationId)
+	if len(orgClusters) == 0 {
 		log.Error().Msgf("no clusters found for organization %s", organizationId)
 		return nil
 	}
-	log.Debug().Interface("number", len(c.ConnHelper.ClusterReference)).Msg("Known clusters")
+	log.Debug().Interface("number", len(orgClusters)).Msg("Known clusters")
 
 	log.Debug().Int("number of cluster to send undeploy", len(targetClusters)).Msg("send undeploy to clusters")
 	if len(targetClusters) == 0 {
@@ -1040,7 +1269,7 @@ func (c *Manager) undeployClustersInstance(organizationId string, appInstanceId
 
 	for _, clusterId := range targetClusters {
 
-		clusterEntry, found := c.ConnHelper.ClusterReference[clusterId]
+		clusterEntry, found := orgClusters[clusterId]
 		if !found {
 			log.Error().Str("clusterId", clusterId).Str("clusterHost", clusterEntry.Hostname).Msg("unknown clusterHost for the clusterId")
 			return errors.New(fmt.Sprintf("unknown host for cluster id %s", clusterId))
@@ -1085,20 +1314,11 @@ func (c *Manager) undeployFragment(organizationId string, appInstanceId string,
 	log.Debug().Str("app_instance_id", appInstanceId).Str("fragmentID", fragmentId).Msg("undeploy fragment from cluster")
 
 	// Unauthorize the members of this fragment
-	fragment, err := c.AppClusterDB.GetFragmentsApp(targetClusterId, appInstanceId)
+	targetFragment, err := c.AppClusterDB.GetDeploymentFragment(targetClusterId, fragmentId)
 	if err != nil {
 		log.Error().Msg("impossible to get deployment fragment to unauthorize")
 	}
 
-	var targetFragment *entities.DeploymentFragment = nil
-	for _, f := range fragment {
-		// find the cluster we are looking for
-		if f.FragmentId == fragmentId {
-			targetFragment = &f
-			break
-		}
-	}
-
 	if targetFragment == nil {
 		// this is extremely weird to occur
 		log.Error().Msg("a deployment fragment could not be found. We cannot unauthorize fragment entries")
@@ -1130,12 +1350,13 @@ func (c *Manager) undeployFragment(organizationId string, appInstanceId string,
 			log.Error().Err(err).Str("organizationID", organizationId).Msg("error updating connections for organization")
 			return err
 		}
-		if len(c.ConnHelper.ClusterReference) == 0 {
+		orgClusters := c.ConnHelper.GetOrganizationClusters(organizationId)
+		if len(orgClusters) == 0 {
 			log.Error().Msgf("no clusters found for organization %s", organizationId)
 			return nil
 		}
 
-		clusterEntry, found := c.ConnHelper.ClusterReference[targetClusterId]
+		clusterEntry, found := orgClusters[targetClusterId]
 		if !found {
 			log.Error().Str("clusterId", targetClusterId).Str("clusterHost", clusterEntry.Hostname).Msg("unknown clusterHost for the clusterId")
 			return errors.New(fmt.Sprintf("unknown host for cluster id %s", targetClusterId))
@@ -1238,28 +1459,26 @@ func (c *Manager) Rollback(organizationId string, appInstanceId string, clusterI
 //  appInstanceId
 //  clusterIds
 func (c *Manager) unauthorizeEntries(organizationId string, appInstanceId string, clusterIds []string) {
-	for _, clusterId := range clusterIds {
-		fragments, err := c.AppClusterDB.GetFragmentsApp(clusterId, appInstanceId)
-		if err != nil {
-			log.Error().Err(err).Msg("impossible to find fragments to unauthorize entries")
-			continue
-		}
-		// unauthorize every entry
-		for _, f := range fragments {
-			for _, ds := range f.Stages {
-				for _, serv := range ds.Services {
-					unauthorizeReq := pbNetwork.DisauthorizeMemberRequest{
-						OrganizationId:               serv.OrganizationId,
-						AppInstanceId:                serv.AppInstanceId,
-						ServiceGroupInstanceId:       serv.ServiceGroupInstanceId,
-						ServiceApplicationInstanceId: serv.ServiceInstanceId,
-					}
-					ctx, cancel := context.WithTimeout(context.Background(), ConductorQueueTimeout)
-					err := c.NetworkOpsProducer.Send(ctx, &unauthorizeReq)
-					cancel()
-					if err != nil {
-						log.Error().Err(err).Msg("problem sending unauthorize request to the queue")
-					}
+	fragments, err := c.fragmentsInClusters(appInstanceId, clusterIds)
+	if err != nil {
+		log.Error().Err(err).Msg("impossible to find fragments to unauthorize entries")
+		return
+	}
+	// unauthorize every entry
+	for _, f := range fragments {
+		for _, ds := range f.Stages {
+			for _, serv := range ds.Services {
+				unauthorizeReq := pbNetwork.DisauthorizeMemberRequest{
+					OrganizationId:               serv.OrganizationId,
+					AppInstanceId:                serv.AppInstanceId,
+					ServiceGroupInstanceId:       serv.ServiceGroupInstanceId,
+					ServiceApplicationInstanceId: serv.ServiceInstanceId,
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), ConductorQueueTimeout)
+				err := c.NetworkOpsProducer.Send(ctx, &unauthorizeReq)
+				cancel()
+				if err != nil {
+					log.Error().Err(err).Msg("problem sending unauthorize request to the queue")
 				}
 			}
 		}
@@ -1348,21 +1567,79 @@ func (c *Manager) createVSA(appDescriptor entities.AppDescriptor, appInstanceId
 }
 */
 
-// Drain a cluster if and only if it is already cordoned, removed all the running applications and schedule the removed
-// fragments.
+// Drain a cluster received from the infrastructure operations queue. All the running applications are removed and
+// the removed fragments are scheduled again.
 func (c *Manager) DrainCluster(drainRequest *pbConductor.DrainClusterRequest) {
-	// get all the apps deployed on that cluster
-
-	fragmentIds, err := c.AppClusterDB.GetFragmentsInCluster(drainRequest.ClusterId.ClusterId)
+	operationId, fragments, err := c.newDrainOperation(drainRequest)
 	if err != nil {
-		log.Error().Err(err).Str("clusterId", drainRequest.ClusterId.ClusterId).
-			Msg("impossible to obtain fragments running in cluster")
+		log.Error().Err(err).Str("clusterId", drainRequest.ClusterId.ClusterId).Msg("impossible to drain cluster")
 		return
 	}
+	c.drainCluster(operationId, drainRequest, fragments)
+}
+
+// Start the drain of a cluster if and only if it is already cordoned. The drain runs in background and its progress
+// can be followed using the returned operation.
+// params:
+//  drainRequest cluster to be drained
+// return:
+//  identifier of the drain operation or error if the cluster cannot be drained
+func (c *Manager) StartDrainCluster(drainRequest *pbConductor.DrainClusterRequest) (string, derrors.Error) {
+	if err := entities.ValidDrainClusterRequest(drainRequest); err != nil {
+		return "", err
+	}
+	clusterId := drainRequest.ClusterId.ClusterId
+	// the cluster may be new or its cordon status may have changed, update the connections of the organization
+	if err := c.ConnHelper.UpdateClusterConnections(drainRequest.ClusterId.OrganizationId); err != nil {
+		log.Error().Err(err).Str("organizationId", drainRequest.ClusterId.OrganizationId).
+			Msg("error updating connections for organization")
+		return "", derrors.NewUnavailableError("impossible to check the status of the cluster", err)
+	}
+	clusterEntry, found := c.ConnHelper.GetClusterEntry(clusterId)
+	if !found || clusterEntry.OrganizationId != drainRequest.ClusterId.OrganizationId {
+		return "", derrors.NewNotFoundError(fmt.Sprintf("cluster %s not found", clusterId))
+	}
+	if !clusterEntry.Cordon {
+		return "", derrors.NewFailedPreconditionError(
+			fmt.Sprintf("cluster %s must be cordoned before being drained", clusterId))
+	}
+
+	operationId, fragments, err := c.newDrainOperation(drainRequest)
+	if err != nil {
+		return "", err
+	}
+	go c.drainCluster(operationId, drainRequest, fragments)
+	return operationId, nil
+}
+
+// Record a new drain operation for the fragments running in a cluster. The operation is recorded before the drain
+// starts so it can be queried as soon as its id is known.
+// params:
+//  drainRequest cluster to be drained
+// return:
+//  identifier of the drain operation, fragments to be drained or error if any
+func (c *Manager) newDrainOperation(drainRequest *pbConductor.DrainClusterRequest) (string, []entities.DeploymentFragment, derrors.Error) {
+	clusterId := drainRequest.ClusterId.ClusterId
+	fragments, err := c.AppClusterDB.GetFragmentsInCluster(clusterId)
+	if err != nil {
+		log.Error().Err(err).Str("clusterId", clusterId).Msg("impossible to obtain fragments running in cluster")
+		return "", nil, derrors.NewInternalError("impossible to obtain fragments running in cluster", err)
+	}
+	op := entities.NewDrainOperation(drainRequest.ClusterId.OrganizationId, clusterId, len(fragments))
+	c.addOperation(op)
+	log.Info().Str("clusterId", clusterId).Str("operationId", op.OperationId).Msg("drain operation started")
+	return op.OperationId, fragments, nil
+}
 
+// Remove all the running applications of a cluster and schedule the removed fragments. The progress is recorded
+// in the indicated drain operation.
+func (c *Manager) drainCluster(operationId string, drainRequest *pbConductor.DrainClusterRequest,
+	fragmentIds []entities.DeploymentFragment) {
+	c.recordPhase(operationId, entities.PHASE_DRAIN_STARTED, nil)
 	if len(fragmentIds) == 0 {
 		log.Info().Str("clusterId", drainRequest.ClusterId.ClusterId).
 			Msg("nothing to do for drain. Target cluster has no running deployments")
+		c.finishDrain(operationId)
 		return
 	}
 
@@ -1379,48 +1656,170 @@ func (c *Manager) DrainCluster(drainRequest *pbConductor.DrainClusterRequest) {
 		Int("numFragmentsToReschedule", len(toReschedule)).
 		Msg("schedule drained operations to be scheduled again...")
 
+	// schedule a fragment again and record the result
+	reschedule := func(d *entities.DeploymentFragment) derrors.Error {
+		err := c.scheduleDeploymentFragment(d)
+		if err != nil {
+			c.recordDrainedFragment(operationId, entities.DRAINED_FRAGMENT_FAILED)
+		} else {
+			c.recordDrainedFragment(operationId, entities.DRAINED_FRAGMENT_RESCHEDULED)
+		}
+		return err
+	}
+
 	if !drainRequest.ClusterOffline {
 		observer := observer.NewDeploymentFragmentsObserver(toReschedule, c.AppClusterDB)
 		// Run an observer in a separated thread to send the schedule to the queue when is terminating
 		go observer.ObserveOrganizationLevel(ConductorDrainClusterAppTimeout, entities.FRAGMENT_TERMINATING,
-			drainRequest.ClusterId.OrganizationId, c.scheduleDeploymentFragment, nil)
+			drainRequest.ClusterId.OrganizationId, reschedule, func(string) {
+				c.finishDrain(operationId)
+				log.Info().Str("clusterId", drainRequest.ClusterId.ClusterId).Str("operationId", operationId).
+					Msg("cluster drain operation finished")
+			})
 		// Drain the whole cluster
 		log.Info().Str("clusterId", drainRequest.ClusterId.ClusterId).Msg("start cluster drain operation...")
 		for _, fragment := range toReschedule {
-			c.undeployFragment(drainRequest.ClusterId.OrganizationId, fragment.AppInstanceId, fragment.FragmentId, drainRequest.ClusterId.ClusterId, drainRequest.ClusterOffline)
+			c.instances.Lock(fragment.AppInstanceId)
+			err := c.undeployFragment(drainRequest.ClusterId.OrganizationId, fragment.AppInstanceId, fragment.FragmentId, drainRequest.ClusterId.ClusterId, drainRequest.ClusterOffline)
+			c.instances.Unlock(fragment.AppInstanceId)
+			if err != nil {
+				c.recordDrainedFragment(operationId, entities.DRAINED_FRAGMENT_FAILED)
+			} else {
+				c.recordDrainedFragment(operationId, entities.DRAINED_FRAGMENT_REMOVED)
+			}
 		}
+		c.recordPhase(operationId, entities.PHASE_FRAGMENTS_REMOVED, nil)
 		log.Info().Str("clusterId", drainRequest.ClusterId.ClusterId).Msg("schedule drained operations to be scheduled again done")
 	} else {
 		// The observer will fail as no events will be sent by the deployment manager
 		for _, fragment := range toReschedule {
 			log.Debug().Msg("calling undeploy fragment")
-			c.undeployFragment(drainRequest.ClusterId.OrganizationId, fragment.AppInstanceId, fragment.FragmentId, drainRequest.ClusterId.ClusterId, drainRequest.ClusterOffline)
+			c.instances.Lock(fragment.AppInstanceId)
+			err := c.undeployFragment(drainRequest.ClusterId.OrganizationId, fragment.AppInstanceId, fragment.FragmentId, drainRequest.ClusterId.ClusterId, drainRequest.ClusterOffline)
+			c.instances.Unlock(fragment.AppInstanceId)
+			if err == nil {
+				c.recordDrainedFragment(operationId, entities.DRAINED_FRAGMENT_REMOVED)
+			}
 
 			// retrieve fragment
 			toRedeploy, err := c.AppClusterDB.GetDeploymentFragment(fragment.ClusterId, fragment.FragmentId)
-			if err != nil {
+			if err != nil || toRedeploy == nil {
 				log.Error().Err(err).Str("clusterID", fragment.ClusterId).Str("fragmentID", fragment.FragmentId).Msg("unable to redeploy fragment")
+				c.recordDrainedFragment(operationId, entities.DRAINED_FRAGMENT_FAILED)
 			} else {
 				log.Debug().Msg("scheduling fragment")
-				err := c.scheduleDeploymentFragment(toRedeploy)
+				err := reschedule(toRedeploy)
 				if err != nil {
 					log.Error().Interface("fragment", toRedeploy).Msg("unable to redeploy")
 				}
 				log.Info().Str("clusterId", drainRequest.ClusterId.ClusterId).Msg("schedule drained operations to be scheduled again done")
 			}
 		}
+		c.recordPhase(operationId, entities.PHASE_FRAGMENTS_REMOVED, nil)
+		c.finishDrain(operationId)
 	}
 
 	log.Info().Str("clusterId", drainRequest.ClusterId.ClusterId).Msg("cluster drain operation complete")
 }
 
+// Finish a drain operation once the removed fragments were scheduled again.
+func (c *Manager) finishDrain(operationId string) {
+	c.finishOperation(operationId, entities.PHASE_FRAGMENTS_RESCHEDULED)
+}
+
+// Store a new operation. Operations are not tracked if there is no operations database.
+func (c *Manager) addOperation(op *entities.Operation) {
+	if c.Operations == nil {
+		return
+	}
+	if err := c.Operations.AddOperation(op); err != nil {
+		log.Error().Err(err).Str("operationId", op.OperationId).Msg("impossible to store operation")
+	}
+}
+
+// Record a new phase of an operation. Requests not linked to any operation are ignored.
+func (c *Manager) recordPhase(operationId string, phase entities.OperationPhase, cause error) {
+	if c.Operations == nil || operationId == "" {
+		return
+	}
+	if err := c.Operations.RecordPhase(operationId, phase, cause); err != nil {
+		log.Error().Err(err).Str("operationId", operationId).Msg("impossible to record operation phase")
+	}
+}
+
+// Count a fragment handled by a drain operation.
+func (c *Manager) recordDrainedFragment(operationId string, outcome entities.DrainedFragmentOutcome) {
+	if c.Operations == nil || operationId == "" {
+		return
+	}
+	if err := c.Operations.RecordDrainedFragment(operationId, outcome); err != nil {
+		log.Error().Err(err).Str("operationId", operationId).Msg("impossible to record drained fragment")
+	}
+}
+
+// Finish an operation after reaching its final phase.
+func (c *Manager) finishOperation(operationId string, phase entities.OperationPhase) {
+	if c.Operations == nil || operationId == "" {
+		return
+	}
+	if err := c.Operations.Finish(operationId, phase); err != nil {
+		log.Error().Err(err).Str("operationId", operationId).Msg("impossible to finish operation")
+	}
+}
+
+// Finish an operation with an error.
+func (c *Manager) failOperation(operationId string, cause error) {
+	if c.Operations == nil || operationId == "" {
+		return
+	}
+	if err := c.Operations.Fail(operationId, cause); err != nil {
+		log.Error().Err(err).Str("operationId", operationId).Msg("impossible to set operation as failed")
+	}
+}
+
+// Set the deployment operation in progress of an application instance as running.
+// params:
+//  appInstanceId application instance that is running
+func (c *Manager) DeploymentRunning(appInstanceId string) {
+	if c.Operations == nil {
+		return
+	}
+	op, err := c.Operations.GetInProgressOperation(appInstanceId, entities.DEPLOY_OPERATION)
+	if err != nil {
+		log.Error().Err(err).Str("appInstanceId", appInstanceId).Msg("impossible to find deployment operation")
+		return
+	}
+	if op != nil {
+		c.finishOperation(op.OperationId, entities.PHASE_RUNNING)
+	}
+}
+
+// Record that a deployment was queued again after a failure.
+// params:
+//  operationId operation tracking the deployment
+//  cause error that made the deployment be queued again
+func (c *Manager) DeploymentRequeued(operationId string, cause error) {
+	c.recordPhase(operationId, entities.PHASE_QUEUED, cause)
+}
+
+// Set a deployment operation as failed.
+// params:
+//  operationId operation tracking the deployment
+//  cause error that made the deployment fail
+func (c *Manager) DeploymentFailed(operationId string, cause error) {
+	c.failOperation(operationId, cause)
+}
+
 // This function schedules a existing deployment fragment to be deployed again an updates the corresponding db status.
+// Deployments and undeployments of the same instance are not processed while the fragment is scheduled again.
 // params:
 //  d deployment fragment to be deployed again
 // return:
 //  error if any
 func (c *Manager) scheduleDeploymentFragment(d *entities.DeploymentFragment) derrors.Error {
 	log.Debug().Str("deploymentFragmentId", d.DeploymentId).Msg("deployment fragment to be re-scheduled")
+	c.instances.Lock(d.AppInstanceId)
+	defer c.instances.Unlock(d.AppInstanceId)
 	// Update the application instance removing the affected service group
 	ctx, cancel := context.WithTimeout(context.Background(), ConductorAppTimeout*time.Second)
 	defer cancel()
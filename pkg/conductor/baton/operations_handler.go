@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Service in charge of reporting the progress of long running operations: deployments, undeployments and cluster
+// drains.
+
+package baton
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+	pbConductor "github.com/nalej/grpc-conductor-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/rs/zerolog/log"
+)
+
+// Component storing the long running operations.
+type OperationsProvider interface {
+	GetOperation(operationId string) (*entities.Operation, derrors.Error)
+	GetOperationsByRequestId(requestId string) ([]entities.Operation, derrors.Error)
+	GetOperationsByAppInstanceId(appInstanceId string) ([]entities.Operation, derrors.Error)
+}
+
+//OperationsHandler struct with a related OperationsProvider
+type OperationsHandler struct {
+	operations OperationsProvider
+}
+
+//NewOperationsHandler creates a new OperationsHandler with its given OperationsProvider
+func NewOperationsHandler(operations OperationsProvider) *OperationsHandler {
+	return &OperationsHandler{operations: operations}
+}
+
+//GetOperation validates the request and retrieves an operation with its phases
+func (h *OperationsHandler) GetOperation(ctx context.Context, request *pbConductor.OperationId) (*pbConductor.Operation, error) {
+	log.Debug().Interface("operationId", request).Msg("GetOperation")
+	if err := entities.ValidOperationId(request); err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+	if err := h.checkOperations(); err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+	op, err := h.operations.GetOperation(request.OperationId)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+	// operations of other organizations are not disclosed
+	if op == nil || op.OrganizationId != request.OrganizationId {
+		return nil, conversions.ToGRPCError(
+			derrors.NewNotFoundError(fmt.Sprintf("operation %s not found", request.OperationId)))
+	}
+	return op.ToGRPC(), nil
+}
+
+//ListOperations validates the request and lists the operations triggered by a request or the operations of an
+//application instance
+func (h *OperationsHandler) ListOperations(ctx context.Context, request *pbConductor.ListOperationsRequest) (*pbConductor.OperationList, error) {
+	log.Debug().Interface("listOperationsRequest", request).Msg("ListOperations")
+	if err := entities.ValidListOperationsRequest(request); err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+	if err := h.checkOperations(); err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+	var ops []entities.Operation
+	var err derrors.Error
+	if request.RequestId != "" {
+		ops, err = h.operations.GetOperationsByRequestId(request.RequestId)
+	} else {
+		ops, err = h.operations.GetOperationsByAppInstanceId(request.AppInstanceId)
+	}
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+	result := make([]*pbConductor.Operation, 0, len(ops))
+	for _, op := range ops {
+		if op.OrganizationId == request.OrganizationId {
+			result = append(result, op.ToGRPC())
+		}
+	}
+	return &pbConductor.OperationList{Operations: result}, nil
+}
+
+// Check that the operations are being tracked.
+func (h *OperationsHandler) checkOperations() derrors.Error {
+	if h.operations == nil {
+		return derrors.NewUnavailableError("operations are not being tracked")
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package baton
+
+import (
+	"context"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/internal/persistence/operations"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/conductor/pkg/provider/kv"
+	pbConductor "github.com/nalej/grpc-conductor-go"
+	"github.com/nalej/grpc-utils/pkg/test"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"os"
+)
+
+var _ = ginkgo.Describe("Operations server API", func() {
+
+	var server *grpc.Server
+	var listener *bufconn.Listener
+	var client pbConductor.ConductorOperationsClient
+	var opsDB *operations.OperationsDB
+	var localDB provider.KeyValueProvider
+	dbPath := "/tmp/operations_handler_test.db"
+
+	ginkgo.BeforeEach(func() {
+		aux, errDB := kv.NewLocalDB(dbPath)
+		gomega.Expect(errDB).ToNot(gomega.HaveOccurred())
+		localDB = aux
+		opsDB = operations.NewOperationsDB(localDB)
+
+		listener = test.GetDefaultListener()
+		server = grpc.NewServer()
+		pbConductor.RegisterConductorOperationsServer(server, NewOperationsHandler(opsDB))
+		test.LaunchServer(server, listener)
+
+		conn, err := test.GetConn(*listener)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		client = pbConductor.NewConductorOperationsClient(conn)
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Stop()
+		listener.Close()
+		gomega.Expect(localDB.Close()).ToNot(gomega.HaveOccurred())
+		gomega.Expect(os.Remove(dbPath)).ToNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("returns the progress of a drain operation", func() {
+		op := entities.NewDrainOperation("org1", "cluster1", 2)
+		gomega.Expect(opsDB.AddOperation(op)).ToNot(gomega.HaveOccurred())
+		gomega.Expect(opsDB.RecordPhase(op.OperationId, entities.PHASE_DRAIN_STARTED, nil)).ToNot(gomega.HaveOccurred())
+		gomega.Expect(opsDB.RecordDrainedFragment(op.OperationId, entities.DRAINED_FRAGMENT_REMOVED)).
+			ToNot(gomega.HaveOccurred())
+
+		result, err := client.GetOperation(context.Background(),
+			&pbConductor.OperationId{OrganizationId: "org1", OperationId: op.OperationId})
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(result.Type).To(gomega.Equal(pbConductor.OperationType_DRAIN))
+		gomega.Expect(result.ClusterId).To(gomega.Equal("cluster1"))
+		gomega.Expect(result.Status).To(gomega.Equal(pbConductor.OperationStatus_IN_PROGRESS))
+		gomega.Expect(result.Drain).ToNot(gomega.BeNil())
+		gomega.Expect(result.Drain.TotalFragments).To(gomega.Equal(int32(2)))
+		gomega.Expect(result.Drain.RemovedFragments).To(gomega.Equal(int32(1)))
+	})
+
+	ginkgo.It("returns an operation with its phases", func() {
+		op := entities.NewOperation("op1", entities.DEPLOY_OPERATION, "req1", "org1", "app1", "")
+		gomega.Expect(opsDB.AddOperation(op)).ToNot(gomega.HaveOccurred())
+		gomega.Expect(opsDB.RecordPhase("op1", entities.PHASE_QUEUED, nil)).ToNot(gomega.HaveOccurred())
+
+		result, err := client.GetOperation(context.Background(),
+			&pbConductor.OperationId{OrganizationId: "org1", OperationId: "op1"})
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(result.RequestId).To(gomega.Equal("req1"))
+		gomega.Expect(result.Phases).To(gomega.HaveLen(1))
+		gomega.Expect(result.Phases[0].Phase).To(gomega.Equal(string(entities.PHASE_QUEUED)))
+		gomega.Expect(result.Finished).To(gomega.BeZero())
+	})
+
+	ginkgo.It("lists the operations by request and application instance", func() {
+		gomega.Expect(opsDB.AddOperation(entities.NewOperation("op1", entities.DEPLOY_OPERATION, "req1", "org1", "app1", ""))).
+			ToNot(gomega.HaveOccurred())
+		gomega.Expect(opsDB.AddOperation(entities.NewOperation("op2", entities.UNDEPLOY_OPERATION, "", "org1", "app1", ""))).
+			ToNot(gomega.HaveOccurred())
+
+		byRequest, err := client.ListOperations(context.Background(),
+			&pbConductor.ListOperationsRequest{OrganizationId: "org1", RequestId: "req1"})
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(byRequest.Operations).To(gomega.HaveLen(1))
+
+		byApp, err := client.ListOperations(context.Background(),
+			&pbConductor.ListOperationsRequest{OrganizationId: "org1", AppInstanceId: "app1"})
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(byApp.Operations).To(gomega.HaveLen(2))
+
+		otherOrg, err := client.ListOperations(context.Background(),
+			&pbConductor.ListOperationsRequest{OrganizationId: "org2", AppInstanceId: "app1"})
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(otherOrg.Operations).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("returns not found for unknown operations and operations of other organizations", func() {
+		gomega.Expect(opsDB.AddOperation(entities.NewOperation("op1", entities.DEPLOY_OPERATION, "req1", "org1", "app1", ""))).
+			ToNot(gomega.HaveOccurred())
+		_, err := client.GetOperation(context.Background(),
+			&pbConductor.OperationId{OrganizationId: "org1", OperationId: "unknown"})
+		gomega.Expect(status.Code(err)).To(gomega.Equal(codes.NotFound))
+		_, err = client.GetOperation(context.Background(),
+			&pbConductor.OperationId{OrganizationId: "org2", OperationId: "op1"})
+		gomega.Expect(status.Code(err)).To(gomega.Equal(codes.NotFound))
+	})
+
+	ginkgo.It("rejects invalid requests", func() {
+		_, err := client.GetOperation(context.Background(), &pbConductor.OperationId{OrganizationId: "org1"})
+		gomega.Expect(status.Code(err)).To(gomega.Equal(codes.InvalidArgument))
+		_, err = client.ListOperations(context.Background(), &pbConductor.ListOperationsRequest{OrganizationId: "org1"})
+		gomega.Expect(status.Code(err)).To(gomega.Equal(codes.InvalidArgument))
+	})
+})
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Service in charge of processing planning gRPC requests.
+
+package baton
+
+import (
+	"context"
+
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+	pbConductor "github.com/nalej/grpc-conductor-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/rs/zerolog/log"
+)
+
+// Component able to compute plans without deploying them.
+type DryRunner interface {
+	DryRun(request *entities.DryRunRequest) (*entities.DryRunResult, derrors.Error)
+}
+
+//PlanningHandler struct with a related DryRunner
+type PlanningHandler struct {
+	planner DryRunner
+}
+
+//NewPlanningHandler creates a new PlanningHandler with its given DryRunner
+func NewPlanningHandler(planner DryRunner) *PlanningHandler {
+	return &PlanningHandler{planner: planner}
+}
+
+//DryRun validates the request and computes the plan of an application instance or descriptor without deploying it
+func (h *PlanningHandler) DryRun(ctx context.Context, request *pbConductor.DryRunRequest) (*pbConductor.DryRunResponse, error) {
+	log.Debug().Interface("dryRunRequest", request).Msg("DryRun")
+	toPlan := entities.NewDryRunRequestFromGRPC(request)
+	if err := entities.ValidDryRunRequest(toPlan); err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+	result, err := h.planner.DryRun(toPlan)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+	return result.ToGRPC(), nil
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package baton
+
+import (
+	"context"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+	pbConductor "github.com/nalej/grpc-conductor-go"
+	"github.com/nalej/grpc-utils/pkg/test"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Planner returning a fixed plan and recording the received requests.
+type fakeDryRunner struct {
+	received []entities.DryRunRequest
+}
+
+func (f *fakeDryRunner) DryRun(request *entities.DryRunRequest) (*entities.DryRunResult, derrors.Error) {
+	f.received = append(f.received, *request)
+	if request.AppDescriptorId == "unknown" {
+		return nil, derrors.NewNotFoundError("descriptor not found")
+	}
+	score := entities.NewClustersScore()
+	clusterScore := entities.NewClusterDeploymentScore("cluster1")
+	clusterScore.AddScore([]string{"group1"}, 0.5)
+	score.AddClusterScore(clusterScore)
+	plan := &entities.DeploymentPlan{
+		DeploymentId:   "plan1",
+		OrganizationId: request.OrganizationId,
+		AppInstanceId:  request.AppInstanceId,
+		Fragments:      []entities.DeploymentFragment{{FragmentId: "fragment1", ClusterId: "cluster1"}},
+	}
+	return &entities.DryRunResult{Score: &score, Plan: plan}, nil
+}
+
+var _ = ginkgo.Describe("Planning server API", func() {
+
+	var server *grpc.Server
+	var listener *bufconn.Listener
+	var client pbConductor.ConductorPlanningClient
+	var planner *fakeDryRunner
+
+	ginkgo.BeforeEach(func() {
+		listener = test.GetDefaultListener()
+		server = grpc.NewServer()
+		planner = &fakeDryRunner{}
+		pbConductor.RegisterConductorPlanningServer(server, NewPlanningHandler(planner))
+		test.LaunchServer(server, listener)
+
+		conn, err := test.GetConn(*listener)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		client = pbConductor.NewConductorPlanningClient(conn)
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Stop()
+		listener.Close()
+	})
+
+	ginkgo.It("returns the plan of an application instance", func() {
+		result, err := client.DryRun(context.Background(),
+			&pbConductor.DryRunRequest{OrganizationId: "org1", AppInstanceId: "app1"})
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(planner.received).To(gomega.Equal([]entities.DryRunRequest{
+			{OrganizationId: "org1", AppInstanceId: "app1"}}))
+
+		gomega.Expect(result.Plan).ToNot(gomega.BeNil())
+		gomega.Expect(result.Plan.DeploymentId).To(gomega.Equal("plan1"))
+		gomega.Expect(result.Plan.Fragments).To(gomega.HaveLen(1))
+		gomega.Expect(result.Plan.Fragments[0].ClusterId).To(gomega.Equal("cluster1"))
+
+		gomega.Expect(result.Scores).To(gomega.HaveLen(1))
+		gomega.Expect(result.Scores[0].ClusterId).To(gomega.Equal("cluster1"))
+		gomega.Expect(result.Scores[0].Scores).To(gomega.HaveKeyWithValue("group1", float32(0.5)))
+	})
+
+	ginkgo.It("returns the plan of an application descriptor", func() {
+		_, err := client.DryRun(context.Background(),
+			&pbConductor.DryRunRequest{OrganizationId: "org1", AppDescriptorId: "desc1"})
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(planner.received).To(gomega.Equal([]entities.DryRunRequest{
+			{OrganizationId: "org1", AppDescriptorId: "desc1"}}))
+	})
+
+	ginkgo.It("rejects invalid requests", func() {
+		_, err := client.DryRun(context.Background(), &pbConductor.DryRunRequest{OrganizationId: "org1"})
+		gomega.Expect(status.Code(err)).To(gomega.Equal(codes.InvalidArgument))
+		gomega.Expect(planner.received).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("returns the errors of the planner", func() {
+		_, err := client.DryRun(context.Background(),
+			&pbConductor.DryRunRequest{OrganizationId: "org1", AppDescriptorId: "unknown"})
+		gomega.Expect(status.Code(err)).To(gomega.Equal(codes.NotFound))
+	})
+})
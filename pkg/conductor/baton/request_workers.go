@@ -0,0 +1,248 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package baton
+
+import (
+	"context"
+	"github.com/nalej/conductor/internal/entities"
+	"sync"
+)
+
+// Default number of deployment requests processed concurrently.
+const DefaultDeploymentWorkers = 4
+
+// Set of locks per application instance. Operations on the same application instance are serialized while
+// operations on different instances run concurrently.
+type instanceLocks struct {
+	// locks indexed by app instance id
+	locks map[string]*instanceLock
+	// Mutex for the locks map
+	mux sync.Mutex
+}
+
+type instanceLock struct {
+	mux sync.Mutex
+	// number of goroutines holding or waiting for this lock
+	refs int
+}
+
+func newInstanceLocks() *instanceLocks {
+	return &instanceLocks{locks: make(map[string]*instanceLock, 0)}
+}
+
+// Lock the indicated application instance.
+//  params:
+//   appInstanceId identifier of the instance to be locked
+func (l *instanceLocks) Lock(appInstanceId string) {
+	l.mux.Lock()
+	entry, found := l.locks[appInstanceId]
+	if !found {
+		entry = &instanceLock{}
+		l.locks[appInstanceId] = entry
+	}
+	entry.refs++
+	l.mux.Unlock()
+	entry.mux.Lock()
+}
+
+// Unlock the indicated application instance.
+//  params:
+//   appInstanceId identifier of the instance to be unlocked
+func (l *instanceLocks) Unlock(appInstanceId string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	entry, found := l.locks[appInstanceId]
+	if !found {
+		return
+	}
+	entry.refs--
+	if entry.refs == 0 {
+		delete(l.locks, appInstanceId)
+	}
+	entry.mux.Unlock()
+}
+
+// Work to be done on an application instance: a deployment request or a task such as its teardown.
+type instanceWork struct {
+	// deployment request to be processed
+	request *entities.DeploymentRequest
+	// task to be run if there is no request
+	task func()
+}
+
+// Pool of workers processing deployment requests. Requests and tasks for the same application instance are
+// processed one after the other in the same order they were dispatched.
+type requestWorkers struct {
+	// free slots for workers
+	slots chan struct{}
+	// work waiting for a previous request or task of the same instance to finish, indexed by app instance id.
+	// An entry exists while work of that instance is being processed.
+	pending map[string][]*instanceWork
+	// functions cancelling the requests being processed, indexed by app instance id
+	inflight map[string]context.CancelFunc
+	// function in charge of processing every request. The context is cancelled when the request is cancelled.
+	process func(ctx context.Context, req *entities.DeploymentRequest)
+	// Mutex for the pending and inflight maps
+	mux sync.Mutex
+}
+
+// Create a new pool of workers.
+//  params:
+//   numWorkers maximum number of requests processed concurrently
+//   process function to be called for every request
+//  return:
+//   pool of workers
+func newRequestWorkers(numWorkers int, process func(ctx context.Context, req *entities.DeploymentRequest)) *requestWorkers {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	return &requestWorkers{slots: make(chan struct{}, numWorkers),
+		pending: make(map[string][]*instanceWork, 0), inflight: make(map[string]context.CancelFunc, 0),
+		process: process}
+}
+
+// Dispatch a request. The request is appended to the pending list of its instance. If other work of the same
+// instance is being processed, the request is processed by the same worker later. Otherwise, the function blocks
+// until a worker is available. Requests waiting for a worker can be removed.
+//  params:
+//   req request to be processed
+func (w *requestWorkers) Dispatch(req *entities.DeploymentRequest) {
+	if w.enqueue(req.AppInstanceId, &instanceWork{request: req}) {
+		w.start(req.AppInstanceId)
+	}
+}
+
+// Submit a task to be run after the work of the same instance dispatched before. The function does not block,
+// the task waits for a worker in the background.
+//  params:
+//   appInstanceId identifier of the instance the task belongs to
+//   task function to be run
+func (w *requestWorkers) Submit(appInstanceId string, task func()) {
+	if w.enqueue(appInstanceId, &instanceWork{task: task}) {
+		go w.start(appInstanceId)
+	}
+}
+
+// Append work to the pending list of an instance.
+//  return:
+//   true if no work of the instance is being processed and a worker has to be started
+func (w *requestWorkers) enqueue(appInstanceId string, work *instanceWork) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if queued, busy := w.pending[appInstanceId]; busy {
+		w.pending[appInstanceId] = append(queued, work)
+		return false
+	}
+	w.pending[appInstanceId] = []*instanceWork{work}
+	return true
+}
+
+// Wait for a free worker and process the pending work of an instance.
+func (w *requestWorkers) start(appInstanceId string) {
+	w.slots <- struct{}{}
+	next, ctx := w.nextPending(appInstanceId)
+	if next == nil {
+		// removed while waiting for a worker
+		<-w.slots
+		return
+	}
+	go w.work(ctx, appInstanceId, next)
+}
+
+// Process the work of an instance and any other work of the same instance dispatched in the meantime.
+func (w *requestWorkers) work(ctx context.Context, appInstanceId string, next *instanceWork) {
+	defer func() { <-w.slots }()
+	for next != nil {
+		if next.request != nil {
+			w.process(ctx, next.request)
+		} else {
+			next.task()
+		}
+		next, ctx = w.nextPending(appInstanceId)
+	}
+}
+
+// Obtain the next pending work of an instance and release the instance if there is none. The request being
+// processed so far is no longer cancellable. If the next work is a request, the context to cancel it is returned.
+func (w *requestWorkers) nextPending(appInstanceId string) (*instanceWork, context.Context) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if cancel, found := w.inflight[appInstanceId]; found {
+		cancel()
+		delete(w.inflight, appInstanceId)
+	}
+	queued := w.pending[appInstanceId]
+	if len(queued) == 0 {
+		delete(w.pending, appInstanceId)
+		return nil, nil
+	}
+	w.pending[appInstanceId] = queued[1:]
+	next := queued[0]
+	if next.request == nil {
+		return next, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.inflight[appInstanceId] = cancel
+	return next, ctx
+}
+
+// Remove the pending requests of an application instance, including a request waiting for a worker. A request
+// already being processed and the pending tasks are not affected.
+//  params:
+//   appInstanceId identifier of the instance
+//  return:
+//   true if any request was removed
+func (w *requestWorkers) Remove(appInstanceId string) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.removeRequests(appInstanceId)
+}
+
+// Cancel the requests of an application instance: the pending requests are removed and the context of the
+// request being processed is cancelled. The pending tasks are not affected.
+//  params:
+//   appInstanceId identifier of the instance
+//  return:
+//   true if any request was removed or cancelled
+func (w *requestWorkers) Cancel(appInstanceId string) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	removed := w.removeRequests(appInstanceId)
+	if cancel, found := w.inflight[appInstanceId]; found {
+		cancel()
+		delete(w.inflight, appInstanceId)
+		removed = true
+	}
+	return removed
+}
+
+// Remove the pending requests of an instance keeping its tasks. The caller must hold the mutex.
+func (w *requestWorkers) removeRequests(appInstanceId string) bool {
+	queued, busy := w.pending[appInstanceId]
+	if !busy {
+		return false
+	}
+	tasks := make([]*instanceWork, 0, len(queued))
+	for _, work := range queued {
+		if work.request == nil {
+			tasks = append(tasks, work)
+		}
+	}
+	w.pending[appInstanceId] = tasks
+	return len(tasks) < len(queued)
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package baton
+
+import (
+	"context"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"sync"
+	"time"
+)
+
+var _ = ginkgo.Describe("Deployment request workers", func() {
+
+	ginkgo.It("processes requests of the same instance in order and never concurrently", func() {
+		var mux sync.Mutex
+		processed := make([]string, 0)
+		running := make(map[string]bool, 0)
+		overlapped := false
+		var wg sync.WaitGroup
+
+		workers := newRequestWorkers(4, func(ctx context.Context, req *entities.DeploymentRequest) {
+			defer wg.Done()
+			mux.Lock()
+			if running[req.AppInstanceId] {
+				overlapped = true
+			}
+			running[req.AppInstanceId] = true
+			mux.Unlock()
+
+			time.Sleep(time.Millisecond * 20)
+
+			mux.Lock()
+			running[req.AppInstanceId] = false
+			processed = append(processed, req.RequestId)
+			mux.Unlock()
+		})
+
+		ids := []string{"req1", "req2", "req3"}
+		wg.Add(len(ids))
+		for _, id := range ids {
+			workers.Dispatch(&entities.DeploymentRequest{RequestId: id, AppInstanceId: "app1"})
+		}
+		wg.Wait()
+
+		gomega.Expect(overlapped).To(gomega.BeFalse())
+		gomega.Expect(processed).To(gomega.Equal(ids))
+	})
+
+	ginkgo.It("processes requests of different instances concurrently", func() {
+		release := make(chan struct{})
+		started := make(chan string, 2)
+		var wg sync.WaitGroup
+		wg.Add(2)
+
+		workers := newRequestWorkers(2, func(ctx context.Context, req *entities.DeploymentRequest) {
+			defer wg.Done()
+			started <- req.AppInstanceId
+			<-release
+		})
+		workers.Dispatch(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		workers.Dispatch(&entities.DeploymentRequest{RequestId: "req2", AppInstanceId: "app2"})
+
+		// both requests must be running before any of them finishes
+		for i := 0; i < 2; i++ {
+			gomega.Eventually(started).Should(gomega.Receive())
+		}
+		close(release)
+		wg.Wait()
+	})
+
+	ginkgo.It("removes pending requests of an instance", func() {
+		release := make(chan struct{})
+		processed := make(chan string, 2)
+
+		workers := newRequestWorkers(1, func(ctx context.Context, req *entities.DeploymentRequest) {
+			<-release
+			processed <- req.RequestId
+		})
+		workers.Dispatch(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		workers.Dispatch(&entities.DeploymentRequest{RequestId: "req2", AppInstanceId: "app1"})
+
+		gomega.Expect(workers.Remove("app1")).To(gomega.BeTrue())
+		gomega.Expect(workers.Remove("app2")).To(gomega.BeFalse())
+		close(release)
+
+		gomega.Eventually(processed).Should(gomega.Receive(gomega.Equal("req1")))
+		gomega.Consistently(processed, time.Millisecond*100).ShouldNot(gomega.Receive())
+	})
+
+	ginkgo.It("removes requests waiting for a free worker", func() {
+		release := make(chan struct{})
+		processed := make(chan string, 2)
+
+		workers := newRequestWorkers(1, func(ctx context.Context, req *entities.DeploymentRequest) {
+			<-release
+			processed <- req.RequestId
+		})
+		workers.Dispatch(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		// the only worker is busy, so the second request blocks until it is free
+		go workers.Dispatch(&entities.DeploymentRequest{RequestId: "req2", AppInstanceId: "app2"})
+
+		gomega.Eventually(func() bool { return workers.Remove("app2") }).Should(gomega.BeTrue())
+		close(release)
+
+		gomega.Eventually(processed).Should(gomega.Receive(gomega.Equal("req1")))
+		gomega.Consistently(processed, time.Millisecond*100).ShouldNot(gomega.Receive())
+	})
+
+	ginkgo.It("runs tasks after the requests of the instance without blocking", func() {
+		release := make(chan struct{})
+		processed := make(chan string, 2)
+
+		workers := newRequestWorkers(1, func(ctx context.Context, req *entities.DeploymentRequest) {
+			<-release
+			processed <- req.RequestId
+		})
+		workers.Dispatch(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		// the worker is busy, the task must not block the caller
+		workers.Submit("app1", func() { processed <- "task" })
+		gomega.Consistently(processed, time.Millisecond*100).ShouldNot(gomega.Receive())
+		close(release)
+
+		gomega.Eventually(processed).Should(gomega.Receive(gomega.Equal("req1")))
+		gomega.Eventually(processed).Should(gomega.Receive(gomega.Equal("task")))
+	})
+
+	ginkgo.It("cancels the request in progress and removes the pending ones keeping the tasks", func() {
+		processed := make(chan string, 3)
+
+		workers := newRequestWorkers(1, func(ctx context.Context, req *entities.DeploymentRequest) {
+			<-ctx.Done()
+			processed <- req.RequestId
+		})
+		workers.Dispatch(&entities.DeploymentRequest{RequestId: "req1", AppInstanceId: "app1"})
+		workers.Dispatch(&entities.DeploymentRequest{RequestId: "req2", AppInstanceId: "app1"})
+		workers.Submit("app1", func() { processed <- "task" })
+
+		gomega.Expect(workers.Cancel("app1")).To(gomega.BeTrue())
+		gomega.Expect(workers.Cancel("app2")).To(gomega.BeFalse())
+
+		gomega.Eventually(processed).Should(gomega.Receive(gomega.Equal("req1")))
+		gomega.Eventually(processed).Should(gomega.Receive(gomega.Equal("task")))
+		gomega.Consistently(processed, time.Millisecond*100).ShouldNot(gomega.Receive())
+	})
+})
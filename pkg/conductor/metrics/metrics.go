@@ -0,0 +1,195 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Prometheus metrics exported by the conductor.
+
+package metrics
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// Namespace of the conductor metrics
+const Namespace = "conductor"
+
+// Path where the metrics are served
+const MetricsPath = "/metrics"
+
+// Phases of a deployment request
+const (
+	PhaseRequirements = "requirements"
+	PhaseScoring      = "scoring"
+	PhasePlanDesign   = "plan_design"
+	PhaseNetwork      = "network_prep"
+	PhaseDeployPlan   = "deploy_plan"
+)
+
+// Queue of deployment requests to be monitored.
+type QueueStats interface {
+	// queue length
+	Len() int
+	// Time the oldest queued request has been waiting since it was pushed.
+	OldestRequestAge() time.Duration
+}
+
+// Pending plans to be monitored.
+type PendingPlansStats interface {
+	// Number of monitored plans, fragments and services.
+	Stats() (int, int, int)
+}
+
+// Registry containing the conductor metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Time spent in every phase of a deployment request
+	DeploymentPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "deployment_phase_duration_seconds",
+		Help:      "Time spent in every phase of a deployment request",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"phase"})
+
+	// Time spent querying the musician of every cluster
+	MusicianScoringDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "musician_scoring_duration_seconds",
+		Help:      "Time spent querying the musician of a cluster for a score",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"cluster"})
+
+	// Failed queries to the musician of every cluster
+	MusicianScoringErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "musician_scoring_errors_total",
+		Help:      "Number of failed queries to the musician of a cluster",
+	}, []string{"cluster"})
+
+	// Deployment requests enqueued again after a failure
+	DeploymentRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "deployment_retries_total",
+		Help:      "Number of deployment requests enqueued again after a failure",
+	})
+
+	// Deployment requests reported as DEPLOYMENT_ERROR
+	DeploymentErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "deployment_errors_total",
+		Help:      "Number of deployment requests with a DEPLOYMENT_ERROR outcome",
+	})
+)
+
+func init() {
+	Registry.MustRegister(DeploymentPhaseDuration, MusicianScoringDuration, MusicianScoringErrors,
+		DeploymentRetries, DeploymentErrors)
+}
+
+// Observe the time spent in a phase of a deployment request.
+//  params:
+//   phase deployment phase
+//   start time the phase started
+func ObservePhase(phase string, start time.Time) {
+	DeploymentPhaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
+
+// Observe a query to the musician of a cluster.
+//  params:
+//   clusterId cluster identifier
+//   start time the query started
+//   failed true if the query failed
+func ObserveMusicianScoring(clusterId string, start time.Time, failed bool) {
+	MusicianScoringDuration.WithLabelValues(clusterId).Observe(time.Since(start).Seconds())
+	if failed {
+		MusicianScoringErrors.WithLabelValues(clusterId).Inc()
+	}
+}
+
+// Export the depth of a requests queue and the age of its oldest request.
+//  params:
+//   queue queue to be monitored
+//  return:
+//   error if the queue metrics were already registered
+func RegisterQueue(queue QueueStats) derrors.Error {
+	depth := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "queue_depth",
+		Help:      "Number of queued deployment requests",
+	}, func() float64 {
+		return float64(queue.Len())
+	})
+	age := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "queue_oldest_request_age_seconds",
+		Help:      "Time the oldest queued deployment request has been waiting",
+	}, func() float64 {
+		return queue.OldestRequestAge().Seconds()
+	})
+	return register(depth, age)
+}
+
+// Export the number of pending plans, fragments and services.
+//  params:
+//   plans pending plans to be monitored
+//  return:
+//   error if the pending plans metrics were already registered
+func RegisterPendingPlans(plans PendingPlansStats) derrors.Error {
+	numPlans := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "pending_plans",
+		Help:      "Number of deployment plans being monitored",
+	}, func() float64 {
+		p, _, _ := plans.Stats()
+		return float64(p)
+	})
+	numFragments := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "pending_fragments",
+		Help:      "Number of deployment fragments being monitored",
+	}, func() float64 {
+		_, f, _ := plans.Stats()
+		return float64(f)
+	})
+	numServices := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "pending_services",
+		Help:      "Number of services being monitored",
+	}, func() float64 {
+		_, _, s := plans.Stats()
+		return float64(s)
+	})
+	return register(numPlans, numFragments, numServices)
+}
+
+// Register a set of collectors in the conductor registry.
+func register(collectors ...prometheus.Collector) derrors.Error {
+	for _, c := range collectors {
+		if err := Registry.Register(c); err != nil {
+			return derrors.NewAlreadyExistsError("impossible to register conductor metrics", err)
+		}
+	}
+	return nil
+}
+
+// Handler serving the conductor metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package metrics
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// Queue with fixed statistics
+type testQueue struct {
+	length int
+	age    time.Duration
+}
+
+func (q *testQueue) Len() int {
+	return q.length
+}
+
+func (q *testQueue) OldestRequestAge() time.Duration {
+	return q.age
+}
+
+// Pending plans with fixed statistics
+type testPendingPlans struct {
+	plans     int
+	fragments int
+	services  int
+}
+
+func (p *testPendingPlans) Stats() (int, int, int) {
+	return p.plans, p.fragments, p.services
+}
+
+var _ = ginkgo.Describe("Conductor metrics", func() {
+
+	var server *httptest.Server
+	queue := &testQueue{}
+	plans := &testPendingPlans{}
+
+	ginkgo.BeforeEach(func() {
+		server = httptest.NewServer(Handler())
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	scrape := func() string {
+		res, err := http.Get(server.URL + MetricsPath)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer res.Body.Close()
+		gomega.Expect(res.StatusCode).To(gomega.Equal(http.StatusOK))
+		body, err := ioutil.ReadAll(res.Body)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		return string(body)
+	}
+
+	ginkgo.It("exports the queue and the pending plans when they are read", func() {
+		err := RegisterQueue(queue)
+		gomega.Expect(err).To(gomega.BeNil())
+		err = RegisterPendingPlans(plans)
+		gomega.Expect(err).To(gomega.BeNil())
+
+		queue.length = 3
+		queue.age = time.Second * 90
+		plans.plans, plans.fragments, plans.services = 2, 4, 7
+		body := scrape()
+		gomega.Expect(body).To(gomega.ContainSubstring("conductor_queue_depth 3"))
+		gomega.Expect(body).To(gomega.ContainSubstring("conductor_queue_oldest_request_age_seconds 90"))
+		gomega.Expect(body).To(gomega.ContainSubstring("conductor_pending_plans 2"))
+		gomega.Expect(body).To(gomega.ContainSubstring("conductor_pending_fragments 4"))
+		gomega.Expect(body).To(gomega.ContainSubstring("conductor_pending_services 7"))
+
+		queue.length = 0
+		gomega.Expect(scrape()).To(gomega.ContainSubstring("conductor_queue_depth 0"))
+
+		// the same metrics cannot be exported twice
+		gomega.Expect(RegisterQueue(queue)).ToNot(gomega.BeNil())
+	})
+
+	ginkgo.It("exports the deployment phases and the musician queries", func() {
+		ObservePhase(PhaseScoring, time.Now().Add(-time.Second))
+		ObserveMusicianScoring("cluster1", time.Now(), false)
+		ObserveMusicianScoring("cluster2", time.Now(), true)
+		DeploymentRetries.Inc()
+		DeploymentErrors.Inc()
+
+		body := scrape()
+		gomega.Expect(body).To(gomega.ContainSubstring(`conductor_deployment_phase_duration_seconds_count{phase="scoring"} 1`))
+		gomega.Expect(body).To(gomega.ContainSubstring(`conductor_musician_scoring_duration_seconds_count{cluster="cluster1"} 1`))
+		gomega.Expect(body).To(gomega.ContainSubstring(`conductor_musician_scoring_duration_seconds_count{cluster="cluster2"} 1`))
+		gomega.Expect(body).To(gomega.ContainSubstring(`conductor_musician_scoring_errors_total{cluster="cluster2"} 1`))
+		gomega.Expect(body).ToNot(gomega.ContainSubstring(`conductor_musician_scoring_errors_total{cluster="cluster1"}`))
+		gomega.Expect(body).To(gomega.ContainSubstring("conductor_deployment_retries_total 1"))
+		gomega.Expect(body).To(gomega.ContainSubstring("conductor_deployment_errors_total 1"))
+	})
+})
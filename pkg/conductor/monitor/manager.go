@@ -26,6 +26,7 @@ import (
 	"github.com/nalej/conductor/internal/entities"
 	"github.com/nalej/conductor/internal/structures"
 	"github.com/nalej/conductor/pkg/conductor/baton"
+	"github.com/nalej/conductor/pkg/conductor/metrics"
 	"github.com/nalej/conductor/pkg/utils"
 	"github.com/nalej/derrors"
 	pbApplication "github.com/nalej/grpc-application-go"
@@ -130,14 +131,8 @@ func (m *Manager) UpdateFragmentStatus(request *pbConductor.DeploymentFragmentUp
 
 	log.Debug().Interface("finalStatus", finalStatus).Msg("update deployment fragment status")
 
-	// Update the view of this deployment fragment in the DB
-	df, err := m.manager.AppClusterDB.GetDeploymentFragment(request.ClusterId, request.FragmentId)
-	if err != nil {
-		e := derrors.NewInternalError("impossible to get deployment fragment status from database", err)
-		return e
-	}
-	df.Status = finalStatus
-	err = m.manager.AppClusterDB.AddDeploymentFragment(df)
+	// Update the view of this deployment fragment in the DB. The change is notified to the fragment observers.
+	_, err := m.manager.AppClusterDB.UpdateFragmentStatus(request.ClusterId, request.FragmentId, finalStatus)
 	if err != nil {
 		e := derrors.NewInternalError("impossible to update deployment fragment status in database", err)
 		return e
@@ -339,6 +334,9 @@ func (m *Manager) updateAppInstanceServiceStatus(instance *pbApplication.AppInst
 		log.Debug().Str("appInstanceId", instance.AppInstanceId).
 			Msg(fmt.Sprintf("update app instance status from %s ---> %s", instance.Status, finalAppStatus))
 		instance.Status = finalAppStatus
+		if finalAppStatus == pbApplication.ApplicationStatus_RUNNING {
+			m.manager.DeploymentRunning(instance.AppInstanceId)
+		}
 	}
 
 	// Update endpoints
@@ -376,7 +374,7 @@ func (m *Manager) updateAppInstanceServiceStatus(instance *pbApplication.AppInst
 //   update request status
 func (m *Manager) processFailedFragment(request *pbConductor.DeploymentFragmentUpdateRequest) *pbApplication.UpdateAppStatusRequest {
 	// get deployment request associated with this plan
-	plan, isThere := m.pendingPlans.Pending[request.DeploymentId]
+	plan, isThere := m.pendingPlans.GetPendingPlan(request.DeploymentId)
 	if !isThere {
 		log.Error().Str("deploymentId", request.DeploymentId).Msg("no pending plan for the deployment id")
 		return nil
@@ -390,12 +388,21 @@ func (m *Manager) processFailedFragment(request *pbConductor.DeploymentFragmentU
 		// Status:
 	}
 
+	if plan.DeploymentRequest == nil {
+		// plans recovered from the deployed fragments after a restart have no request to retry
+		log.Error().Str("deploymentId", request.DeploymentId).Msg("no deployment request to retry the pending plan")
+		toReturn.Status = pbApplication.ApplicationStatus_ERROR
+		toReturn.Info = "deployment request not available to retry the deployment"
+		if request.Info != "" {
+			toReturn.Info = toReturn.Info + " [" + request.Info + "]"
+		}
+		return toReturn
+	}
+
 	// How many times have we tried to deploy this?
 	if plan.DeploymentRequest.NumRetries < baton.ConductorMaxDeploymentRetries-1 {
 		// there is room for one more attempt
-		plan.DeploymentRequest.NumRetries = plan.DeploymentRequest.NumRetries + 1
-		t := time.Now()
-		plan.DeploymentRequest.TimeRetry = &t
+		m.pendingPlans.RecordRetry(request.DeploymentId, time.Now())
 		log.Info().Interface("fragmentUpdate", request).Int32("numRetries", plan.DeploymentRequest.NumRetries).
 			Msg("fragment deployment failed. Enqueue deployment for another retry")
 		// Push this into the queue
@@ -407,13 +414,16 @@ func (m *Manager) processFailedFragment(request *pbConductor.DeploymentFragmentU
 			if request.Info != "" {
 				toReturn.Info = toReturn.Info + " [" + request.Info + "]"
 			}
+			m.manager.DeploymentFailed(plan.DeploymentRequest.OperationId, errors.New(toReturn.Info))
 
 		} else {
+			metrics.DeploymentRetries.Inc()
 			toReturn.Status = pbApplication.ApplicationStatus_QUEUED
 			toReturn.Info = "app queued after failed deployment"
 			if request.Info != "" {
 				toReturn.Info = toReturn.Info + " [" + request.Info + "]"
 			}
+			m.manager.DeploymentRequeued(plan.DeploymentRequest.OperationId, errors.New(toReturn.Info))
 		}
 	} else {
 		// no more retries for this request
@@ -424,6 +434,7 @@ func (m *Manager) processFailedFragment(request *pbConductor.DeploymentFragmentU
 		if request.Info != "" {
 			toReturn.Info = toReturn.Info + " [" + request.Info + "]"
 		}
+		m.manager.DeploymentFailed(plan.DeploymentRequest.OperationId, errors.New(toReturn.Info))
 	}
 
 	// Undeploy the application
@@ -26,9 +26,14 @@ import (
 	"time"
 )
 
-const CheckSleepTime = time.Second
+// This observer can be used to wait for certain deployment fragments and take actions. The observer
+// subscribes to the changes of the app cluster db, so every transition of the observed fragments is evaluated.
 
-// This observer can be used to wait for certain deployment fragments and take actions.
+// Attempts to read the stored state of an observed fragment before giving up on checking it
+const fragmentReadAttempts = 3
+
+// Time to wait between the attempts to read an observed fragment
+const fragmentReadRetryDelay = time.Millisecond * 100
 
 // Auxiliary structure
 type ObservableDeploymentFragment struct {
@@ -37,6 +42,35 @@ type ObservableDeploymentFragment struct {
 	AppInstanceId string
 }
 
+// Condition to be observed in a deployment fragment. The fragment is nil when it is not stored.
+type FragmentPredicate func(fragment *entities.DeploymentFragment) bool
+
+// Predicate satisfied when the fragment reaches a status.
+func StatusIs(status entities.DeploymentFragmentStatus) FragmentPredicate {
+	return func(fragment *entities.DeploymentFragment) bool {
+		return fragment != nil && fragment.Status == status
+	}
+}
+
+// Predicate satisfied when the fragment is not stored.
+func Gone() FragmentPredicate {
+	return func(fragment *entities.DeploymentFragment) bool {
+		return fragment == nil
+	}
+}
+
+// Predicate satisfied when any of the given predicates is satisfied.
+func AnyOf(predicates ...FragmentPredicate) FragmentPredicate {
+	return func(fragment *entities.DeploymentFragment) bool {
+		for _, p := range predicates {
+			if p(fragment) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 type DeploymentFragmentsObserver struct {
 	// Map with the clusterId -> appInstanceId
 	Ids []ObservableDeploymentFragment
@@ -44,97 +78,80 @@ type DeploymentFragmentsObserver struct {
 	AppClusterDB *app_cluster.AppClusterDB
 	// Remaining changes to occur
 	RemainingChanges int
+	// Subscription to the changes of the observed fragments
+	subscription *app_cluster.Subscription
 }
 
+// Create a new observer. The observer subscribes to the changes of the fragments on creation, so the transitions
+// occurring before any of the observe functions is called are not lost. The observe functions release the
+// subscription when they finish, an observer that is not going to be run must be closed.
 func NewDeploymentFragmentsObserver(ids []ObservableDeploymentFragment, appClusterDB *app_cluster.AppClusterDB) DeploymentFragmentsObserver {
-	return DeploymentFragmentsObserver{Ids: ids, AppClusterDB: appClusterDB, RemainingChanges: len(ids)}
+	df := DeploymentFragmentsObserver{Ids: ids, AppClusterDB: appClusterDB, RemainingChanges: len(ids)}
+	df.subscribe()
+	return df
+}
+
+// Release the subscription of an observer that is not going to be run.
+func (df *DeploymentFragmentsObserver) Close() {
+	if df.subscription != nil {
+		df.subscription.Close()
+	}
+}
+
+// Subscribe to the changes of the observed fragments.
+func (df *DeploymentFragmentsObserver) subscribe() {
+	observed := make(map[string]bool, len(df.Ids))
+	for _, id := range df.Ids {
+		observed[observedKey(id.ClusterId, id.FragmentId)] = true
+	}
+	df.subscription = df.AppClusterDB.Subscribe(func(event app_cluster.FragmentEvent) bool {
+		return observed[observedKey(event.ClusterId, event.FragmentId)]
+	})
 }
 
 // Observe changes in the list of observed deployment fragments and run the indicated function if the deployment fragment
 // changes into the given status type. The observer will stop when all the deployment fragments have been observed to
 // change or when a timeout is reached. When this happens the callback function will be called using the
+// organization id of the observed fragments.
 // params:
 //  timeout duration for the timeout of this context
 //  status to be detected
 //  targetOrganizationId
 //  f function to be called when the defined status is found
 //  callback function to be called when the observe method has finished. This function receives a variable number
-// return:
-//  error if any
 func (df *DeploymentFragmentsObserver) ObserveOrganizationLevel(
 	timeout time.Duration,
 	status entities.DeploymentFragmentStatus,
 	targetOrganizationId string,
 	f func(*entities.DeploymentFragment) derrors.Error,
 	callback func(string)) {
-	log.Debug().Interface("observableItems", df.Ids).Msgf("started deployments fragment observer with %d "+
-		"pending observations", df.RemainingChanges)
-	sleep := time.Tick(CheckSleepTime)
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	// store here processed items
-	processed := make(map[string]bool, len(df.Ids))
-	for _, id := range df.Ids {
-		processed[id.FragmentId] = false
-	}
+	df.ObserveOrganizationLevelWhen(timeout, StatusIs(status), targetOrganizationId, f, callback)
+}
 
+// Observe the list of deployment fragments and run the indicated function when a fragment satisfies the predicate.
+// The observer will stop when all the deployment fragments have satisfied the predicate or when a timeout is reached.
+// When this happens the callback function will be called using the organization id of the observed fragments.
+// params:
+//  timeout duration for the timeout of this context
+//  predicate to be satisfied by the fragments
+//  targetOrganizationId
+//  f function to be called when a fragment satisfies the predicate
+//  callback function to be called when the observe method has finished
+func (df *DeploymentFragmentsObserver) ObserveOrganizationLevelWhen(
+	timeout time.Duration,
+	predicate FragmentPredicate,
+	targetOrganizationId string,
+	f func(*entities.DeploymentFragment) derrors.Error,
+	callback func(string)) {
 	if callback != nil {
-		defer callback(targetOrganizationId)
+		defer func() { callback(targetOrganizationId) }()
 	}
-
-	for {
-		select {
-		case <-sleep:
-			for _, observed := range df.Ids {
-				clusterId := observed.ClusterId
-				fragmentId := observed.FragmentId
-
-				// skip if we have already processed this entry
-				done, _ := processed[fragmentId]
-				if done {
-					continue
-				}
-
-				fragment, err := df.AppClusterDB.GetDeploymentFragment(clusterId, fragmentId)
-
-				if fragment == nil {
-					log.Debug().Msgf("no deployment fragment stored for cluster %s with id %s", clusterId, fragmentId)
-					continue
-				}
-
-				targetOrganizationId = fragment.OrganizationId
-
-				if err != nil {
-					log.Error().Err(err).Str("clusterId", clusterId).Str("fragmentId", fragmentId).
-						Msg("error when collecting fragment data")
-					continue
-				}
-
-				if fragment.Status == status {
-					if e := f(fragment); e != nil {
-						log.Error().Err(err).Msg("error when executing callback function after observing change")
-					}
-					// set this entry as processed
-					processed[fragmentId] = true
-
-					// one observed reduce the counter
-					df.RemainingChanges = df.RemainingChanges - 1
-					log.Debug().Msgf("remaining %d deployment fragments to observe", df.RemainingChanges)
-
-					if df.RemainingChanges == 0 {
-						log.Debug().Msg("deployment fragments observer stops after all the elements were processed")
-						return
-					}
-				}
-			}
-
-		case <-ctx.Done():
-			log.Debug().Interface("observableItems", df.Ids).Interface("processed", processed).
-				Msg("timeout reached for deployment fragments observer")
-			return
+	df.observe(timeout, predicate, func(fragment *entities.DeploymentFragment) derrors.Error {
+		if fragment.OrganizationId != "" {
+			targetOrganizationId = fragment.OrganizationId
 		}
-	}
+		return f(fragment)
+	})
 }
 
 // Observe changes in the list of observed deployment fragments and run the indicated function if the deployment fragment
@@ -144,82 +161,139 @@ func (df *DeploymentFragmentsObserver) ObserveOrganizationLevel(
 // params:
 //  timeout duration for the timeout of this context
 //  status to be detected
-//  targetOrganizationId
-//  targetAppInstanceId
 //  f function to be called when the defined status is found
-//  callback function to be called when the observe method has finished. This function targets a single app instance
-//  and requires the organization id and the app instance id.
-// return:
-//  error if any
+//  callback function to be called when the observe method has finished
 func (df *DeploymentFragmentsObserver) Observe(
 	timeout time.Duration,
 	status entities.DeploymentFragmentStatus,
 	f func(*entities.DeploymentFragment) derrors.Error,
 	callback func()) {
+	df.ObserveWhen(timeout, StatusIs(status), f, callback)
+}
+
+// Observe the list of deployment fragments and run the indicated function when a fragment satisfies the predicate.
+// The observer will stop when all the deployment fragments have satisfied the predicate or when a timeout is reached.
+// params:
+//  timeout duration for the timeout of this context
+//  predicate to be satisfied by the fragments
+//  f function to be called when a fragment satisfies the predicate
+//  callback function to be called when the observe method has finished
+func (df *DeploymentFragmentsObserver) ObserveWhen(
+	timeout time.Duration,
+	predicate FragmentPredicate,
+	f func(*entities.DeploymentFragment) derrors.Error,
+	callback func()) {
+	if callback != nil {
+		defer callback()
+	}
+	df.observe(timeout, predicate, f)
+}
+
+// Key identifying an observed fragment
+func observedKey(clusterId string, fragmentId string) string {
+	return clusterId + "/" + fragmentId
+}
+
+// Wait for the observed fragments to satisfy a predicate. The subscription is created before checking the
+// stored fragments so no transition between the check and the arrival of the events is lost.
+func (df *DeploymentFragmentsObserver) observe(
+	timeout time.Duration,
+	predicate FragmentPredicate,
+	f func(*entities.DeploymentFragment) derrors.Error) {
 	log.Debug().Interface("observableItems", df.Ids).Msgf("started deployments fragment observer with %d "+
 		"pending observations", df.RemainingChanges)
-	sleep := time.Tick(CheckSleepTime)
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	if df.subscription == nil {
+		df.subscribe()
+	}
+	defer df.subscription.Close()
+	if df.RemainingChanges <= 0 {
+		return
+	}
 
-	// store here processed items
+	// store here the observed items and whether they were processed
+	observed := make(map[string]ObservableDeploymentFragment, len(df.Ids))
 	processed := make(map[string]bool, len(df.Ids))
 	for _, id := range df.Ids {
-		processed[id.FragmentId] = false
+		key := observedKey(id.ClusterId, id.FragmentId)
+		observed[key] = id
+		processed[key] = false
 	}
 
-	if callback != nil {
-		defer callback()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// check evaluates the current state of a fragment and returns true when all the fragments were processed
+	check := func(key string, current *entities.DeploymentFragment, last *entities.DeploymentFragment) bool {
+		if processed[key] || !predicate(current) {
+			return false
+		}
+		target := current
+		if target == nil {
+			target = last
+		}
+		if target == nil {
+			// the fragment is not known, use the observed identifiers
+			id := observed[key]
+			target = &entities.DeploymentFragment{ClusterId: id.ClusterId, FragmentId: id.FragmentId,
+				AppInstanceId: id.AppInstanceId}
+		}
+		if e := f(target); e != nil {
+			log.Error().Err(e).Msg("error when executing callback function after observing change")
+		}
+		// set this entry as processed
+		processed[key] = true
+
+		// one observed reduce the counter
+		df.RemainingChanges = df.RemainingChanges - 1
+		log.Debug().Msgf("remaining %d deployment fragments to observe", df.RemainingChanges)
+		return df.RemainingChanges == 0
 	}
 
-	for {
-		select {
-		case <-sleep:
-			for _, observed := range df.Ids {
-				clusterId := observed.ClusterId
-				fragmentId := observed.FragmentId
-
-				// skip if we have already processed this entry
-				done, _ := processed[fragmentId]
-				if done {
-					continue
-				}
-
-				fragment, err := df.AppClusterDB.GetDeploymentFragment(clusterId, fragmentId)
-
-				if fragment == nil {
-					log.Debug().Msgf("no deployment fragment stored for cluster %s with id %s", clusterId, fragmentId)
-					continue
-				}
-
-				if err != nil {
-					log.Error().Err(err).Str("clusterId", clusterId).Str("fragmentId", fragmentId).
-						Msg("error when collecting fragment data")
-					continue
-				}
-
-				if fragment.Status == status {
-					if e := f(fragment); e != nil {
-						log.Error().Err(err).Msg("error when executing callback function after observing change")
-					}
-					// set this entry as processed
-					processed[fragmentId] = true
-
-					// one observed reduce the counter
-					df.RemainingChanges = df.RemainingChanges - 1
-					log.Debug().Msgf("remaining %d deployment fragments to observe", df.RemainingChanges)
-
-					if df.RemainingChanges == 0 {
-						log.Debug().Msg("deployment fragments observer stops after all the elements were processed")
-						return
-					}
-				}
-			}
+	// check the stored fragments in case they already satisfy the predicate
+	for _, id := range df.Ids {
+		fragment, err := df.readFragment(id)
+		if err != nil {
+			// a fragment that cannot be read is not gone, its events are still observed
+			log.Error().Str("err", err.DebugReport()).Str("clusterId", id.ClusterId).
+				Str("fragmentId", id.FragmentId).Msg("impossible to read the observed deployment fragment")
+			continue
+		}
+		if check(observedKey(id.ClusterId, id.FragmentId), fragment, nil) {
+			log.Debug().Msg("deployment fragments observer stops after all the elements were processed")
+			return
+		}
+	}
 
-		case <-ctx.Done():
+	for {
+		event, ok := df.subscription.Next(ctx)
+		if !ok {
 			log.Debug().Interface("observableItems", df.Ids).Interface("processed", processed).
 				Msg("timeout reached for deployment fragments observer")
 			return
 		}
+		if check(observedKey(event.ClusterId, event.FragmentId), event.Current, event.Previous) {
+			log.Debug().Msg("deployment fragments observer stops after all the elements were processed")
+			return
+		}
+	}
+}
+
+// Read the stored state of an observed fragment retrying on errors.
+// params:
+//  id observed fragment
+// return:
+//  the fragment, nil if it is not stored, or the latest error if it could not be read
+func (df *DeploymentFragmentsObserver) readFragment(id ObservableDeploymentFragment) (*entities.DeploymentFragment, derrors.Error) {
+	var err derrors.Error
+	for attempt := 1; attempt <= fragmentReadAttempts; attempt++ {
+		var fragment *entities.DeploymentFragment
+		fragment, err = df.AppClusterDB.GetDeploymentFragment(id.ClusterId, id.FragmentId)
+		if err == nil {
+			return fragment, nil
+		}
+		if attempt < fragmentReadAttempts {
+			time.Sleep(fragmentReadRetryDelay)
+		}
 	}
+	return nil, err
 }
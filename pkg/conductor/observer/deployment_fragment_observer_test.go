@@ -0,0 +1,159 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package observer
+
+import (
+	"context"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/internal/persistence/app_cluster"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/conductor/pkg/provider/kv"
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ = ginkgo.Describe("deployment fragments observer", func() {
+
+	var db *app_cluster.AppClusterDB
+	var localDB provider.KeyValueProvider
+	dbPath := "/tmp/deployment_fragments_observer_test.db"
+
+	ids := []ObservableDeploymentFragment{
+		{ClusterId: "cluster1", FragmentId: "fragment1", AppInstanceId: "app1"},
+		{ClusterId: "cluster2", FragmentId: "fragment2", AppInstanceId: "app1"},
+	}
+
+	ginkgo.BeforeEach(func() {
+		aux, errDB := kv.NewLocalDB(dbPath)
+		gomega.Expect(errDB).ToNot(gomega.HaveOccurred())
+
+		localDB = aux
+		db = app_cluster.NewAppClusterDB(localDB)
+		for _, id := range ids {
+			err := db.AddDeploymentFragment(&entities.DeploymentFragment{ClusterId: id.ClusterId,
+				FragmentId: id.FragmentId, AppInstanceId: id.AppInstanceId, OrganizationId: "org1"})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		errClose := localDB.Close()
+		gomega.Expect(errClose).ToNot(gomega.HaveOccurred())
+
+		err := os.Remove(dbPath)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	})
+
+	// collect the fragments processed by the observer
+	var mu sync.Mutex
+	var found []string
+	collect := func(d *entities.DeploymentFragment) derrors.Error {
+		mu.Lock()
+		defer mu.Unlock()
+		found = append(found, d.FragmentId)
+		return nil
+	}
+
+	ginkgo.BeforeEach(func() {
+		found = make([]string, 0)
+	})
+
+	ginkgo.It("reacts to status transitions", func() {
+		fragmentsObserver := NewDeploymentFragmentsObserver(ids, db)
+		done := make(chan struct{})
+		go fragmentsObserver.Observe(time.Minute, entities.FRAGMENT_TERMINATING, collect, func() { close(done) })
+
+		for _, id := range ids {
+			_, err := db.UpdateFragmentStatus(id.ClusterId, id.FragmentId, entities.FRAGMENT_TERMINATING)
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		}
+		gomega.Eventually(done, time.Second).Should(gomega.BeClosed())
+		gomega.Expect(found).To(gomega.ConsistOf("fragment1", "fragment2"))
+	})
+
+	ginkgo.It("does not lose transitions before observing", func() {
+		fragmentsObserver := NewDeploymentFragmentsObserver(ids, db)
+		// the fragments are terminated and removed before the observer runs
+		for _, id := range ids {
+			_, err := db.UpdateFragmentStatus(id.ClusterId, id.FragmentId, entities.FRAGMENT_TERMINATING)
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			err = db.DeleteDeploymentFragment(id.ClusterId, id.FragmentId)
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		}
+		fragmentsObserver.Observe(time.Second, entities.FRAGMENT_TERMINATING, collect, nil)
+		gomega.Expect(found).To(gomega.ConsistOf("fragment1", "fragment2"))
+		gomega.Expect(fragmentsObserver.RemainingChanges).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("waits for a predicate", func() {
+		fragmentsObserver := NewDeploymentFragmentsObserver(ids, db)
+		organizationId := ""
+		done := make(chan struct{})
+		go fragmentsObserver.ObserveOrganizationLevelWhen(time.Minute,
+			AnyOf(StatusIs(entities.FRAGMENT_TERMINATING), Gone()), "", collect,
+			func(orgId string) {
+				organizationId = orgId
+				close(done)
+			})
+
+		_, err := db.UpdateFragmentStatus("cluster1", "fragment1", entities.FRAGMENT_TERMINATING)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		err = db.DeleteDeploymentFragment("cluster2", "fragment2")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		gomega.Eventually(done, time.Second).Should(gomega.BeClosed())
+		gomega.Expect(found).To(gomega.ConsistOf("fragment1", "fragment2"))
+		gomega.Expect(organizationId).To(gomega.Equal("org1"))
+	})
+
+	ginkgo.It("stops when the timeout is reached", func() {
+		fragmentsObserver := NewDeploymentFragmentsObserver(ids, db)
+		fragmentsObserver.Observe(100*time.Millisecond, entities.FRAGMENT_TERMINATING, collect, nil)
+		gomega.Expect(found).To(gomega.BeEmpty())
+		gomega.Expect(fragmentsObserver.RemainingChanges).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("considers gone the fragments of clusters without fragments stored", func() {
+		missing := []ObservableDeploymentFragment{{ClusterId: "cluster3", FragmentId: "fragment3", AppInstanceId: "app1"}}
+		fragmentsObserver := NewDeploymentFragmentsObserver(missing, db)
+		fragmentsObserver.ObserveWhen(100*time.Millisecond, Gone(), collect, nil)
+		gomega.Expect(found).To(gomega.ConsistOf("fragment3"))
+	})
+
+	ginkgo.It("does not consider gone the fragments that cannot be read", func() {
+		fragmentsObserver := NewDeploymentFragmentsObserver(ids, db)
+		// reads fail once the database is closed
+		gomega.Expect(localDB.Close()).To(gomega.Succeed())
+		fragmentsObserver.ObserveWhen(100*time.Millisecond, Gone(), collect, nil)
+		gomega.Expect(found).To(gomega.BeEmpty())
+		gomega.Expect(fragmentsObserver.RemainingChanges).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("releases the subscription when closed", func() {
+		fragmentsObserver := NewDeploymentFragmentsObserver(ids, db)
+		fragmentsObserver.Close()
+		_, err := db.UpdateFragmentStatus("cluster1", "fragment1", entities.FRAGMENT_TERMINATING)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		_, received := fragmentsObserver.subscription.Next(context.Background())
+		gomega.Expect(received).To(gomega.BeFalse())
+	})
+})
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plandesigner
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/internal/structures"
+	"github.com/nalej/conductor/pkg/conductor"
+	"github.com/nalej/conductor/pkg/utils"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+)
+
+/*
+ * This plan designer builds the plan in the same way the simple replica plan designer does, but the target clusters
+ * of all the groups of the application are computed together by the placement solver of the deployment matrix
+ * instead of greedily group by group.
+ */
+
+func NewOptimalPlanDesigner(connHelper *utils.ConnectionsHelper, networkOperator conductor.NetworkOperator) PlanDesigner {
+	designer := NewSimpleReplicaPlanDesigner(connHelper, networkOperator).(*SimpleReplicaPlanDesigner)
+	designer.placer = findOptimalTargetClusters
+	return designer
+}
+
+// Return a map with the list of groups to be deployed per cluster computed by the placement solver.
+// return:
+//  map with the list of groups to be deployed per cluster clusterId -> [group0, group1...]
+//  map with the number of replicas per group id
+//  error if any
+func findOptimalTargetClusters(
+	desc entities.AppDescriptor,
+	deploymentMatrix *structures.DeploymentMatrix) (map[string][]entities.ServiceGroup, map[string]int, derrors.Error) {
+
+	placement, err := deploymentMatrix.FindOptimalPlacement(desc.Groups)
+	if err != nil {
+		log.Error().Err(err).Msg("impossible to find a placement for the application groups")
+		return nil, nil, err
+	}
+
+	resultClusters := make(map[string][]entities.ServiceGroup, 0)
+	resultReplicas := make(map[string]int, 0)
+	for _, g := range desc.Groups {
+		targets, found := placement[g.ServiceGroupId]
+		if !found || len(targets) == 0 {
+			// no replicas were required for this service group
+			continue
+		}
+		log.Debug().Str("groupName", g.Name).Strs("targets", targets).Msg("targets to be deployed on")
+		resultReplicas[g.ServiceGroupId] = len(targets)
+		for _, t := range targets {
+			resultClusters[t] = append(resultClusters[t], g)
+		}
+	}
+	return resultClusters, resultReplicas, nil
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"github.com/nalej/conductor/internal/entities"
 	"github.com/nalej/conductor/pkg/utils"
+	pbApplication "github.com/nalej/grpc-application-go"
 	"strings"
 )
 
@@ -39,6 +40,20 @@ type PlanDesigner interface {
 	DesignPlan(app entities.AppInstance,
 		score entities.DeploymentScore, request entities.DeploymentRequest, groupIds []string,
 		deployedGroups map[string][]string) (*entities.DeploymentPlan, error)
+
+	// Elaborate a deployment plan for a descriptor without any side effect. Service group instances are
+	// simulated and nothing is stored in the system model.
+	//  params:
+	//   app application instance the plan is designed for
+	//   desc parametrized descriptor of the application
+	//   score obtained by musicians
+	//   request deployment request for this plan
+	//   deployedGroups service groups already running per cluster, nil if the application is not deployed
+	//  return:
+	//   A collection of deployment plans each one designed to run in a different cluster.
+	DryRunPlan(app entities.AppInstance, desc *pbApplication.ParametrizedDescriptor,
+		score entities.DeploymentScore, request entities.DeploymentRequest,
+		deployedGroups map[string][]string) (*entities.DeploymentPlan, error)
 }
 
 const (
@@ -19,6 +19,7 @@ package plandesigner
 
 import (
 	"context"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/nalej/conductor/internal/entities"
 	"github.com/nalej/conductor/internal/structures"
@@ -49,16 +50,24 @@ type SimpleReplicaPlanDesigner struct {
 	authxClient pbAuthx.AuthxClient
 	// Network operator
 	networkOperator conductor.NetworkOperator
+	// Function to find the clusters where every group is deployed
+	placer targetClustersFinder
 }
 
+// Function returning the list of groups to be deployed per cluster and the number of replicas per group id.
+type targetClustersFinder func(desc entities.AppDescriptor,
+	deploymentMatrix *structures.DeploymentMatrix) (map[string][]entities.ServiceGroup, map[string]int, derrors.Error)
+
 func NewSimpleReplicaPlanDesigner(connHelper *utils.ConnectionsHelper, networkOperator conductor.NetworkOperator) PlanDesigner {
 	connectionsSM := connHelper.GetSystemModelClients()
 	appClient := pbApplication.NewApplicationsClient(connectionsSM.GetConnections()[0])
 	orgClient := pbOrganization.NewOrganizationsClient(connectionsSM.GetConnections()[0])
 	connectionsAuthx := connHelper.GetAuthxClients()
 	authxClient := pbAuthx.NewAuthxClient(connectionsAuthx.GetConnections()[0])
-	return &SimpleReplicaPlanDesigner{appClient: appClient, orgClient: orgClient, connHelper: connHelper,
+	designer := &SimpleReplicaPlanDesigner{appClient: appClient, orgClient: orgClient, connHelper: connHelper,
 		authxClient: authxClient, networkOperator: networkOperator}
+	designer.placer = designer.findTargetClusters
+	return designer
 }
 
 func (p *SimpleReplicaPlanDesigner) DesignPlan(app entities.AppInstance,
@@ -77,6 +86,25 @@ func (p *SimpleReplicaPlanDesigner) DesignPlan(app entities.AppInstance,
 		return nil, theErr
 	}
 
+	return p.buildPlan(app, retrievedDesc, score, request, groupIds, deployedGroups, false)
+}
+
+func (p *SimpleReplicaPlanDesigner) DryRunPlan(app entities.AppInstance, desc *pbApplication.ParametrizedDescriptor,
+	score entities.DeploymentScore, request entities.DeploymentRequest,
+	deployedGroups map[string][]string) (*entities.DeploymentPlan, error) {
+
+	log.Debug().Str("appInstanceId", app.AppInstanceId).Str("appDescriptorId", desc.AppDescriptorId).
+		Interface("deployedGroup", deployedGroups).Msg("dry run plan invoked")
+
+	return p.buildPlan(app, desc, score, request, nil, deployedGroups, true)
+}
+
+// Build the plan for a given descriptor. In a dry run the service group instances are simulated instead of
+// being added to the system model and the secrets of the device groups are not retrieved.
+func (p *SimpleReplicaPlanDesigner) buildPlan(app entities.AppInstance, retrievedDesc *pbApplication.ParametrizedDescriptor,
+	score entities.DeploymentScore, request entities.DeploymentRequest, groupIds []string,
+	deployedGroups map[string][]string, dryRun bool) (*entities.DeploymentPlan, error) {
+
 	// get organization name
 	org, err := p.orgClient.GetOrganization(context.Background(),
 		&pbOrganization.OrganizationId{OrganizationId: app.OrganizationId})
@@ -138,7 +166,7 @@ func (p *SimpleReplicaPlanDesigner) DesignPlan(app entities.AppInstance,
 	log.Debug().Interface("toDeploy", toDeploy).Msg("this is to deploy")
 
 	// Compute the list of groups to be deployed per cluster
-	clustersMap, groupReplicas, err := p.findTargetClusters(toDeploy, deploymentMatrix)
+	clustersMap, groupReplicas, err := p.placer(toDeploy, deploymentMatrix)
 	if err != nil {
 		return nil, err
 	}
@@ -147,29 +175,17 @@ func (p *SimpleReplicaPlanDesigner) DesignPlan(app entities.AppInstance,
 		Msg("result after finding target clusters")
 
 	// Instantiate the number of replicas we need for every group
-	groupInstances := make(map[string][]entities.ServiceGroupInstance)
-	for serviceGroupId, numReplicas := range groupReplicas {
-		log.Debug().Str("serviceGroupId", serviceGroupId).Int("numReplicas", numReplicas).Msg("instantiate service groups")
-		instancesReq := pbApplication.AddServiceGroupInstancesRequest{
-			AppDescriptorId: app.AppDescriptorId,
-			AppInstanceId:   app.AppInstanceId,
-			OrganizationId:  app.OrganizationId,
-			ServiceGroupId:  serviceGroupId,
-			NumInstances:    int32(numReplicas),
-		}
-		serviceInstances, err := p.appClient.AddServiceGroupInstances(context.Background(), &instancesReq)
+	var groupInstances map[string][]entities.ServiceGroupInstance
+	if dryRun {
+		groupInstances = simulateServiceGroupInstances(app, toDeploy, groupReplicas)
+	} else {
+		groupInstances, err = p.addServiceGroupInstances(app, groupReplicas)
 		if err != nil {
-			log.Error().Err(err).Msg("it was impossible to instantiate the service")
 			return nil, err
 		}
-		createdInstances := make([]entities.ServiceGroupInstance, len(serviceInstances.ServiceGroupInstances))
-		for i, theInstance := range serviceInstances.ServiceGroupInstances {
-			createdInstances[i] = entities.NewServiceGroupInstanceFromGRPC(theInstance)
-		}
-		groupInstances[serviceInstances.ServiceGroupInstances[0].Name] = createdInstances
 	}
 
-	fragments, err := p.buildFragmentsPerCluster(toDeploy, clustersMap, app, groupsOrder, groupInstances, planId, org)
+	fragments, err := p.buildFragmentsPerCluster(toDeploy, clustersMap, app, groupsOrder, groupInstances, planId, org, dryRun)
 
 	if err != nil {
 		log.Error().Err(err).Msg("impossible to build deployment fragments")
@@ -196,6 +212,76 @@ func (p *SimpleReplicaPlanDesigner) DesignPlan(app entities.AppInstance,
 	return &newPlan, nil
 }
 
+// Add the service group instances required by the plan to the system model.
+// return:
+//  map with the list of instances per group name
+func (p *SimpleReplicaPlanDesigner) addServiceGroupInstances(app entities.AppInstance,
+	groupReplicas map[string]int) (map[string][]entities.ServiceGroupInstance, error) {
+	groupInstances := make(map[string][]entities.ServiceGroupInstance)
+	for serviceGroupId, numReplicas := range groupReplicas {
+		log.Debug().Str("serviceGroupId", serviceGroupId).Int("numReplicas", numReplicas).Msg("instantiate service groups")
+		instancesReq := pbApplication.AddServiceGroupInstancesRequest{
+			AppDescriptorId: app.AppDescriptorId,
+			AppInstanceId:   app.AppInstanceId,
+			OrganizationId:  app.OrganizationId,
+			ServiceGroupId:  serviceGroupId,
+			NumInstances:    int32(numReplicas),
+		}
+		serviceInstances, err := p.appClient.AddServiceGroupInstances(context.Background(), &instancesReq)
+		if err != nil {
+			log.Error().Err(err).Msg("it was impossible to instantiate the service")
+			return nil, err
+		}
+		createdInstances := make([]entities.ServiceGroupInstance, len(serviceInstances.ServiceGroupInstances))
+		for i, theInstance := range serviceInstances.ServiceGroupInstances {
+			createdInstances[i] = entities.NewServiceGroupInstanceFromGRPC(theInstance)
+		}
+		groupInstances[serviceInstances.ServiceGroupInstances[0].Name] = createdInstances
+	}
+	return groupInstances, nil
+}
+
+// Build local service group instances for a dry run. Identifiers are generated locally and nothing is stored
+// in the system model.
+// return:
+//  map with the list of instances per group name
+func simulateServiceGroupInstances(app entities.AppInstance, desc entities.AppDescriptor,
+	groupReplicas map[string]int) map[string][]entities.ServiceGroupInstance {
+	toReturn := make(map[string][]entities.ServiceGroupInstance, 0)
+	for _, g := range desc.Groups {
+		numReplicas, found := groupReplicas[g.ServiceGroupId]
+		if !found {
+			continue
+		}
+		instances := make([]entities.ServiceGroupInstance, numReplicas)
+		for i := 0; i < numReplicas; i++ {
+			groupInstanceId := uuid.New().String()
+			services := make([]entities.ServiceInstance, len(g.Services))
+			for j, serv := range g.Services {
+				instance := serv.ToServiceInstance(app.AppInstanceId)
+				instance.ServiceInstanceId = uuid.New().String()
+				instance.ServiceGroupId = g.ServiceGroupId
+				instance.ServiceGroupInstanceId = groupInstanceId
+				services[j] = *instance
+			}
+			instances[i] = entities.ServiceGroupInstance{
+				OrganizationId:         app.OrganizationId,
+				AppDescriptorId:        app.AppDescriptorId,
+				AppInstanceId:          app.AppInstanceId,
+				ServiceGroupId:         g.ServiceGroupId,
+				ServiceGroupInstanceId: groupInstanceId,
+				Name:                   g.Name,
+				ServiceInstances:       services,
+				Policy:                 g.Policy,
+				Specs:                  g.Specs,
+				Labels:                 g.Labels,
+			}
+		}
+		toReturn[g.Name] = instances
+	}
+	return toReturn
+}
+
 // Build the fragments to be sent to every cluster
 func (p *SimpleReplicaPlanDesigner) buildFragmentsPerCluster(
 	desc entities.AppDescriptor,
@@ -204,7 +290,8 @@ func (p *SimpleReplicaPlanDesigner) buildFragmentsPerCluster(
 	groupsOrder map[string][][]entities.Service,
 	groupInstances map[string][]entities.ServiceGroupInstance,
 	planId string,
-	org *pbOrganization.Organization) ([]entities.DeploymentFragment, derrors.Error) {
+	org *pbOrganization.Organization,
+	dryRun bool) ([]entities.DeploymentFragment, derrors.Error) {
 
 	toReturn := make([]entities.DeploymentFragment, 0)
 	// combine all the groups per cluster into the corresponding fragment
@@ -227,7 +314,7 @@ func (p *SimpleReplicaPlanDesigner) buildFragmentsPerCluster(
 
 			// this stage must deploy the services following this order
 			for _, sequence := range groupsOrder[g.Name] {
-				stage, err := p.buildDeploymentStage(desc, fragmentUUID, localGroupInstance, sequence)
+				stage, err := p.buildDeploymentStage(desc, fragmentUUID, localGroupInstance, sequence, dryRun)
 				if err != nil {
 					log.Error().Err(err).Str("fragmentId", fragmentUUID).Msg("impossible to build stage")
 					return nil, derrors.NewGenericError("impossible to build stage", err)
@@ -268,29 +355,104 @@ func (p *SimpleReplicaPlanDesigner) findTargetClusters(
 	resultClusters := make(map[string][]entities.ServiceGroup, 0)
 	resultReplicas := make(map[string]int, 0)
 
+	// Groups with a SameCluster policy are placed as a single unit. Groups with a SeparateClusters policy
+	// cannot share a cluster with any other SeparateClusters group.
+	collocated := make([]entities.ServiceGroup, 0)
+	separated := make([]entities.ServiceGroup, 0)
+	remaining := make([]entities.ServiceGroup, 0)
 	for _, g := range desc.Groups {
-		log.Debug().Str("groupName", g.Name).Msg("find target cluster for this group")
-		targets, err := deploymentMatrix.FindBestTargetsForReplication(g)
+		switch g.Policy {
+		case entities.SameCluster:
+			collocated = append(collocated, g)
+		case entities.SeparateClusters:
+			separated = append(separated, g)
+		default:
+			remaining = append(remaining, g)
+		}
+	}
+
+	units := make([][]entities.ServiceGroup, 0)
+	if len(collocated) > 0 {
+		units = append(units, collocated)
+	}
+	for _, g := range separated {
+		units = append(units, []entities.ServiceGroup{g})
+	}
+	for _, g := range remaining {
+		units = append(units, []entities.ServiceGroup{g})
+	}
+
+	// clusters already running a SeparateClusters group
+	// cluster id -> service group id
+	separatedClusters := make(map[string]string, 0)
+	for clusterId, groupIds := range deploymentMatrix.GroupsCluster {
+		for _, g := range separated {
+			for _, groupId := range groupIds {
+				if groupId == g.ServiceGroupId {
+					separatedClusters[clusterId] = g.ServiceGroupId
+				}
+			}
+		}
+	}
+
+	for _, unit := range units {
+		groupNames := make([]string, len(unit))
+		for i, g := range unit {
+			groupNames[i] = g.Name
+		}
+		log.Debug().Strs("groupNames", groupNames).Msg("find target cluster for these groups")
+
+		isSeparated := len(unit) == 1 && unit[0].Policy == entities.SeparateClusters
+		var excluded map[string]bool
+		if isSeparated {
+			excluded = make(map[string]bool, 0)
+			for clusterId, groupId := range separatedClusters {
+				if groupId != unit[0].ServiceGroupId {
+					excluded[clusterId] = true
+				}
+			}
+		}
+
+		targets, err := deploymentMatrix.FindBestTargetsForCollocation(unit, excluded)
 		if err != nil {
-			log.Error().Err(err).Msg("impossible to find best targets for replication")
+			log.Error().Err(err).Strs("groupNames", groupNames).Msg("impossible to find best targets for replication")
+			if len(unit) > 1 {
+				return nil, nil, derrors.NewFailedPreconditionError(
+					fmt.Sprintf("groups %v with a same cluster policy cannot be deployed together", groupNames), err)
+			}
+			if isSeparated && len(excluded) > 0 {
+				return nil, nil, derrors.NewFailedPreconditionError(
+					fmt.Sprintf("group %s with a separate clusters policy cannot be deployed apart from other groups",
+						unit[0].Name), err)
+			}
 			return nil, nil, err
 		}
 		if targets == nil {
-			// no replicas were required for this service group
+			// no replicas were required for these service groups
 			continue
 		}
 
-		log.Debug().Str("groupName", g.Name).Interface("targets", targets).Msg("targets to be deployed on")
-		// Add the number of replicas we need for this group
-		resultReplicas[g.ServiceGroupId] = len(targets)
-
-		// Add the group per cluster
-		for _, t := range targets {
-			current, found := resultClusters[t]
+		log.Debug().Strs("groupNames", groupNames).Interface("targets", targets).Msg("targets to be deployed on")
+		for _, g := range unit {
+			groupTargets, found := targets[g.ServiceGroupId]
 			if !found {
-				resultClusters[t] = []entities.ServiceGroup{g}
-			} else {
-				resultClusters[t] = append(current, g)
+				// no replicas were required for this service group
+				continue
+			}
+			// Add the number of replicas we need for this group
+			resultReplicas[g.ServiceGroupId] = len(groupTargets)
+
+			// Add the group per cluster
+			for _, t := range groupTargets {
+				current, found := resultClusters[t]
+				if !found {
+					resultClusters[t] = []entities.ServiceGroup{g}
+				} else {
+					resultClusters[t] = append(current, g)
+				}
+				if isSeparated {
+					separatedClusters[t] = g.ServiceGroupId
+				}
 			}
 		}
 	}
@@ -310,7 +472,7 @@ func (p *SimpleReplicaPlanDesigner) existsService(sequence []entities.Service, s
 // For a given sequence of services, it generates the corresponding deployment stage. This includes the
 // instantiation of new services in a service group instance.
 func (p *SimpleReplicaPlanDesigner) buildDeploymentStage(desc entities.AppDescriptor, fragmentUUID string, group entities.ServiceGroupInstance,
-	sequence []entities.Service) (*entities.DeploymentStage, error) {
+	sequence []entities.Service, dryRun bool) (*entities.DeploymentStage, error) {
 
 	serviceNames := make(map[string]*pbApplication.ServiceInstance, 0) // variable to store the service names
 	serviceInstances := make([]entities.ServiceInstance, 0)
@@ -339,6 +501,10 @@ func (p *SimpleReplicaPlanDesigner) buildDeploymentStage(desc entities.AppDescri
 			} else if rule.Access == entities.DeviceGroup {
 				sgJwtSecrets := make([]string, 0)
 				for _, sg := range rule.DeviceGroupIds {
+					if dryRun {
+						// secrets are not exposed in a dry run
+						break
+					}
 					secret, err := p.authxClient.GetDeviceGroupSecret(context.Background(), &pbDevice.DeviceGroupId{
 						OrganizationId: rule.OrganizationId,
 						DeviceGroupId:  sg,
@@ -94,8 +94,8 @@ func (h ApplicationOpsHandler) consumeUndeployRequest() {
 	for {
 		received := <-h.cons.Config.ChUndeployRequest
 		log.Debug().Interface("undeployRequest", received).Msg("<- incoming undeploy request")
-		aux := entities.UndeployRequest{OrganizationId: received.OrganizationId, AppInstanceId: received.AppInstanceId}
-		err := h.baton.Undeploy(&aux)
+		aux := entities.NewUndeployRequest(received.OrganizationId, received.AppInstanceId)
+		err := h.baton.Undeploy(aux)
 		if err != nil {
 			log.Error().Err(err).Msg("failed processing undeploy request")
 		}
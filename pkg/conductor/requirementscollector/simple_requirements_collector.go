@@ -38,6 +38,8 @@ func (s *SimpleRequirementsCollector) FindRequirements(appDescriptor *pbApplicat
 	}
 
 	foundRequirements := entities.NewRequirements()
+	// groups that must be deployed in the same cluster
+	sameCluster := make([]string, 0)
 
 	// Generate one set of requirements per service group
 	for _, g := range appDescriptor.Groups {
@@ -51,6 +53,13 @@ func (s *SimpleRequirementsCollector) FindRequirements(appDescriptor *pbApplicat
 		}
 
 		foundRequirements.AddRequirement(*req)
+		if g.Policy == pbApplication.CollocationPolicy_SAME_CLUSTER {
+			sameCluster = append(sameCluster, req.GroupServiceId)
+		}
+	}
+
+	if len(sameCluster) > 1 {
+		foundRequirements.AddCollocationSet(sameCluster)
 	}
 
 	return &foundRequirements, nil
@@ -92,6 +101,10 @@ func (s *SimpleRequirementsCollector) FindRequirementForGroup(serviceGroupId str
 	var totalStorage int64 = 0
 	var totalCPU int64 = 0
 	var totalMemory int64 = 0
+	// resources of the largest service replica
+	var maxCPU int64 = 0
+	var maxMemory int64 = 0
+	var maxStorage int64 = 0
 
 	for _, serv := range g.Services {
 
@@ -103,8 +116,20 @@ func (s *SimpleRequirementsCollector) FindRequirementForGroup(serviceGroupId str
 		totalCPU = totalCPU + (serv.Specs.Cpu * numServReplicas)
 		totalMemory = totalMemory + (serv.Specs.Memory * numServReplicas)
 		// accumulate requested provider
+		var servStorage int64 = 0
 		for _, st := range serv.Storage {
-			totalStorage = totalStorage + (st.Size * numServReplicas)
+			servStorage = servStorage + st.Size
+		}
+		totalStorage = totalStorage + (servStorage * numServReplicas)
+
+		if serv.Specs.Cpu > maxCPU {
+			maxCPU = serv.Specs.Cpu
+		}
+		if serv.Specs.Memory > maxMemory {
+			maxMemory = serv.Specs.Memory
+		}
+		if servStorage > maxStorage {
+			maxStorage = servStorage
 		}
 	}
 
@@ -117,6 +142,9 @@ func (s *SimpleRequirementsCollector) FindRequirementForGroup(serviceGroupId str
 
 	// TODO: requirements for every fragment only permit one replica per requirement. Requirements are for a single service group
 	toReturn := entities.NewRequirement(appInstanceId, g.Name, totalCPU, totalMemory, totalStorage, 1, selectors)
+	toReturn.MaxServiceCPU = maxCPU
+	toReturn.MaxServiceMemory = maxMemory
+	toReturn.MaxServiceStorage = maxStorage
 	return &toReturn, nil
 
 }
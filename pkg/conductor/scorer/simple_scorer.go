@@ -23,25 +23,72 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/conductor/metrics"
 	"github.com/nalej/conductor/pkg/utils"
+	"github.com/nalej/derrors"
 	pbAppClusterApi "github.com/nalej/grpc-app-cluster-api-go"
 	pbConductor "github.com/nalej/grpc-conductor-go"
 	pbInfrastructure "github.com/nalej/grpc-infrastructure-go"
 	"github.com/nalej/grpc-utils/pkg/tools"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"time"
 )
 
-const MusicianQueryTimeout = time.Minute
+const (
+	// Timeout for every query to a musician
+	MusicianQueryTimeout = time.Minute
+	// Default deadline to collect the scores of all the clusters
+	DefaultScoringDeadline = time.Minute
+	// Default maximum number of musicians queried at the same time
+	DefaultMaxConcurrentQueries = 10
+)
 
 type SimpleScorer struct {
 	connHelper *utils.ConnectionsHelper
 	musicians  *tools.ConnectionsMap
 	// Infrastructure client
 	clusterClient pbInfrastructure.ClustersClient
+	// Maximum number of musicians queried at the same time
+	maxConcurrentQueries int
+	// Deadline to collect the scores of all the clusters
+	scoringDeadline time.Duration
+	// Weight the scores by the confidence of every musician
+	weightByConfidence bool
 }
 
 func NewSimpleScorer(connHelper *utils.ConnectionsHelper) Scorer {
+	return NewSimpleScorerWithLimits(connHelper, DefaultMaxConcurrentQueries, DefaultScoringDeadline)
+}
+
+// Create a simple scorer limiting how musicians are queried.
+//  params:
+//   connHelper connections helper
+//   maxConcurrentQueries maximum number of musicians queried at the same time
+//   scoringDeadline deadline to collect the scores of all the clusters
+//  return:
+//   scorer instance
+func NewSimpleScorerWithLimits(connHelper *utils.ConnectionsHelper, maxConcurrentQueries int, scoringDeadline time.Duration) Scorer {
+	return newSimpleScorer(connHelper, maxConcurrentQueries, scoringDeadline, false)
+}
+
+// Create a simple scorer weighting the scores of every musician by its confidence. Musicians with a short history
+// of observations report a low confidence.
+//  params:
+//   connHelper connections helper
+//   maxConcurrentQueries maximum number of musicians queried at the same time
+//   scoringDeadline deadline to collect the scores of all the clusters
+//  return:
+//   scorer instance
+func NewConfidenceWeightedScorer(connHelper *utils.ConnectionsHelper, maxConcurrentQueries int, scoringDeadline time.Duration) Scorer {
+	return newSimpleScorer(connHelper, maxConcurrentQueries, scoringDeadline, true)
+}
+
+func newSimpleScorer(connHelper *utils.ConnectionsHelper, maxConcurrentQueries int, scoringDeadline time.Duration,
+	weightByConfidence bool) Scorer {
 	// initialize clients
 	pool := connHelper.GetSystemModelClients()
 	if pool != nil && len(pool.GetConnections()) == 0 {
@@ -52,7 +99,16 @@ func NewSimpleScorer(connHelper *utils.ConnectionsHelper) Scorer {
 	// Create associated clients
 	clusterClient := pbInfrastructure.NewClustersClient(conn)
 
-	return SimpleScorer{musicians: connHelper.GetClusterClients(), connHelper: connHelper, clusterClient: clusterClient}
+	if maxConcurrentQueries < 1 {
+		maxConcurrentQueries = DefaultMaxConcurrentQueries
+	}
+	if scoringDeadline <= 0 {
+		scoringDeadline = DefaultScoringDeadline
+	}
+
+	return SimpleScorer{musicians: connHelper.GetClusterClients(), connHelper: connHelper, clusterClient: clusterClient,
+		maxConcurrentQueries: maxConcurrentQueries, scoringDeadline: scoringDeadline,
+		weightByConfidence: weightByConfidence}
 }
 
 // For a existing set of deployment requirements score potential candidates.
@@ -66,11 +122,20 @@ func (s SimpleScorer) ScoreRequirements(organizationId string, requirements *ent
 		log.Error().Err(nil_error)
 		return nil, nil_error
 	}
-	scores := s.collectScores(organizationId, requirements)
+	scores, timedOut := s.collectScores(organizationId, requirements)
+	return newDeploymentScore(scores, timedOut)
+}
 
+// Build the deployment score from the collected musician responses.
+//  params:
+//   scores collected musician responses, nil if none
+//   timedOut clusters that did not answer before the scoring deadline
+//  return:
+//   candidates score or error if there is no score
+func newDeploymentScore(scores []*pbConductor.ClusterScoreResponse, timedOut []string) (*entities.DeploymentScore, error) {
 	if scores == nil {
 		noScores := errors.New("no available scores found")
-		log.Error().Err(noScores).Msg("simple scorer could not collect any score")
+		log.Error().Err(noScores).Strs("timedOut", timedOut).Msg("simple scorer could not collect any score")
 		return nil, noScores
 	}
 
@@ -84,75 +149,172 @@ func (s SimpleScorer) ScoreRequirements(organizationId string, requirements *ent
 		}
 		clusterScores.AddClusterScore(collectedScores)
 	}
+	for _, clusterId := range timedOut {
+		clusterScores.AddTimedOutCluster(clusterId)
+	}
 
 	log.Debug().Str("component", "conductor").Interface("score", clusterScores).Msg("final found scores")
 	return &clusterScores, nil
 }
 
-// Internal method to query known clusters about requirements scoring.
-func (s SimpleScorer) collectScores(organizationId string, requirements *entities.Requirements) []*pbConductor.ClusterScoreResponse {
+// Result of querying the musician of a cluster.
+type clusterScoreResult struct {
+	// Cluster the result belongs to
+	clusterId string
+	// Musician response, nil if the cluster did not answer
+	response *pbConductor.ClusterScoreResponse
+	// The cluster did not answer before the deadline
+	timedOut bool
+	// The musician has no recent status to score the requirements
+	notReady bool
+}
+
+// Internal method to query known clusters about requirements scoring. Musicians are queried in parallel with
+// a limited number of concurrent queries. Clusters that do not answer before the scoring deadline are ignored.
+//  params:
+//   organizationId where the request is taking place
+//   requirements to be scored
+//  return:
+//   collected scores (nil if none) and the list of clusters that timed out
+func (s SimpleScorer) collectScores(organizationId string, requirements *entities.Requirements) ([]*pbConductor.ClusterScoreResponse, []string) {
 
 	err := s.connHelper.UpdateClusterConnections(organizationId)
 	if err != nil {
 		log.Error().Err(err).Msgf("error updating connections for organization %s", organizationId)
-		return nil
+		return nil, nil
 	}
-	if len(s.connHelper.ClusterReference) == 0 {
+	orgClusters := s.connHelper.GetOrganizationClusters(organizationId)
+	if len(orgClusters) == 0 {
 		log.Error().Msgf("no clusters found for organization %s", organizationId)
-		return nil
+		return nil, nil
 	}
 
 	// we expect as many scores as musicians we have
-	log.Debug().Msgf("we have %d known clusters", len(s.connHelper.ClusterReference))
-	collectedScores := make([]*pbConductor.ClusterScoreResponse, 0, 0)
+	log.Debug().Msgf("we have %d known clusters", len(orgClusters))
 
-	found_scores := 0
+	return s.scoreClusters(orgClusters, func(ctx context.Context, clusterId string, clusterEntry utils.ClusterEntry) clusterScoreResult {
+		return s.scoreCluster(ctx, organizationId, clusterId, clusterEntry, requirements)
+	})
+}
 
-	for clusterId, clusterEntry := range s.connHelper.ClusterReference {
+// Score a set of clusters in parallel with a limited number of concurrent queries. Clusters that do not answer
+// before the scoring deadline are ignored.
+//  params:
+//   clusters to be scored indexed by cluster id. Cordoned clusters are skipped.
+//   scoreCluster function querying the musician of a cluster
+//  return:
+//   collected scores (nil if none) and the list of clusters that timed out
+func (s SimpleScorer) scoreClusters(clusters map[string]utils.ClusterEntry,
+	scoreCluster func(ctx context.Context, clusterId string, clusterEntry utils.ClusterEntry) clusterScoreResult) ([]*pbConductor.ClusterScoreResponse, []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.scoringDeadline)
+	defer cancel()
+
+	results := make(chan clusterScoreResult, len(clusters))
+	slots := make(chan struct{}, s.maxConcurrentQueries)
+	numQueries := 0
+
+	for clusterId, clusterEntry := range clusters {
 		if clusterEntry.Cordon {
 			log.Debug().Str("clusterId", clusterId).Msg("skip scoring this cluster because it is cordoned")
 			continue
 		}
-
-		// Check what requests can be sent to this cluster
-		requestsToSend := s.findRequirementsCluster(organizationId, clusterId, requirements)
-		if requestsToSend != nil {
-			// there is something to send
-
-			log.Debug().Msgf("conductor query musician cluster %s at %s", clusterId, clusterEntry.Hostname)
-
-			conn, err := s.musicians.GetConnection(fmt.Sprintf("%s:%d", clusterEntry.Hostname, utils.APP_CLUSTER_API_PORT))
-			if err != nil {
-				log.Error().Err(err).Msgf("impossible to get connection for %s", clusterEntry.Hostname)
+		numQueries = numQueries + 1
+		go func(clusterId string, clusterEntry utils.ClusterEntry) {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results <- clusterScoreResult{clusterId: clusterId, timedOut: true}
+				return
 			}
+			defer func() { <-slots }()
+			results <- scoreCluster(ctx, clusterId, clusterEntry)
+		}(clusterId, clusterEntry)
+	}
 
-			c := pbAppClusterApi.NewMusicianClient(conn)
-
-			res := s.queryMusician(c, requestsToSend)
-
-			if res == nil {
-				log.Error().Err(err).Msg("impossible to query musician to obtain requirements score. Ignore it.")
-			} else {
-				log.Info().Interface("response", res).Msg("musician responded with score")
-				collectedScores = append(collectedScores, res)
-				found_scores = found_scores + 1
-			}
+	collectedScores := make([]*pbConductor.ClusterScoreResponse, 0, 0)
+	timedOut := make([]string, 0)
+	// every query is bounded by the scoring deadline
+	for i := 0; i < numQueries; i++ {
+		result := <-results
+		if result.timedOut {
+			log.Warn().Str("clusterId", result.clusterId).Msg("musician did not answer before the scoring deadline")
+			timedOut = append(timedOut, result.clusterId)
+		} else if result.notReady {
+			log.Warn().Str("clusterId", result.clusterId).Msg("skip cluster because its musician is not ready to score")
+		} else if result.response != nil {
+			log.Info().Interface("response", result.response).Msg("musician responded with score")
+			collectedScores = append(collectedScores, result.response)
 		}
 	}
 
-	if found_scores == 0 {
+	if len(collectedScores) == 0 {
 		log.Debug().Msg("not found scores")
 		collectedScores = nil
 	}
 
 	log.Debug().Msgf("returned score %v", collectedScores)
-	return collectedScores
+	return collectedScores, timedOut
+}
+
+// Query the musician of a cluster with the requirements it can fulfill.
+func (s SimpleScorer) scoreCluster(ctx context.Context, organizationId string, clusterId string,
+	clusterEntry utils.ClusterEntry, requirements *entities.Requirements) clusterScoreResult {
+	result := clusterScoreResult{clusterId: clusterId}
+
+	// Check what requests can be sent to this cluster
+	requestsToSend := s.findRequirementsCluster(ctx, organizationId, clusterId, requirements)
+	if requestsToSend == nil {
+		result.timedOut = ctx.Err() == context.DeadlineExceeded
+		return result
+	}
+
+	// there is something to send
+	log.Debug().Msgf("conductor query musician cluster %s at %s", clusterId, clusterEntry.Hostname)
+
+	queryStart := time.Now()
+	conn, err := s.musicians.GetConnection(fmt.Sprintf("%s:%d", clusterEntry.Hostname, utils.APP_CLUSTER_API_PORT))
+	if err != nil {
+		log.Error().Err(err).Msgf("impossible to get connection for %s", clusterEntry.Hostname)
+		metrics.ObserveMusicianScoring(clusterId, queryStart, true)
+		return result
+	}
+
+	return s.queryCluster(ctx, clusterId, pbAppClusterApi.NewMusicianClient(conn), requestsToSend)
+}
+
+// Query the musician of a cluster and classify the result.
+//  params:
+//   ctx context bounded by the scoring deadline
+//   clusterId cluster the musician belongs to
+//   musicianClient client of the musician
+//   requirements to be scored
+//  return:
+//   result of the query
+func (s SimpleScorer) queryCluster(ctx context.Context, clusterId string, musicianClient pbConductor.MusicianClient,
+	requirements *entities.Requirements) clusterScoreResult {
+	result := clusterScoreResult{clusterId: clusterId}
+	queryStart := time.Now()
+	res, qErr := s.queryMusician(ctx, musicianClient, requirements)
+	metrics.ObserveMusicianScoring(clusterId, queryStart, qErr != nil)
+	if qErr != nil {
+		switch qErr.Type() {
+		case derrors.DeadlineExceeded:
+			result.timedOut = true
+		case derrors.FailedPrecondition:
+			result.notReady = true
+		default:
+			log.Error().Str("clusterId", clusterId).Msg("impossible to query musician to obtain requirements score. Ignore it.")
+		}
+		return result
+	}
+	result.response = res
+	return result
 }
 
 // Private function to decide what requirements can be sent to a cluster in order to ask the musician. This decision is
 // done based on the cluster deployment selector tags. The function returns a requirements entry or nil if nothing to send.
-func (s SimpleScorer) findRequirementsCluster(organizationId string, clusterId string, requirements *entities.Requirements) *entities.Requirements {
-	cluster, err := s.clusterClient.GetCluster(context.Background(), &pbInfrastructure.ClusterId{OrganizationId: organizationId, ClusterId: clusterId})
+func (s SimpleScorer) findRequirementsCluster(ctx context.Context, organizationId string, clusterId string, requirements *entities.Requirements) *entities.Requirements {
+	cluster, err := s.clusterClient.GetCluster(ctx, &pbInfrastructure.ClusterId{OrganizationId: organizationId, ClusterId: clusterId})
 	if err != nil {
 		log.Error().Err(err).Msg("impossible to return cluster information when checking requirements")
 		return nil
@@ -188,25 +350,93 @@ func (s SimpleScorer) findRequirementsCluster(organizationId string, clusterId s
 		return nil
 	}
 
+	// only co-location sets whose groups can be deployed in the cluster are scored
+	filteredGroups := make(map[string]bool, len(filteredRequirements.List))
+	for _, req := range filteredRequirements.List {
+		filteredGroups[req.GroupServiceId] = true
+	}
+	for _, set := range requirements.CollocationSets {
+		allFound := true
+		for _, groupId := range set {
+			if !filteredGroups[groupId] {
+				allFound = false
+				break
+			}
+		}
+		if allFound {
+			filteredRequirements.AddCollocationSet(set)
+		}
+	}
+
 	return &filteredRequirements
 }
 
-// Private function to query a target musician about the score of a given set of requirements.
-func (s SimpleScorer) queryMusician(musicianClient pbAppClusterApi.MusicianClient, requirements *entities.Requirements) *pbConductor.ClusterScoreResponse {
+// Private function to query a target musician about the score of a given set of requirements. The query is
+// bounded by MusicianQueryTimeout and the deadline of the parent context.
+//  return:
+//   musician response or error if any. A DeadlineExceeded error is returned if the query timed out and a
+//   FailedPrecondition error if the musician has no recent status to score the requirements.
+func (s SimpleScorer) queryMusician(parent context.Context, musicianClient pbConductor.MusicianClient,
+	requirements *entities.Requirements) (*pbConductor.ClusterScoreResponse, derrors.Error) {
 
-	ctx, cancel := context.WithTimeout(context.Background(), MusicianQueryTimeout)
+	ctx, cancel := context.WithTimeout(parent, MusicianQueryTimeout)
 	defer cancel()
+	// the placement of several groups in the same cluster is checked with the score of their combination. Large
+	// requests cannot be scored in every combination, so their groups are scored individually plus the
+	// co-location sets.
+	options := entities.NewCombinationsScoringOptions()
+	if len(requirements.List) > entities.MaxCombinationRequirements {
+		options = entities.NewIndividualScoringOptions(requirements.CollocationSets)
+	}
+	// the largest service of every group must fit into a single node
+	for _, r := range requirements.List {
+		if r.MaxServiceCPU == 0 && r.MaxServiceMemory == 0 && r.MaxServiceStorage == 0 {
+			continue
+		}
+		if options.LargestServices == nil {
+			options.LargestServices = make(map[string]entities.ServiceResources, len(requirements.List))
+		}
+		options.LargestServices[r.GroupServiceId] = entities.ServiceResources{
+			CPU: r.MaxServiceCPU, Memory: r.MaxServiceMemory, Storage: r.MaxServiceStorage}
+	}
+	ctx = utils.AppendScoringOptions(ctx, options)
 
 	req := pbConductor.ClusterScoreRequest{
 		RequestId:    uuid.New().String(),
 		Requirements: requirements.ToGRPC(),
 	}
-	res, err := musicianClient.Score(ctx, &req)
+	var header metadata.MD
+	res, err := musicianClient.Score(ctx, &req, grpc.Header(&header))
 
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, derrors.NewDeadlineExceededError("musician did not answer in time", err)
+		}
+		if status.Code(err) == codes.FailedPrecondition {
+			log.Warn().Err(err).Msg("musician is not ready to score")
+			return nil, derrors.NewFailedPreconditionError("musician is not ready to score", err)
+		}
 		log.Error().Err(err).Msg("errors found querying musician")
-		return nil
+		return nil, derrors.NewUnavailableError("errors found querying musician", err)
 	}
 
-	return res
+	confidence := utils.ConfidenceFromHeader(header)
+	log.Debug().Str("clusterId", res.ClusterId).Float64("confidence", confidence).Msg("musician confidence")
+	if s.weightByConfidence {
+		weightScores(res, confidence)
+	}
+
+	return res, nil
+}
+
+// Weight the feasible scores of a musician response by the confidence of the musician.
+//  params:
+//   response musician response to be updated
+//   confidence of the musician from 0 to 1
+func weightScores(response *pbConductor.ClusterScoreResponse, confidence float64) {
+	for _, score := range response.Score {
+		if score.Score > 0 {
+			score.Score = score.Score * float32(confidence)
+		}
+	}
 }
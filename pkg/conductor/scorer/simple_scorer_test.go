@@ -31,7 +31,11 @@ import (
 	"github.com/nalej/grpc-utils/pkg/tools"
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -190,3 +194,145 @@ var _ = ginkgo.Describe("Simple scorer functionality with two musicians", func()
 		})
 	})
 })
+
+// Musician client answering after a delay. A musician blocked longer than the deadline of the query fails
+// with the context error.
+type fakeMusicianClient struct {
+	clusterId string
+	// time to wait before answering
+	delay time.Duration
+	// error to be returned instead of the score, if any
+	err error
+	// number of queries running at the same time and the maximum observed, shared among clients
+	running    *int32
+	maxRunning *int32
+}
+
+func (f *fakeMusicianClient) Score(ctx context.Context, in *pbConductor.ClusterScoreRequest,
+	opts ...grpc.CallOption) (*pbConductor.ClusterScoreResponse, error) {
+	current := atomic.AddInt32(f.running, 1)
+	defer atomic.AddInt32(f.running, -1)
+	for {
+		observed := atomic.LoadInt32(f.maxRunning)
+		if current <= observed || atomic.CompareAndSwapInt32(f.maxRunning, observed, current) {
+			break
+		}
+	}
+
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &pbConductor.ClusterScoreResponse{RequestId: in.RequestId, ClusterId: f.clusterId,
+		Score: []*pbConductor.DeploymentScore{{GroupServiceInstances: []string{"group"}, Score: 1}}}, nil
+}
+
+var _ = ginkgo.Describe("Simple scorer limits", func() {
+
+	var running int32
+	var maxRunning int32
+	var musicians map[string]*fakeMusicianClient
+	requirements := &entities.Requirements{List: []entities.Requirement{
+		{GroupServiceId: "group", Replicas: 1, CPU: 50, Memory: 100, Storage: 100},
+	}}
+
+	addMusician := func(clusterId string, delay time.Duration, err error) {
+		musicians[clusterId] = &fakeMusicianClient{clusterId: clusterId, delay: delay, err: err,
+			running: &running, maxRunning: &maxRunning}
+	}
+
+	score := func(s SimpleScorer, cordoned ...string) ([]*pbConductor.ClusterScoreResponse, []string) {
+		clusters := make(map[string]utils.ClusterEntry, len(musicians))
+		for clusterId := range musicians {
+			clusters[clusterId] = utils.ClusterEntry{Hostname: clusterId}
+		}
+		for _, clusterId := range cordoned {
+			clusters[clusterId] = utils.ClusterEntry{Hostname: clusterId, Cordon: true}
+		}
+		return s.scoreClusters(clusters, func(ctx context.Context, clusterId string, clusterEntry utils.ClusterEntry) clusterScoreResult {
+			return s.queryCluster(ctx, clusterId, musicians[clusterId], requirements)
+		})
+	}
+
+	respondedClusters := func(responses []*pbConductor.ClusterScoreResponse) []string {
+		clusterIds := make([]string, 0, len(responses))
+		for _, r := range responses {
+			clusterIds = append(clusterIds, r.ClusterId)
+		}
+		return clusterIds
+	}
+
+	ginkgo.BeforeEach(func() {
+		running = 0
+		maxRunning = 0
+		musicians = make(map[string]*fakeMusicianClient, 0)
+	})
+
+	ginkgo.It("never queries more musicians than the concurrency limit", func() {
+		for i := 0; i < 5; i++ {
+			addMusician(fmt.Sprintf("cluster%d", i), time.Millisecond*50, nil)
+		}
+		s := SimpleScorer{maxConcurrentQueries: 2, scoringDeadline: time.Second * 5}
+
+		responses, timedOut := score(s)
+		gomega.Expect(responses).To(gomega.HaveLen(5))
+		gomega.Expect(timedOut).To(gomega.BeEmpty())
+		gomega.Expect(atomic.LoadInt32(&maxRunning)).To(gomega.Equal(int32(2)))
+	})
+
+	ginkgo.It("returns the partial results and the clusters that missed the scoring deadline", func() {
+		addMusician("fast", 0, nil)
+		addMusician("slow", time.Minute, nil)
+		s := SimpleScorer{maxConcurrentQueries: 2, scoringDeadline: time.Millisecond * 200}
+
+		start := time.Now()
+		responses, timedOut := score(s)
+		gomega.Expect(time.Since(start) < time.Second*5).To(gomega.BeTrue())
+		gomega.Expect(respondedClusters(responses)).To(gomega.Equal([]string{"fast"}))
+		gomega.Expect(timedOut).To(gomega.Equal([]string{"slow"}))
+
+		result, err := newDeploymentScore(responses, timedOut)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(result.NumEvaluatedClusters).To(gomega.Equal(1))
+		gomega.Expect(result.DeploymentsScore[0].ClusterId).To(gomega.Equal("fast"))
+		gomega.Expect(result.TimedOutClusters).To(gomega.Equal([]string{"slow"}))
+	})
+
+	ginkgo.It("reports the clusters still waiting for a free slot when the deadline expires", func() {
+		addMusician("blocked1", time.Minute, nil)
+		addMusician("blocked2", time.Minute, nil)
+		s := SimpleScorer{maxConcurrentQueries: 1, scoringDeadline: time.Millisecond * 200}
+
+		responses, timedOut := score(s)
+		gomega.Expect(responses).To(gomega.BeNil())
+		gomega.Expect(timedOut).To(gomega.ConsistOf("blocked1", "blocked2"))
+		gomega.Expect(atomic.LoadInt32(&maxRunning)).To(gomega.Equal(int32(1)))
+
+		_, err := newDeploymentScore(responses, timedOut)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("ignores the musicians that fail or are not ready", func() {
+		addMusician("ok", 0, nil)
+		addMusician("failed", 0, status.Error(codes.Unavailable, "musician unavailable"))
+		addMusician("notready", 0, status.Error(codes.FailedPrecondition, "stale status"))
+		s := SimpleScorer{maxConcurrentQueries: 3, scoringDeadline: time.Second * 5}
+
+		responses, timedOut := score(s)
+		gomega.Expect(respondedClusters(responses)).To(gomega.Equal([]string{"ok"}))
+		gomega.Expect(timedOut).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("skips the cordoned clusters", func() {
+		addMusician("ok", 0, nil)
+		s := SimpleScorer{maxConcurrentQueries: 1, scoringDeadline: time.Second * 5}
+
+		responses, timedOut := score(s, "cordoned")
+		gomega.Expect(respondedClusters(responses)).To(gomega.Equal([]string{"ok"}))
+		gomega.Expect(timedOut).To(gomega.BeEmpty())
+	})
+})
@@ -18,11 +18,14 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"github.com/nalej/conductor/internal/persistence/app_cluster"
+	"github.com/nalej/conductor/internal/persistence/operations"
 	"github.com/nalej/conductor/internal/structures"
 	"github.com/nalej/conductor/pkg/conductor"
 	"github.com/nalej/conductor/pkg/conductor/baton"
+	"github.com/nalej/conductor/pkg/conductor/metrics"
 	"github.com/nalej/conductor/pkg/conductor/network"
 	"github.com/nalej/conductor/pkg/conductor/scorer"
 	"github.com/nalej/conductor/pkg/provider/kv"
@@ -47,7 +50,9 @@ import (
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/reflection"
 	"net"
+	"net/http"
 	"strconv"
+	"time"
 )
 
 const (
@@ -70,11 +75,56 @@ func ConductorNetworkingModeFromString(mode string) (ConductorNetworkingMode, er
 	}
 }
 
+const (
+	ConductorRequestsQueueMemory     = "memory"
+	ConductorRequestsQueuePersistent = "persistent"
+	ConductorRequestsQueueFair       = "fair"
+	ConductorRequestsQueueError      = ""
+)
+
+// Type of queue used to store incoming deployment requests
+type ConductorRequestsQueueType string
+
+func ConductorRequestsQueueTypeFromString(queueType string) (ConductorRequestsQueueType, error) {
+	switch queueType {
+	case ConductorRequestsQueueMemory:
+		return ConductorRequestsQueueMemory, nil
+	case ConductorRequestsQueuePersistent:
+		return ConductorRequestsQueuePersistent, nil
+	case ConductorRequestsQueueFair:
+		return ConductorRequestsQueueFair, nil
+	default:
+		return ConductorRequestsQueueError, derrors.NewInternalError("unknown requests queue type")
+	}
+}
+
+const (
+	ConductorPlanDesignerSimple  = "simple"
+	ConductorPlanDesignerOptimal = "optimal"
+	ConductorPlanDesignerError   = ""
+)
+
+// Type of plan designer used to place the groups of an application
+type ConductorPlanDesignerType string
+
+func ConductorPlanDesignerTypeFromString(designerType string) (ConductorPlanDesignerType, error) {
+	switch designerType {
+	case ConductorPlanDesignerSimple:
+		return ConductorPlanDesignerSimple, nil
+	case ConductorPlanDesignerOptimal:
+		return ConductorPlanDesignerOptimal, nil
+	default:
+		return ConductorPlanDesignerError, derrors.NewInternalError("unknown plan designer type")
+	}
+}
+
 
 
 type ConductorConfig struct {
 	// incoming port
 	Port uint32
+	// Port where the metrics are served
+	MetricsPort uint32
 	// URL where the system model is available
 	SystemModelURL string
 	// URL where the networking client is available
@@ -99,12 +149,29 @@ type ConductorConfig struct {
 	DBFolder string
 	// Networking mode to use
 	NetworkingMode ConductorNetworkingMode
+	// Type of queue for incoming deployment requests
+	RequestsQueueType ConductorRequestsQueueType
+	// Weight of every organization when using the fair requests queue
+	OrganizationWeights map[string]int
+	// Number of deployment requests processed concurrently
+	DeploymentWorkers int
+	// Maximum number of musicians queried at the same time
+	ScoringConcurrency int
+	// Deadline to collect the scores of all the clusters
+	ScoringDeadline time.Duration
+	// Weight the scores of every musician by its confidence
+	WeightScoresByConfidence bool
+	// Plan designer to use
+	PlanDesignerType ConductorPlanDesignerType
+	// Time finished operations are kept before being removed
+	OperationsRetention time.Duration
 	// Debugging flag
 	Debug bool
 }
 
 func (conf *ConductorConfig) Print() {
 	log.Info().Uint32("port", conf.Port).Msg("gRPC port")
+	log.Info().Uint32("metricsPort", conf.MetricsPort).Msg("metrics port")
 	log.Info().Str("URL", conf.SystemModelURL).Msg("System Model")
 	log.Info().Str("NetworkingServiceURL", conf.NetworkingServiceURL).Msg("Networking service URL")
 	log.Info().Str("AuthxURL", conf.AuthxURL).Msg("Authx service URL")
@@ -118,6 +185,14 @@ func (conf *ConductorConfig) Print() {
 	log.Info().Str("CACertPath", conf.CACertPath).Msg("CA cert path")
 	log.Info().Str("ClientCertPath", conf.ClientCertPath).Msg("Client cert path")
 	log.Info().Str("NetworkingMode", string(conf.NetworkingMode)).Msg("Networking mode")
+	log.Info().Str("RequestsQueueType", string(conf.RequestsQueueType)).Msg("Requests queue type")
+	log.Info().Interface("OrganizationWeights", conf.OrganizationWeights).Msg("Organization weights")
+	log.Info().Int("DeploymentWorkers", conf.DeploymentWorkers).Msg("Deployment workers")
+	log.Info().Int("ScoringConcurrency", conf.ScoringConcurrency).Msg("Scoring concurrency")
+	log.Info().Str("ScoringDeadline", conf.ScoringDeadline.String()).Msg("Scoring deadline")
+	log.Info().Bool("WeightScoresByConfidence", conf.WeightScoresByConfidence).Msg("Weight scores by musician confidence")
+	log.Info().Str("PlanDesignerType", string(conf.PlanDesignerType)).Msg("Plan designer type")
+	log.Info().Str("OperationsRetention", conf.OperationsRetention.String()).Msg("Operations retention")
 }
 
 type ConductorService struct {
@@ -279,14 +354,46 @@ func NewConductorService(config *ConductorConfig) (*ConductorService, error) {
 	}
 	log.Info().Msg("done")
 
-	// TODO replace this memory queue by the system queue solution
-	log.Info().Msg("instantiate local queue in memory...")
-	q := structures.NewMemoryRequestQueue()
-	log.Info().Msg("done")
-	log.Info().Msg("instantiate local pending plans structure...")
-	pendingPlans := structures.NewPendingPlans()
-	log.Info().Msg("done")
-	scr := scorer.NewSimpleScorer(connectionsHelper)
+	var q structures.RequestsQueue
+	switch config.RequestsQueueType {
+	case ConductorRequestsQueuePersistent:
+		log.Info().Msg("instantiate persistent local queue...")
+		queueProvider, err := kv.NewLocalDB(config.DBFolder + "/queue.db")
+		if err != nil {
+			log.Panic().Err(err).Msgf("impossible to instantiate bolt provider for the requests queue in %s", config.DBFolder)
+			return nil, err
+		}
+		q, err = structures.NewPersistentRequestQueue(queueProvider, time.Second*baton.ConductorSleepBetweenRetries)
+		if err != nil {
+			log.Panic().Err(err).Msg("impossible to load the persistent requests queue")
+			return nil, err
+		}
+		log.Info().Int("queued", q.Len()).Msg("done")
+	case ConductorRequestsQueueFair:
+		log.Info().Msg("instantiate persistent fair local queue...")
+		queueProvider, err := kv.NewLocalDB(config.DBFolder + "/queue.db")
+		if err != nil {
+			log.Panic().Err(err).Msgf("impossible to instantiate bolt provider for the requests queue in %s", config.DBFolder)
+			return nil, err
+		}
+		q, err = structures.NewPersistentFairRequestQueue(queueProvider,
+			time.Second*baton.ConductorSleepBetweenRetries, config.OrganizationWeights)
+		if err != nil {
+			log.Panic().Err(err).Msg("impossible to load the fair requests queue")
+			return nil, err
+		}
+		log.Info().Int("queued", q.Len()).Msg("done")
+	default:
+		log.Info().Msg("instantiate local queue in memory...")
+		q = structures.NewMemoryRequestQueue(time.Second * baton.ConductorSleepBetweenRetries)
+		log.Info().Msg("done")
+	}
+	var scr scorer.Scorer
+	if config.WeightScoresByConfidence {
+		scr = scorer.NewConfidenceWeightedScorer(connectionsHelper, config.ScoringConcurrency, config.ScoringDeadline)
+	} else {
+		scr = scorer.NewSimpleScorerWithLimits(connectionsHelper, config.ScoringConcurrency, config.ScoringDeadline)
+	}
 	reqColl := requirementscollector.NewSimpleRequirementsCollector()
 
 	log.Info().Msg("instantiate local app cluster db...")
@@ -297,6 +404,57 @@ func NewConductorService(config *ConductorConfig) (*ConductorService, error) {
 		return nil, err
 	}
 	appClusterDB := app_cluster.NewAppClusterDB(boltProvider)
+	upgraded, err := appClusterDB.Migrate()
+	if err != nil {
+		log.Panic().Err(err).Msg("impossible to migrate the app cluster db")
+		return nil, err
+	}
+	log.Info().Int("upgraded", upgraded).Msg("done")
+	err = appClusterDB.RebuildIndexes()
+	if err != nil {
+		log.Panic().Err(err).Msg("impossible to rebuild the app cluster db indexes")
+		return nil, err
+	}
+
+	log.Info().Msg("instantiate local pending plans structure...")
+	// pending plans are stored in the app cluster db with the fragments deployed from them
+	pendingPlans, err := structures.NewPersistentPendingPlans(appClusterDB)
+	if err != nil {
+		log.Panic().Err(err).Msg("impossible to load the pending plans")
+		return nil, err
+	}
+	// resume the monitoring of the fragments deployed before the restart
+	deployed, err := appClusterDB.GetAllFragments()
+	if err != nil {
+		log.Panic().Err(err).Msg("impossible to get the deployed fragments")
+		return nil, err
+	}
+	pendingPlans.Reconcile(deployed)
+	log.Info().Msg("done")
+
+	err = metrics.RegisterQueue(q)
+	if err != nil {
+		log.Panic().Err(err).Msg("impossible to register the requests queue metrics")
+		return nil, err
+	}
+	err = metrics.RegisterPendingPlans(pendingPlans)
+	if err != nil {
+		log.Panic().Err(err).Msg("impossible to register the pending plans metrics")
+		return nil, err
+	}
+
+	log.Info().Msg("instantiate local operations db...")
+	operationsProvider, err := kv.NewLocalDB(config.DBFolder + "/operations.db")
+	if err != nil {
+		log.Panic().Err(err).Msgf("impossible to instantiate bolt provider for operations in %s", config.DBFolder)
+		return nil, err
+	}
+	operationsDB := operations.NewOperationsDB(operationsProvider)
+	err = operationsDB.RebuildIndexes()
+	if err != nil {
+		log.Panic().Err(err).Msg("impossible to rebuild the operations db indexes")
+		return nil, err
+	}
 	log.Info().Msg("done")
 
 
@@ -309,10 +467,17 @@ func NewConductorService(config *ConductorConfig) (*ConductorService, error) {
     }
 
 	log.Info().Msg("instantiate plan designer...")
-	designer := plandesigner.NewSimpleReplicaPlanDesigner(connectionsHelper, networkOperator)
+	var designer plandesigner.PlanDesigner
+	switch config.PlanDesignerType {
+	case ConductorPlanDesignerOptimal:
+		designer = plandesigner.NewOptimalPlanDesigner(connectionsHelper, networkOperator)
+	default:
+		designer = plandesigner.NewSimpleReplicaPlanDesigner(connectionsHelper, networkOperator)
+	}
 	log.Info().Msg("done")
 
-	batonMgr := baton.NewManager(connectionsHelper, q, scr, reqColl, designer, pendingPlans, appClusterDB, netOpsProducer, networkOperator)
+	batonMgr := baton.NewManager(connectionsHelper, q, scr, reqColl, designer, pendingPlans, appClusterDB, operationsDB,
+		netOpsProducer, networkOperator, config.DeploymentWorkers)
 	if batonMgr == nil {
 		log.Panic().Msg("impossible to create baton service")
 		return nil, errors.New("impossible to create baton service")
@@ -349,13 +514,18 @@ func (c *ConductorService) Run() {
 	// register services
 	conductorService := baton.NewHandler(c.conductor)
 	monitorService := monitor.NewHandler(c.monitor)
+	planningService := baton.NewPlanningHandler(c.conductor)
+	operationsService := baton.NewOperationsHandler(c.conductor.Operations)
 
 	// Server and registry
 	// -- conductor service
 	pbConductor.RegisterConductorServer(c.server, conductorService)
 	// -- monitor service
 	pbConductor.RegisterConductorMonitorServer(c.server, monitorService)
-
+	// -- planning service
+	pbConductor.RegisterConductorPlanningServer(c.server, planningService)
+	// -- operations service
+	pbConductor.RegisterConductorOperationsServer(c.server, operationsService)
 	// Register reflection service on gRPC server.
 	if c.configuration.Debug {
 		reflection.Register(c.server)
@@ -379,6 +549,13 @@ func (c *ConductorService) Run() {
 	// Launch the main deployment manager in a separate routine
 	go c.conductor.Run()
 
+	// Periodically remove the expired operations
+	go c.conductor.Operations.RunGarbageCollector(context.Background(), c.configuration.OperationsRetention,
+		operations.GarbageCollectorPeriod)
+
+	// Serve the metrics
+	go c.runMetrics()
+
 	// Run
 	log.Info().Uint32("port", c.configuration.Port).Msg("Launching gRPC server")
 	if err := c.server.Serve(lis); err != nil {
@@ -386,3 +563,13 @@ func (c *ConductorService) Run() {
 	}
 
 }
+
+// Serve the conductor metrics.
+func (c *ConductorService) runMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle(metrics.MetricsPath, metrics.Handler())
+	log.Info().Uint32("port", c.configuration.MetricsPort).Msg("Launching metrics server")
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", c.configuration.MetricsPort), mux); err != nil {
+		log.Error().Err(err).Msg("failed to serve metrics")
+	}
+}
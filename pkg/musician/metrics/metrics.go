@@ -0,0 +1,185 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Prometheus metrics exported by the musician.
+
+package metrics
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// Namespace of the musician metrics
+const Namespace = "musician"
+
+// Path where the metrics are served
+const MetricsPath = "/metrics"
+
+// Results of a score request
+const (
+	ScoreSuccess = "success"
+	ScoreError   = "error"
+)
+
+// Source of the latest cluster status.
+type StatusSource interface {
+	// Get the current status.
+	GetStatus() (*entities.Status, error)
+}
+
+// Collector keeping its observations in a cache.
+type CacheSource interface {
+	// Time every cached entry was updated, indexed by the entry key.
+	CacheTimestamps() map[string]time.Time
+}
+
+// Registry containing the musician metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Failed queries of the status collector
+	CollectorErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "collector_errors_total",
+		Help:      "Number of failed queries of the status collector",
+	}, []string{"query"})
+
+	// Score requests received by the musician
+	ScoreRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "score_requests_total",
+		Help:      "Number of score requests received",
+	}, []string{"result"})
+
+	// Time spent answering score requests
+	ScoreDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "score_duration_seconds",
+		Help:      "Time spent answering a score request",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+var (
+	cacheEntryAgeDesc = prometheus.NewDesc(prometheus.BuildFQName(Namespace, "collector", "cache_entry_age_seconds"),
+		"Time since every cached observation of the status collector was updated", []string{"key"}, nil)
+	statusTimestampDesc = prometheus.NewDesc(prometheus.BuildFQName(Namespace, "status", "timestamp_seconds"),
+		"Timestamp of the latest cluster status", nil, nil)
+	statusMemFreeDesc = prometheus.NewDesc(prometheus.BuildFQName(Namespace, "status", "mem_free"),
+		"Free memory in the latest cluster status", nil, nil)
+	statusCPUNumDesc = prometheus.NewDesc(prometheus.BuildFQName(Namespace, "status", "cpu_num"),
+		"Number of CPUs in the latest cluster status", nil, nil)
+	statusCPUIdleDesc = prometheus.NewDesc(prometheus.BuildFQName(Namespace, "status", "cpu_idle"),
+		"Idle CPU in the latest cluster status", nil, nil)
+	statusDiskFreeDesc = prometheus.NewDesc(prometheus.BuildFQName(Namespace, "status", "disk_free"),
+		"Free disk in the latest cluster status", nil, nil)
+)
+
+func init() {
+	Registry.MustRegister(CollectorErrors, ScoreRequests, ScoreDuration)
+}
+
+// Observe a score request.
+//  params:
+//   start time the request was received
+//   failed true if the request failed
+func ObserveScore(start time.Time, failed bool) {
+	ScoreDuration.Observe(time.Since(start).Seconds())
+	if failed {
+		ScoreRequests.WithLabelValues(ScoreError).Inc()
+	} else {
+		ScoreRequests.WithLabelValues(ScoreSuccess).Inc()
+	}
+}
+
+// Collector exporting the age of the cached observations when the metrics are gathered.
+type cacheCollector struct {
+	source CacheSource
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheEntryAgeDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for key, timestamp := range c.source.CacheTimestamps() {
+		ch <- prometheus.MustNewConstMetric(cacheEntryAgeDesc, prometheus.GaugeValue, now.Sub(timestamp).Seconds(), key)
+	}
+}
+
+// Collector exporting the latest cluster status when the metrics are gathered.
+type statusCollector struct {
+	source StatusSource
+}
+
+func (c *statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- statusTimestampDesc
+	ch <- statusMemFreeDesc
+	ch <- statusCPUNumDesc
+	ch <- statusCPUIdleDesc
+	ch <- statusDiskFreeDesc
+}
+
+func (c *statusCollector) Collect(ch chan<- prometheus.Metric) {
+	status, err := c.source.GetStatus()
+	if err != nil || status == nil {
+		// nothing observed yet
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(statusTimestampDesc, prometheus.GaugeValue, float64(status.Timestamp.Unix()))
+	ch <- prometheus.MustNewConstMetric(statusMemFreeDesc, prometheus.GaugeValue, status.MemFree)
+	ch <- prometheus.MustNewConstMetric(statusCPUNumDesc, prometheus.GaugeValue, status.CPUNum)
+	ch <- prometheus.MustNewConstMetric(statusCPUIdleDesc, prometheus.GaugeValue, status.CPUIdle)
+	ch <- prometheus.MustNewConstMetric(statusDiskFreeDesc, prometheus.GaugeValue, status.DiskFree)
+}
+
+// Export the age of the observations cached by a status collector.
+//  params:
+//   source collector keeping a cache
+//  return:
+//   error if the cache metrics were already registered
+func RegisterCache(source CacheSource) derrors.Error {
+	return register(&cacheCollector{source: source})
+}
+
+// Export the latest status of the cluster.
+//  params:
+//   source status collector
+//  return:
+//   error if the status metrics were already registered
+func RegisterStatus(source StatusSource) derrors.Error {
+	return register(&statusCollector{source: source})
+}
+
+// Register a collector in the musician registry.
+func register(collector prometheus.Collector) derrors.Error {
+	if err := Registry.Register(collector); err != nil {
+		return derrors.NewAlreadyExistsError("impossible to register musician metrics", err)
+	}
+	return nil
+}
+
+// Handler serving the musician metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package metrics
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// Status collector with a fixed status and cache
+type testCollector struct {
+	status     *entities.Status
+	timestamps map[string]time.Time
+}
+
+func (c *testCollector) GetStatus() (*entities.Status, error) {
+	if c.status == nil {
+		return nil, derrors.NewNotFoundError("not found cache entries")
+	}
+	return c.status, nil
+}
+
+func (c *testCollector) CacheTimestamps() map[string]time.Time {
+	return c.timestamps
+}
+
+var _ = ginkgo.Describe("Musician metrics", func() {
+
+	var server *httptest.Server
+	collector := &testCollector{}
+
+	ginkgo.BeforeEach(func() {
+		server = httptest.NewServer(Handler())
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	scrape := func() string {
+		res, err := http.Get(server.URL + MetricsPath)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer res.Body.Close()
+		gomega.Expect(res.StatusCode).To(gomega.Equal(http.StatusOK))
+		body, err := ioutil.ReadAll(res.Body)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		return string(body)
+	}
+
+	ginkgo.It("exports the latest status and the age of the cached observations", func() {
+		gomega.Expect(RegisterStatus(collector)).To(gomega.BeNil())
+		gomega.Expect(RegisterCache(collector)).To(gomega.BeNil())
+
+		// nothing collected yet
+		body := scrape()
+		gomega.Expect(body).ToNot(gomega.ContainSubstring("musician_status_mem_free"))
+		gomega.Expect(body).ToNot(gomega.ContainSubstring("musician_collector_cache_entry_age_seconds"))
+
+		collector.status = &entities.Status{Timestamp: time.Unix(1000, 0), MemFree: 2048, CPUNum: 4, CPUIdle: 0.5, DiskFree: 10}
+		collector.timestamps = map[string]time.Time{"mem_free": time.Now().Add(-time.Hour)}
+		body = scrape()
+		gomega.Expect(body).To(gomega.ContainSubstring("musician_status_timestamp_seconds 1000"))
+		gomega.Expect(body).To(gomega.ContainSubstring("musician_status_mem_free 2048"))
+		gomega.Expect(body).To(gomega.ContainSubstring("musician_status_cpu_num 4"))
+		gomega.Expect(body).To(gomega.ContainSubstring("musician_status_cpu_idle 0.5"))
+		gomega.Expect(body).To(gomega.ContainSubstring("musician_status_disk_free 10"))
+		gomega.Expect(body).To(gomega.ContainSubstring(`musician_collector_cache_entry_age_seconds{key="mem_free"} 3600`))
+
+		// the same metrics cannot be exported twice
+		gomega.Expect(RegisterStatus(collector)).ToNot(gomega.BeNil())
+	})
+
+	ginkgo.It("exports the score requests and the collector errors", func() {
+		ObserveScore(time.Now(), false)
+		ObserveScore(time.Now(), false)
+		ObserveScore(time.Now(), true)
+		CollectorErrors.WithLabelValues("cpu_num").Inc()
+
+		body := scrape()
+		gomega.Expect(body).To(gomega.ContainSubstring(`musician_score_requests_total{result="success"} 2`))
+		gomega.Expect(body).To(gomega.ContainSubstring(`musician_score_requests_total{result="error"} 1`))
+		gomega.Expect(body).To(gomega.ContainSubstring("musician_score_duration_seconds_count 3"))
+		gomega.Expect(body).To(gomega.ContainSubstring(`musician_collector_errors_total{query="cpu_num"} 1`))
+	})
+})
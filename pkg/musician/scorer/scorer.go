@@ -20,6 +20,7 @@
 package scorer
 
 import (
+	"github.com/nalej/conductor/internal/entities"
 	pbConductor "github.com/nalej/grpc-conductor-go"
 )
 
@@ -28,7 +29,8 @@ type Scorer interface {
 	// For a given score request return a scoring response.
 	//  params:
 	//   request to be processed.
+	//   options indicating which sets of requirements are scored, nil to score every combination.
 	//  return:
 	//   score response or error if any.
-	Score(request *pbConductor.ClusterScoreRequest) (*pbConductor.ClusterScoreResponse, error)
+	Score(request *pbConductor.ClusterScoreRequest, options *entities.ScoringOptions) (*pbConductor.ClusterScoreResponse, error)
 }
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package scorer
+
+import (
+	"fmt"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+	pbConductor "github.com/nalej/grpc-conductor-go"
+	"github.com/rs/zerolog/log"
+)
+
+// Compute the sets of requirements to be scored.
+//  params:
+//   reqs requirements of the request
+//   options scoring options, nil for the combinations mode. Requests too large to score every combination are
+//   scored individually.
+//  return:
+//   sets of requirements or error if the request cannot be scored
+func getScoringSets(reqs []*pbConductor.Requirement, options *entities.ScoringOptions) ([][]*pbConductor.Requirement, derrors.Error) {
+	if options == nil || options.Mode == entities.CombinationsScoringMode || options.Mode == "" {
+		if len(reqs) > entities.MaxCombinationRequirements {
+			// too many combinations, the requirements are scored one by one instead
+			log.Warn().Int("requirements", len(reqs)).Int("maximum", entities.MaxCombinationRequirements).
+				Msg("request too large to score every combination, scoring the requirements individually")
+			return getScoringSets(reqs, entities.NewIndividualScoringOptions(nil))
+		}
+		return getCombinations(reqs), nil
+	}
+
+	if options.Mode != entities.IndividualScoringMode {
+		return nil, derrors.NewInvalidArgumentError(fmt.Sprintf("unknown scoring mode %s", options.Mode))
+	}
+	if len(options.CollocationSets) > entities.MaxCollocationSets {
+		return nil, derrors.NewInvalidArgumentError(fmt.Sprintf(
+			"request with %d co-location sets is too large to be scored, the maximum is %d",
+			len(options.CollocationSets), entities.MaxCollocationSets))
+	}
+
+	byGroup := make(map[string]*pbConductor.Requirement, len(reqs))
+	sets := make([][]*pbConductor.Requirement, 0, len(reqs)+len(options.CollocationSets))
+	for _, r := range reqs {
+		byGroup[r.GroupServiceInstanceId] = r
+		sets = append(sets, []*pbConductor.Requirement{r})
+	}
+	for _, groups := range options.CollocationSets {
+		if len(groups) < 2 {
+			// single groups are already scored
+			continue
+		}
+		set := make([]*pbConductor.Requirement, 0, len(groups))
+		for _, groupId := range groups {
+			r, found := byGroup[groupId]
+			if !found {
+				return nil, derrors.NewInvalidArgumentError(fmt.Sprintf(
+					"co-location set references group %s not found in the requirements", groupId))
+			}
+			set = append(set, r)
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package scorer
+
+import (
+	"context"
+	"fmt"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/musician/statuscollector"
+	"github.com/nalej/conductor/pkg/utils"
+	pbConductor "github.com/nalej/grpc-conductor-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc/metadata"
+)
+
+// Generate a request with the indicated number of requirements named g0, g1, ...
+func generateScoreRequest(numRequirements int) *pbConductor.ClusterScoreRequest {
+	reqs := make([]*pbConductor.Requirement, numRequirements)
+	for i := 0; i < numRequirements; i++ {
+		reqs[i] = &pbConductor.Requirement{AppInstanceId: "app", GroupServiceInstanceId: fmt.Sprintf("g%d", i),
+			Replicas: 1, Cpu: 100, Memory: 100}
+	}
+	return &pbConductor.ClusterScoreRequest{RequestId: "request", Requirements: reqs}
+}
+
+// Obtain the group ids of every returned score
+func scoredGroups(response *pbConductor.ClusterScoreResponse) [][]string {
+	toReturn := make([][]string, 0)
+	for _, s := range response.Score {
+		toReturn = append(toReturn, s.GroupServiceInstances)
+	}
+	return toReturn
+}
+
+var _ = ginkgo.Describe("Scoring options", func() {
+
+	var scorer Scorer
+
+	ginkgo.BeforeEach(func() {
+		scorer = NewSpreadScorer(statuscollector.NewFakeCollector())
+	})
+
+	ginkgo.It("scores every combination by default", func() {
+		response, err := scorer.Score(generateScoreRequest(3), nil)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(response.Score).To(gomega.HaveLen(7))
+	})
+
+	ginkgo.It("scores individually the requests too large to score every combination", func() {
+		response, err := scorer.Score(generateScoreRequest(entities.MaxCombinationRequirements+1), nil)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		groups := scoredGroups(response)
+		gomega.Expect(groups).To(gomega.HaveLen(entities.MaxCombinationRequirements + 1))
+		gomega.Expect(groups[0]).To(gomega.Equal([]string{"g0"}))
+	})
+
+	ginkgo.It("scores groups individually plus the co-location sets", func() {
+		options := entities.NewIndividualScoringOptions([][]string{{"g1", "g3"}})
+		response, err := scorer.Score(generateScoreRequest(20), options)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		groups := scoredGroups(response)
+		gomega.Expect(groups).To(gomega.HaveLen(21))
+		gomega.Expect(groups[0]).To(gomega.Equal([]string{"g0"}))
+		gomega.Expect(groups[20]).To(gomega.Equal([]string{"g1", "g3"}))
+	})
+
+	ginkgo.It("rejects co-location sets with unknown groups", func() {
+		options := entities.NewIndividualScoringOptions([][]string{{"g1", "unknown"}})
+		_, err := scorer.Score(generateScoreRequest(2), options)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("sends the options as request metadata", func() {
+		options := entities.NewIndividualScoringOptions([][]string{{"g1", "g3"}, {"g0", "g2", "g4"}})
+		outgoing := utils.AppendScoringOptions(context.Background(), options)
+		md, found := metadata.FromOutgoingContext(outgoing)
+		gomega.Expect(found).To(gomega.BeTrue())
+
+		received := utils.ScoringOptionsFromContext(metadata.NewIncomingContext(context.Background(), md))
+		gomega.Expect(received).To(gomega.Equal(options))
+
+		gomega.Expect(utils.ScoringOptionsFromContext(context.Background()).Mode).To(gomega.Equal(entities.CombinationsScoringMode))
+	})
+
+	ginkgo.It("sends the largest service of every group as request metadata", func() {
+		options := entities.NewIndividualScoringOptions(nil)
+		options.LargestServices = map[string]entities.ServiceResources{
+			"g0":       {CPU: 500, Memory: 1024, Storage: 0},
+			"group=id": {CPU: 2000, Memory: 4096, Storage: 100},
+		}
+		outgoing := utils.AppendScoringOptions(context.Background(), options)
+		md, found := metadata.FromOutgoingContext(outgoing)
+		gomega.Expect(found).To(gomega.BeTrue())
+
+		received := utils.ScoringOptionsFromContext(metadata.NewIncomingContext(context.Background(), md))
+		gomega.Expect(received.LargestServices).To(gomega.Equal(options.LargestServices))
+	})
+
+	ginkgo.It("rejects groups whose largest service does not fit into any node", func() {
+		const GB = 1024 * 1024 * 1024
+		collector := statuscollector.NewFakeCollector()
+		// 64GB free spread over two nodes
+		collector.(*statuscollector.FakeCollector).SetStatus(entities.Status{CPUNum: 16, MemFree: 64 * GB, DiskFree: 100 * GB,
+			Nodes: []entities.NodeStatus{
+				{Name: "node1", CPU: 8, Memory: 32 * GB, Disk: 50 * GB, MaxPods: 110, Pods: 10},
+				{Name: "node2", CPU: 8, Memory: 32 * GB, Disk: 50 * GB, MaxPods: 110, Pods: 110},
+			}})
+		request := &pbConductor.ClusterScoreRequest{RequestId: "request", Requirements: []*pbConductor.Requirement{
+			{AppInstanceId: "app", GroupServiceInstanceId: "small", Replicas: 1, Cpu: 1000, Memory: 40 * GB},
+			{AppInstanceId: "app", GroupServiceInstanceId: "large", Replicas: 1, Cpu: 1000, Memory: 40 * GB},
+		}}
+		options := entities.NewIndividualScoringOptions(nil)
+		options.LargestServices = map[string]entities.ServiceResources{
+			// two services of 20GB
+			"small": {CPU: 500, Memory: 20 * GB},
+			// a single service of 40GB
+			"large": {CPU: 1000, Memory: 40 * GB},
+		}
+
+		for _, scorer := range []Scorer{NewSpreadScorer(collector), NewBinPackingScorer(collector, DefaultResourceWeights)} {
+			response, err := scorer.Score(request, options)
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(response.Score).To(gomega.HaveLen(2))
+			gomega.Expect(response.Score[0].Score).ToNot(gomega.Equal(float32(InfeasibleScore)))
+			gomega.Expect(response.Score[1].Score).To(gomega.Equal(float32(InfeasibleScore)))
+		}
+
+		// the only node with room for the small service is full of pods
+		collector.(*statuscollector.FakeCollector).Status.Nodes[0].Pods = 110
+		response, err := NewSpreadScorer(collector).Score(request, options)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(response.Score[0].Score).To(gomega.Equal(float32(InfeasibleScore)))
+	})
+})
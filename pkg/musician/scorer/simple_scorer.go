@@ -18,6 +18,7 @@
 package scorer
 
 import (
+	"github.com/nalej/conductor/internal/entities"
 	"github.com/nalej/conductor/pkg/musician/statuscollector"
 	"github.com/nalej/conductor/pkg/utils"
 	pbConductor "github.com/nalej/grpc-conductor-go"
@@ -34,20 +35,30 @@ func NewSimpleScorer(collector statuscollector.StatusCollector) Scorer {
 	return &SimpleScorer{collector}
 }
 
-func (s *SimpleScorer) Score(request *pbConductor.ClusterScoreRequest) (*pbConductor.ClusterScoreResponse, error) {
+func (s *SimpleScorer) Score(request *pbConductor.ClusterScoreRequest, options *entities.ScoringOptions) (*pbConductor.ClusterScoreResponse, error) {
 	log.Debug().Interface("request", request).Msg("musician simple scorer queried")
 	// check
 	status, err := s.collector.GetStatus()
 
 	if err != nil {
-		log.Error().Err(err).Msg("error obtaining status")
+		if statuscollector.IsNotReady(err) {
+			log.Warn().Err(err).Msg("refusing to score without recent status")
+		} else {
+			log.Error().Err(err).Msg("error obtaining status")
+		}
 		return nil, err
 	}
+	// score with the statistics of the latest observations when available
+	status = windowedStatus(status)
 
 	foundScores := make([]*pbConductor.DeploymentScore, 0)
 
-	// Compute the combinations of requirements
-	sets := s.getCombinations(request.Requirements)
+	// Compute the sets of requirements to be scored
+	sets, setsErr := getScoringSets(request.Requirements, options)
+	if setsErr != nil {
+		log.Error().Str("err", setsErr.DebugReport()).Msg("impossible to score the request")
+		return nil, setsErr
+	}
 
 	for _, s := range sets {
 		var totalCPU float64 = 0
@@ -65,6 +76,7 @@ func (s *SimpleScorer) Score(request *pbConductor.ClusterScoreRequest) (*pbCondu
 
 		// compute score based on requested and available
 		dCPU := status.CPUNum - totalCPU
+		// idle cpus of the window when the status has one
 		dCPUIdle := status.CPUIdle
 		dMem := status.MemFree - totalMem
 		// only take persistence into account when the requirement is set
@@ -76,13 +88,13 @@ func (s *SimpleScorer) Score(request *pbConductor.ClusterScoreRequest) (*pbCondu
 		log.Debug().Float64("dCPU", dCPU).Float64("dMem", dMem).Float64("dDisk", dDisk).
 			Float64("dCPUIdle", dCPUIdle).Msg("computed values")
 
-		var score float64
-		if dCPU*dMem*dDisk*dCPUIdle <= 0 {
-			score = -1
+		var score float64 = InfeasibleScore
+		// storage is not taken into account when it is not requested
+		// every service must fit into a single node
+		if dCPU > 0 && dMem > 0 && dCPUIdle > 0 && (totalStorage == 0 || dDisk > 0) && fitsNodes(status, s, options) {
+			// The score for this requirement is the module of the vector with the individual components
+			score = math.Sqrt(dCPU*dCPU + dMem*dMem + dDisk*dDisk + dCPUIdle*dCPUIdle)
 		}
-
-		// The score for this requirement is the module of the vector with the individual components
-		score = math.Sqrt(dCPU*dCPU + dMem*dMem + dDisk*dDisk + dCPUIdle*dCPUIdle)
 		scoreForGroup := &pbConductor.DeploymentScore{
 			Score:                 float32(score),
 			AppInstanceId:         s[0].AppInstanceId,
@@ -110,7 +122,7 @@ func (s *SimpleScorer) Score(request *pbConductor.ClusterScoreRequest) (*pbCondu
 // return:
 //  array of arrays with all the permutations.
 //  E.G.: [A, B, C] -> [[A], [B], [C], [A, B], [A, C], [B, C], [A, B, C]]
-func (s *SimpleScorer) getCombinations(reqs []*pbConductor.Requirement) [][]*pbConductor.Requirement {
+func getCombinations(reqs []*pbConductor.Requirement) [][]*pbConductor.Requirement {
 	length := uint(len(reqs))
 
 	subsets := make([][]*pbConductor.Requirement, 0)
@@ -0,0 +1,269 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package scorer
+
+import (
+	"fmt"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/musician/statuscollector"
+	"github.com/nalej/conductor/pkg/utils"
+	"github.com/nalej/derrors"
+	pbConductor "github.com/nalej/grpc-conductor-go"
+	"github.com/rs/zerolog/log"
+	"math"
+	"os"
+)
+
+// Score returned for combinations of requirements that cannot be deployed in the cluster.
+const InfeasibleScore = -1
+
+// Available scoring strategies
+const (
+	SimpleStrategy     = "simple"
+	WeightedStrategy   = "weighted"
+	BinPackingStrategy = "binpacking"
+	SpreadStrategy     = "spread"
+)
+
+// Relative weight of every resource when scoring.
+type ResourceWeights struct {
+	CPU    float64
+	Memory float64
+	Disk   float64
+}
+
+// Default weights giving the same relevance to every resource.
+var DefaultResourceWeights = ResourceWeights{CPU: 1, Memory: 1, Disk: 1}
+
+// Fraction of the available resources of the cluster that a set of requirements would consume. Every value
+// is dimensionless so resources with different units can be combined.
+type resourceUsage struct {
+	CPU    float64
+	Memory float64
+	Disk   float64
+	// Disk is only taken into account when storage is requested
+	UseDisk bool
+}
+
+// Compute the fraction of the available resources consumed by a set of requirements. Requested CPU is expressed
+// in millicores while the status reports the number of cores of the cluster.
+//  params:
+//   status latest known status of the cluster
+//   reqs set of requirements to be deployed together
+//  return:
+//   resource usage and false if the requirements do not fit into the cluster
+func computeUsage(status *entities.Status, reqs []*pbConductor.Requirement) (resourceUsage, bool) {
+	var totalCPU float64 = 0
+	var totalMem float64 = 0
+	var totalStorage float64 = 0
+	for _, r := range reqs {
+		totalCPU = totalCPU + float64(r.Cpu*int64(r.Replicas))
+		totalMem = totalMem + float64(r.Memory*int64(r.Replicas))
+		totalStorage = totalStorage + float64(r.Storage*int64(r.Replicas))
+	}
+
+	cpu, cpuFits := ratio(totalCPU, status.CPUNum*1000)
+	mem, memFits := ratio(totalMem, status.MemFree)
+	usage := resourceUsage{CPU: cpu, Memory: mem, UseDisk: totalStorage != 0}
+	feasible := cpuFits && memFits
+	if usage.UseDisk {
+		disk, diskFits := ratio(totalStorage, status.DiskFree)
+		usage.Disk = disk
+		feasible = feasible && diskFits
+	}
+	return usage, feasible
+}
+
+// Check whether the largest service replica of every requirement in a set fits into a single node of the
+// cluster. Requirements without information about their largest service are not checked.
+//  params:
+//   status latest known status of the cluster
+//   set requirements to be deployed together
+//   options scoring options, nil if not available
+//  return:
+//   false if any of the services cannot be placed in any node
+func fitsNodes(status *entities.Status, set []*pbConductor.Requirement, options *entities.ScoringOptions) bool {
+	if options == nil || len(options.LargestServices) == 0 {
+		return true
+	}
+	for _, r := range set {
+		resources, found := options.LargestServices[r.GroupServiceInstanceId]
+		if !found {
+			continue
+		}
+		if !status.FitsInAnyNode(float64(resources.CPU), float64(resources.Memory), float64(resources.Storage)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fraction of the available amount that is requested.
+func ratio(requested float64, available float64) (float64, bool) {
+	if requested <= 0 {
+		return 0, true
+	}
+	if available <= 0 {
+		return math.Inf(1), false
+	}
+	value := requested / available
+	return value, value <= 1
+}
+
+// Weighted average of the usage.
+func weightedUsage(usage resourceUsage, weights ResourceWeights) float64 {
+	sum := weights.CPU*usage.CPU + weights.Memory*usage.Memory
+	totalWeight := weights.CPU + weights.Memory
+	if usage.UseDisk {
+		sum = sum + weights.Disk*usage.Disk
+		totalWeight = totalWeight + weights.Disk
+	}
+	if totalWeight <= 0 {
+		return 0
+	}
+	return sum / totalWeight
+}
+
+// Scorer computing the score of every combination of requirements with a scoring function. Combinations that
+// do not fit into the cluster obtain InfeasibleScore. Feasible combinations obtain a score in [0, 1], higher
+// scores being better.
+type StrategyScorer struct {
+	collector statuscollector.StatusCollector
+	// Name of the strategy
+	strategy string
+	// Scoring function for feasible combinations
+	scoreFunc func(usage resourceUsage) float64
+}
+
+// Create a scorer using the normalized weighted sum of the free resources remaining after the deployment.
+//  params:
+//   collector status collector
+//   weights relative weight of every resource
+//  return:
+//   scorer instance
+func NewWeightedScorer(collector statuscollector.StatusCollector, weights ResourceWeights) Scorer {
+	return &StrategyScorer{collector: collector, strategy: WeightedStrategy,
+		scoreFunc: func(usage resourceUsage) float64 {
+			return 1 - weightedUsage(usage, weights)
+		}}
+}
+
+// Create a scorer preferring the fullest cluster that still fits the requirements.
+//  params:
+//   collector status collector
+//   weights relative weight of every resource
+//  return:
+//   scorer instance
+func NewBinPackingScorer(collector statuscollector.StatusCollector, weights ResourceWeights) Scorer {
+	return &StrategyScorer{collector: collector, strategy: BinPackingStrategy,
+		scoreFunc: func(usage resourceUsage) float64 {
+			return weightedUsage(usage, weights)
+		}}
+}
+
+// Create a scorer preferring the emptiest cluster. The score is the headroom of the most constrained resource.
+//  params:
+//   collector status collector
+//  return:
+//   scorer instance
+func NewSpreadScorer(collector statuscollector.StatusCollector) Scorer {
+	return &StrategyScorer{collector: collector, strategy: SpreadStrategy,
+		scoreFunc: func(usage resourceUsage) float64 {
+			maxUsage := math.Max(usage.CPU, usage.Memory)
+			if usage.UseDisk {
+				maxUsage = math.Max(maxUsage, usage.Disk)
+			}
+			return 1 - maxUsage
+		}}
+}
+
+// Create a scorer for the indicated strategy.
+//  params:
+//   strategy name of the strategy
+//   collector status collector
+//   weights relative weight of every resource for the strategies using them
+//  return:
+//   scorer instance or error if the strategy is unknown
+func NewScorerFromStrategy(strategy string, collector statuscollector.StatusCollector, weights ResourceWeights) (Scorer, derrors.Error) {
+	switch strategy {
+	case SimpleStrategy:
+		return NewSimpleScorer(collector), nil
+	case WeightedStrategy:
+		return NewWeightedScorer(collector, weights), nil
+	case BinPackingStrategy:
+		return NewBinPackingScorer(collector, weights), nil
+	case SpreadStrategy:
+		return NewSpreadScorer(collector), nil
+	default:
+		return nil, derrors.NewInvalidArgumentError(fmt.Sprintf("unknown scoring strategy %s", strategy))
+	}
+}
+
+func (s *StrategyScorer) Score(request *pbConductor.ClusterScoreRequest, options *entities.ScoringOptions) (*pbConductor.ClusterScoreResponse, error) {
+	log.Debug().Str("strategy", s.strategy).Interface("request", request).Msg("musician scorer queried")
+	status, err := s.collector.GetStatus()
+	if err != nil {
+		if statuscollector.IsNotReady(err) {
+			log.Warn().Err(err).Msg("refusing to score without recent status")
+		} else {
+			log.Error().Err(err).Msg("error obtaining status")
+		}
+		return nil, err
+	}
+	// score with the statistics of the latest observations when available
+	status = windowedStatus(status)
+
+	sets, setsErr := getScoringSets(request.Requirements, options)
+	if setsErr != nil {
+		log.Error().Str("err", setsErr.DebugReport()).Msg("impossible to score the request")
+		return nil, setsErr
+	}
+
+	foundScores := make([]*pbConductor.DeploymentScore, 0)
+
+	for _, set := range sets {
+		listOfServiceGroups := make([]string, 0)
+		for _, r := range set {
+			listOfServiceGroups = append(listOfServiceGroups, r.GroupServiceInstanceId)
+		}
+
+		var score float64 = InfeasibleScore
+		usage, feasible := computeUsage(status, set)
+		feasible = feasible && fitsNodes(status, set, options)
+		if feasible {
+			score = s.scoreFunc(usage)
+		}
+		log.Debug().Interface("usage", usage).Bool("feasible", feasible).Float64("score", score).
+			Strs("groups", listOfServiceGroups).Msg("computed score")
+
+		foundScores = append(foundScores, &pbConductor.DeploymentScore{
+			Score:                 float32(score),
+			AppInstanceId:         set[0].AppInstanceId,
+			GroupServiceInstances: listOfServiceGroups,
+		})
+	}
+
+	response := &pbConductor.ClusterScoreResponse{
+		ClusterId: os.Getenv(utils.MUSICIAN_CLUSTER_ID),
+		RequestId: request.RequestId,
+		Score:     foundScores,
+	}
+
+	log.Debug().Interface("score request", request).Interface("score", foundScores).Msg("returned scores")
+	return response, nil
+}
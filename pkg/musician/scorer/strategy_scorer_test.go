@@ -0,0 +1,141 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package scorer
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/musician/statuscollector"
+	pbConductor "github.com/nalej/grpc-conductor-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// Score a single requirement with every cluster status and return the scores in the same order.
+func scoreStatuses(newScorer func(collector statuscollector.StatusCollector) Scorer,
+	requirement *pbConductor.Requirement, statuses []entities.Status) []float32 {
+	scores := make([]float32, 0)
+	for _, status := range statuses {
+		collector := statuscollector.NewFakeCollector()
+		collector.(*statuscollector.FakeCollector).SetStatus(status)
+		response, err := newScorer(collector).Score(&pbConductor.ClusterScoreRequest{
+			RequestId:    "request",
+			Requirements: []*pbConductor.Requirement{requirement},
+		}, nil)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(response.Score).To(gomega.HaveLen(1))
+		scores = append(scores, response.Score[0].Score)
+	}
+	return scores
+}
+
+var _ = ginkgo.Describe("Scoring strategies", func() {
+
+	const GB = 1024 * 1024 * 1024
+
+	// 1 core and 1GB
+	requirement := &pbConductor.Requirement{AppInstanceId: "app", GroupServiceInstanceId: "group", Replicas: 1,
+		Cpu: 1000, Memory: GB}
+	// 1 core, 1GB and 10GB of disk
+	storageRequirement := &pbConductor.Requirement{AppInstanceId: "app", GroupServiceInstanceId: "group", Replicas: 1,
+		Cpu: 1000, Memory: GB, Storage: 10 * GB}
+
+	// Clusters sorted from the emptiest to the fullest
+	empty := entities.Status{CPUNum: 8, MemFree: 16 * GB, DiskFree: 100 * GB}
+	half := entities.Status{CPUNum: 4, MemFree: 8 * GB, DiskFree: 100 * GB}
+	full := entities.Status{CPUNum: 2, MemFree: 2 * GB, DiskFree: 100 * GB}
+	// Clusters where the requirements do not fit
+	noMemory := entities.Status{CPUNum: 8, MemFree: GB / 2, DiskFree: 100 * GB}
+	noCPU := entities.Status{CPUNum: 0.5, MemFree: 16 * GB, DiskFree: 100 * GB}
+	noDisk := entities.Status{CPUNum: 8, MemFree: 16 * GB, DiskFree: GB}
+
+	weighted := func(collector statuscollector.StatusCollector) Scorer {
+		return NewWeightedScorer(collector, DefaultResourceWeights)
+	}
+	binPacking := func(collector statuscollector.StatusCollector) Scorer {
+		return NewBinPackingScorer(collector, DefaultResourceWeights)
+	}
+	spread := func(collector statuscollector.StatusCollector) Scorer {
+		return NewSpreadScorer(collector)
+	}
+
+	cases := []struct {
+		name        string
+		newScorer   func(collector statuscollector.StatusCollector) Scorer
+		requirement *pbConductor.Requirement
+		statuses    []entities.Status
+		expected    []float32
+	}{
+		{"weighted prefers more free resources", weighted, requirement,
+			[]entities.Status{empty, half, full}, []float32{0.90625, 0.8125, 0.5}},
+		{"bin-packing prefers the fullest cluster", binPacking, requirement,
+			[]entities.Status{empty, half, full}, []float32{0.09375, 0.1875, 0.5}},
+		{"spread prefers the emptiest cluster", spread, requirement,
+			[]entities.Status{empty, half, full}, []float32{0.875, 0.75, 0.5}},
+		{"weighted rejects clusters without enough resources", weighted, storageRequirement,
+			[]entities.Status{noMemory, noCPU, noDisk}, []float32{InfeasibleScore, InfeasibleScore, InfeasibleScore}},
+		{"bin-packing rejects clusters without enough resources", binPacking, storageRequirement,
+			[]entities.Status{noMemory, noCPU, noDisk}, []float32{InfeasibleScore, InfeasibleScore, InfeasibleScore}},
+		{"spread rejects clusters without enough resources", spread, storageRequirement,
+			[]entities.Status{noMemory, noCPU, noDisk}, []float32{InfeasibleScore, InfeasibleScore, InfeasibleScore}},
+		{"disk is ignored when no storage is requested", spread, requirement,
+			[]entities.Status{noDisk}, []float32{0.875}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		ginkgo.It(tc.name, func() {
+			scores := scoreStatuses(tc.newScorer, tc.requirement, tc.statuses)
+			gomega.Expect(scores).To(gomega.HaveLen(len(tc.expected)))
+			for i, expected := range tc.expected {
+				gomega.Expect(scores[i]).To(gomega.BeNumerically("~", expected, 0.0001))
+			}
+		})
+	}
+
+	ginkgo.It("weights change the relevance of every resource", func() {
+		cpuOnly := func(collector statuscollector.StatusCollector) Scorer {
+			return NewWeightedScorer(collector, ResourceWeights{CPU: 1})
+		}
+		// same CPU, different memory
+		scores := scoreStatuses(cpuOnly, requirement, []entities.Status{half, {CPUNum: 4, MemFree: 2 * GB}})
+		gomega.Expect(scores[0]).To(gomega.Equal(scores[1]))
+	})
+
+	ginkgo.It("simple scorer marks infeasible combinations", func() {
+		scores := scoreStatuses(NewSimpleScorer, storageRequirement, []entities.Status{noMemory})
+		gomega.Expect(scores[0]).To(gomega.Equal(float32(InfeasibleScore)))
+	})
+
+	ginkgo.It("scorers refuse to score when the collector is not ready", func() {
+		collector := statuscollector.NewFakeCollector()
+		collector.(*statuscollector.FakeCollector).SetError(statuscollector.NewNotReadyError("no observation for mem_free"))
+		for _, scorer := range []Scorer{NewSimpleScorer(collector), weighted(collector), binPacking(collector), spread(collector)} {
+			response, err := scorer.Score(&pbConductor.ClusterScoreRequest{
+				RequestId:    "request",
+				Requirements: []*pbConductor.Requirement{requirement},
+			}, nil)
+			gomega.Expect(response).To(gomega.BeNil())
+			gomega.Expect(statuscollector.IsNotReady(err)).To(gomega.BeTrue())
+		}
+	})
+
+	ginkgo.It("unknown strategies are rejected", func() {
+		_, err := NewScorerFromStrategy("unknown", statuscollector.NewFakeCollector(), DefaultResourceWeights)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package scorer
+
+import (
+	"math"
+
+	"github.com/nalej/conductor/internal/entities"
+)
+
+// Adjust a status to the statistics of its time window. The cpus are reduced by the 95th percentile of their
+// utilisation, the idle cpus are the ones left by that percentile instead of the latest idle counter, and the
+// free memory is projected with its trend over the length of the window.
+//  params:
+//   status latest known status of the cluster
+//  return:
+//   adjusted status, the same one if it has no window
+func windowedStatus(status *entities.Status) *entities.Status {
+	window := status.Window
+	if window == nil {
+		return status
+	}
+	adjusted := *status
+	if window.CPUUsageP95 >= 0 {
+		adjusted.CPUNum = status.CPUNum * (1 - math.Min(1, window.CPUUsageP95))
+		adjusted.CPUIdle = adjusted.CPUNum
+	}
+	if window.MemFreeTrend < 0 {
+		adjusted.MemFree = math.Max(0, status.MemFree+window.MemFreeTrend*window.Duration.Seconds())
+	}
+	return &adjusted
+}
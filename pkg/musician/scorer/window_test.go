@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package scorer
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/utils"
+	pbConductor "github.com/nalej/grpc-conductor-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc/metadata"
+	"time"
+)
+
+var _ = ginkgo.Describe("Windowed scoring", func() {
+
+	const GB = 1024 * 1024 * 1024
+
+	// 1 core and 1GB
+	requirement := &pbConductor.Requirement{AppInstanceId: "app", GroupServiceInstanceId: "group", Replicas: 1,
+		Cpu: 1000, Memory: GB}
+
+	ginkgo.It("keeps the status when there is no window", func() {
+		status := &entities.Status{CPUNum: 8, MemFree: 16 * GB}
+		gomega.Expect(windowedStatus(status)).To(gomega.Equal(status))
+	})
+
+	ginkgo.It("adjusts the status to the CPU utilisation and the memory trend", func() {
+		status := &entities.Status{CPUNum: 8, CPUIdle: 8000, MemFree: 16 * GB, Window: &entities.StatusWindow{
+			Samples: 10, Duration: time.Minute * 10, CPUUsageP95: 0.75, MemFreeTrend: -float64(GB) / 60, Confidence: 1}}
+		adjusted := windowedStatus(status)
+		gomega.Expect(adjusted.CPUNum).To(gomega.BeNumerically("~", 2, 0.0001))
+		gomega.Expect(adjusted.CPUIdle).To(gomega.BeNumerically("~", 2, 0.0001))
+		gomega.Expect(adjusted.MemFree).To(gomega.BeNumerically("~", 6*GB, 1))
+		// the original status is not modified
+		gomega.Expect(status.CPUNum).To(gomega.Equal(float64(8)))
+
+		// unknown utilisation and growing free memory
+		status.Window.CPUUsageP95 = -1
+		status.Window.MemFreeTrend = GB
+		adjusted = windowedStatus(status)
+		gomega.Expect(adjusted.CPUNum).To(gomega.Equal(float64(8)))
+		gomega.Expect(adjusted.CPUIdle).To(gomega.Equal(float64(8000)))
+		gomega.Expect(adjusted.MemFree).To(gomega.Equal(float64(16 * GB)))
+	})
+
+	ginkgo.It("scores busy clusters worse than their latest observation suggests", func() {
+		latest := entities.Status{CPUNum: 8, MemFree: 16 * GB, DiskFree: 100 * GB}
+		busy := latest
+		busy.Window = &entities.StatusWindow{Samples: 10, Duration: time.Minute * 10, CPUUsageP95: 0.75,
+			Confidence: 1}
+		saturated := latest
+		saturated.Window = &entities.StatusWindow{Samples: 10, Duration: time.Minute * 10, CPUUsageP95: 1,
+			Confidence: 1}
+
+		scores := scoreStatuses(NewSpreadScorer, requirement, []entities.Status{latest, busy, saturated})
+		gomega.Expect(scores[1]).To(gomega.BeNumerically("<", scores[0]))
+		gomega.Expect(scores[2]).To(gomega.Equal(float32(InfeasibleScore)))
+	})
+
+	ginkgo.It("reads the confidence of a musician", func() {
+		gomega.Expect(utils.ConfidenceFromHeader(nil)).To(gomega.Equal(float64(1)))
+		gomega.Expect(utils.ConfidenceFromHeader(metadata.Pairs(utils.ConfidenceMetadataKey, "0.25"))).To(gomega.Equal(0.25))
+		gomega.Expect(utils.ConfidenceFromHeader(metadata.Pairs(utils.ConfidenceMetadataKey, "2"))).To(gomega.Equal(float64(1)))
+		gomega.Expect(utils.ConfidenceFromHeader(metadata.Pairs(utils.ConfidenceMetadataKey, "-1"))).To(gomega.Equal(float64(0)))
+		gomega.Expect(utils.ConfidenceFromHeader(metadata.Pairs(utils.ConfidenceMetadataKey, "high"))).To(gomega.Equal(float64(1)))
+	})
+})
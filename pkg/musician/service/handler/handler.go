@@ -20,8 +20,13 @@ package handler
 import (
 	"context"
 	"errors"
+	"github.com/nalej/conductor/pkg/musician/metrics"
+	"github.com/nalej/conductor/pkg/utils"
+	"github.com/nalej/derrors"
 	pbConductor "github.com/nalej/grpc-conductor-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
 	"github.com/rs/zerolog/log"
+	"time"
 )
 
 type Handler struct {
@@ -37,5 +42,18 @@ func (h *Handler) Score(ctx context.Context, request *pbConductor.ClusterScoreRe
 	if request == nil {
 		return nil, errors.New("empty request")
 	}
-	return h.m.Score(request)
+	start := time.Now()
+	options := utils.ScoringOptionsFromContext(ctx)
+	response, err := h.m.Score(request, options)
+	metrics.ObserveScore(start, err != nil)
+	if err != nil {
+		if dErr, ok := err.(derrors.Error); ok {
+			return nil, conversions.ToGRPCError(dErr)
+		}
+		return nil, err
+	}
+	if err := utils.SendConfidence(ctx, h.m.Confidence()); err != nil {
+		log.Debug().Err(err).Msg("impossible to send the confidence of the score")
+	}
+	return response, nil
 }
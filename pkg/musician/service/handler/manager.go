@@ -18,6 +18,7 @@
 package handler
 
 import (
+	"github.com/nalej/conductor/internal/entities"
 	"github.com/nalej/conductor/pkg/musician/scorer"
 	"github.com/nalej/conductor/pkg/musician/statuscollector"
 	pbConductor "github.com/nalej/grpc-conductor-go"
@@ -32,6 +33,20 @@ func NewManager(collector *statuscollector.StatusCollector, serv scorer.Scorer)
 	return &Manager{collector, serv}
 }
 
-func (m *Manager) Score(request *pbConductor.ClusterScoreRequest) (*pbConductor.ClusterScoreResponse, error) {
-	return m.ScorerMethod.Score(request)
+func (m *Manager) Score(request *pbConductor.ClusterScoreRequest, options *entities.ScoringOptions) (*pbConductor.ClusterScoreResponse, error) {
+	return m.ScorerMethod.Score(request, options)
+}
+
+// Confidence of the musician on its scores.
+//  return:
+//   confidence from 0 to 1, 1 if the collector keeps no history of the status
+func (m *Manager) Confidence() float64 {
+	if m.Status == nil {
+		return 1
+	}
+	status, err := (*m.Status).GetStatus()
+	if err != nil || status.Window == nil {
+		return 1
+	}
+	return status.Window.Confidence
 }
@@ -19,6 +19,7 @@ package service
 
 import (
 	"fmt"
+	"github.com/nalej/conductor/pkg/musician/metrics"
 	"github.com/nalej/conductor/pkg/musician/scorer"
 	"github.com/nalej/conductor/pkg/musician/service/handler"
 	"github.com/nalej/conductor/pkg/musician/statuscollector"
@@ -28,12 +29,15 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 	"net"
+	"net/http"
 	"os"
 )
 
 type MusicianConfig struct {
 	// Musician server port
 	Port uint32
+	// Port where the metrics are served
+	MetricsPort uint32
 	// Status collector
 	Collector *statuscollector.StatusCollector
 	// Scorer
@@ -53,6 +57,18 @@ func NewMusicianService(config *MusicianConfig) (*MusicianService, error) {
 	musicianServer := grpc.NewServer()
 	c := handler.NewManager(config.Collector, *config.Scorer)
 	instance := MusicianService{c, config, musicianServer}
+
+	collector := *config.Collector
+	err := metrics.RegisterStatus(collector)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := collector.(metrics.CacheSource); ok {
+		err = metrics.RegisterCache(cached)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &instance, nil
 }
 
@@ -78,6 +94,9 @@ func (m *MusicianService) Run() {
 		reflection.Register(m.server)
 	}
 
+	// Serve the metrics
+	go m.runMetrics()
+
 	// Run
 	log.Info().Uint32("port", m.configuration.Port).Msg("Launching gRPC server")
 	if err := m.server.Serve(lis); err != nil {
@@ -85,3 +104,13 @@ func (m *MusicianService) Run() {
 	}
 
 }
+
+// Serve the musician metrics.
+func (m *MusicianService) runMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle(metrics.MetricsPath, metrics.Handler())
+	log.Info().Uint32("port", m.configuration.MetricsPort).Msg("Launching metrics server")
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", m.configuration.MetricsPort), mux); err != nil {
+		log.Error().Err(err).Msg("failed to serve metrics")
+	}
+}
@@ -45,4 +45,9 @@ type Cache interface {
 	// return:
 	//  map with the cached entries
 	GetAll() map[string]CacheEntry
+
+	// Get the time every cached entry was updated
+	// return:
+	//  map with the update time of the cached entries
+	Timestamps() map[string]time.Time
 }
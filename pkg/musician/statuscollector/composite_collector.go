@@ -0,0 +1,226 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package statuscollector
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/musician/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Status collector wrapping several collectors in priority order. Every metric of the status is taken from the
+// first collector with a recent observation of it, so a failing or stale source is replaced by the next one.
+type CompositeStatusCollector struct {
+	// Collectors sorted by priority
+	collectors []StatusCollector
+	// Closed when the collector is finalized
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Create a status collector combining other collectors.
+//  params:
+//   collectors to be combined sorted by priority
+//  return:
+//   status collector
+func NewCompositeStatusCollector(collectors ...StatusCollector) StatusCollector {
+	return &CompositeStatusCollector{
+		collectors: collectors,
+		done:       make(chan struct{}),
+	}
+}
+
+// Start every wrapped collector and wait until the collector is finalized.
+// return:
+//  Error if any
+func (coll *CompositeStatusCollector) Run() error {
+	log.Info().Str("collectors", coll.Name()).Msg("starting composite status collector...")
+
+	for _, c := range coll.collectors {
+		go func(c StatusCollector) {
+			err := c.Run()
+			if err != nil {
+				log.Error().Err(err).Str("collector", c.Name()).Msg("status collector stopped")
+			}
+		}(c)
+	}
+
+	<-coll.done
+	return nil
+}
+
+// Stop every wrapped collector.
+// return:
+//  Error if any
+func (coll *CompositeStatusCollector) Finalize(killSignal bool) error {
+	log.Info().Msg("finalize was called")
+	var firstErr error
+	for _, c := range coll.collectors {
+		err := c.Finalize(killSignal)
+		if err != nil {
+			log.Error().Err(err).Str("collector", c.Name()).Msg("error finalizing status collector")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	coll.closeOnce.Do(func() { close(coll.done) })
+	return firstErr
+}
+
+// Get the current status combining the metrics of the wrapped collectors. The sources of the status report the
+// collector that produced every metric and the timestamp is the one of the oldest observation used.
+// return:
+//  Current status of the cluster or a not ready error if any required metric has no recent observation.
+func (coll *CompositeStatusCollector) GetStatus() (*entities.Status, error) {
+	status := &entities.Status{Sources: make(map[string]string)}
+	pending := make(map[string]bool, len(RequiredMetrics)+1)
+	for _, metric := range RequiredMetrics {
+		pending[metric] = true
+	}
+	pending[NodesMetric] = true
+
+	for _, c := range coll.collectors {
+		if len(pending) == 0 {
+			break
+		}
+		partial, available, err := partialStatus(c)
+		if err != nil {
+			log.Debug().Err(err).Str("collector", c.Name()).Msg("status collector without status")
+			continue
+		}
+		used := false
+		for _, metric := range available {
+			if !pending[metric] {
+				continue
+			}
+			copyMetric(status, partial, metric)
+			status.Sources[metric] = c.Name()
+			delete(pending, metric)
+			used = true
+		}
+		if used && (status.Timestamp.IsZero() || partial.Timestamp.Before(status.Timestamp)) {
+			status.Timestamp = partial.Timestamp
+		}
+	}
+
+	missing := make([]string, 0, len(pending))
+	for _, metric := range RequiredMetrics {
+		if pending[metric] {
+			missing = append(missing, metric)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, NewNotReadyError(fmt.Sprintf("no recent observation for %s", strings.Join(missing, ", ")))
+	}
+	return status, nil
+}
+
+// Get the part of the status a collector can provide. Collectors not supporting partial statuses provide
+// either the whole status or nothing.
+//  params:
+//   c status collector
+//  return:
+//   status, names of the metrics it contains or an error if any
+func partialStatus(c StatusCollector) (*entities.Status, []string, error) {
+	if partial, ok := c.(PartialStatusCollector); ok {
+		status, available := partial.GetPartialStatus()
+		if len(available) == 0 {
+			return nil, nil, NewNotReadyError(fmt.Sprintf("no recent observations in %s", c.Name()))
+		}
+		return status, available, nil
+	}
+	status, err := c.GetStatus()
+	if err != nil {
+		return nil, nil, err
+	}
+	available := append([]string{}, RequiredMetrics...)
+	if len(status.Nodes) > 0 {
+		available = append(available, NodesMetric)
+	}
+	return status, available, nil
+}
+
+// Estimate the CPU utilisation with the collector that produced the CPU metrics of both statuses.
+// params:
+//  previous status observed before the current one, nil if there is none
+//  current status
+// return:
+//  CPU utilisation from 0 to 1 and whether it could be estimated
+func (coll *CompositeStatusCollector) CPUUsage(previous *entities.Status, current *entities.Status) (float64, bool) {
+	source := current.Sources[CPUIdleMetric]
+	if current.Sources[CPUNumMetric] != source {
+		return 0, false
+	}
+	if previous != nil && (previous.Sources[CPUIdleMetric] != source || previous.Sources[CPUNumMetric] != source) {
+		// a counter cannot be compared with the values of another source
+		previous = nil
+	}
+	for _, c := range coll.collectors {
+		if c.Name() != source {
+			continue
+		}
+		estimator, ok := c.(CPUUsageEstimator)
+		if !ok {
+			return 0, false
+		}
+		return estimator.CPUUsage(previous, current)
+	}
+	return 0, false
+}
+
+// Time every cached observation of the wrapped collectors was updated.
+// return:
+//  map with the update time of the observations indexed by collector and observation name
+func (coll *CompositeStatusCollector) CacheTimestamps() map[string]time.Time {
+	timestamps := make(map[string]time.Time)
+	for _, c := range coll.collectors {
+		source, ok := c.(metrics.CacheSource)
+		if !ok {
+			continue
+		}
+		for key, timestamp := range source.CacheTimestamps() {
+			timestamps[c.Name()+"/"+key] = timestamp
+		}
+	}
+	return timestamps
+}
+
+// Return the status collector name.
+// return:
+//  Name of this collector.
+func (coll *CompositeStatusCollector) Name() string {
+	names := make([]string, 0, len(coll.collectors))
+	for _, c := range coll.collectors {
+		names = append(names, c.Name())
+	}
+	return fmt.Sprintf("composite status collector (%s)", strings.Join(names, ", "))
+}
+
+// Return a description of this status collector.
+// return:
+//  Description of this collector.
+func (coll *CompositeStatusCollector) Description() string {
+	return "Status collector falling back to the next collector for every metric missing or outdated"
+}
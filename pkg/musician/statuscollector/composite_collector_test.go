@@ -0,0 +1,103 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package statuscollector
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"time"
+)
+
+var _ = ginkgo.Describe("Composite status collector", func() {
+
+	var cache *SimpleCache
+	var prometheus *PrometheusStatusCollector
+	var fake *FakeCollector
+
+	// Store an observation with the given timestamp
+	observe := func(key string, value interface{}, timestamp time.Time) {
+		cache.pool[key] = CacheEntry{TimeStamp: timestamp, Value: value}
+	}
+
+	ginkgo.BeforeEach(func() {
+		cache = NewSimpleCache()
+		prometheus = &PrometheusStatusCollector{cached: cache, maxAge: time.Minute}
+		fake = NewFakeCollector().(*FakeCollector)
+		fake.SetStatus(entities.Status{Timestamp: time.Now(), MemFree: 1, CPUNum: 2, CPUIdle: 3, DiskFree: 4})
+	})
+
+	ginkgo.It("takes every metric from the first collector with a recent observation", func() {
+		observed := time.Now().Add(-time.Second * 30)
+		observe(PROM_MEM_FREE_NAME, float64(2048), observed)
+		observe(PROM_DISK_FREE_NAME, float64(10), time.Now())
+		// outdated
+		observe(PROM_CPU_NUM_NAME, float64(8), time.Now().Add(-time.Hour))
+		collector := NewCompositeStatusCollector(prometheus, fake)
+
+		status, err := collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status.MemFree).To(gomega.Equal(float64(2048)))
+		gomega.Expect(status.DiskFree).To(gomega.Equal(float64(10)))
+		gomega.Expect(status.CPUNum).To(gomega.Equal(float64(2)))
+		gomega.Expect(status.CPUIdle).To(gomega.Equal(float64(3)))
+		gomega.Expect(status.Timestamp.Equal(observed)).To(gomega.BeTrue())
+		gomega.Expect(status.Sources).To(gomega.Equal(map[string]string{
+			MemFreeMetric:  prometheus.Name(),
+			DiskFreeMetric: prometheus.Name(),
+			CPUNumMetric:   fake.Name(),
+			CPUIdleMetric:  fake.Name(),
+		}))
+	})
+
+	ginkgo.It("takes the nodes from the first collector reporting them", func() {
+		nodes := []entities.NodeStatus{{Name: "node1", CPU: 4, Memory: 8192}}
+		observe(PROM_NODES_NAME, nodes, time.Now())
+		collector := NewCompositeStatusCollector(fake, prometheus)
+
+		status, err := collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status.MemFree).To(gomega.Equal(float64(1)))
+		gomega.Expect(status.Nodes).To(gomega.Equal(nodes))
+		gomega.Expect(status.Sources[MemFreeMetric]).To(gomega.Equal(fake.Name()))
+		gomega.Expect(status.Sources[NodesMetric]).To(gomega.Equal(prometheus.Name()))
+	})
+
+	ginkgo.It("is not ready when a metric has no recent observation in any collector", func() {
+		observe(PROM_MEM_FREE_NAME, float64(2048), time.Now())
+		fake.SetError(derrors.NewUnavailableError("down"))
+		collector := NewCompositeStatusCollector(prometheus, fake)
+
+		status, err := collector.GetStatus()
+		gomega.Expect(status).To(gomega.BeNil())
+		gomega.Expect(IsNotReady(err)).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("stops running when finalized", func() {
+		collector := NewCompositeStatusCollector(fake)
+		done := make(chan error)
+		go func() {
+			done <- collector.Run()
+		}()
+		gomega.Expect(collector.Finalize(false)).To(gomega.Succeed())
+		gomega.Eventually(done).Should(gomega.Receive(gomega.BeNil()))
+		// finalizing twice is harmless
+		gomega.Expect(collector.Finalize(false)).To(gomega.Succeed())
+	})
+})
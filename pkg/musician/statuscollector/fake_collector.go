@@ -22,6 +22,8 @@ import "github.com/nalej/conductor/internal/entities"
 type FakeCollector struct {
 	// Single observed status
 	Status *entities.Status
+	// Error returned instead of the status, if any
+	Err error
 }
 
 func NewFakeCollector() StatusCollector {
@@ -32,6 +34,10 @@ func (c *FakeCollector) SetStatus(status entities.Status) {
 	c.Status = &status
 }
 
+func (c *FakeCollector) SetError(err error) {
+	c.Err = err
+}
+
 func (c *FakeCollector) Run() error {
 	return nil
 }
@@ -41,6 +47,9 @@ func (c *FakeCollector) Finalize(killSignal bool) error {
 }
 
 func (c *FakeCollector) GetStatus() (*entities.Status, error) {
+	if c.Err != nil {
+		return nil, c.Err
+	}
 	if c.Status == nil {
 		// No status was set, return the basic one.
 		return &entities.Status{CPUNum: 0.1, MemFree: 0.2, DiskFree: 0.3}, nil
@@ -0,0 +1,232 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package statuscollector
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nalej/conductor/internal/entities"
+)
+
+// Percentile of the CPU utilisation reported in the status window
+const cpuUsagePercentile = 0.95
+
+// Function estimating the CPU utilisation of a cluster from consecutive statuses.
+//  params:
+//   previous status observed before the current one, nil if there is none
+//   current status
+//  return:
+//   CPU utilisation from 0 to 1 and whether it could be estimated
+type CPUUsageFunc func(previous *entities.Status, current *entities.Status) (float64, bool)
+
+// Interface to be fulfilled by the collectors able to estimate the CPU utilisation from their observations.
+type CPUUsageEstimator interface {
+
+	// Estimate the CPU utilisation of the cluster.
+	// params:
+	//  previous status observed before the current one, nil if there is none
+	//  current status
+	// return:
+	//  CPU utilisation from 0 to 1 and whether it could be estimated
+	CPUUsage(previous *entities.Status, current *entities.Status) (float64, bool)
+}
+
+// Ring buffer keeping the latest observed statuses.
+type StatusHistory struct {
+	sync.Mutex
+	// Stored observations
+	observations []entities.Status
+	// Position of the next observation
+	next int
+	// Number of stored observations
+	size int
+}
+
+// Create a status history.
+//  params:
+//   capacity maximum number of observations kept
+//  return:
+//   empty status history
+func NewStatusHistory(capacity int) *StatusHistory {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &StatusHistory{observations: make([]entities.Status, capacity)}
+}
+
+// Add a new observation replacing the oldest one when the history is full.
+//  params:
+//   status observed status
+//  return:
+//   false if the status is not newer than the latest observation and was discarded
+func (h *StatusHistory) Add(status entities.Status) bool {
+	h.Lock()
+	defer h.Unlock()
+	if h.size > 0 {
+		latest := h.observations[(h.next+len(h.observations)-1)%len(h.observations)]
+		if !status.Timestamp.After(latest.Timestamp) {
+			return false
+		}
+	}
+	// the window of a stored status is not kept
+	status.Window = nil
+	h.observations[h.next] = status
+	h.next = (h.next + 1) % len(h.observations)
+	if h.size < len(h.observations) {
+		h.size++
+	}
+	return true
+}
+
+// Get the stored observations.
+//  return:
+//   observations sorted from the oldest to the newest
+func (h *StatusHistory) Observations() []entities.Status {
+	h.Lock()
+	defer h.Unlock()
+	result := make([]entities.Status, 0, h.size)
+	first := (h.next + len(h.observations) - h.size) % len(h.observations)
+	for i := 0; i < h.size; i++ {
+		result = append(result, h.observations[(first+i)%len(h.observations)])
+	}
+	return result
+}
+
+// Compute the statistics of the observations in a time window.
+//  params:
+//   window length of the time window
+//   now end of the time window
+//   usage function estimating the CPU utilisation, nil if unknown
+//  return:
+//   statistics of the window
+func (h *StatusHistory) Window(window time.Duration, now time.Time, usage CPUUsageFunc) *entities.StatusWindow {
+	observations := h.Observations()
+	start := now.Add(-window)
+	first := sort.Search(len(observations), func(i int) bool {
+		return !observations[i].Timestamp.Before(start)
+	})
+
+	result := &entities.StatusWindow{Samples: len(observations) - first, CPUUsageP95: -1}
+	if result.Samples == 0 {
+		return result
+	}
+	inWindow := observations[first:]
+	result.Duration = inWindow[len(inWindow)-1].Timestamp.Sub(inWindow[0].Timestamp)
+	if window > 0 {
+		result.Confidence = math.Min(1, float64(result.Duration)/float64(window))
+	}
+	result.MemFreeTrend = memFreeTrend(inWindow)
+
+	if usage != nil {
+		usages := make([]float64, 0, len(inWindow))
+		for i := first; i < len(observations); i++ {
+			var previous *entities.Status
+			if i > 0 {
+				previous = &observations[i-1]
+			}
+			if value, ok := usage(previous, &observations[i]); ok {
+				usages = append(usages, value)
+			}
+		}
+		if len(usages) > 0 {
+			result.CPUUsageP95 = percentile(usages, cpuUsagePercentile)
+		}
+	}
+	return result
+}
+
+// Slope of the least squares line fitting the free memory over time.
+//  params:
+//   observations sorted by time
+//  return:
+//   variation of the free memory in bytes per second, zero if there are not enough observations
+func memFreeTrend(observations []entities.Status) float64 {
+	if len(observations) < 2 {
+		return 0
+	}
+	origin := observations[0].Timestamp
+	var sumX, sumY, sumXY, sumXX float64
+	for _, o := range observations {
+		x := o.Timestamp.Sub(origin).Seconds()
+		sumX += x
+		sumY += o.MemFree
+		sumXY += x * o.MemFree
+		sumXX += x * x
+	}
+	n := float64(len(observations))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// Nearest rank percentile of a set of values.
+//  params:
+//   values non empty set of values, they are sorted in place
+//   p percentile from 0 to 1
+//  return:
+//   percentile value
+func percentile(values []float64, p float64) float64 {
+	sort.Float64s(values)
+	rank := int(math.Ceil(p*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return values[rank]
+}
+
+// Keep a CPU utilisation between 0 and 1.
+func clampUsage(usage float64) float64 {
+	return math.Max(0, math.Min(1, usage))
+}
+
+// Estimate the CPU utilisation when the idle CPU is a cumulative counter of idle seconds.
+//  params:
+//   previous status observed before the current one, nil if there is none
+//   current status
+//  return:
+//   CPU utilisation from 0 to 1 and whether it could be estimated
+func CounterCPUUsage(previous *entities.Status, current *entities.Status) (float64, bool) {
+	if previous == nil || current.CPUNum <= 0 {
+		return 0, false
+	}
+	elapsed := current.Timestamp.Sub(previous.Timestamp).Seconds()
+	idle := current.CPUIdle - previous.CPUIdle
+	// the counter was reset
+	if elapsed <= 0 || idle < 0 {
+		return 0, false
+	}
+	return clampUsage(1 - idle/(elapsed*current.CPUNum)), true
+}
+
+// Estimate the CPU utilisation when the idle CPU is the number of available millicores.
+//  params:
+//   previous status observed before the current one, not used
+//   current status
+//  return:
+//   CPU utilisation from 0 to 1 and whether it could be estimated
+func AvailableCPUUsage(previous *entities.Status, current *entities.Status) (float64, bool) {
+	if current.CPUNum <= 0 {
+		return 0, false
+	}
+	return clampUsage(1 - current.CPUIdle/(current.CPUNum*1000)), true
+}
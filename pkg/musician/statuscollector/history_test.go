@@ -0,0 +1,116 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package statuscollector
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"time"
+)
+
+var _ = ginkgo.Describe("Status history", func() {
+
+	now := time.Now()
+
+	// Status observed the given seconds ago
+	at := func(secondsAgo int, memFree float64, cpuIdle float64) entities.Status {
+		return entities.Status{Timestamp: now.Add(-time.Duration(secondsAgo) * time.Second),
+			MemFree: memFree, CPUNum: 4, CPUIdle: cpuIdle}
+	}
+
+	ginkgo.It("keeps the latest observations sorted by time", func() {
+		history := NewStatusHistory(3)
+		gomega.Expect(history.Observations()).To(gomega.BeEmpty())
+		for i := 5; i > 0; i-- {
+			gomega.Expect(history.Add(at(i*10, float64(i), 0))).To(gomega.BeTrue())
+		}
+		// not newer than the latest one
+		gomega.Expect(history.Add(at(20, 100, 0))).To(gomega.BeFalse())
+
+		observations := history.Observations()
+		gomega.Expect(observations).To(gomega.HaveLen(3))
+		gomega.Expect(observations[0].MemFree).To(gomega.Equal(float64(3)))
+		gomega.Expect(observations[1].MemFree).To(gomega.Equal(float64(2)))
+		gomega.Expect(observations[2].MemFree).To(gomega.Equal(float64(1)))
+	})
+
+	ginkgo.It("reports a low confidence with a short history", func() {
+		history := NewStatusHistory(10)
+		window := history.Window(time.Minute, now, AvailableCPUUsage)
+		gomega.Expect(window.Samples).To(gomega.Equal(0))
+		gomega.Expect(window.Confidence).To(gomega.Equal(float64(0)))
+		gomega.Expect(window.CPUUsageP95).To(gomega.BeNumerically("<", 0))
+
+		history.Add(at(0, 1000, 1000))
+		window = history.Window(time.Minute, now, AvailableCPUUsage)
+		gomega.Expect(window.Samples).To(gomega.Equal(1))
+		gomega.Expect(window.Confidence).To(gomega.Equal(float64(0)))
+	})
+
+	ginkgo.It("computes the statistics of the observations in the window", func() {
+		history := NewStatusHistory(20)
+		// outside the window
+		history.Add(at(120, 5000, 0))
+		// free memory decreasing 10 bytes per second, usage growing from 0 to 0.9
+		for i := 0; i <= 10; i++ {
+			history.Add(at(60-i*6, float64(2000-i*60), float64(4000-i*360)))
+		}
+
+		window := history.Window(time.Minute, now, AvailableCPUUsage)
+		gomega.Expect(window.Samples).To(gomega.Equal(11))
+		gomega.Expect(window.Duration).To(gomega.Equal(time.Minute))
+		gomega.Expect(window.Confidence).To(gomega.Equal(float64(1)))
+		gomega.Expect(window.MemFreeTrend).To(gomega.BeNumerically("~", -10, 0.0001))
+		gomega.Expect(window.CPUUsageP95).To(gomega.BeNumerically("~", 0.9, 0.0001))
+
+		// without CPU utilisation estimation
+		window = history.Window(time.Minute*2, now, nil)
+		gomega.Expect(window.Samples).To(gomega.Equal(12))
+		gomega.Expect(window.Confidence).To(gomega.Equal(float64(1)))
+		gomega.Expect(window.CPUUsageP95).To(gomega.BeNumerically("<", 0))
+		// half of the window covered
+		window = history.Window(time.Minute*4, now, nil)
+		gomega.Expect(window.Confidence).To(gomega.Equal(0.5))
+	})
+
+	ginkgo.It("estimates the CPU utilisation from an idle time counter", func() {
+		previous := at(10, 0, 100)
+		current := at(0, 0, 120)
+		usage, ok := CounterCPUUsage(&previous, &current)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(usage).To(gomega.BeNumerically("~", 0.5, 0.0001))
+
+		_, ok = CounterCPUUsage(nil, &current)
+		gomega.Expect(ok).To(gomega.BeFalse())
+		// counter reset
+		_, ok = CounterCPUUsage(&current, &previous)
+		gomega.Expect(ok).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("estimates the CPU utilisation from the available millicores", func() {
+		current := at(0, 0, 1000)
+		usage, ok := AvailableCPUUsage(nil, &current)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(usage).To(gomega.BeNumerically("~", 0.75, 0.0001))
+
+		current.CPUNum = 0
+		_, ok = AvailableCPUUsage(nil, &current)
+		gomega.Expect(ok).To(gomega.BeFalse())
+	})
+})
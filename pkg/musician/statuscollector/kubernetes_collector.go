@@ -0,0 +1,313 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package statuscollector
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/musician/metrics"
+
+	"github.com/nalej/derrors"
+
+	"github.com/rs/zerolog/log"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Cache key with the status of every node
+const kubeNodesKey = "nodes"
+
+// Names of the Kubernetes API queries in the collector metrics
+const (
+	kubeNodesQuery = "kubernetes_nodes"
+	kubePodsQuery  = "kubernetes_pods"
+)
+
+// Only pods that are not terminated hold their requested resources
+const activePodsSelector = "status.phase!=" + string(v1.PodSucceeded) + ",status.phase!=" + string(v1.PodFailed)
+
+// Status collector reading the allocatable resources of the nodes and the resources requested by the pods
+// directly from the Kubernetes API.
+type KubernetesStatusCollector struct {
+	client kubernetes.Interface
+
+	// Milliseconds to sleep between calls.
+	sleepDuration time.Duration
+	ticker        *time.Ticker
+	// Maximum age of the observations used to build a status
+	maxAge time.Duration
+
+	// Cached status
+	cached Cache
+}
+
+// Create a Kubernetes client.
+//  params:
+//   kubeConfigPath path of the kubeconfig file, empty to use the in cluster configuration
+//  return:
+//   Kubernetes client
+//   error if any
+func NewKubernetesClient(kubeConfigPath string) (kubernetes.Interface, derrors.Error) {
+	var config *rest.Config
+	var err error
+	if kubeConfigPath == "" {
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeConfigPath)
+	}
+	if err != nil {
+		return nil, derrors.AsError(err, "impossible to load the Kubernetes configuration")
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, derrors.AsError(err, "impossible to create the Kubernetes client")
+	}
+	return client, nil
+}
+
+// Create a status collector querying the Kubernetes API.
+//  params:
+//   client Kubernetes client
+//   sleepTime milliseconds to sleep between queries
+//   maxAge maximum age of the observations used to build a status, zero for no limit
+//  return:
+//   status collector
+func NewKubernetesStatusCollector(client kubernetes.Interface, sleepTime uint32, maxAge time.Duration) StatusCollector {
+	return &KubernetesStatusCollector{
+		client:        client,
+		sleepDuration: time.Duration(sleepTime) * time.Millisecond,
+		maxAge:        maxAge,
+		cached:        NewSimpleCache(),
+	}
+}
+
+// Start the collector
+// return:
+//  Error if any
+func (coll *KubernetesStatusCollector) Run() error {
+	log.Info().Msg("starting Kubernetes status collector...")
+
+	err := coll.gatherStats()
+	if err != nil {
+		log.Warn().Err(err).Msg("error initializing cache with stats; continuing gather loop anyway")
+	}
+
+	coll.ticker = time.NewTicker(coll.sleepDuration)
+
+	for {
+		select {
+		case <-coll.ticker.C:
+			err = coll.gatherStats()
+			if err != nil {
+				log.Warn().Err(err).Msg("error collecting status from the Kubernetes API. continuing.")
+			}
+		}
+	}
+
+	return nil
+}
+
+// Read the nodes and the active pods and cache the resulting status of every node.
+func (coll *KubernetesStatusCollector) gatherStats() error {
+	nodes, err := coll.client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		metrics.CollectorErrors.WithLabelValues(kubeNodesQuery).Inc()
+		return err
+	}
+	pods, err := coll.client.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{FieldSelector: activePodsSelector})
+	if err != nil {
+		metrics.CollectorErrors.WithLabelValues(kubePodsQuery).Inc()
+		return err
+	}
+
+	status := nodesFromKubernetes(nodes.Items, pods.Items)
+	log.Debug().Interface("nodes", status).Msg("collected nodes status")
+	coll.cached.Put(kubeNodesKey, status)
+
+	return nil
+}
+
+// Build the status of the nodes accepting new pods.
+//  params:
+//   nodes cluster nodes
+//   pods pods scheduled into the nodes
+//  return:
+//   status of every ready and schedulable node sorted by name
+func nodesFromKubernetes(nodes []v1.Node, pods []v1.Pod) []entities.NodeStatus {
+	byName := make(map[string]*entities.NodeStatus, len(nodes))
+	for _, node := range nodes {
+		if !isSchedulable(node) {
+			continue
+		}
+		allocatable := node.Status.Allocatable
+		byName[node.Name] = &entities.NodeStatus{
+			Name:    node.Name,
+			CPU:     float64(allocatable.Cpu().MilliValue()) / 1000,
+			Memory:  float64(allocatable.Memory().Value()),
+			Disk:    float64(allocatable.StorageEphemeral().Value()),
+			MaxPods: float64(allocatable.Pods().Value()),
+		}
+	}
+
+	for _, pod := range pods {
+		// the field selector may not be honored, so terminated pods are filtered again
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		node, found := byName[pod.Spec.NodeName]
+		if !found {
+			continue
+		}
+		requests := podRequests(pod)
+		node.Pods++
+		node.RequestedCPU += float64(requests.Cpu().MilliValue()) / 1000
+		node.RequestedMemory += float64(requests.Memory().Value())
+		node.RequestedDisk += float64(requests.StorageEphemeral().Value())
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	status := make([]entities.NodeStatus, 0, len(names))
+	for _, name := range names {
+		status = append(status, *byName[name])
+	}
+	return status
+}
+
+// A node accepts new pods when it is ready and has not been cordoned.
+func isSchedulable(node v1.Node) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Resources requested by a pod following the scheduler rules: the sum of the requests of its containers or
+// the largest request of its init containers, whichever is higher.
+//  params:
+//   pod to be evaluated
+//  return:
+//   requested resources
+func podRequests(pod v1.Pod) v1.ResourceList {
+	requests := v1.ResourceList{}
+	for _, container := range pod.Spec.Containers {
+		for name, quantity := range container.Resources.Requests {
+			if current, found := requests[name]; found {
+				current.Add(quantity)
+				requests[name] = current
+			} else {
+				requests[name] = quantity.DeepCopy()
+			}
+		}
+	}
+	for _, container := range pod.Spec.InitContainers {
+		for name, quantity := range container.Resources.Requests {
+			if current, found := requests[name]; !found || quantity.Cmp(current) > 0 {
+				requests[name] = quantity.DeepCopy()
+			}
+		}
+	}
+	return requests
+}
+
+// Stop the collector.
+// return:
+//  Error if any
+func (coll *KubernetesStatusCollector) Finalize(killSignal bool) error {
+	log.Info().Msg("finalize was called")
+	if coll.ticker != nil {
+		coll.ticker.Stop()
+	}
+	return nil
+}
+
+// Get the current status. The cluster wide values are the resources not yet requested in the schedulable nodes.
+// CPU and memory are accumulated for all the nodes while the free disk is the one of the node with the largest
+// free space, as the Prometheus collector does, because a volume cannot span several nodes.
+func (coll *KubernetesStatusCollector) GetStatus() (*entities.Status, error) {
+	values, observed, err := cachedObservations(coll.cached, []string{kubeNodesKey}, coll.maxAge)
+	if err != nil {
+		return nil, err
+	}
+	nodes, ok := values[kubeNodesKey].([]entities.NodeStatus)
+	if !ok {
+		return nil, derrors.NewInternalError(fmt.Sprintf("unexpected value type for %s", kubeNodesKey))
+	}
+
+	status := &entities.Status{
+		Timestamp: observed,
+		Nodes:     nodes,
+	}
+	for _, node := range nodes {
+		freeCPU := headroom(node.CPU, node.RequestedCPU)
+		freeDisk := headroom(node.Disk, node.RequestedDisk)
+		status.CPUNum += freeCPU
+		status.CPUIdle += freeCPU * 1000 // cores to millicores
+		status.MemFree += headroom(node.Memory, node.RequestedMemory)
+		// the disk is not accumulated, the available disk space is the one of the node with the largest available space
+		if freeDisk > status.DiskFree {
+			status.DiskFree = freeDisk
+		}
+	}
+
+	return status, nil
+}
+
+// Amount of an allocatable resource that has not been requested yet.
+func headroom(allocatable float64, requested float64) float64 {
+	if requested >= allocatable {
+		return 0
+	}
+	return allocatable - requested
+}
+
+// Time every cached observation was updated.
+// return:
+//  map with the update time of the observations indexed by key
+func (coll *KubernetesStatusCollector) CacheTimestamps() map[string]time.Time {
+	return coll.cached.Timestamps()
+}
+
+// Return the status collector name.
+// return:
+//  Name of this collector.
+func (coll *KubernetesStatusCollector) Name() string {
+	return "Kubernetes status collector"
+}
+
+// Return a description of this status collector.
+// return:
+//  Description of this collector.
+func (coll *KubernetesStatusCollector) Description() string {
+	return "Status collector based on the Kubernetes API"
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package statuscollector
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"time"
+)
+
+var _ = ginkgo.Describe("Kubernetes status collector", func() {
+
+	const gi = 1024 * 1024 * 1024
+
+	newNode := func(name string, cpu string, memory string, ready bool) *v1.Node {
+		condition := v1.ConditionFalse
+		if ready {
+			condition = v1.ConditionTrue
+		}
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status: v1.NodeStatus{
+				Allocatable: v1.ResourceList{
+					v1.ResourceCPU:              resource.MustParse(cpu),
+					v1.ResourceMemory:           resource.MustParse(memory),
+					v1.ResourceEphemeralStorage: resource.MustParse("100Gi"),
+					v1.ResourcePods:             resource.MustParse("110"),
+				},
+				Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: condition}},
+			},
+		}
+	}
+
+	newPod := func(name string, node string, phase v1.PodPhase, cpu string, memory string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: v1.PodSpec{
+				NodeName: node,
+				Containers: []v1.Container{{
+					Name: name,
+					Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+						v1.ResourceCPU:    resource.MustParse(cpu),
+						v1.ResourceMemory: resource.MustParse(memory),
+					}},
+				}},
+			},
+			Status: v1.PodStatus{Phase: phase},
+		}
+	}
+
+	newCollector := func(objects ...runtime.Object) *KubernetesStatusCollector {
+		return NewKubernetesStatusCollector(fake.NewSimpleClientset(objects...), 1000, time.Minute).(*KubernetesStatusCollector)
+	}
+
+	ginkgo.It("is not ready before collecting anything", func() {
+		collector := newCollector()
+		status, err := collector.GetStatus()
+		gomega.Expect(status).To(gomega.BeNil())
+		gomega.Expect(IsNotReady(err)).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("computes the headroom of every schedulable node", func() {
+		cordoned := newNode("node3", "8", "16Gi", true)
+		cordoned.Spec.Unschedulable = true
+		collector := newCollector(
+			newNode("node1", "4", "8Gi", true),
+			newNode("node2", "2", "4Gi", true),
+			cordoned,
+			newNode("node4", "8", "16Gi", false),
+			newPod("pod1", "node1", v1.PodRunning, "1", "2Gi"),
+			newPod("pod2", "node1", v1.PodPending, "500m", "1Gi"),
+			newPod("done", "node1", v1.PodSucceeded, "2", "4Gi"),
+			newPod("pod3", "node2", v1.PodRunning, "2", "1Gi"),
+			newPod("pod4", "node3", v1.PodRunning, "1", "1Gi"),
+		)
+		gomega.Expect(collector.gatherStats()).To(gomega.Succeed())
+
+		status, err := collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status.Nodes).To(gomega.Equal([]entities.NodeStatus{
+			{Name: "node1", CPU: 4, Memory: 8 * gi, Disk: 100 * gi, MaxPods: 110, Pods: 2,
+				RequestedCPU: 1.5, RequestedMemory: 3 * gi},
+			{Name: "node2", CPU: 2, Memory: 4 * gi, Disk: 100 * gi, MaxPods: 110, Pods: 1,
+				RequestedCPU: 2, RequestedMemory: 1 * gi},
+		}))
+		gomega.Expect(status.CPUNum).To(gomega.Equal(2.5))
+		gomega.Expect(status.CPUIdle).To(gomega.Equal(float64(2500)))
+		gomega.Expect(status.MemFree).To(gomega.Equal(float64(8 * gi)))
+		gomega.Expect(status.DiskFree).To(gomega.Equal(float64(100 * gi)))
+
+		// node2 has no CPU left
+		gomega.Expect(status.FitsInAnyNode(2000, gi, 0)).To(gomega.BeTrue())
+		gomega.Expect(status.FitsInAnyNode(3000, gi, 0)).To(gomega.BeFalse())
+		gomega.Expect(status.Nodes[1].Fits(100, gi, 0)).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("takes the largest init container request into account", func() {
+		pod := newPod("pod1", "node1", v1.PodRunning, "500m", "1Gi")
+		pod.Spec.InitContainers = []v1.Container{{
+			Name: "init",
+			Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+				v1.ResourceCPU: resource.MustParse("2"),
+			}},
+		}}
+		requests := podRequests(*pod)
+		gomega.Expect(requests.Cpu().MilliValue()).To(gomega.Equal(int64(2000)))
+		gomega.Expect(requests.Memory().Value()).To(gomega.Equal(int64(gi)))
+	})
+
+	ginkgo.It("is not ready when the observations are too old", func() {
+		collector := newCollector(newNode("node1", "4", "8Gi", true))
+		gomega.Expect(collector.gatherStats()).To(gomega.Succeed())
+		entry, _ := collector.cached.Get(kubeNodesKey)
+		collector.cached.(*SimpleCache).pool[kubeNodesKey] = CacheEntry{TimeStamp: time.Now().Add(-time.Hour), Value: entry.Value}
+
+		status, err := collector.GetStatus()
+		gomega.Expect(status).To(gomega.BeNil())
+		gomega.Expect(IsNotReady(err)).To(gomega.BeTrue())
+	})
+})
@@ -19,9 +19,11 @@ package statuscollector
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/musician/metrics"
 
 	"github.com/nalej/derrors"
 
@@ -36,6 +38,8 @@ type MetricsAPICollector struct {
 	// Milliseconds to sleep between calls.
 	sleepDuration time.Duration
 	ticker        *time.Ticker
+	// Maximum age of the observations used to build a status
+	maxAge time.Duration
 
 	// Cached status
 	// TODO: Evaluate potential ways to have a more efficient provider.
@@ -48,16 +52,30 @@ type MetricsAPICollector struct {
 
 const apiTimeout = time.Second * 15
 
+// Name of the cluster summary query in the collector metrics
+const clusterSummaryQuery = "cluster_summary"
+
 const (
 	cpuKey  = "cpu"
 	memKey  = "mem"
 	diskKey = "disk"
 )
 
-func NewMetricsAPICollector(client grpc_monitoring_go.MetricsCollectorClient, organizationId string, clusterId string, sleepTime uint32) StatusCollector {
+// Create a status collector querying the metrics collector API.
+//  params:
+//   client metrics collector client
+//   organizationId organization the cluster belongs to
+//   clusterId cluster to be monitored
+//   sleepTime milliseconds to sleep between queries
+//   maxAge maximum age of the observations used to build a status, zero for no limit
+//  return:
+//   status collector
+func NewMetricsAPICollector(client grpc_monitoring_go.MetricsCollectorClient, organizationId string, clusterId string,
+	sleepTime uint32, maxAge time.Duration) StatusCollector {
 	c := &MetricsAPICollector{
 		client:         client,
 		sleepDuration:  time.Duration(sleepTime) * time.Millisecond,
+		maxAge:         maxAge,
 		cached:         NewSimpleCache(),
 		organizationId: organizationId,
 		clusterId:      clusterId,
@@ -102,6 +120,7 @@ func (coll *MetricsAPICollector) gatherStats() error {
 
 	summary, err := coll.client.GetClusterSummary(ctx, req)
 	if err != nil {
+		metrics.CollectorErrors.WithLabelValues(clusterSummaryQuery).Inc()
 		return err
 	}
 
@@ -128,28 +147,94 @@ func (coll *MetricsAPICollector) Finalize(killSignal bool) error {
 // Get the current status.
 func (coll *MetricsAPICollector) GetStatus() (*entities.Status, error) {
 	// Build the status and return it
-	cacheContent := coll.cached.GetAll()
-	if cacheContent == nil {
+	if coll.cached.GetAll() == nil {
 		log.Debug().Msg("no status entry found in cache; trying to retrieve now")
 		err := coll.gatherStats()
 		if err != nil {
 			log.Warn().Err(err).Msg("error gathering stats")
-			return nil, derrors.NewNotFoundError("no cache entries found and unable to retrieve stats", err)
+			return nil, NewNotReadyError("no cache entries found and unable to retrieve stats", err)
+		}
+	}
+
+	values, observed, dErr := cachedObservations(coll.cached, []string{cpuKey, memKey, diskKey}, coll.maxAge)
+	if dErr != nil {
+		return nil, dErr
+	}
+
+	stats := make(map[string]*grpc_monitoring_go.ClusterStat, len(values))
+	for key, value := range values {
+		stat, ok := value.(*grpc_monitoring_go.ClusterStat)
+		if !ok {
+			return nil, derrors.NewInternalError(fmt.Sprintf("unexpected value type for %s", key))
 		}
-		cacheContent = coll.cached.GetAll()
+		stats[key] = stat
 	}
 
+	// The cluster summary only carries cluster wide totals, so the nodes are left unknown
+	// and the scorers skip the per node checks.
 	status := &entities.Status{
-		Timestamp: time.Now(),
-		MemFree:   float64(cacheContent[memKey].Value.(*grpc_monitoring_go.ClusterStat).GetAvailable()),
-		CPUIdle:   float64(cacheContent[cpuKey].Value.(*grpc_monitoring_go.ClusterStat).GetAvailable()),
-		DiskFree:  float64(cacheContent[diskKey].Value.(*grpc_monitoring_go.ClusterStat).GetAvailable()),
-		CPUNum:    float64(cacheContent[cpuKey].Value.(*grpc_monitoring_go.ClusterStat).GetTotal() / 1000), // millicores to cores
+		Timestamp: observed,
+		MemFree:   float64(stats[memKey].GetAvailable()),
+		CPUIdle:   float64(stats[cpuKey].GetAvailable()),
+		DiskFree:  float64(stats[diskKey].GetAvailable()),
+		CPUNum:    float64(stats[cpuKey].GetTotal() / 1000), // millicores to cores
 	}
 
 	return status, nil
 }
 
+// Get the metrics of the current status with recent observations. The cluster summary has no per node data.
+// return:
+//  status stamped with the time of its oldest observation and the names of the metrics it contains
+func (coll *MetricsAPICollector) GetPartialStatus() (*entities.Status, []string) {
+	status := &entities.Status{}
+	available := make([]string, 0, len(RequiredMetrics))
+	for _, key := range []string{cpuKey, memKey, diskKey} {
+		entry := cachedObservation(coll.cached, key, coll.maxAge)
+		if entry == nil {
+			continue
+		}
+		stat, ok := entry.Value.(*grpc_monitoring_go.ClusterStat)
+		if !ok {
+			log.Warn().Str("key", key).Msg("unexpected cached value")
+			continue
+		}
+		if status.Timestamp.IsZero() || entry.TimeStamp.Before(status.Timestamp) {
+			status.Timestamp = entry.TimeStamp
+		}
+		switch key {
+		case cpuKey:
+			status.CPUIdle = float64(stat.GetAvailable())
+			status.CPUNum = float64(stat.GetTotal() / 1000) // millicores to cores
+			available = append(available, CPUIdleMetric, CPUNumMetric)
+		case memKey:
+			status.MemFree = float64(stat.GetAvailable())
+			available = append(available, MemFreeMetric)
+		case diskKey:
+			status.DiskFree = float64(stat.GetAvailable())
+			available = append(available, DiskFreeMetric)
+		}
+	}
+	return status, available
+}
+
+// Estimate the CPU utilisation from the available millicores.
+// params:
+//  previous status observed before the current one, nil if there is none
+//  current status
+// return:
+//  CPU utilisation from 0 to 1 and whether it could be estimated
+func (coll *MetricsAPICollector) CPUUsage(previous *entities.Status, current *entities.Status) (float64, bool) {
+	return AvailableCPUUsage(previous, current)
+}
+
+// Time every cached observation was updated.
+// return:
+//  map with the update time of the observations indexed by resource
+func (coll *MetricsAPICollector) CacheTimestamps() map[string]time.Time {
+	return coll.cached.Timestamps()
+}
+
 // Return the status collector name.
 // return:
 //  Name of this collector.
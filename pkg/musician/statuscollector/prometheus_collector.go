@@ -19,29 +19,27 @@ package statuscollector
 
 import (
 	"context"
+	"fmt"
 	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/musician/metrics"
 	"github.com/nalej/derrors"
 	"github.com/prometheus/client_golang/api"
 	"github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
 	"github.com/rs/zerolog/log"
+	"math"
+	"sort"
 	"time"
 )
 
+// Names of the observations collected from Prometheus
 const (
-	// describe the set of queries we use for Prometheus to collecto monitor stats
-	// accumulated free memory for all the nodes in the cluster
-	PROM_MEM_FREE_QUERY = "sum(node_memory_MemFree)"
-	PROM_MEM_FREE_NAME  = "mem_free"
-	// accumulated idle time for all the cpus in the cluster
-	PROM_CPU_NUM_QUERY = "count(count by (nodename,cpu) (node_cpu))"
-	PROM_CPU_NUM_NAME  = "cpu_num"
-	// the available disk space is the one of the node with the largest available space
-	PROM_DISK_FREE_QUERY = "max(node_filesystem_free{mountpoint=\"/\"})"
-	PROM_DISK_FREE_NAME  = "disk_free"
-	// Sum of total idle CPUNum time in the cluster
-	PROM_CPU_IDLE_QUERY = "sum(node_cpu {mode=\"idle\"}) by (mode)"
-	PROM_CPU_IDLE_NAME  = "cpu_idle"
+	PROM_MEM_FREE_NAME  = MemFreeMetric
+	PROM_CPU_NUM_NAME   = CPUNumMetric
+	PROM_DISK_FREE_NAME = DiskFreeMetric
+	PROM_CPU_IDLE_NAME  = CPUIdleMetric
+	// cache key for the per node status
+	PROM_NODES_NAME = NodesMetric
 )
 
 // Simple client to query Prometheus HTTP API.
@@ -63,32 +61,59 @@ func NewPrometheusClient(address string) *PrometheusClient {
 	return &PrometheusClient{api, address}
 }
 
-// Internal function to exec an existing query
+// Internal function to exec an existing query returning a single value. Queries returning several series, such as
+// the ones not aggregated by node or device, are summed.
 // params:
 //  query to be executed
 // returns:
 //  floating value returned from Prometheus
 //  error if any
 func (c *PrometheusClient) execQuery(query string) (float64, error) {
-	value, err := c.runQuery(query)
+	vectorValue, err := c.execVectorQuery(query)
 	if err != nil {
-		log.Error().Err(err).Str("query", query).Msg("error querying prometheus")
 		return -1, err
 	}
 
-	// We expect a vector value
-	var vectorValue model.Vector
-	vectorValue = (*value).(model.Vector)
-
+	if vectorValue.Len() == 0 {
+		log.Error().Str("query", query).Msg("query returned no entries")
+		return -1, derrors.NewNotFoundError("query returned no entries")
+	}
 	if vectorValue.Len() > 1 {
-		log.Error().Str("query", query).Msg("query returned more than one entry")
-		log.Error().Interface("vectorValue", vectorValue).Msg("data returned")
-		return -1, derrors.NewInternalError("query returned more than one entry")
+		log.Debug().Str("query", query).Int("series", vectorValue.Len()).Msg("sum the series returned by the query")
+	}
+	toReturn := float64(0)
+	for _, sample := range vectorValue {
+		toReturn = toReturn + float64(sample.Value)
+	}
+	if math.IsNaN(toReturn) || math.IsInf(toReturn, 0) {
+		log.Error().Str("query", query).Msg("query returned a non finite value")
+		return -1, derrors.NewInternalError("query returned a non finite value")
 	}
-	toReturn := float64(vectorValue[0].Value)
 	return toReturn, nil
 }
 
+// Internal function to exec an existing query returning a vector
+// params:
+//  query to be executed
+// returns:
+//  vector returned from Prometheus
+//  error if any
+func (c *PrometheusClient) execVectorQuery(query string) (model.Vector, error) {
+	value, err := c.runQuery(query)
+	if err != nil {
+		log.Error().Err(err).Str("query", query).Msg("error querying prometheus")
+		return nil, err
+	}
+
+	// We expect a vector value
+	vectorValue, ok := (*value).(model.Vector)
+	if !ok {
+		log.Error().Str("query", query).Msg("query did not return a vector")
+		return nil, derrors.NewInternalError("query did not return a vector")
+	}
+	return vectorValue, nil
+}
+
 func (c *PrometheusClient) runQuery(query string) (*model.Value, error) {
 	value, _, err := c.api.Query(context.Background(), query, time.Now())
 	if err != nil {
@@ -104,26 +129,41 @@ type PrometheusStatusCollector struct {
 	client PrometheusClient
 	// Milliseconds to sleep between calls.
 	sleepDuration time.Duration
+	// Maximum age of the observations used to build a status
+	maxAge time.Duration
 	// Map of queries to be sent to Prometheus
 	prometheusQueries map[string]string
+	// Queries for the per node status
+	nodeAllocatableQuery string
+	nodePodsQuery        string
 	// Cached status
 	// TODO: Evaluate potential ways to have a more efficient provider.
 	cached Cache
 }
 
-func NewPrometheusStatusCollector(address string, sleepTime uint32) StatusCollector {
+// Create a status collector querying Prometheus.
+//  params:
+//   address Prometheus address
+//   sleepTime milliseconds to sleep between queries
+//   maxAge maximum age of the observations used to build a status, zero for no limit
+//   queries PromQL queries to be sent
+//  return:
+//   status collector
+func NewPrometheusStatusCollector(address string, sleepTime uint32, maxAge time.Duration,
+	queries PrometheusQueries) StatusCollector {
 	// Build a client
 	client := NewPrometheusClient(address)
 	sleepDuration := time.Duration(time.Millisecond) * time.Duration(sleepTime)
 	cache := NewSimpleCache()
 	prometheusQueries := map[string]string{
-		PROM_MEM_FREE_NAME:  PROM_MEM_FREE_QUERY,
-		PROM_CPU_NUM_NAME:   PROM_CPU_NUM_QUERY,
-		PROM_DISK_FREE_NAME: PROM_DISK_FREE_QUERY,
-		PROM_CPU_IDLE_NAME:  PROM_CPU_IDLE_QUERY,
+		PROM_MEM_FREE_NAME:  queries.MemFree,
+		PROM_CPU_NUM_NAME:   queries.CPUNum,
+		PROM_DISK_FREE_NAME: queries.DiskFree,
+		PROM_CPU_IDLE_NAME:  queries.CPUIdle,
 	}
-	return &PrometheusStatusCollector{client: *client, sleepDuration: sleepDuration, cached: cache,
-		prometheusQueries: prometheusQueries}
+	return &PrometheusStatusCollector{client: *client, sleepDuration: sleepDuration, maxAge: maxAge, cached: cache,
+		prometheusQueries: prometheusQueries, nodeAllocatableQuery: queries.NodeAllocatable,
+		nodePodsQuery: queries.NodePods}
 }
 
 // Start the collector
@@ -136,22 +176,113 @@ func (coll *PrometheusStatusCollector) Run() error {
 	for {
 		select {
 		case <-sleep:
-			for queryName, query := range coll.prometheusQueries {
-				value, err := coll.client.execQuery(query)
-				if err == nil {
-					// log.Debug().Str("query",queryName).Float64("value", value).
-					//    Msgf("%s -> %f",queryName, value)
-					coll.cached.Put(queryName, float64(value))
-				} else {
-					log.Error().Err(err).Msgf("error when querying %s", queryName)
-				}
-			}
+			coll.collect()
 		}
 	}
 
 	return nil
 }
 
+// Run every query once and cache the results.
+func (coll *PrometheusStatusCollector) collect() {
+	for queryName, query := range coll.prometheusQueries {
+		value, err := coll.client.execQuery(query)
+		if err == nil {
+			// log.Debug().Str("query",queryName).Float64("value", value).
+			//    Msgf("%s -> %f",queryName, value)
+			coll.cached.Put(queryName, float64(value))
+		} else {
+			log.Error().Err(err).Msgf("error when querying %s", queryName)
+			metrics.CollectorErrors.WithLabelValues(queryName).Inc()
+		}
+	}
+	if coll.nodeAllocatableQuery == "" {
+		return
+	}
+	nodes, err := coll.collectNodes()
+	if err == nil {
+		coll.cached.Put(PROM_NODES_NAME, nodes)
+	} else {
+		log.Error().Err(err).Msg("error when querying the nodes status")
+		metrics.CollectorErrors.WithLabelValues(PROM_NODES_NAME).Inc()
+	}
+}
+
+// Query the allocatable resources and the number of pods of every node.
+// return:
+//  status of every node
+//  error if any
+func (coll *PrometheusStatusCollector) collectNodes() ([]entities.NodeStatus, error) {
+	allocatable, err := coll.client.execVectorQuery(coll.nodeAllocatableQuery)
+	if err != nil {
+		return nil, err
+	}
+	var pods model.Vector
+	if coll.nodePodsQuery != "" {
+		pods, err = coll.client.execVectorQuery(coll.nodePodsQuery)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nodesFromSamples(allocatable, pods), nil
+}
+
+// Build the status of every node from the samples returned by Prometheus.
+// params:
+//  allocatable samples labelled by node and resource
+//  pods samples with the number of pods labelled by node
+// return:
+//  status of every node sorted by name
+func nodesFromSamples(allocatable model.Vector, pods model.Vector) []entities.NodeStatus {
+	byName := make(map[string]*entities.NodeStatus)
+	node := func(name string) *entities.NodeStatus {
+		found, exists := byName[name]
+		if !exists {
+			found = &entities.NodeStatus{Name: name}
+			byName[name] = found
+		}
+		return found
+	}
+
+	for _, sample := range allocatable {
+		name := string(sample.Metric["node"])
+		if name == "" {
+			continue
+		}
+		value := float64(sample.Value)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		switch string(sample.Metric["resource"]) {
+		case "cpu":
+			node(name).CPU = value
+		case "memory":
+			node(name).Memory = value
+		case "ephemeral_storage":
+			node(name).Disk = value
+		case "pods":
+			node(name).MaxPods = value
+		}
+	}
+	for _, sample := range pods {
+		name := string(sample.Metric["node"])
+		if current, exists := byName[name]; exists && !math.IsNaN(float64(sample.Value)) {
+			current.Pods = float64(sample.Value)
+		}
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nodes := make([]entities.NodeStatus, 0, len(names))
+	for _, name := range names {
+		nodes = append(nodes, *byName[name])
+	}
+	return nodes
+}
+
 // Stop the collector.
 // return:
 //  Error if any
@@ -163,21 +294,98 @@ func (coll *PrometheusStatusCollector) Finalize(killSignal bool) error {
 // Get the current status.
 func (coll *PrometheusStatusCollector) GetStatus() (*entities.Status, error) {
 	// Build the status and return it
-	cacheContent := coll.cached.GetAll()
-	if cacheContent == nil {
-		return nil, derrors.NewNotFoundError("not found cache entries")
+	values, observed, err := cachedObservations(coll.cached,
+		[]string{PROM_MEM_FREE_NAME, PROM_CPU_IDLE_NAME, PROM_DISK_FREE_NAME, PROM_CPU_NUM_NAME}, coll.maxAge)
+	if err != nil {
+		return nil, err
+	}
+
+	floats := make(map[string]float64, len(values))
+	for key, value := range values {
+		f, ok := value.(float64)
+		if !ok {
+			return nil, derrors.NewInternalError(fmt.Sprintf("unexpected value type for %s", key))
+		}
+		floats[key] = f
 	}
 
 	return &entities.Status{
-		Timestamp: time.Now(),
-		MemFree:   cacheContent[PROM_MEM_FREE_NAME].Value.(float64),
-		CPUIdle:   cacheContent[PROM_CPU_IDLE_NAME].Value.(float64),
-		DiskFree:  cacheContent[PROM_DISK_FREE_NAME].Value.(float64),
-		CPUNum:    cacheContent[PROM_CPU_NUM_NAME].Value.(float64),
+		Timestamp: observed,
+		MemFree:   floats[PROM_MEM_FREE_NAME],
+		CPUIdle:   floats[PROM_CPU_IDLE_NAME],
+		DiskFree:  floats[PROM_DISK_FREE_NAME],
+		CPUNum:    floats[PROM_CPU_NUM_NAME],
+		Nodes:     coll.cachedNodes(),
 	}, nil
 
 }
 
+// Get the metrics of the current status with recent observations.
+// return:
+//  status stamped with the time of its oldest observation and the names of the metrics it contains
+func (coll *PrometheusStatusCollector) GetPartialStatus() (*entities.Status, []string) {
+	status := &entities.Status{}
+	available := make([]string, 0, len(RequiredMetrics)+1)
+	for _, metric := range RequiredMetrics {
+		entry := cachedObservation(coll.cached, metric, coll.maxAge)
+		if entry == nil {
+			continue
+		}
+		value, ok := entry.Value.(float64)
+		if !ok {
+			log.Warn().Str("metric", metric).Msg("unexpected cached value")
+			continue
+		}
+		if status.Timestamp.IsZero() || entry.TimeStamp.Before(status.Timestamp) {
+			status.Timestamp = entry.TimeStamp
+		}
+		setMetric(status, metric, value)
+		available = append(available, metric)
+	}
+	status.Nodes = coll.cachedNodes()
+	if len(status.Nodes) > 0 {
+		available = append(available, NodesMetric)
+	}
+	return status, available
+}
+
+// Estimate the CPU utilisation from the cumulative idle time of the cpus.
+// params:
+//  previous status observed before the current one, nil if there is none
+//  current status
+// return:
+//  CPU utilisation from 0 to 1 and whether it could be estimated
+func (coll *PrometheusStatusCollector) CPUUsage(previous *entities.Status, current *entities.Status) (float64, bool) {
+	return CounterCPUUsage(previous, current)
+}
+
+// Per node status is optional: clusters without kube-state-metrics only report cluster wide values.
+// return:
+//  status of every node, nil if unknown or too old
+func (coll *PrometheusStatusCollector) cachedNodes() []entities.NodeStatus {
+	entry, _ := coll.cached.Get(PROM_NODES_NAME)
+	if entry == nil {
+		return nil
+	}
+	if coll.maxAge > 0 && time.Since(entry.TimeStamp) > coll.maxAge {
+		log.Warn().Time("observed", entry.TimeStamp).Msg("ignoring outdated nodes status")
+		return nil
+	}
+	nodes, ok := entry.Value.([]entities.NodeStatus)
+	if !ok {
+		log.Warn().Msg("unexpected cached nodes status")
+		return nil
+	}
+	return nodes
+}
+
+// Time every cached observation was updated.
+// return:
+//  map with the update time of the observations indexed by query name
+func (coll *PrometheusStatusCollector) CacheTimestamps() map[string]time.Time {
+	return coll.cached.Timestamps()
+}
+
 // Return the status collector name.
 // return:
 //  Name of this collector.
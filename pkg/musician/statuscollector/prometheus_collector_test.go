@@ -0,0 +1,248 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package statuscollector
+
+import (
+	"fmt"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"github.com/prometheus/common/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var _ = ginkgo.Describe("Prometheus status collector", func() {
+
+	var cache *SimpleCache
+	var collector *PrometheusStatusCollector
+
+	// Store all the observations with the given timestamp
+	observe := func(timestamp time.Time) {
+		cache.Put(PROM_MEM_FREE_NAME, float64(2048))
+		cache.Put(PROM_CPU_NUM_NAME, float64(4))
+		cache.Put(PROM_CPU_IDLE_NAME, float64(0.5))
+		cache.Put(PROM_DISK_FREE_NAME, float64(10))
+		for key, entry := range cache.GetAll() {
+			cache.pool[key] = CacheEntry{TimeStamp: timestamp, Value: entry.Value}
+		}
+	}
+
+	ginkgo.BeforeEach(func() {
+		cache = NewSimpleCache()
+		collector = &PrometheusStatusCollector{cached: cache, maxAge: time.Minute}
+	})
+
+	ginkgo.It("is not ready before collecting anything", func() {
+		status, err := collector.GetStatus()
+		gomega.Expect(status).To(gomega.BeNil())
+		gomega.Expect(IsNotReady(err)).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("is not ready while an observation is missing", func() {
+		cache.Put(PROM_MEM_FREE_NAME, float64(2048))
+		cache.Put(PROM_CPU_NUM_NAME, float64(4))
+		status, err := collector.GetStatus()
+		gomega.Expect(status).To(gomega.BeNil())
+		gomega.Expect(IsNotReady(err)).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("returns the status stamped with the oldest observation", func() {
+		observed := time.Now().Add(-time.Second * 30)
+		observe(observed)
+		cache.Put(PROM_MEM_FREE_NAME, float64(4096))
+
+		status, err := collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status.Timestamp.Equal(observed)).To(gomega.BeTrue())
+		gomega.Expect(status.MemFree).To(gomega.Equal(float64(4096)))
+		gomega.Expect(status.CPUNum).To(gomega.Equal(float64(4)))
+		gomega.Expect(status.CPUIdle).To(gomega.Equal(float64(0.5)))
+		gomega.Expect(status.DiskFree).To(gomega.Equal(float64(10)))
+	})
+
+	ginkgo.It("is not ready when the observations are too old", func() {
+		observe(time.Now().Add(-time.Hour))
+		status, err := collector.GetStatus()
+		gomega.Expect(status).To(gomega.BeNil())
+		gomega.Expect(IsNotReady(err)).To(gomega.BeTrue())
+
+		// no limit
+		collector.maxAge = 0
+		status, err = collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status).ToNot(gomega.BeNil())
+	})
+
+	ginkgo.It("rejects unexpected cached values", func() {
+		observe(time.Now())
+		cache.Put(PROM_CPU_NUM_NAME, "four")
+		status, err := collector.GetStatus()
+		gomega.Expect(status).To(gomega.BeNil())
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(IsNotReady(err)).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("only reports not ready errors as not ready", func() {
+		gomega.Expect(IsNotReady(NewNotReadyError("stale"))).To(gomega.BeTrue())
+		gomega.Expect(IsNotReady(derrors.NewInternalError("other"))).To(gomega.BeFalse())
+		gomega.Expect(IsNotReady(nil)).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("attaches the nodes status when available and recent", func() {
+		observe(time.Now())
+		status, err := collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status.Nodes).To(gomega.BeEmpty())
+
+		nodes := []entities.NodeStatus{{Name: "node1", CPU: 4, Memory: 8192, Disk: 100, MaxPods: 110, Pods: 10}}
+		cache.Put(PROM_NODES_NAME, nodes)
+		status, err = collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status.Nodes).To(gomega.Equal(nodes))
+
+		// outdated nodes are ignored without affecting the status
+		cache.pool[PROM_NODES_NAME] = CacheEntry{TimeStamp: time.Now().Add(-time.Hour), Value: nodes}
+		status, err = collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status.Nodes).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("builds the nodes status from the Prometheus samples", func() {
+		sample := func(node string, resource string, value float64) *model.Sample {
+			metric := model.Metric{"node": model.LabelValue(node)}
+			if resource != "" {
+				metric["resource"] = model.LabelValue(resource)
+			}
+			return &model.Sample{Metric: metric, Value: model.SampleValue(value)}
+		}
+		allocatable := model.Vector{
+			sample("node2", "cpu", 2),
+			sample("node1", "cpu", 4),
+			sample("node1", "memory", 8192),
+			sample("node1", "ephemeral_storage", 100),
+			sample("node1", "pods", 110),
+			sample("node2", "memory", 4096),
+			sample("", "cpu", 8),
+		}
+		pods := model.Vector{
+			sample("node1", "", 10),
+			sample("unknown", "", 3),
+		}
+
+		nodes := nodesFromSamples(allocatable, pods)
+		gomega.Expect(nodes).To(gomega.Equal([]entities.NodeStatus{
+			{Name: "node1", CPU: 4, Memory: 8192, Disk: 100, MaxPods: 110, Pods: 10},
+			{Name: "node2", CPU: 2, Memory: 4096},
+		}))
+		gomega.Expect(nodes[0].PodHeadroom()).To(gomega.Equal(float64(100)))
+		gomega.Expect(nodes[1].PodHeadroom()).To(gomega.BeNumerically("<", 0))
+	})
+})
+
+var _ = ginkgo.Describe("Prometheus status collector against a Prometheus server", func() {
+
+	// Data returned by the Prometheus stand-in indexed by query
+	var responses map[string]string
+	var server *httptest.Server
+
+	// Build an instant vector with the given samples
+	vector := func(samples ...string) string {
+		return fmt.Sprintf(`{"resultType":"vector","result":[%s]}`, strings.Join(samples, ","))
+	}
+	sample := func(labels string, value string) string {
+		return fmt.Sprintf(`{"metric":{%s},"value":[1570000000,"%s"]}`, labels, value)
+	}
+
+	ginkgo.BeforeEach(func() {
+		responses = make(map[string]string)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, found := responses[r.FormValue("query")]
+			if !found {
+				data = vector()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"status":"success","data":%s}`, data)
+		}))
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	ginkgo.It("returns the single value of a query", func() {
+		responses["q"] = vector(sample(`"instance":"node1"`, "2048"))
+		value, err := NewPrometheusClient(server.URL).execQuery("q")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(value).To(gomega.Equal(float64(2048)))
+	})
+
+	ginkgo.It("sums the series of a query", func() {
+		responses["q"] = vector(sample(`"instance":"node1"`, "1024"), sample(`"instance":"node2"`, "2048"))
+		value, err := NewPrometheusClient(server.URL).execQuery("q")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(value).To(gomega.Equal(float64(3072)))
+	})
+
+	ginkgo.It("rejects empty, non finite and non vector results", func() {
+		client := NewPrometheusClient(server.URL)
+		responses["nan"] = vector(sample(`"instance":"node1"`, "NaN"))
+		responses["inf"] = vector(sample(`"instance":"node1"`, "+Inf"))
+		responses["multinan"] = vector(sample(`"instance":"node1"`, "1"), sample(`"instance":"node2"`, "NaN"))
+		responses["scalar"] = `{"resultType":"scalar","result":[1570000000,"1"]}`
+		for _, query := range []string{"empty", "nan", "inf", "multinan", "scalar"} {
+			_, err := client.execQuery(query)
+			gomega.Expect(err).To(gomega.HaveOccurred(), query)
+		}
+	})
+
+	ginkgo.It("collects the status with the queries of the profile", func() {
+		queries := PrometheusProfiles[ModernPrometheusProfile]
+		responses[queries.MemFree] = vector(sample("", "2048"))
+		responses[queries.CPUNum] = vector(sample("", "4"))
+		responses[queries.CPUIdle] = vector(sample(`"mode":"idle"`, "0.5"))
+		responses[queries.DiskFree] = vector(sample("", "10"))
+		responses[queries.NodeAllocatable] = vector(
+			sample(`"node":"node1","resource":"cpu"`, "4"),
+			sample(`"node":"node1","resource":"memory"`, "8192"),
+			sample(`"node":"node1","resource":"pods"`, "110"))
+		responses[queries.NodePods] = vector(sample(`"node":"node1"`, "10"))
+
+		collector := NewPrometheusStatusCollector(server.URL, 1000, time.Minute, queries).(*PrometheusStatusCollector)
+		collector.collect()
+		status, err := collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status.MemFree).To(gomega.Equal(float64(2048)))
+		gomega.Expect(status.CPUNum).To(gomega.Equal(float64(4)))
+		gomega.Expect(status.CPUIdle).To(gomega.Equal(float64(0.5)))
+		gomega.Expect(status.DiskFree).To(gomega.Equal(float64(10)))
+		gomega.Expect(status.Nodes).To(gomega.Equal([]entities.NodeStatus{
+			{Name: "node1", CPU: 4, Memory: 8192, MaxPods: 110, Pods: 10}}))
+
+		// the legacy queries return nothing on this server
+		legacy := NewPrometheusStatusCollector(server.URL, 1000, time.Minute,
+			PrometheusProfiles[LegacyPrometheusProfile]).(*PrometheusStatusCollector)
+		legacy.collect()
+		status, err = legacy.GetStatus()
+		gomega.Expect(status).To(gomega.BeNil())
+		gomega.Expect(IsNotReady(err)).To(gomega.BeTrue())
+	})
+})
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package statuscollector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/nalej/derrors"
+	"gopkg.in/yaml.v2"
+)
+
+// Profile for node_exporter versions older than 0.16 and kube-state-metrics older than 1.4
+const LegacyPrometheusProfile = "legacy"
+
+// Profile for node_exporter 0.16 or newer and kube-state-metrics 1.4 or newer
+const ModernPrometheusProfile = "modern"
+
+// The default profile matches the node_exporter deployed with the platform
+const DefaultPrometheusProfile = LegacyPrometheusProfile
+
+// Set of PromQL queries used by the Prometheus status collector.
+type PrometheusQueries struct {
+	// Accumulated free memory for all the nodes in the cluster
+	MemFree string `yaml:"mem_free"`
+	// Number of cpus in the cluster
+	CPUNum string `yaml:"cpu_num"`
+	// Accumulated idle time for all the cpus in the cluster
+	CPUIdle string `yaml:"cpu_idle"`
+	// The available disk space is the one of the node with the largest available space
+	DiskFree string `yaml:"disk_free"`
+	// Allocatable resources of every node labelled by node and resource
+	NodeAllocatable string `yaml:"node_allocatable"`
+	// Number of pending or running pods labelled by node
+	NodePods string `yaml:"node_pods"`
+}
+
+// Number of pending or running pods scheduled into every node as reported by kube-state-metrics
+const nodePodsQuery = "count by (node) (kube_pod_info * on (namespace, pod) group_left() " +
+	"(sum by (namespace, pod) (kube_pod_status_phase{phase=~\"Pending|Running\"}) == 1))"
+
+// Built-in queries indexed by profile name
+var PrometheusProfiles = map[string]PrometheusQueries{
+	LegacyPrometheusProfile: {
+		MemFree:  "sum(node_memory_MemFree)",
+		CPUNum:   "count(count by (nodename,cpu) (node_cpu))",
+		CPUIdle:  "sum(node_cpu {mode=\"idle\"}) by (mode)",
+		DiskFree: "max(node_filesystem_free{mountpoint=\"/\"})",
+		NodeAllocatable: "sum by (node, resource) (label_replace(kube_node_status_allocatable_cpu_cores, \"resource\", \"cpu\", \"\", \"\")) " +
+			"or sum by (node, resource) (label_replace(kube_node_status_allocatable_memory_bytes, \"resource\", \"memory\", \"\", \"\")) " +
+			"or sum by (node, resource) (label_replace(kube_node_status_allocatable_pods, \"resource\", \"pods\", \"\", \"\"))",
+		NodePods: nodePodsQuery,
+	},
+	ModernPrometheusProfile: {
+		MemFree:         "sum(node_memory_MemFree_bytes)",
+		CPUNum:          "count(count by (instance,cpu) (node_cpu_seconds_total))",
+		CPUIdle:         "sum(node_cpu_seconds_total {mode=\"idle\"}) by (mode)",
+		DiskFree:        "max(node_filesystem_free_bytes{mountpoint=\"/\"})",
+		NodeAllocatable: "sum by (node, resource) (kube_node_status_allocatable)",
+		NodePods:        nodePodsQuery,
+	},
+}
+
+// Content of a queries file. Queries not set in the file are taken from the profile.
+type prometheusQueriesFile struct {
+	// Profile the queries are based on, empty to keep the one set by the caller
+	Profile string `yaml:"profile"`
+	// Queries overriding the ones of the profile
+	Queries PrometheusQueries `yaml:"queries"`
+}
+
+// Get the queries of a built-in profile.
+//  params:
+//   profile name of the profile
+//  return:
+//   queries of the profile or an error if the profile does not exist
+func GetPrometheusProfile(profile string) (*PrometheusQueries, derrors.Error) {
+	queries, found := PrometheusProfiles[profile]
+	if !found {
+		names := make([]string, 0, len(PrometheusProfiles))
+		for name := range PrometheusProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, derrors.NewInvalidArgumentError(fmt.Sprintf("unknown Prometheus profile %s, expected one of %s",
+			profile, strings.Join(names, ", ")))
+	}
+	return &queries, nil
+}
+
+// Load the queries for the Prometheus status collector.
+//  params:
+//   profile name of the built-in profile the queries are based on
+//   path YAML file with the profile and the queries overriding it, empty to use the profile as it is
+//  return:
+//   queries or an error if the file or the profile are not valid
+func LoadPrometheusQueries(profile string, path string) (*PrometheusQueries, derrors.Error) {
+	var file prometheusQueriesFile
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, derrors.AsError(err, "impossible to read the Prometheus queries file")
+		}
+		err = yaml.UnmarshalStrict(content, &file)
+		if err != nil {
+			return nil, derrors.NewInvalidArgumentError("impossible to parse the Prometheus queries file", err)
+		}
+		if file.Profile != "" {
+			profile = file.Profile
+		}
+	}
+
+	queries, dErr := GetPrometheusProfile(profile)
+	if dErr != nil {
+		return nil, dErr
+	}
+	override(&queries.MemFree, file.Queries.MemFree)
+	override(&queries.CPUNum, file.Queries.CPUNum)
+	override(&queries.CPUIdle, file.Queries.CPUIdle)
+	override(&queries.DiskFree, file.Queries.DiskFree)
+	override(&queries.NodeAllocatable, file.Queries.NodeAllocatable)
+	override(&queries.NodePods, file.Queries.NodePods)
+	return queries, nil
+}
+
+// Replace a query if a new one is set.
+func override(query *string, value string) {
+	value = strings.TrimSpace(value)
+	if value != "" {
+		*query = value
+	}
+}
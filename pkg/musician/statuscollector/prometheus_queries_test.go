@@ -0,0 +1,90 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package statuscollector
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+)
+
+var _ = ginkgo.Describe("Prometheus queries", func() {
+
+	var path string
+
+	// Write a queries file
+	write := func(content string) {
+		file, err := ioutil.TempFile("", "prometheus-queries")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		_, err = file.WriteString(content)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(file.Close()).To(gomega.Succeed())
+		path = file.Name()
+	}
+
+	ginkgo.AfterEach(func() {
+		if path != "" {
+			os.Remove(path)
+			path = ""
+		}
+	})
+
+	ginkgo.It("defines every query in the built-in profiles", func() {
+		for name, queries := range PrometheusProfiles {
+			for _, query := range []string{queries.MemFree, queries.CPUNum, queries.CPUIdle, queries.DiskFree,
+				queries.NodeAllocatable, queries.NodePods} {
+				gomega.Expect(query).ToNot(gomega.BeEmpty(), name)
+			}
+		}
+		_, err := GetPrometheusProfile(DefaultPrometheusProfile)
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.It("uses the profile when there is no file", func() {
+		queries, err := LoadPrometheusQueries(ModernPrometheusProfile, "")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(*queries).To(gomega.Equal(PrometheusProfiles[ModernPrometheusProfile]))
+	})
+
+	ginkgo.It("overrides the queries of the profile with the ones in the file", func() {
+		write(`
+profile: modern
+queries:
+  mem_free: sum(node_memory_MemAvailable_bytes)
+`)
+		queries, err := LoadPrometheusQueries(LegacyPrometheusProfile, path)
+		gomega.Expect(err).To(gomega.Succeed())
+		modern := PrometheusProfiles[ModernPrometheusProfile]
+		gomega.Expect(queries.MemFree).To(gomega.Equal("sum(node_memory_MemAvailable_bytes)"))
+		gomega.Expect(queries.CPUNum).To(gomega.Equal(modern.CPUNum))
+		gomega.Expect(queries.NodePods).To(gomega.Equal(modern.NodePods))
+	})
+
+	ginkgo.It("rejects unknown profiles and invalid files", func() {
+		_, err := LoadPrometheusQueries("unknown", "")
+		gomega.Expect(err).ToNot(gomega.Succeed())
+
+		_, err = LoadPrometheusQueries(DefaultPrometheusProfile, "/nonexistent/queries.yaml")
+		gomega.Expect(err).ToNot(gomega.Succeed())
+
+		write("queries:\n  memfree: sum(node_memory_MemFree)\n")
+		_, err = LoadPrometheusQueries(DefaultPrometheusProfile, path)
+		gomega.Expect(err).ToNot(gomega.Succeed())
+	})
+})
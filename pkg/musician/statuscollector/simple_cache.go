@@ -70,3 +70,17 @@ func (c *SimpleCache) GetAll() map[string]CacheEntry {
 	}
 	return c.pool
 }
+
+// Get the time every cached entry was updated
+// return:
+//  map with the update time of the cached entries
+func (c *SimpleCache) Timestamps() map[string]time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	toReturn := make(map[string]time.Time, len(c.pool))
+	for key, entry := range c.pool {
+		toReturn[key] = entry.TimeStamp
+	}
+	return toReturn
+}
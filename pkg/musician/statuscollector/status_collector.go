@@ -17,7 +17,15 @@
 
 package statuscollector
 
-import "github.com/nalej/conductor/internal/entities"
+import (
+	"fmt"
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+	"time"
+)
+
+// Default maximum age of the observations used to build a status
+const DefaultMaxStatusAge = time.Minute * 5
 
 // Interface to be fulfilled by any StatusCollector implementation. In a few words a status collector is a service
 // running in the background collecting status information from the cluster where it was deployed. This is done
@@ -34,9 +42,9 @@ type StatusCollector interface {
 	//  Error if any
 	Finalize(killSignal bool) error
 
-	// Get the current status.
+	// Get the current status. The timestamp of the status is the time of its oldest observation.
 	// return:
-	//  Current status of the cluster.
+	//  Current status of the cluster or a not ready error if there are no recent observations.
 	GetStatus() (*entities.Status, error)
 
 	// Return the status collector name.
@@ -49,3 +57,126 @@ type StatusCollector interface {
 	//  Description of this collector.
 	Description() string
 }
+
+// Names of the metrics in a status
+const (
+	MemFreeMetric  = "mem_free"
+	CPUNumMetric   = "cpu_num"
+	CPUIdleMetric  = "cpu_idle"
+	DiskFreeMetric = "disk_free"
+	NodesMetric    = "nodes"
+)
+
+// Metrics every status must contain. The nodes are optional.
+var RequiredMetrics = []string{MemFreeMetric, CPUNumMetric, CPUIdleMetric, DiskFreeMetric}
+
+// Interface to be fulfilled by the collectors able to report part of the status when some of their observations
+// are missing or outdated.
+type PartialStatusCollector interface {
+
+	// Get the metrics of the current status with recent observations.
+	// return:
+	//  Status stamped with the time of its oldest observation and the names of the metrics it contains.
+	GetPartialStatus() (*entities.Status, []string)
+}
+
+// Create an error indicating that the collector has no recent observations to build a status.
+//  params:
+//   msg error message
+//   causes underlying causes, if any
+//  return:
+//   not ready error
+func NewNotReadyError(msg string, causes ...error) derrors.Error {
+	return derrors.NewFailedPreconditionError(fmt.Sprintf("status collector not ready: %s", msg), causes...)
+}
+
+// Check whether an error indicates that the collector is not ready.
+//  params:
+//   err error to be checked
+//  return:
+//   true if the collector has no recent observations
+func IsNotReady(err error) bool {
+	dErr, ok := err.(derrors.Error)
+	return ok && dErr.Type() == derrors.FailedPrecondition
+}
+
+// Build a status with the observations found in a cache. The status is stamped with the time of the oldest
+// observation.
+//  params:
+//   cache cache containing the observations
+//   keys observations required to build the status
+//   maxAge maximum age of the observations, zero for no limit
+//  return:
+//   observed values indexed by key, the time of the oldest observation or an error if any
+func cachedObservations(cache Cache, keys []string, maxAge time.Duration) (map[string]interface{}, time.Time, derrors.Error) {
+	values := make(map[string]interface{}, len(keys))
+	var oldest time.Time
+	for _, key := range keys {
+		entry, _ := cache.Get(key)
+		if entry == nil {
+			return nil, oldest, NewNotReadyError(fmt.Sprintf("no observation for %s", key))
+		}
+		if oldest.IsZero() || entry.TimeStamp.Before(oldest) {
+			oldest = entry.TimeStamp
+		}
+		values[key] = entry.Value
+	}
+	if maxAge > 0 && time.Since(oldest) > maxAge {
+		return nil, oldest, NewNotReadyError(fmt.Sprintf("observations from %s are older than %s",
+			oldest.Format(time.RFC3339), maxAge))
+	}
+	return values, oldest, nil
+}
+
+// Get a cached observation if it is recent enough.
+//  params:
+//   cache cache containing the observations
+//   key observation to be retrieved
+//   maxAge maximum age of the observation, zero for no limit
+//  return:
+//   cached entry, nil if missing or too old
+func cachedObservation(cache Cache, key string, maxAge time.Duration) *CacheEntry {
+	entry, _ := cache.Get(key)
+	if entry == nil || (maxAge > 0 && time.Since(entry.TimeStamp) > maxAge) {
+		return nil
+	}
+	return entry
+}
+
+// Set the value of a metric in a status.
+//  params:
+//   status to be updated
+//   metric name of the scalar metric
+//   value new value
+func setMetric(status *entities.Status, metric string, value float64) {
+	switch metric {
+	case MemFreeMetric:
+		status.MemFree = value
+	case CPUNumMetric:
+		status.CPUNum = value
+	case CPUIdleMetric:
+		status.CPUIdle = value
+	case DiskFreeMetric:
+		status.DiskFree = value
+	}
+}
+
+// Copy the value of a metric from one status to another.
+//  params:
+//   to status to be updated
+//   from status containing the metric
+//   metric name of the metric
+func copyMetric(to *entities.Status, from *entities.Status, metric string) {
+	switch metric {
+	case MemFreeMetric:
+		to.MemFree = from.MemFree
+	case CPUNumMetric:
+		to.CPUNum = from.CPUNum
+	case CPUIdleMetric:
+		to.CPUIdle = from.CPUIdle
+	case DiskFreeMetric:
+		to.DiskFree = from.DiskFree
+	case NodesMetric:
+		to.Nodes = from.Nodes
+	}
+}
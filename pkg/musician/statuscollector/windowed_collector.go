@@ -0,0 +1,159 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package statuscollector
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/conductor/pkg/musician/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Default length of the window of observations used to score
+const DefaultStatusWindow = time.Minute * 10
+
+// Status collector keeping a history of the statuses of another collector. The statuses it returns include the
+// statistics of the observations in the latest time window.
+type WindowedStatusCollector struct {
+	// Wrapped collector
+	collector StatusCollector
+	// Latest observations
+	history *StatusHistory
+	// Length of the window
+	window time.Duration
+	// Milliseconds to sleep between observations.
+	sleepDuration time.Duration
+	// Closed when the collector is finalized
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Create a status collector keeping a history of the observations of another one.
+//  params:
+//   collector collector to be observed
+//   sleepTime milliseconds to sleep between observations
+//   window length of the time window
+//  return:
+//   status collector
+func NewWindowedStatusCollector(collector StatusCollector, sleepTime uint32, window time.Duration) StatusCollector {
+	sleepDuration := time.Duration(sleepTime) * time.Millisecond
+	capacity := 2
+	if sleepDuration > 0 && int(window/sleepDuration)+1 > capacity {
+		capacity = int(window/sleepDuration) + 1
+	}
+	return &WindowedStatusCollector{
+		collector:     collector,
+		history:       NewStatusHistory(capacity),
+		window:        window,
+		sleepDuration: sleepDuration,
+		done:          make(chan struct{}),
+	}
+}
+
+// Start the wrapped collector and observe it periodically until the collector is finalized.
+// return:
+//  Error if any
+func (coll *WindowedStatusCollector) Run() error {
+	log.Info().Str("window", coll.window.String()).Msg("starting windowed status collector...")
+
+	go func() {
+		err := coll.collector.Run()
+		if err != nil {
+			log.Error().Err(err).Str("collector", coll.collector.Name()).Msg("status collector stopped")
+		}
+	}()
+
+	ticker := time.NewTicker(coll.sleepDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			coll.observe()
+		case <-coll.done:
+			return nil
+		}
+	}
+}
+
+// Store the current status of the wrapped collector. Only the ticker of Run records observations so the
+// samples of the window are evenly spaced.
+func (coll *WindowedStatusCollector) observe() {
+	status, err := coll.collector.GetStatus()
+	if err != nil {
+		log.Debug().Err(err).Msg("no status to be observed")
+		return
+	}
+	coll.history.Add(*status)
+}
+
+// Stop the wrapped collector.
+// return:
+//  Error if any
+func (coll *WindowedStatusCollector) Finalize(killSignal bool) error {
+	log.Info().Msg("finalize was called")
+	err := coll.collector.Finalize(killSignal)
+	coll.closeOnce.Do(func() { close(coll.done) })
+	return err
+}
+
+// Get the current status of the wrapped collector with the statistics of the latest time window. The status is
+// not added to the history.
+// return:
+//  Current status of the cluster or a not ready error if there are no recent observations.
+func (coll *WindowedStatusCollector) GetStatus() (*entities.Status, error) {
+	status, err := coll.collector.GetStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	var usage CPUUsageFunc
+	if estimator, ok := coll.collector.(CPUUsageEstimator); ok {
+		usage = estimator.CPUUsage
+	}
+	windowed := *status
+	windowed.Window = coll.history.Window(coll.window, time.Now(), usage)
+	return &windowed, nil
+}
+
+// Time every cached observation of the wrapped collector was updated.
+// return:
+//  map with the update time of the observations, empty if the wrapped collector has no cache
+func (coll *WindowedStatusCollector) CacheTimestamps() map[string]time.Time {
+	if source, ok := coll.collector.(metrics.CacheSource); ok {
+		return source.CacheTimestamps()
+	}
+	return map[string]time.Time{}
+}
+
+// Return the status collector name.
+// return:
+//  Name of this collector.
+func (coll *WindowedStatusCollector) Name() string {
+	return coll.collector.Name()
+}
+
+// Return a description of this status collector.
+// return:
+//  Description of this collector.
+func (coll *WindowedStatusCollector) Description() string {
+	return fmt.Sprintf("%s with the statistics of the last %s", coll.collector.Description(), coll.window)
+}
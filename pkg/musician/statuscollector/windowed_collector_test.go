@@ -0,0 +1,122 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package statuscollector
+
+import (
+	"github.com/nalej/conductor/internal/entities"
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"time"
+)
+
+var _ = ginkgo.Describe("Windowed status collector", func() {
+
+	var cache *SimpleCache
+	var prometheus *PrometheusStatusCollector
+	var collector *WindowedStatusCollector
+
+	// Store all the Prometheus observations with the given timestamp and record them as a tick of Run does
+	observe := func(timestamp time.Time, memFree float64, cpuIdle float64) {
+		for key, value := range map[string]float64{PROM_MEM_FREE_NAME: memFree, PROM_CPU_NUM_NAME: 4,
+			PROM_CPU_IDLE_NAME: cpuIdle, PROM_DISK_FREE_NAME: 10} {
+			cache.pool[key] = CacheEntry{TimeStamp: timestamp, Value: value}
+		}
+		collector.observe()
+	}
+
+	ginkgo.BeforeEach(func() {
+		cache = NewSimpleCache()
+		prometheus = &PrometheusStatusCollector{cached: cache, maxAge: time.Hour}
+		collector = NewWindowedStatusCollector(prometheus, 1000, time.Minute).(*WindowedStatusCollector)
+	})
+
+	ginkgo.It("returns the errors of the wrapped collector", func() {
+		status, err := collector.GetStatus()
+		gomega.Expect(status).To(gomega.BeNil())
+		gomega.Expect(IsNotReady(err)).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("reports a low confidence until the observations cover the window", func() {
+		start := time.Now().Add(-time.Second * 40)
+		observe(start, 2000, 100)
+		status, err := collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status.MemFree).To(gomega.Equal(float64(2000)))
+		gomega.Expect(status.Window.Samples).To(gomega.Equal(1))
+		gomega.Expect(status.Window.Confidence).To(gomega.Equal(float64(0)))
+		// a single observation of a counter
+		gomega.Expect(status.Window.CPUUsageP95).To(gomega.BeNumerically("<", 0))
+
+		observe(start.Add(time.Second*20), 1800, 140)
+		status, err = collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status.Window.Confidence).To(gomega.BeNumerically("~", 0.33, 0.01))
+		gomega.Expect(status.Window.MemFreeTrend).To(gomega.BeNumerically("~", -10, 0.0001))
+		gomega.Expect(status.Window.CPUUsageP95).To(gomega.BeNumerically("~", 0.5, 0.0001))
+
+		observe(start.Add(time.Second*40), 1600, 140)
+		status, err = collector.GetStatus()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(status.Window.Samples).To(gomega.Equal(3))
+		gomega.Expect(status.Window.Confidence).To(gomega.BeNumerically("~", 0.67, 0.01))
+		gomega.Expect(status.Window.CPUUsageP95).To(gomega.BeNumerically("~", 1, 0.0001))
+	})
+
+	ginkgo.It("does not record the statuses it returns", func() {
+		observe(time.Now().Add(-time.Second*20), 2000, 100)
+		for i := 0; i < 3; i++ {
+			status, err := collector.GetStatus()
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(status.Window.Samples).To(gomega.Equal(1))
+		}
+		gomega.Expect(collector.history.Observations()).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("estimates the CPU utilisation with the source of the CPU metrics", func() {
+		fake := NewFakeCollector().(*FakeCollector)
+		composite := NewCompositeStatusCollector(prometheus, fake).(*CompositeStatusCollector)
+		name := prometheus.Name()
+		previous := &entities.Status{Timestamp: time.Now().Add(-time.Second * 10), CPUNum: 4, CPUIdle: 100,
+			Sources: map[string]string{CPUNumMetric: name, CPUIdleMetric: name}}
+		current := &entities.Status{Timestamp: time.Now(), CPUNum: 4, CPUIdle: 120,
+			Sources: map[string]string{CPUNumMetric: name, CPUIdleMetric: name}}
+
+		usage, ok := composite.CPUUsage(previous, current)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(usage).To(gomega.BeNumerically("~", 0.5, 0.0001))
+
+		// the fake collector does not estimate the utilisation
+		current.Sources[CPUIdleMetric] = fake.Name()
+		current.Sources[CPUNumMetric] = fake.Name()
+		_, ok = composite.CPUUsage(previous, current)
+		gomega.Expect(ok).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("stops running when finalized", func() {
+		fake := NewFakeCollector().(*FakeCollector)
+		fake.SetError(derrors.NewUnavailableError("down"))
+		windowed := NewWindowedStatusCollector(fake, 10, time.Minute)
+		done := make(chan error)
+		go func() {
+			done <- windowed.Run()
+		}()
+		gomega.Expect(windowed.Finalize(false)).To(gomega.Succeed())
+		gomega.Eventually(done).Should(gomega.Receive(gomega.BeNil()))
+	})
+})
@@ -26,6 +26,73 @@ type KVTuple struct {
 	Value []byte
 }
 
+// Function called for every pair visited by a scan. The scan stops when the function returns false.
+type ScanFunc func(key []byte, value []byte) bool
+
+// Transaction on a key value provider. Transactions are obtained through the Update and View
+// functions of the provider and must not be used once those functions return.
+type KeyValueTx interface {
+
+	// Get a value in the bucket with the given key. If the key is not found,
+	// the returned value is nil.
+	// params:
+	//  bucket
+	//  key
+	// return:
+	//  found item, nil if the key was not found
+	Get(bucket []byte, key []byte) ([]byte, derrors.Error)
+
+	// Put a new value for a key. Read-only transactions return an error.
+	// params:
+	//  bucket to be used
+	//  key
+	//  value
+	// return:
+	//  error if any
+	Put(bucket []byte, key []byte, value []byte) derrors.Error
+
+	// Delete a key from a bucket. Read-only transactions return an error.
+	// params:
+	//  bucket
+	//  key
+	// return:
+	//  error if any
+	Delete(bucket []byte, key []byte) derrors.Error
+
+	// Check if a bucket exists
+	// params:
+	//  bucket
+	// return:
+	//  true if the bucket exists
+	BucketExists(bucket []byte) bool
+
+	// Get all the current buckets
+	// return:
+	//  Array of byte arrays with the bucket names
+	GetBuckets() [][]byte
+
+	// Visit in order the pairs of a bucket whose key starts with a prefix. A nil prefix visits the
+	// whole bucket. The visited pairs must not be modified during the scan.
+	// params:
+	//  bucket
+	//  prefix of the keys to be visited
+	//  fn function called for every pair
+	// return:
+	//  error if any
+	ScanPrefix(bucket []byte, prefix []byte, fn ScanFunc) derrors.Error
+
+	// Visit in order the pairs of a bucket with keys in the range [from, to). A nil to visits
+	// until the end of the bucket. The visited pairs must not be modified during the scan.
+	// params:
+	//  bucket
+	//  from first key of the range
+	//  to end of the range, not included
+	//  fn function called for every pair
+	// return:
+	//  error if any
+	ScanRange(bucket []byte, from []byte, to []byte, fn ScanFunc) derrors.Error
+}
+
 type KeyValueProvider interface {
 
 	// Close the database
@@ -70,4 +137,40 @@ type KeyValueProvider interface {
 	// return:
 	//  Array of byte arrays with the bucket names
 	GetBuckets() [][]byte
+
+	// Run a function in a read-write transaction. All the changes done by the function are committed
+	// together, or discarded if the function returns an error. The function must only access the
+	// provider through the given transaction.
+	// params:
+	//  fn function to run in the transaction
+	// return:
+	//  error returned by the function or error if the transaction could not be committed
+	Update(fn func(tx KeyValueTx) derrors.Error) derrors.Error
+
+	// Run a function in a read-only transaction. The function has a consistent view of the
+	// provider and must only access it through the given transaction.
+	// params:
+	//  fn function to run in the transaction
+	// return:
+	//  error returned by the function if any
+	View(fn func(tx KeyValueTx) derrors.Error) derrors.Error
+
+	// Visit in order the pairs of a bucket whose key starts with a prefix without loading the whole bucket.
+	// params:
+	//  bucket
+	//  prefix of the keys to be visited
+	//  fn function called for every pair
+	// return:
+	//  error if any
+	ScanPrefix(bucket []byte, prefix []byte, fn ScanFunc) derrors.Error
+
+	// Visit in order the pairs of a bucket with keys in the range [from, to) without loading the whole bucket.
+	// params:
+	//  bucket
+	//  from first key of the range
+	//  to end of the range, not included
+	//  fn function called for every pair
+	// return:
+	//  error if any
+	ScanRange(bucket []byte, from []byte, to []byte, fn ScanFunc) derrors.Error
 }
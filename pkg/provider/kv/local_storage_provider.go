@@ -152,3 +152,56 @@ func (ldb *LocalDB) GetAllPairsInBucket(bucket []byte) ([]provider.KVTuple, derr
 	}
 	return result, nil
 }
+
+func (ldb *LocalDB) Update(fn func(tx provider.KeyValueTx) derrors.Error) derrors.Error {
+	ldb.mu.Lock()
+	defer ldb.mu.Unlock()
+	var fnErr derrors.Error
+	err := ldb.db.Update(func(tx *bolt.Tx) error {
+		fnErr = fn(&localTx{tx: tx})
+		if fnErr != nil {
+			// returning an error rolls back the transaction
+			return fnErr
+		}
+		return nil
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return derrors.NewInternalError("impossible to commit transaction", err)
+	}
+	return nil
+}
+
+func (ldb *LocalDB) View(fn func(tx provider.KeyValueTx) derrors.Error) derrors.Error {
+	ldb.mu.Lock()
+	defer ldb.mu.Unlock()
+	var fnErr derrors.Error
+	err := ldb.db.View(func(tx *bolt.Tx) error {
+		fnErr = fn(&localTx{tx: tx})
+		if fnErr != nil {
+			return fnErr
+		}
+		return nil
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return derrors.NewInternalError("impossible to run read-only transaction", err)
+	}
+	return nil
+}
+
+func (ldb *LocalDB) ScanPrefix(bucket []byte, prefix []byte, fn provider.ScanFunc) derrors.Error {
+	return ldb.View(func(tx provider.KeyValueTx) derrors.Error {
+		return tx.ScanPrefix(bucket, prefix, fn)
+	})
+}
+
+func (ldb *LocalDB) ScanRange(bucket []byte, from []byte, to []byte, fn provider.ScanFunc) derrors.Error {
+	return ldb.View(func(tx provider.KeyValueTx) derrors.Error {
+		return tx.ScanRange(bucket, from, to, fn)
+	})
+}
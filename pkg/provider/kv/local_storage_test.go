@@ -19,6 +19,7 @@ package kv
 
 import (
 	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/derrors"
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 	"os"
@@ -92,4 +93,87 @@ var _ = ginkgo.Describe("test local database using bolt", func() {
 		gomega.Expect(len(retrievedBuckets)).To(gomega.Equal(len(buckets)))
 
 	})
+
+	ginkgo.It("commits all the changes of a transaction", func() {
+		bucket := []byte("testbucket")
+		err := db.Update(func(tx provider.KeyValueTx) derrors.Error {
+			if err := tx.Put(bucket, []byte("key1"), []byte("value1")); err != nil {
+				return err
+			}
+			return tx.Put([]byte("otherbucket"), []byte("key2"), []byte("value2"))
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		retrieved, errGet := db.Get(bucket, []byte("key1"))
+		gomega.Expect(errGet).NotTo(gomega.HaveOccurred())
+		gomega.Expect(retrieved).Should(gomega.Equal([]byte("value1")))
+		retrieved, errGet = db.Get([]byte("otherbucket"), []byte("key2"))
+		gomega.Expect(errGet).NotTo(gomega.HaveOccurred())
+		gomega.Expect(retrieved).Should(gomega.Equal([]byte("value2")))
+	})
+
+	ginkgo.It("discards the changes of a failed transaction", func() {
+		bucket := []byte("testbucket")
+		errPut := db.Put(bucket, []byte("key1"), []byte("value1"))
+		gomega.Expect(errPut).NotTo(gomega.HaveOccurred())
+
+		err := db.Update(func(tx provider.KeyValueTx) derrors.Error {
+			if err := tx.Delete(bucket, []byte("key1")); err != nil {
+				return err
+			}
+			if err := tx.Put(bucket, []byte("key2"), []byte("value2")); err != nil {
+				return err
+			}
+			return derrors.NewFailedPreconditionError("abort transaction")
+		})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Type()).To(gomega.Equal(derrors.FailedPrecondition))
+
+		retrieved, errGet := db.Get(bucket, []byte("key1"))
+		gomega.Expect(errGet).NotTo(gomega.HaveOccurred())
+		gomega.Expect(retrieved).Should(gomega.Equal([]byte("value1")))
+		retrieved, errGet = db.Get(bucket, []byte("key2"))
+		gomega.Expect(errGet).NotTo(gomega.HaveOccurred())
+		gomega.Expect(retrieved).Should(gomega.BeNil())
+	})
+
+	ginkgo.It("scans the keys with a prefix and in a range", func() {
+		bucket := []byte("testbucket")
+		for _, k := range []string{"a/1", "a/2", "b/1", "b/2", "c/1"} {
+			errPut := db.Put(bucket, []byte(k), []byte("value"))
+			gomega.Expect(errPut).NotTo(gomega.HaveOccurred())
+		}
+
+		visited := make([]string, 0)
+		err := db.ScanPrefix(bucket, []byte("b/"), func(key []byte, value []byte) bool {
+			visited = append(visited, string(key))
+			return true
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(visited).To(gomega.Equal([]string{"b/1", "b/2"}))
+
+		visited = make([]string, 0)
+		err = db.ScanRange(bucket, []byte("a/2"), []byte("c/"), func(key []byte, value []byte) bool {
+			visited = append(visited, string(key))
+			return true
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(visited).To(gomega.Equal([]string{"a/2", "b/1", "b/2"}))
+
+		// stop the scan after the first pair
+		visited = make([]string, 0)
+		err = db.ScanPrefix(bucket, nil, func(key []byte, value []byte) bool {
+			visited = append(visited, string(key))
+			return false
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(visited).To(gomega.Equal([]string{"a/1"}))
+	})
+
+	ginkgo.It("fails when scanning a non-existing bucket", func() {
+		err := db.ScanPrefix([]byte("bucket"), nil, func(key []byte, value []byte) bool {
+			return true
+		})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
 })
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/nalej/conductor/pkg/provider"
+	"github.com/nalej/derrors"
+)
+
+// Transaction wrapper for the bolt local db. Values returned by bolt are only valid during the
+// transaction so they are copied before returning them to the caller.
+
+type localTx struct {
+	tx *bolt.Tx
+}
+
+func copyValue(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	result := make([]byte, len(value))
+	copy(result, value)
+	return result
+}
+
+func (l *localTx) Get(bucket []byte, key []byte) ([]byte, derrors.Error) {
+	b := l.tx.Bucket(bucket)
+	if b == nil {
+		return nil, derrors.NewInternalError(fmt.Sprintf("bucket %s not found", bucket))
+	}
+	return copyValue(b.Get(key)), nil
+}
+
+func (l *localTx) Put(bucket []byte, key []byte, value []byte) derrors.Error {
+	b, err := l.tx.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return derrors.NewInternalError(fmt.Sprintf("impossible to create bucket %s", bucket), err)
+	}
+	err = b.Put(key, value)
+	if err != nil {
+		return derrors.NewInternalError("error setting db value", err)
+	}
+	return nil
+}
+
+func (l *localTx) Delete(bucket []byte, key []byte) derrors.Error {
+	b := l.tx.Bucket(bucket)
+	if b == nil {
+		return derrors.NewInternalError(fmt.Sprintf("bucket %s not found", bucket))
+	}
+	err := b.Delete(key)
+	if err != nil {
+		return derrors.NewInternalError(fmt.Sprintf("impossible to delete key %s from bucket %s", key, bucket), err)
+	}
+	return nil
+}
+
+func (l *localTx) BucketExists(bucket []byte) bool {
+	return l.tx.Bucket(bucket) != nil
+}
+
+func (l *localTx) GetBuckets() [][]byte {
+	listBuckets := make([][]byte, 0)
+	l.tx.ForEach(func(bucketName []byte, b *bolt.Bucket) error {
+		listBuckets = append(listBuckets, copyValue(bucketName))
+		return nil
+	})
+	return listBuckets
+}
+
+func (l *localTx) ScanPrefix(bucket []byte, prefix []byte, fn provider.ScanFunc) derrors.Error {
+	b := l.tx.Bucket(bucket)
+	if b == nil {
+		return derrors.NewInternalError(fmt.Sprintf("bucket %s not found", bucket))
+	}
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if !fn(copyValue(k), copyValue(v)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (l *localTx) ScanRange(bucket []byte, from []byte, to []byte, fn provider.ScanFunc) derrors.Error {
+	b := l.tx.Bucket(bucket)
+	if b == nil {
+		return derrors.NewInternalError(fmt.Sprintf("bucket %s not found", bucket))
+	}
+	c := b.Cursor()
+	for k, v := c.Seek(from); k != nil && (to == nil || bytes.Compare(k, to) < 0); k, v = c.Next() {
+		if !fn(copyValue(k), copyValue(v)) {
+			break
+		}
+	}
+	return nil
+}
@@ -48,6 +48,8 @@ type ClusterEntry struct {
 	Cordon bool
 	// Labels
 	Labels map[string]string
+	// Organization the cluster belongs to
+	OrganizationId string
 }
 
 type ConnectionsHelper struct {
@@ -61,7 +63,9 @@ type ConnectionsHelper struct {
 	NetworkingClients *tools.ConnectionsMap
 	onceNC            sync.Once
 	// Translation map between cluster ids and their ip addresses
-	ClusterReference map[string]ClusterEntry
+	clusterReference map[string]ClusterEntry
+	// Mutex for the cluster reference map
+	clusterMux sync.RWMutex
 	// useTLS connections
 	useTLS bool
 	// path for the ca cert
@@ -81,7 +85,7 @@ type ConnectionsHelper struct {
 func NewConnectionsHelper(useTLS bool, clientCertPath string, caCertPath string, skipServerCertValidation bool) *ConnectionsHelper {
 
 	return &ConnectionsHelper{
-		ClusterReference:         make(map[string]ClusterEntry, 0),
+		clusterReference:         make(map[string]ClusterEntry, 0),
 		useTLS:                   useTLS,
 		clientCertPath:           clientCertPath,
 		caCertPath:               caCertPath,
@@ -116,9 +120,6 @@ func (h *ConnectionsHelper) GetUnifiedLoggingClients() *tools.ConnectionsMap {
 func (h *ConnectionsHelper) GetClusterClients() *tools.ConnectionsMap {
 	h.onceClusters.Do(func() {
 		h.ClusterClients = tools.NewConnectionsMap(clusterClientFactory)
-		if h.ClusterReference == nil {
-			h.ClusterReference = make(map[string]ClusterEntry, 0)
-		}
 	})
 	return h.ClusterClients
 }
@@ -278,15 +279,44 @@ func networkingClientFactory(hostname string, port int, params ...interface{}) (
 	return basicClientFactory(hostname, port)
 }
 
+// Thread-safe method to find the latest known information of a cluster.
+//  params:
+//   clusterId cluster identifier
+//  return:
+//   cluster entry and true if the cluster is known
+func (h *ConnectionsHelper) GetClusterEntry(clusterId string) (ClusterEntry, bool) {
+	h.clusterMux.RLock()
+	defer h.clusterMux.RUnlock()
+	entry, found := h.clusterReference[clusterId]
+	return entry, found
+}
+
+// Thread-safe method to obtain the known clusters of an organization.
+//  params:
+//   organizationId organization identifier
+//  return:
+//   copy of the cluster entries indexed by cluster id
+func (h *ConnectionsHelper) GetOrganizationClusters(organizationId string) map[string]ClusterEntry {
+	h.clusterMux.RLock()
+	defer h.clusterMux.RUnlock()
+	toReturn := make(map[string]ClusterEntry, 0)
+	for clusterId, entry := range h.clusterReference {
+		if entry.OrganizationId == organizationId {
+			toReturn[clusterId] = entry
+		}
+	}
+	return toReturn
+}
+
 // This is a common sharing function to check the system model and update the available clusters.
 // Additionally, the function updates the available connections for musicians and deployment managers.
-// The common ClusterReference object is updated with the cluster ids and the corresponding ip.
+// The entries of the organization in the common cluster reference are replaced with the cluster ids and the
+// corresponding ip. Entries from other organizations are not modified so requests from different organizations
+// can be processed concurrently.
 //  params:
 //   organizationId
 func (h *ConnectionsHelper) UpdateClusterConnections(organizationId string) error {
 	log.Debug().Msg("update cluster connections...")
-	// Rebuild the map
-	h.ClusterReference = make(map[string]ClusterEntry, 0)
 
 	cmClients := h.GetSystemModelClients()
 	// no available system model client
@@ -308,12 +338,15 @@ func (h *ConnectionsHelper) UpdateClusterConnections(organizationId string) erro
 
 	clusters := h.GetClusterClients()
 
+	// Rebuild the entries of this organization
+	orgReference := make(map[string]ClusterEntry, 0)
 	for _, cluster := range clusterList.Clusters {
 		// The cluster is running and is not in cordon status
 		if h.isClusterInstalled(cluster) {
 			targetHostname := fmt.Sprintf("appcluster.%s", cluster.Hostname)
 			clusterCordon := cluster.ClusterStatus == grpc_connectivity_manager_go.ClusterStatus_ONLINE_CORDON || cluster.ClusterStatus == grpc_connectivity_manager_go.ClusterStatus_OFFLINE_CORDON
-			h.ClusterReference[cluster.ClusterId] = ClusterEntry{Hostname: targetHostname, Cordon: clusterCordon, Labels: cluster.Labels}
+			orgReference[cluster.ClusterId] = ClusterEntry{Hostname: targetHostname, Cordon: clusterCordon,
+				Labels: cluster.Labels, OrganizationId: organizationId}
 			targetPort := int(APP_CLUSTER_API_PORT)
 			params := make([]interface{}, 0)
 			params = append(params, h.useTLS)
@@ -324,6 +357,17 @@ func (h *ConnectionsHelper) UpdateClusterConnections(organizationId string) erro
 			clusters.AddConnection(targetHostname, targetPort, params...)
 		}
 	}
+
+	h.clusterMux.Lock()
+	defer h.clusterMux.Unlock()
+	for clusterId, entry := range h.clusterReference {
+		if entry.OrganizationId == organizationId {
+			delete(h.clusterReference, clusterId)
+		}
+	}
+	for clusterId, entry := range orgReference {
+		h.clusterReference[clusterId] = entry
+	}
 	return nil
 }
 
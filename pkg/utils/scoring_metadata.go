@@ -0,0 +1,138 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package utils
+
+// Codec of the scoring options and the musician confidence exchanged as gRPC metadata between the conductor
+// and the musicians.
+
+import (
+	"context"
+	"fmt"
+	"github.com/nalej/conductor/internal/entities"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Keys of the gRPC metadata used to send the scoring options along with a score request.
+const (
+	ScoringModeMetadataKey    = "scoring-mode"
+	CollocationSetMetadataKey = "collocation-set"
+	LargestServiceMetadataKey = "largest-service"
+)
+
+// Key of the gRPC header used to send the confidence of the musician along with a score response.
+const ConfidenceMetadataKey = "score-confidence"
+
+// Serialize the resources of a service as a metadata value.
+func formatServiceResources(r entities.ServiceResources) string {
+	return fmt.Sprintf("%d,%d,%d", r.CPU, r.Memory, r.Storage)
+}
+
+// Parse the resources of a service from a metadata value.
+//  params:
+//   value serialized resources
+//  return:
+//   service resources or error if the value is malformed
+func parseServiceResources(value string) (entities.ServiceResources, error) {
+	var toReturn entities.ServiceResources
+	_, err := fmt.Sscanf(value, "%d,%d,%d", &toReturn.CPU, &toReturn.Memory, &toReturn.Storage)
+	return toReturn, err
+}
+
+// Attach the scoring options to the outgoing context of a score request.
+//  params:
+//   ctx context of the request
+//   options scoring options
+//  return:
+//   context with the options as metadata
+func AppendScoringOptions(ctx context.Context, options *entities.ScoringOptions) context.Context {
+	pairs := []string{ScoringModeMetadataKey, options.Mode}
+	for _, set := range options.CollocationSets {
+		pairs = append(pairs, CollocationSetMetadataKey, strings.Join(set, ","))
+	}
+	for groupId, resources := range options.LargestServices {
+		pairs = append(pairs, LargestServiceMetadataKey, fmt.Sprintf("%s=%s", groupId, formatServiceResources(resources)))
+	}
+	return metadata.AppendToOutgoingContext(ctx, pairs...)
+}
+
+// Recover the scoring options sent with a score request. Requests without options use the combinations mode.
+//  params:
+//   ctx context of the incoming request
+//  return:
+//   scoring options
+func ScoringOptionsFromContext(ctx context.Context) *entities.ScoringOptions {
+	toReturn := entities.NewCombinationsScoringOptions()
+	md, found := metadata.FromIncomingContext(ctx)
+	if !found {
+		return toReturn
+	}
+	if mode := md.Get(ScoringModeMetadataKey); len(mode) > 0 {
+		toReturn.Mode = mode[0]
+	}
+	for _, set := range md.Get(CollocationSetMetadataKey) {
+		toReturn.CollocationSets = append(toReturn.CollocationSets, strings.Split(set, ","))
+	}
+	for _, entry := range md.Get(LargestServiceMetadataKey) {
+		// group ids may contain the separator, the resources do not
+		separator := strings.LastIndex(entry, "=")
+		if separator < 0 {
+			continue
+		}
+		resources, err := parseServiceResources(entry[separator+1:])
+		if err != nil {
+			// malformed entries are not checked
+			continue
+		}
+		if toReturn.LargestServices == nil {
+			toReturn.LargestServices = make(map[string]entities.ServiceResources, 0)
+		}
+		toReturn.LargestServices[entry[:separator]] = resources
+	}
+	return toReturn
+}
+
+// Send the confidence of the musician on its scores in the header of the response.
+//  params:
+//   ctx context of the score request
+//   confidence from 0 to 1
+//  return:
+//   error if any
+func SendConfidence(ctx context.Context, confidence float64) error {
+	return grpc.SetHeader(ctx, metadata.Pairs(ConfidenceMetadataKey, strconv.FormatFloat(confidence, 'f', -1, 64)))
+}
+
+// Get the confidence of a musician from the header of a score response.
+//  params:
+//   header received header
+//  return:
+//   confidence from 0 to 1, 1 if the musician did not send it
+func ConfidenceFromHeader(header metadata.MD) float64 {
+	values := header.Get(ConfidenceMetadataKey)
+	if len(values) == 0 {
+		return 1
+	}
+	confidence, err := strconv.ParseFloat(values[0], 64)
+	if err != nil || math.IsNaN(confidence) {
+		return 1
+	}
+	return math.Max(0, math.Min(1, confidence))
+}
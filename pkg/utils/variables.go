@@ -32,6 +32,9 @@ const (
 // Standard conductor port
 var CONDUCTOR_PORT uint32 = 5000
 
+// Port where the conductor metrics are served
+var CONDUCTOR_METRICS_PORT uint32 = 5001
+
 // Standard system model port
 var SYSTEM_MODEL_PORT uint32 = 8800
 
@@ -41,6 +44,9 @@ var APP_CLUSTER_API_PORT uint32 = 443
 // Relevant ports for the system
 var MUSICIAN_PORT uint32 = 5100
 
+// Port where the musician metrics are served
+var MUSICIAN_METRICS_PORT uint32 = 5101
+
 // Standard deployment manager port
 var DEPLOYMENT_MANAGER_PORT uint32 = 443
 